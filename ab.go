@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gagliardetto/messari-challenge/feed"
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// runAB implements the ab subcommand, which runs two configurations over
+// the same inputs in one pass (reading and decoding them once), then prints
+// the differences between their results, as diff does, and the performance
+// of each one. It returns the exit status: 0 if the results are the same,
+// 1 if they differ.
+func runAB(args []string) int {
+	flags := flag.NewFlagSet("ab", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s ab [flags] -config-a a.yaml -config-b b.yaml\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var inputs stringsFlag
+	flags.Var(&inputs, "input", "Input to read trades from: - (stdin) or a file path; can be repeated (the inputs are read one after the other)")
+	format := flags.String("format", "json", fmt.Sprintf("Input format (one of %v)", feed.Formats()))
+	configA := flags.String("config-a", "", "YAML config file of the pipelines of configuration A")
+	configB := flags.String("config-b", "", "YAML config file of the pipelines of configuration B")
+	outputA := flags.String("output-a", "", "Also write the results of configuration A to this path (instead of the outputs of its pipelines)")
+	outputB := flags.String("output-b", "", "Also write the results of configuration B to this path (instead of the outputs of its pipelines)")
+	tolerance := flags.Float64("tolerance", 1e-9, "Relative difference up to which numbers are considered equal")
+	var fieldTolerances stringsFlag
+	flags.Var(&fieldTolerances, "field-tolerance", "Tolerance for a specific field, as field=tolerance (e.g. vwap=1e-6); can be repeated")
+	flags.Parse(args)
+	if flags.NArg() != 0 || *configA == "" || *configB == "" {
+		flags.Usage()
+		return exitUsage
+	}
+	tolerances, err := parseFieldTolerances(fieldTolerances)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	if len(inputs) == 0 {
+		inputs = stringsFlag{"-"}
+	}
+	if *outputA != "" && *outputA == *outputB {
+		panic(withExitCode(exitUsage, fmt.Errorf("-output-a and -output-b must be different")))
+	}
+
+	sides := make([]*abSide, 2)
+	for i, side := range []struct{ name, config, output string }{
+		{"A", *configA, *outputA},
+		{"B", *configB, *outputB},
+	} {
+		sides[i], err = newABSide(side.name, side.config, side.output, inputs)
+		if err != nil {
+			panic(defaultExitCode(exitUsage, err))
+		}
+	}
+	needsTime := false
+	for _, side := range sides {
+		for _, p := range side.pipelines {
+			needsTime = needsTime || p.needsTime()
+		}
+	}
+
+	// The trades are decoded once, and added to the pipelines of each side
+	// in turn, timing them:
+	opts := inputOptions{
+		format:      *format,
+		delimiter:   '\n',
+		records:     recordLimits{maxLength: 16 << 20, maxDepth: 32},
+		encoding:    feed.EncodingAuto,
+		sideRules:   sideRules{def: feed.SideRuleIsBuy},
+		compression: feed.CompressionAuto,
+	}
+	start := time.Now()
+	numTrades := uint64(0)
+	for _, location := range inputs {
+		run, err := openSource(location, opts)
+		if err != nil {
+			panic(defaultExitCode(exitInput, err))
+		}
+		values := make([]float64, len(tradeVars))
+		var addErr error
+		run.err = run.source.Each(func(trade models.Trade) bool {
+			numTrades++
+			if needsTime && trade.Timestamp == 0 {
+				trade.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+			}
+			values = tradeValues(trade, values)
+			for _, side := range sides {
+				if addErr = side.add(location, trade, values); addErr != nil {
+					return false
+				}
+			}
+			return true
+		})
+		run.closer.Close()
+		if addErr != nil {
+			panic(addErr)
+		}
+		if run.err != nil {
+			panic(defaultExitCode(exitInput, fmt.Errorf("error while reading %s: %w", location, run.err)))
+		}
+	}
+	// The time of the reading and the decoding, without the aggregation:
+	elapsed := time.Since(start)
+	for _, side := range sides {
+		elapsed -= side.elapsed
+	}
+	for _, side := range sides {
+		if err := side.end(); err != nil {
+			panic(err)
+		}
+	}
+
+	fmt.Fprintf(
+		os.Stderr,
+		"Read and decoded %v trades once for both configurations in %s (%s TPS)\n",
+		humanize.Comma(int64(numTrades)),
+		elapsed.Round(time.Microsecond),
+		humanize.CommafWithDigits(float64(numTrades)/elapsed.Seconds(), 0),
+	)
+	for _, side := range sides {
+		side.printReport(numTrades)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if writeDiffs(out, sides[0].results, sides[1].results, *tolerance, tolerances) > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// abSide is a configuration of the ab subcommand.
+type abSide struct {
+	name      string
+	config    string
+	pipelines []*pipeline
+	outs      *outputs
+	// results are those of the pipelines, by key (see resultKeyString),
+	// as they would be read back from their output.
+	results map[string]M
+	// elapsed is the time spent aggregating the trades and emitting the
+	// results, including collecting them (see observer), which takes collecting.
+	elapsed    time.Duration
+	collecting time.Duration
+	// numMarkets is the number of markets in the state of the pipelines,
+	// at the end of the inputs.
+	numMarkets int
+	err        error
+}
+
+// newABSide creates the pipelines of a configuration, writing their
+// results to output (or discarding them, if empty).
+func newABSide(name string, config string, output string, inputs []string) (*abSide, error) {
+	conf, err := LoadConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.Pipelines) == 0 {
+		return nil, fmt.Errorf("configuration %s (%s) has no pipelines", name, config)
+	}
+	confs, err := expandRollups(conf.Pipelines)
+	if err == nil {
+		confs, err = expandPerInput(confs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if output == "" {
+		output = os.DevNull
+	}
+	side := &abSide{
+		name:    name,
+		config:  config,
+		outs:    newOutputs(outputOptions{floatPrecision: -1, undefined: undefinedNull, workers: runtime.GOMAXPROCS(0)}),
+		results: map[string]M{},
+	}
+	for _, pc := range confs {
+		pc.Output = output
+		// Windows are by the time of the trades, so that the results
+		// don't depend on the speed of each configuration:
+		p, err := newPipeline(pc, inputs, side.outs, timeModeEvent, 0)
+		if err != nil {
+			return nil, fmt.Errorf("configuration %s: %s", name, err)
+		}
+		p.observers = append(p.observers, side.observer(p.out))
+		side.pipelines = append(side.pipelines, p)
+	}
+	return side, nil
+}
+
+// observer returns the observer collecting the results of a pipeline,
+// encoded and decoded as they are written to out.
+func (side *abSide) observer(out *output) func(M) {
+	return func(res M) {
+		start := time.Now()
+		defer func() {
+			side.collecting += time.Since(start)
+		}()
+		res, err := writtenResult(out, res)
+		if err != nil {
+			if side.err == nil {
+				side.err = withExitCode(exitOutput, fmt.Errorf("error while encoding the results of configuration %s: %s", side.name, err))
+			}
+			return
+		}
+		side.results[resultKeyString(res)] = res
+	}
+}
+
+// writtenResult returns a result as it is read back from out,
+// where it is written as JSON (see decodeResult).
+func writtenResult(out *output, res M) (M, error) {
+	line, err := json.Marshal(out.opts.format(res))
+	if err != nil {
+		return nil, err
+	}
+	return decodeResult(line)
+}
+
+// add adds a trade to the pipelines of the configuration.
+func (side *abSide) add(source string, trade models.Trade, values []float64) error {
+	start := time.Now()
+	defer func() {
+		side.elapsed += time.Since(start)
+	}()
+	for _, p := range side.pipelines {
+		if err := p.add(source, trade, values); err != nil {
+			return err
+		}
+	}
+	return side.err
+}
+
+// end emits the results of the last windows, and of the pipelines without windows.
+func (side *abSide) end() error {
+	for _, p := range side.pipelines {
+		for _, source := range p.sources {
+			ag := p.aggregator(source)
+			ag.mu.RLock()
+			side.numMarkets += len(ag.mapper)
+			ag.mu.RUnlock()
+		}
+	}
+	start := time.Now()
+	for _, p := range side.pipelines {
+		var err error
+		if p.eventTime {
+			err = p.emitLast()
+		} else if p.window == 0 {
+			err = p.emit(time.Time{}, time.Time{})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := side.outs.closeAll(); err != nil {
+		return err
+	}
+	side.elapsed += time.Since(start)
+	return side.err
+}
+
+// printReport prints the performance of the configuration to stderr.
+func (side *abSide) printReport(numTrades uint64) {
+	elapsed := side.elapsed - side.collecting
+	fmt.Fprintf(
+		os.Stderr,
+		"%s (%s, %v pipeline(s)): aggregated in %s (%s TPS), %v markets in state at the end, %v results\n",
+		side.name,
+		side.config,
+		len(side.pipelines),
+		elapsed.Round(time.Microsecond),
+		humanize.CommafWithDigits(float64(numTrades)/elapsed.Seconds(), 0),
+		humanize.Comma(int64(side.numMarkets)),
+		humanize.Comma(int64(len(side.results))),
+	)
+}
@@ -0,0 +1,76 @@
+package main
+
+import "time"
+
+// defaultActivityHorizon is the default horizon of the activity metrics
+// (see -activity-horizon).
+const defaultActivityHorizon = time.Hour
+
+// activity tracks the rate of activity of a market, by second.
+// The trades are counted by second, so that they can arrive in any order
+// (e.g. from several inputs); only the seconds within the horizon before
+// the latest one are kept, so that its memory is bounded on live inputs.
+type activity struct {
+	// counts are the numbers of trades by second (Unix seconds).
+	counts map[int64]int64
+	first  int64 // Unix seconds
+	last   int64 // Unix seconds
+
+	peakSecond int64
+	peakCount  int64
+}
+
+// add records a trade at the given time (Unix milliseconds); horizon is the
+// number of seconds before the latest one whose trades are counted (zero for
+// all of them). A trade before the horizon only counts in the mean, as its
+// second has been dropped.
+func (a *activity) add(ts int64, horizon int64) {
+	second := floorDiv(ts, 1000)
+	if a.counts == nil {
+		a.counts = map[int64]int64{}
+		a.first, a.last = second, second
+	}
+	if second < a.first {
+		a.first = second
+	}
+	if second > a.last {
+		a.last = second
+	}
+	if horizon > 0 && second < a.last-horizon {
+		return
+	}
+	count := a.counts[second] + 1
+	a.counts[second] = count
+	// The seconds past the horizon are dropped once they are as many as
+	// those within it, so that the cost of dropping them is amortized:
+	if horizon > 0 && int64(len(a.counts)) > 2*(horizon+1) {
+		for s := range a.counts {
+			if s < a.last-horizon {
+				delete(a.counts, s)
+			}
+		}
+	}
+	// The busiest second is the earliest one with the most trades:
+	if count > a.peakCount || (count == a.peakCount && second < a.peakSecond) {
+		a.peakCount = count
+		a.peakSecond = second
+	}
+}
+
+// compute adds the activity metrics to the result.
+func (a *activity) compute(res M, numTrades int) {
+	// The mean is over the seconds from the first trade to the last one,
+	// inclusive, so that it is comparable to the peak:
+	span := a.last - a.first + 1
+	res["peak_tps"] = a.peakCount
+	res["mean_tps"] = float64(numTrades) / float64(span)
+	res["busiest_second"] = time.Unix(a.peakSecond, 0).UTC()
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActivityHorizon(t *testing.T) {
+	const horizon = 10
+	var a activity
+	// A day of trades, one per second, with three in the first one:
+	start := int64(1640995200)
+	a.add(start*1000, horizon)
+	a.add(start*1000+500, horizon)
+	for s := start; s < start+86400; s++ {
+		a.add(s*1000+999, horizon)
+		if len(a.counts) > 2*(horizon+1) {
+			t.Fatalf("%v seconds kept at %v, with a horizon of %v", len(a.counts), s-start, horizon)
+		}
+	}
+	// Late trades count in the peak within the horizon, but not before it:
+	busiest := start + 86399 - horizon
+	for i := 0; i < 3; i++ {
+		a.add(busiest*1000, horizon)
+	}
+	for i := 0; i < 5; i++ {
+		a.add(start*1000, horizon)
+	}
+
+	res := M{}
+	a.compute(res, 86410)
+	if res["peak_tps"] != int64(4) {
+		t.Errorf("got peak_tps %v, want 4", res["peak_tps"])
+	}
+	if res["busiest_second"] != time.Unix(busiest, 0).UTC() {
+		t.Errorf("got busiest_second %v, want %v", res["busiest_second"], time.Unix(busiest, 0).UTC())
+	}
+	if res["mean_tps"] != 86410.0/86400 {
+		t.Errorf("got mean_tps %v, want %v", res["mean_tps"], 86410.0/86400)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// backfill tracks the end of the historical input read before the live ones
+// (see -backfill), so that the trades of the live inputs that it already
+// has are skipped: the live inputs are connected before it is read, so that
+// no trade is missed in between.
+type backfill struct {
+	// end is the latest timestamp of the backfill (Unix milliseconds),
+	// and atEnd the trades with that timestamp.
+	end   int64
+	atEnd map[backfillTrade]bool
+
+	numSkipped uint64
+}
+
+type backfillTrade struct {
+	market uint64
+	id     int
+}
+
+func newBackfill() *backfill {
+	return &backfill{atEnd: map[backfillTrade]bool{}}
+}
+
+// add records a trade of the backfill.
+func (bf *backfill) add(trade models.Trade) {
+	switch {
+	case trade.Timestamp > bf.end:
+		bf.end = trade.Timestamp
+		bf.atEnd = map[backfillTrade]bool{}
+		fallthrough
+	case trade.Timestamp == bf.end:
+		bf.atEnd[backfillTrade{market: trade.Market, id: trade.ID}] = true
+	}
+}
+
+// skip tells whether a trade of a live input is already in the backfill
+// (and counts it): if it is before its end, or at its end with the same ID.
+// Trades without a timestamp are never skipped. A nil backfill skips nothing.
+func (bf *backfill) skip(trade models.Trade) bool {
+	if bf == nil || trade.Timestamp == 0 || trade.Timestamp > bf.end {
+		return false
+	}
+	if trade.Timestamp == bf.end && !bf.atEnd[backfillTrade{market: trade.Market, id: trade.ID}] {
+		return false
+	}
+	atomic.AddUint64(&bf.numSkipped, 1)
+	return true
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bigQueryPrefix is the prefix of the outputs that load the results
+// into a BigQuery table, e.g.
+//
+//	bigquery:my-project.my_dataset.trades
+const bigQueryPrefix = "bigquery:"
+
+const (
+	// bigQueryLoadSize is the size of the results buffered before
+	// they are loaded (load jobs are subject to daily quotas,
+	// so results are loaded in as few jobs as possible).
+	bigQueryLoadSize = 64 << 20
+	// bigQueryPollInterval is the interval between checks of a load job.
+	bigQueryPollInterval = time.Second
+)
+
+// bigQueryLoader loads the results into a BigQuery table with load jobs
+// of newline-delimited JSON. The table is created if needed, with a schema
+// inferred from the results (and extended with the fields of later results),
+// partitioned by day of window_start, or of the load (the run date)
+// for results without windows.
+//
+// Requests are authenticated with the OAuth 2.0 access token in
+// GOOGLE_OAUTH_ACCESS_TOKEN (e.g. from gcloud auth print-access-token);
+// BIGQUERY_EMULATOR_HOST redirects them to an emulator.
+type bigQueryLoader struct {
+	project string
+	dataset string
+	table   string
+	opts    outputOptions
+	token   string
+	api     string
+	client  *http.Client
+
+	buf bytes.Buffer
+	// schema are the BigQuery types of the fields of the buffered results.
+	schema   map[string]string
+	windowed bool
+}
+
+func newBigQueryLoader(location string, opts outputOptions) (*bigQueryLoader, error) {
+	parts := strings.Split(strings.TrimPrefix(location, bigQueryPrefix), ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid output %q: expected %sproject.dataset.table", location, bigQueryPrefix)
+	}
+	bq := &bigQueryLoader{
+		project: parts[0],
+		dataset: parts[1],
+		table:   parts[2],
+		opts:    opts,
+		token:   os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"),
+		api:     "https://bigquery.googleapis.com",
+		client:  &http.Client{Timeout: 5 * time.Minute},
+		schema:  map[string]string{},
+	}
+	if host := os.Getenv("BIGQUERY_EMULATOR_HOST"); host != "" {
+		bq.api = "http://" + host
+	} else if bq.token == "" {
+		return nil, fmt.Errorf("output %q: GOOGLE_OAUTH_ACCESS_TOKEN is not set", location)
+	}
+	return bq, nil
+}
+
+// write buffers the market results (metadata records are skipped),
+// and loads them once enough are buffered.
+func (bq *bigQueryLoader) write(results []M) error {
+	for _, res := range results {
+		if _, ok := res["market"]; !ok {
+			continue
+		}
+		formatted := bq.opts.format(res)
+		for name, value := range formatted {
+			if typ, ok := bq.schema[name]; !ok || typ == "" {
+				bq.schema[name] = bigQueryType(value)
+			}
+		}
+		if _, ok := res["window_start"]; ok {
+			bq.windowed = true
+		}
+		line, err := json.Marshal(formatted)
+		if err != nil {
+			return withExitCode(exitOutput, fmt.Errorf("error while encoding result: %s", err))
+		}
+		bq.buf.Write(line)
+		bq.buf.WriteByte('\n')
+	}
+	if bq.buf.Len() >= bigQueryLoadSize {
+		return bq.load()
+	}
+	return nil
+}
+
+func (bq *bigQueryLoader) close() error {
+	return bq.load()
+}
+
+// bigQueryType returns the BigQuery type of a field with the given value;
+// it is empty for nulls, whose type is not known yet.
+func bigQueryType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return ""
+	case uint64:
+		// Market IDs can exceed the range of INTEGER:
+		return "NUMERIC"
+	case int:
+		return "INTEGER"
+	case bool:
+		return "BOOLEAN"
+	case string:
+		return "STRING"
+	case time.Time:
+		return "TIMESTAMP"
+	default:
+		return "FLOAT"
+	}
+}
+
+// load loads the buffered results, and waits for the load job to complete.
+func (bq *bigQueryLoader) load() error {
+	if bq.buf.Len() == 0 {
+		return nil
+	}
+	job, location, err := bq.insertJob()
+	if err != nil {
+		return withExitCode(exitOutput, fmt.Errorf("error while loading into %s.%s.%s: %s", bq.project, bq.dataset, bq.table, err))
+	}
+	if err := bq.wait(job, location); err != nil {
+		return withExitCode(exitOutput, fmt.Errorf("error of load job %s: %s", job, err))
+	}
+	bq.buf.Reset()
+	return nil
+}
+
+// insertJob starts a load job of the buffered results,
+// and returns its ID and location.
+func (bq *bigQueryLoader) insertJob() (string, string, error) {
+	names := make([]string, 0, len(bq.schema))
+	for name := range bq.schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]M, len(names))
+	for i, name := range names {
+		typ := bq.schema[name]
+		if typ == "" {
+			typ = "FLOAT"
+		}
+		fields[i] = M{"name": name, "type": typ, "mode": "NULLABLE"}
+	}
+	partitioning := M{"type": "DAY"}
+	if bq.windowed {
+		partitioning["field"] = bq.opts.fieldName("window_start")
+	}
+	config, err := json.Marshal(M{
+		"configuration": M{
+			"load": M{
+				"destinationTable": M{
+					"projectId": bq.project,
+					"datasetId": bq.dataset,
+					"tableId":   bq.table,
+				},
+				"sourceFormat":        "NEWLINE_DELIMITED_JSON",
+				"schema":              M{"fields": fields},
+				"createDisposition":   "CREATE_IF_NEEDED",
+				"writeDisposition":    "WRITE_APPEND",
+				"schemaUpdateOptions": []string{"ALLOW_FIELD_ADDITION"},
+				"timePartitioning":    partitioning,
+			},
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		data        []byte
+	}{
+		{"application/json; charset=UTF-8", config},
+		{"application/octet-stream", bq.buf.Bytes()},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return "", "", err
+		}
+		w.Write(part.data)
+	}
+	mw.Close()
+
+	url := fmt.Sprintf("%s/upload/bigquery/v2/projects/%s/jobs?uploadType=multipart", bq.api, bq.project)
+	var job struct {
+		JobReference struct {
+			JobID    string `json:"jobId"`
+			Location string `json:"location"`
+		} `json:"jobReference"`
+	}
+	if err := bq.do(http.MethodPost, url, "multipart/related; boundary="+mw.Boundary(), &body, &job); err != nil {
+		return "", "", err
+	}
+	return job.JobReference.JobID, job.JobReference.Location, nil
+}
+
+// wait waits for the load job to complete.
+func (bq *bigQueryLoader) wait(jobID string, location string) error {
+	url := fmt.Sprintf("%s/bigquery/v2/projects/%s/jobs/%s?location=%s", bq.api, bq.project, jobID, location)
+	for {
+		var job struct {
+			Status struct {
+				State       string `json:"state"`
+				ErrorResult *struct {
+					Message string `json:"message"`
+				} `json:"errorResult"`
+			} `json:"status"`
+		}
+		if err := bq.do(http.MethodGet, url, "", nil, &job); err != nil {
+			return err
+		}
+		if job.Status.State == "DONE" {
+			if job.Status.ErrorResult != nil {
+				return fmt.Errorf("%s", job.Status.ErrorResult.Message)
+			}
+			return nil
+		}
+		time.Sleep(bigQueryPollInterval)
+	}
+}
+
+// do sends a request to the API, and decodes the response into v.
+func (bq *bigQueryLoader) do(method string, url string, contentType string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if bq.token != "" {
+		req.Header.Set("Authorization", "Bearer "+bq.token)
+	}
+	resp, err := bq.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// orderBook is the L2 order book of a market.
+type orderBook struct {
+	bids bookSide // sorted by descending price
+	asks bookSide // sorted by ascending price
+	// seen is the (arrival) time of the last update, in Unix nanoseconds.
+	seen int64
+}
+
+type bookLevel struct {
+	price float64
+	size  float64
+}
+
+type bookSide struct {
+	levels     []bookLevel
+	descending bool
+}
+
+// set sets the size of the level at the given price (0 removes it).
+func (s *bookSide) set(price float64, size float64) {
+	i := sort.Search(len(s.levels), func(i int) bool {
+		if s.descending {
+			return s.levels[i].price <= price
+		}
+		return s.levels[i].price >= price
+	})
+	found := i < len(s.levels) && s.levels[i].price == price
+	switch {
+	case found && size <= 0:
+		s.levels = append(s.levels[:i], s.levels[i+1:]...)
+	case found:
+		s.levels[i].size = size
+	case size > 0:
+		s.levels = append(s.levels, bookLevel{})
+		copy(s.levels[i+1:], s.levels[i:])
+		s.levels[i] = bookLevel{price: price, size: size}
+	}
+}
+
+// depth returns the total size of the best levels.
+func (s *bookSide) depth(levels int) float64 {
+	total := 0.0
+	for i := 0; i < len(s.levels) && i < levels; i++ {
+		total += s.levels[i].size
+	}
+	return total
+}
+
+// imbalance returns (bids - asks) / (bids + asks) over the best levels of each side,
+// between -1 (only asks) and 1 (only bids).
+func (b *orderBook) imbalance(levels int) (float64, bool) {
+	bids := b.bids.depth(levels)
+	asks := b.asks.depth(levels)
+	if bids+asks == 0 {
+		return 0, false
+	}
+	return (bids - asks) / (bids + asks), true
+}
+
+// orderBooks are the order books of all markets.
+type orderBooks struct {
+	mu     sync.Mutex
+	mapper map[uint64]*orderBook
+}
+
+func newOrderBooks() *orderBooks {
+	return &orderBooks{
+		mapper: map[uint64]*orderBook{},
+	}
+}
+
+// apply applies the update, and returns the resulting imbalance.
+func (books *orderBooks) apply(update models.BookUpdate, levels int, seen int64) (float64, bool) {
+	books.mu.Lock()
+	defer books.mu.Unlock()
+	book, ok := books.mapper[update.Market]
+	if !ok {
+		book = &orderBook{
+			bids: bookSide{descending: true},
+		}
+		books.mapper[update.Market] = book
+	}
+	book.seen = seen
+	if update.Side == "bid" {
+		book.bids.set(update.Price, update.Size)
+	} else {
+		book.asks.set(update.Price, update.Size)
+	}
+	return book.imbalance(levels)
+}
+
+// bookStats tracks the book imbalance of a market.
+type bookStats struct {
+	numUpdates    int
+	imbalanceSum  float64
+	numImbalances int
+	lastImbalance float64
+}
+
+// AddBookUpdate processes an order book update for its market.
+func (ag *Markets) AddBookUpdate(update models.BookUpdate) {
+	now := ag.now()
+	imbalance, ok := ag.books.apply(update, ag.opts.BookDepth, now)
+
+	ag.lockMarket(update.Market, func(mkt *Market) {
+		mkt.lastSeen = now
+		mkt.book.numUpdates++
+		if ok {
+			mkt.book.imbalanceSum += imbalance
+			mkt.book.numImbalances++
+			mkt.book.lastImbalance = imbalance
+		}
+	})
+}
+
+// compute adds the book metrics to the result.
+func (s *bookStats) compute(res M) {
+	res["num_book_updates"] = s.numUpdates
+	if s.numImbalances > 0 {
+		res["mean_book_imbalance"] = s.imbalanceSum / float64(s.numImbalances)
+		res["last_book_imbalance"] = s.lastImbalance
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// marketGuard bounds the number of distinct markets of a run, so that a
+// corrupt input (e.g. with a mis-mapped market field) can't exhaust memory.
+type marketGuard struct {
+	mu   sync.RWMutex
+	max  int
+	warn bool
+	seen map[uint64]struct{}
+	// exceeded is set when the bound is first exceeded.
+	exceeded bool
+}
+
+// newMarketGuard returns a guard for at most max distinct markets;
+// if warn is true, exceeding the bound is only reported to stderr (once).
+func newMarketGuard(max int, warn bool) *marketGuard {
+	return &marketGuard{
+		max:  max,
+		warn: warn,
+		seen: map[uint64]struct{}{},
+	}
+}
+
+// check records the market, and returns an error if the bound is exceeded.
+// A nil guard doesn't check anything.
+func (g *marketGuard) check(market uint64) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	_, ok := g.seen[market]
+	exceeded := g.exceeded
+	g.mu.RUnlock()
+	if ok || exceeded {
+		// After a warning, markets are not tracked anymore:
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.seen[market]; ok || g.exceeded {
+		return nil
+	}
+	if len(g.seen) < g.max {
+		g.seen[market] = struct{}{}
+		return nil
+	}
+	g.exceeded = true
+	if g.warn {
+		fmt.Fprintf(os.Stderr, "warning: more than %v distinct markets (first market above the bound: %v)\n", g.max, market)
+		return nil
+	}
+	return fmt.Errorf("more than %v distinct markets (first market above the bound: %v); the input might be corrupt", g.max, market)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	chartFormatSVG = "svg"
+	chartFormatPNG = "png"
+)
+
+// charter collects the results of the windows of each market,
+// and renders their volume and VWAP as charts (see -charts).
+type charter struct {
+	dir    string
+	format string
+
+	mu     sync.Mutex
+	series map[chartKey][]chartPoint
+}
+
+// chartKey identifies the series of results of a market.
+type chartKey struct {
+	pipeline string
+	source   string
+	market   uint64
+}
+
+type chartPoint struct {
+	start  time.Time
+	end    time.Time
+	volume float64
+	vwap   float64
+}
+
+func newCharter(dir string, format string) (*charter, error) {
+	if format != chartFormatSVG && format != chartFormatPNG {
+		return nil, fmt.Errorf("invalid -chart-format %q: must be svg or png", format)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error while creating %s: %s", dir, err)
+	}
+	return &charter{dir: dir, format: format, series: map[chartKey][]chartPoint{}}, nil
+}
+
+// observe records a result, if it is the result of a window.
+func (c *charter) observe(res M) {
+	start, ok := res["window_start"].(time.Time)
+	if !ok {
+		return
+	}
+	market, ok := res["market"].(uint64)
+	if !ok {
+		return
+	}
+	key := chartKey{market: market}
+	key.pipeline, _ = res["pipeline"].(string)
+	key.source, _ = res["source"].(string)
+	point := chartPoint{start: start, volume: numericValue(res["total_volume"]), vwap: numericValue(res["vwap"])}
+	point.end, _ = res["window_end"].(time.Time)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.series[key] = append(c.series[key], point)
+}
+
+// render writes a chart for each market.
+func (c *charter) render() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, points := range c.series {
+		sort.Slice(points, func(i, j int) bool {
+			return points[i].start.Before(points[j].start)
+		})
+		path := filepath.Join(c.dir, key.filename()+"."+c.format)
+		if err := c.renderFile(path, key.title(), points); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *charter) renderFile(path string, title string, points []chartPoint) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error while creating chart %s: %s", path, err)
+	}
+	var canvas chartCanvas
+	if c.format == chartFormatPNG {
+		canvas = newPNGCanvas(chartWidth, chartHeight)
+	} else {
+		canvas = newSVGCanvas(chartWidth, chartHeight)
+	}
+	drawChart(canvas, title, points)
+	w := bufio.NewWriter(file)
+	if err := canvas.encode(w); err != nil {
+		file.Close()
+		return fmt.Errorf("error while writing chart %s: %s", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("error while writing chart %s: %s", path, err)
+	}
+	return file.Close()
+}
+
+// filename returns the name of the chart file of the market (without extension).
+func (key chartKey) filename() string {
+	var parts []string
+	for _, tag := range []string{key.pipeline, key.source} {
+		if tag != "" {
+			parts = append(parts, sanitizeFilename(tag))
+		}
+	}
+	parts = append(parts, "market-"+strconv.FormatUint(key.market, 10))
+	return strings.Join(parts, "-")
+}
+
+func (key chartKey) title() string {
+	title := "market " + strconv.FormatUint(key.market, 10)
+	if key.source != "" {
+		title += " (" + key.source + ")"
+	}
+	if key.pipeline != "" {
+		title += ", pipeline " + key.pipeline
+	}
+	return title
+}
+
+// sanitizeFilename replaces the characters that aren't safe in file names.
+func sanitizeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+const (
+	chartWidth  = 800
+	chartHeight = 480
+	chartLeft   = 80
+	chartRight  = 20
+)
+
+var (
+	chartAxisColor   = color.RGBA{0x66, 0x66, 0x66, 0xff}
+	chartGridColor   = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	chartVWAPColor   = color.RGBA{0x1f, 0x77, 0xb4, 0xff}
+	chartVolumeColor = color.RGBA{0xff, 0x7f, 0x0e, 0xff}
+)
+
+// chartCanvas is a drawing surface, in pixels from the top left corner.
+type chartCanvas interface {
+	line(x1, y1, x2, y2 float64, c color.RGBA)
+	rect(x, y, w, h float64, c color.RGBA)
+	// text draws a label at x, y (its baseline), anchored at its start,
+	// middle or end; PNG charts have no labels.
+	text(x, y float64, s string, anchor string)
+	encode(w io.Writer) error
+}
+
+// drawChart draws the VWAP of the windows as a line (top panel),
+// and their volume as bars (bottom panel).
+func drawChart(canvas chartCanvas, title string, points []chartPoint) {
+	canvas.rect(0, 0, chartWidth, chartHeight, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	canvas.text(chartWidth/2, 24, title, "middle")
+
+	from, to := points[0].start, points[len(points)-1].end
+	if !to.After(from) {
+		to = from.Add(time.Second)
+	}
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	x := func(t time.Time) float64 {
+		return chartLeft + plotWidth*float64(t.Sub(from))/float64(to.Sub(from))
+	}
+
+	// VWAP:
+	const vwapTop, vwapHeight = 50, 170
+	lo, hi := chartRange(points, func(p chartPoint) float64 { return p.vwap }, false)
+	drawPanel(canvas, "vwap", vwapTop, vwapHeight, lo, hi)
+	prevX, prevY := math.NaN(), math.NaN()
+	for _, p := range points {
+		if math.IsNaN(p.vwap) || math.IsInf(p.vwap, 0) {
+			// Undefined VWAPs (no volume) break the line:
+			prevX, prevY = math.NaN(), math.NaN()
+			continue
+		}
+		px := (x(p.start) + x(p.end)) / 2
+		py := vwapTop + vwapHeight*(hi-p.vwap)/(hi-lo)
+		if !math.IsNaN(prevX) {
+			canvas.line(prevX, prevY, px, py, chartVWAPColor)
+		}
+		canvas.rect(px-2, py-2, 4, 4, chartVWAPColor)
+		prevX, prevY = px, py
+	}
+
+	// Volume:
+	const volumeTop, volumeHeight = 260, 170
+	lo, hi = chartRange(points, func(p chartPoint) float64 { return p.volume }, true)
+	drawPanel(canvas, "volume", volumeTop, volumeHeight, lo, hi)
+	for _, p := range points {
+		if math.IsNaN(p.volume) || p.volume <= 0 {
+			continue
+		}
+		x1, x2 := x(p.start), x(p.end)
+		if x2-x1 > 3 {
+			x1, x2 = x1+1, x2-1
+		}
+		h := volumeHeight * (p.volume - lo) / (hi - lo)
+		canvas.rect(x1, volumeTop+volumeHeight-h, x2-x1, h, chartVolumeColor)
+	}
+
+	// Time axis:
+	canvas.text(chartLeft, chartHeight-20, from.UTC().Format(time.RFC3339), "start")
+	canvas.text(chartWidth-chartRight, chartHeight-20, to.UTC().Format(time.RFC3339), "end")
+}
+
+// drawPanel draws the axes, grid and labels of a panel.
+func drawPanel(canvas chartCanvas, label string, top float64, height float64, lo float64, hi float64) {
+	const ticks = 4
+	for i := 0; i <= ticks; i++ {
+		y := top + height*float64(i)/ticks
+		canvas.line(chartLeft, y, chartWidth-chartRight, y, chartGridColor)
+		value := hi - (hi-lo)*float64(i)/ticks
+		canvas.text(chartLeft-6, y+4, strconv.FormatFloat(value, 'g', 6, 64), "end")
+	}
+	canvas.line(chartLeft, top, chartLeft, top+height, chartAxisColor)
+	canvas.line(chartLeft, top+height, chartWidth-chartRight, top+height, chartAxisColor)
+	canvas.text(chartLeft, top-6, label, "start")
+}
+
+// chartRange returns the range of the values of the points
+// (from zero, if fromZero is true).
+func chartRange(points []chartPoint, value func(chartPoint) float64, fromZero bool) (float64, float64) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	if fromZero {
+		lo = 0
+	}
+	for _, p := range points {
+		v := value(p)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	if math.IsInf(lo, 0) || math.IsInf(hi, 0) {
+		return 0, 1
+	}
+	if hi == lo {
+		// A flat series is drawn in the middle:
+		return lo - 1, hi + 1
+	}
+	return lo, hi
+}
+
+// svgCanvas draws an SVG document.
+type svgCanvas struct {
+	b strings.Builder
+}
+
+func newSVGCanvas(width int, height int) *svgCanvas {
+	c := &svgCanvas{}
+	fmt.Fprintf(&c.b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`+"\n", width, height, width, height)
+	return c
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (c *svgCanvas) line(x1, y1, x2, y2 float64, col color.RGBA) {
+	fmt.Fprintf(&c.b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s"/>`+"\n", x1, y1, x2, y2, svgColor(col))
+}
+
+func (c *svgCanvas) rect(x, y, w, h float64, col color.RGBA) {
+	fmt.Fprintf(&c.b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n", x, y, w, h, svgColor(col))
+}
+
+func (c *svgCanvas) text(x, y float64, s string, anchor string) {
+	fmt.Fprintf(&c.b, `<text x="%.1f" y="%.1f" text-anchor="%s">%s</text>`+"\n", x, y, anchor, html.EscapeString(s))
+}
+
+func (c *svgCanvas) encode(w io.Writer) error {
+	_, err := io.WriteString(w, c.b.String()+"</svg>\n")
+	return err
+}
+
+// pngCanvas draws a PNG image.
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func newPNGCanvas(width int, height int) *pngCanvas {
+	return &pngCanvas{img: image.NewRGBA(image.Rect(0, 0, width, height))}
+}
+
+func (c *pngCanvas) line(x1, y1, x2, y2 float64, col color.RGBA) {
+	steps := int(math.Max(math.Abs(x2-x1), math.Abs(y2-y1))) + 1
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		c.img.SetRGBA(int(math.Round(x1+(x2-x1)*t)), int(math.Round(y1+(y2-y1)*t)), col)
+	}
+}
+
+func (c *pngCanvas) rect(x, y, w, h float64, col color.RGBA) {
+	for py := int(math.Round(y)); py < int(math.Round(y+h)); py++ {
+		for px := int(math.Round(x)); px < int(math.Round(x+w)); px++ {
+			c.img.SetRGBA(px, py, col)
+		}
+	}
+}
+
+func (c *pngCanvas) text(x, y float64, s string, anchor string) {}
+
+func (c *pngCanvas) encode(w io.Writer) error {
+	return png.Encode(w, c.img)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files of the tests in testdata")
+
+// chartResults are the results of the windows of a market, with a window
+// without volume (whose VWAP is undefined, breaking the line).
+func chartResults() []M {
+	start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	var results []M
+	for i, v := range []struct{ volume, vwap float64 }{
+		{12.5, 100.25}, {30, 101}, {0, math.NaN()}, {7.25, 99.5}, {18, 100.75},
+	} {
+		results = append(results, M{
+			"market":       uint64(42),
+			"pipeline":     "minutes",
+			"source":       "a/b.json",
+			"total_volume": v.volume,
+			"vwap":         v.vwap,
+			"window_start": start.Add(time.Duration(i) * time.Minute),
+			"window_end":   start.Add(time.Duration(i+1) * time.Minute),
+		})
+	}
+	return results
+}
+
+// renderCharts renders the charts of the results in the given format,
+// returning the files written.
+func renderCharts(t *testing.T, format string, results []M) map[string][]byte {
+	dir := t.TempDir()
+	c, err := newCharter(dir, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In reverse order, as the windows may be emitted in any order:
+	for i := len(results) - 1; i >= 0; i-- {
+		c.observe(results[i])
+	}
+	c.observe(M{"market": uint64(7), "total_volume": 1.0}) // Not of a window.
+	if err := c.render(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = data
+	}
+	return files
+}
+
+func TestChartSVG(t *testing.T) {
+	const name = "minutes-a_b.json-market-42.svg"
+	files := renderCharts(t, chartFormatSVG, chartResults())
+	if len(files) != 1 || files[name] == nil {
+		t.Fatalf("got charts %v, want %s", keys(files), name)
+	}
+	got := files[name]
+
+	// The chart must be well-formed XML:
+	dec := xml.NewDecoder(bytes.NewReader(got))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("invalid SVG: %s", err)
+		}
+	}
+
+	golden := filepath.Join("testdata", "chart.svg")
+	if *updateGolden {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("the chart differs from %s (run the test with -update if the change is intended):\n%s", golden, got)
+	}
+}
+
+func TestChartPNG(t *testing.T) {
+	files := renderCharts(t, chartFormatPNG, chartResults())
+	data := files["minutes-a_b.json-market-42.png"]
+	if data == nil {
+		t.Fatalf("got charts %v", keys(files))
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != chartWidth || size.Y != chartHeight {
+		t.Errorf("got a chart of %v, want %vx%v", size, chartWidth, chartHeight)
+	}
+}
+
+func keys(files map[string][]byte) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/gagliardetto/messari-challenge/feed"
+)
+
+// A checkpoint is the state of the markets of the pipelines in a compact
+// binary format, to resume the aggregation with -warm-start (as from
+// results written with -state, but smaller and faster for many markets).
+//
+// It starts with checkpointMagic, the version of the format (a byte) and
+// the name of the codec of the rest (a length-prefixed string, "none" if
+// uncompressed). The rest has the number of sections (uvarint), and for
+// each pipeline and source a section:
+//
+//	pipeline, source    strings
+//	derived             uvarint count, then their names
+//	markets             uvarint count, then the markets by increasing id
+//
+// and for each market: the delta of its id to the previous one (uvarint),
+// the flags of the optional parts (uvarint), num_trades and num_buy
+// (uvarints), total_volume, total_price, price_volume_sum, buy_volume and
+// the derived sums (float64s), then the optional parts, if flagged: the OHLC
+// prices (float64s), the time span (varints), the spreads and the book stats
+// (their sums as float64s, their counts as uvarints), and since version 2
+// the number of trades shed (uvarint). Strings are a uvarint length followed
+// by the bytes, float64s are 8 bytes little-endian.
+//
+// Later versions may only add to the format: readers load the versions up to
+// theirs, and reject the later ones.
+const (
+	checkpointMagic   = "MCKP"
+	checkpointVersion = 2
+)
+
+// The flags of the optional parts of a market in a checkpoint.
+const (
+	checkpointOHLC = 1 << iota
+	checkpointSpan
+	checkpointSpreads
+	checkpointBook
+	checkpointShed
+)
+
+// defaultCheckpointCompression is the default codec of the checkpoints.
+const defaultCheckpointCompression = "zstd"
+
+// checkpointWriter encodes the fields of a checkpoint.
+type checkpointWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *checkpointWriter) uvarint(v uint64) {
+	w.w.Write(w.buf[:binary.PutUvarint(w.buf[:], v)])
+}
+
+func (w *checkpointWriter) varint(v int64) {
+	w.w.Write(w.buf[:binary.PutVarint(w.buf[:], v)])
+}
+
+func (w *checkpointWriter) float(f float64) {
+	binary.LittleEndian.PutUint64(w.buf[:8], math.Float64bits(f))
+	w.w.Write(w.buf[:8])
+}
+
+func (w *checkpointWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.w.WriteString(s)
+}
+
+// market encodes the state of a market.
+func (w *checkpointWriter) market(delta uint64, st marketState) {
+	flags := uint64(0)
+	if st.hasOHLC {
+		flags |= checkpointOHLC
+	}
+	if st.span.first != 0 {
+		flags |= checkpointSpan
+	}
+	if st.numQuotes > 0 || st.numEffective > 0 {
+		flags |= checkpointSpreads
+	}
+	if st.numUpdates > 0 {
+		flags |= checkpointBook
+	}
+	if st.numShed > 0 {
+		flags |= checkpointShed
+	}
+	w.uvarint(delta)
+	w.uvarint(flags)
+	w.uvarint(uint64(st.numTrades))
+	w.uvarint(uint64(st.numBuy))
+	w.float(st.totalVolume)
+	w.float(st.totalPrice)
+	w.float(st.priceVolumeSum)
+	w.float(st.buyVolume)
+	for _, sum := range st.derivedSums {
+		w.float(sum)
+	}
+	if flags&checkpointOHLC != 0 {
+		w.float(st.open)
+		w.float(st.high)
+		w.float(st.low)
+		w.float(st.close)
+	}
+	if flags&checkpointSpan != 0 {
+		w.varint(st.span.first)
+		w.varint(st.span.last)
+	}
+	if flags&checkpointSpreads != 0 {
+		w.float(st.spreadSum)
+		w.uvarint(uint64(st.numQuotes))
+		w.float(st.effectiveSum)
+		w.uvarint(uint64(st.numEffective))
+	}
+	if flags&checkpointBook != 0 {
+		w.uvarint(uint64(st.numUpdates))
+		w.float(st.imbalanceSum)
+		w.uvarint(uint64(st.numImbalances))
+		w.float(st.lastImbalance)
+	}
+	if flags&checkpointShed != 0 {
+		w.uvarint(uint64(st.numShed))
+	}
+}
+
+// section encodes the markets of an aggregator.
+func (w *checkpointWriter) section(name string, source string, ag *Markets) {
+	ag.mu.RLock()
+	defer ag.mu.RUnlock()
+	w.string(name)
+	w.string(source)
+	w.uvarint(uint64(len(ag.opts.Derived)))
+	for _, derived := range ag.opts.Derived {
+		w.string(derived.Name)
+	}
+	ids := make([]uint64, 0, len(ag.mapper))
+	for id := range ag.mapper {
+		ids = append(ids, id)
+	}
+	sortMarkets(ids)
+	w.uvarint(uint64(len(ids)))
+	previous := uint64(0)
+	for _, id := range ids {
+		ag.mapper[id].Lock(func(mkt *Market) {
+			w.market(id-previous, mkt.state())
+		})
+		previous = id
+	}
+}
+
+// writeCheckpoint writes the state of the markets of the pipelines (but
+// their rollups, which are not resumed) to a checkpoint at path, compressed
+// with the codec (or not, if nil). It is written to a temporary file first,
+// so that a checkpoint is either complete or the previous one.
+func writeCheckpoint(path string, codec *feed.Codec, pipelines []*pipeline) (err error) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error while writing checkpoint: %s", err)
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	out := bufio.NewWriter(file)
+	out.WriteString(checkpointMagic)
+	out.WriteByte(checkpointVersion)
+	header := &checkpointWriter{w: out}
+	if codec != nil {
+		header.string(codec.Name)
+	} else {
+		header.string(feed.CompressionNone)
+	}
+	compressed, err := feed.NewCodecWriter(codec, out)
+	if err != nil {
+		return fmt.Errorf("error while writing checkpoint: %s", err)
+	}
+	w := &checkpointWriter{w: bufio.NewWriterSize(compressed, 1<<16)}
+	var sections []*pipeline
+	for _, p := range pipelines {
+		if p.rollup == nil {
+			sections = append(sections, p)
+		}
+	}
+	numSections := 0
+	for _, p := range sections {
+		numSections += len(p.sources)
+	}
+	w.uvarint(uint64(numSections))
+	for _, p := range sections {
+		for _, source := range p.sources {
+			w.section(p.name, source, p.ags[source])
+		}
+	}
+
+	if err := w.w.Flush(); err != nil {
+		return fmt.Errorf("error while writing checkpoint: %s", err)
+	}
+	if err := compressed.Close(); err != nil {
+		return fmt.Errorf("error while writing checkpoint: %s", err)
+	}
+	if err := out.Flush(); err != nil {
+		return fmt.Errorf("error while writing checkpoint: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error while writing checkpoint: %s", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error while writing checkpoint: %s", err)
+	}
+	return nil
+}
+
+// isCheckpoint tells whether the file at path is a checkpoint
+// (rather than results).
+func isCheckpoint(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("error while opening %s: %s", path, err)
+	}
+	defer file.Close()
+	magic := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(magic, []byte(checkpointMagic)), nil
+}
+
+// checkpointReader decodes the fields of a checkpoint,
+// keeping the first error.
+type checkpointReader struct {
+	r   *bufio.Reader
+	err error
+	buf [8]byte
+}
+
+func (r *checkpointReader) fail(err error) {
+	if r.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+	}
+}
+
+func (r *checkpointReader) uvarint() uint64 {
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+func (r *checkpointReader) varint() int64 {
+	v, err := binary.ReadVarint(r.r)
+	if err != nil {
+		r.fail(err)
+	}
+	return v
+}
+
+func (r *checkpointReader) float() float64 {
+	if _, err := io.ReadFull(r.r, r.buf[:]); err != nil {
+		r.fail(err)
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(r.buf[:]))
+}
+
+// string reads a string of at most maxLen bytes.
+func (r *checkpointReader) string(maxLen uint64) string {
+	n := r.uvarint()
+	if n > maxLen {
+		r.fail(fmt.Errorf("invalid string length %v", n))
+	}
+	if r.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.fail(err)
+	}
+	return string(b)
+}
+
+// market decodes the state of a market, with numDerived derived sums;
+// it returns the delta of its id.
+func (r *checkpointReader) market(numDerived int) (uint64, marketState) {
+	delta := r.uvarint()
+	flags := r.uvarint()
+	st := marketState{
+		numTrades:      int(r.uvarint()),
+		numBuy:         int(r.uvarint()),
+		totalVolume:    r.float(),
+		totalPrice:     r.float(),
+		priceVolumeSum: r.float(),
+		buyVolume:      r.float(),
+		derivedSums:    make([]float64, numDerived),
+	}
+	for i := range st.derivedSums {
+		st.derivedSums[i] = r.float()
+	}
+	if flags&checkpointOHLC != 0 {
+		st.hasOHLC = true
+		st.open = r.float()
+		st.high = r.float()
+		st.low = r.float()
+		st.close = r.float()
+	}
+	if flags&checkpointSpan != 0 {
+		st.span.first = r.varint()
+		st.span.last = r.varint()
+	}
+	if flags&checkpointSpreads != 0 {
+		st.spreadSum = r.float()
+		st.numQuotes = int(r.uvarint())
+		st.effectiveSum = r.float()
+		st.numEffective = int(r.uvarint())
+	}
+	if flags&checkpointBook != 0 {
+		st.numUpdates = int(r.uvarint())
+		st.imbalanceSum = r.float()
+		st.numImbalances = int(r.uvarint())
+		st.lastImbalance = r.float()
+	}
+	if flags&checkpointShed != 0 {
+		st.numShed = int(r.uvarint())
+	}
+	return delta, st
+}
+
+// restoreCheckpoint initializes the aggregators of the pipeline
+// from its sections of a checkpoint.
+func (p *pipeline) restoreCheckpoint(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error while opening %s: %s", path, err)
+	}
+	defer file.Close()
+	in := bufio.NewReader(file)
+	header := &checkpointReader{r: in}
+	magic := make([]byte, len(checkpointMagic))
+	io.ReadFull(in, magic)
+	version, err := in.ReadByte()
+	if err != nil || string(magic) != checkpointMagic {
+		return fmt.Errorf("%s is not a checkpoint", path)
+	}
+	if version > checkpointVersion {
+		return fmt.Errorf("checkpoint %s has version %v, written by a later release (this one reads up to version %v)", path, version, checkpointVersion)
+	}
+	compression := header.string(64)
+	if header.err != nil {
+		return fmt.Errorf("error while reading checkpoint %s: %s", path, header.err)
+	}
+	codec, err := feed.GetCodec(compression, "")
+	if err != nil {
+		return fmt.Errorf("error while reading checkpoint %s: %s", path, err)
+	}
+	decompressed, err := feed.NewCodecReader(codec, in)
+	if err != nil {
+		return fmt.Errorf("error while reading checkpoint %s: %s", path, err)
+	}
+
+	r := &checkpointReader{r: bufio.NewReaderSize(decompressed, 1<<16)}
+	numSections := r.uvarint()
+	for i := uint64(0); i < numSections && r.err == nil; i++ {
+		name := r.string(1 << 16)
+		source := r.string(1 << 16)
+		numDerived := int(r.uvarint())
+		if numDerived > 1<<16 {
+			r.fail(fmt.Errorf("invalid number of derived metrics %v", numDerived))
+		}
+		derived := make([]string, 0, numDerived)
+		for j := 0; j < numDerived && r.err == nil; j++ {
+			derived = append(derived, r.string(1<<16))
+		}
+		numMarkets := r.uvarint()
+		if r.err != nil {
+			break
+		}
+
+		// The markets of other pipelines are skipped:
+		var ag *Markets
+		var order []int
+		if name == p.name {
+			ag = p.ags[""]
+			if p.tagSources {
+				ag = p.ags[source]
+				if ag == nil {
+					return fmt.Errorf("error while restoring from %s: source %q is not an input", path, source)
+				}
+			}
+			if order, err = derivedOrder(derived, ag.opts.Derived); err != nil {
+				return fmt.Errorf("error while restoring from %s: %s", path, err)
+			}
+		}
+		id := uint64(0)
+		for j := uint64(0); j < numMarkets && r.err == nil; j++ {
+			delta, st := r.market(numDerived)
+			id += delta
+			if ag == nil || r.err != nil {
+				continue
+			}
+			sums := make([]float64, len(order))
+			for k, from := range order {
+				sums[k] = st.derivedSums[from]
+			}
+			st.derivedSums = sums
+			ag.restore(id, st)
+		}
+	}
+	if r.err != nil {
+		return fmt.Errorf("error while reading checkpoint %s: %s", path, r.err)
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return fmt.Errorf("error while reading checkpoint %s: trailing data", path)
+	}
+	return nil
+}
+
+// derivedOrder returns the index in the checkpoint of each derived metric
+// of the pipeline, which must all be in it.
+func derivedOrder(names []string, derived []*DerivedMetric) ([]int, error) {
+	index := map[string]int{}
+	for i, name := range names {
+		index[name] = i
+	}
+	order := make([]int, len(derived))
+	for i, d := range derived {
+		from, ok := index[d.Name]
+		if !ok {
+			available := append([]string(nil), names...)
+			sort.Strings(available)
+			return nil, fmt.Errorf("derived metric %s is not in the checkpoint (it has %v)", d.Name, available)
+		}
+		order[i] = from
+	}
+	return order, nil
+}
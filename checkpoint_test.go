@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gagliardetto/messari-challenge/feed"
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// checkpointConfig is the config of the pipelines of the checkpoint tests,
+// with all the state a checkpoint has.
+func checkpointConfig(warmStart string) PipelineConfig {
+	return PipelineConfig{
+		Name:      "p",
+		Derive:    []string{"notional=price*volume", "fee=volume*0.001"},
+		NetFlow:   true,
+		Profile:   profileExtended,
+		Quotes:    true,
+		BookDepth: 2,
+		WarmStart: warmStart,
+	}
+}
+
+// checkpointFixture returns a pipeline whose markets have every part of the
+// state of a checkpoint: OHLC prices, time span, spreads, book stats and
+// trades shed (all those of market 9), with ids far apart.
+// It must not change: testdata/checkpoint-v2.mckp was written from it.
+func checkpointFixture(t *testing.T) *pipeline {
+	p, err := newPipeline(checkpointConfig(""), []string{""}, nil, timeModeEvent, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := int64(1640995200000)
+	values := make([]float64, len(tradeVars))
+	for i, market := range []uint64{1, 5, 1 << 40, 1, 5, 1, 1 << 40, 1} {
+		ts += 250
+		p.addQuote("", models.Quote{Market: market, Bid: 99.5 + float64(i), Ask: 100.5 + float64(i), Timestamp: ts})
+		p.addBookUpdate("", models.BookUpdate{Market: market, Side: "bid", Price: 99 + float64(i), Size: 2 + float64(i), Timestamp: ts})
+		p.addBookUpdate("", models.BookUpdate{Market: market, Side: "ask", Price: 101 + float64(i), Size: 1.5, Timestamp: ts})
+		trade := models.Trade{ID: i, Market: market, Price: 100 + float64(i)*0.75, Volume: 0.5 + float64(i%3), IsBuy: i%3 != 0, Timestamp: ts}
+		if err := p.add("", trade, tradeValues(trade, values)); err != nil {
+			t.Fatal(err)
+		}
+		if i%4 == 1 {
+			p.shed("", trade)
+		}
+	}
+	p.shed("", models.Trade{Market: 9, Price: 1, Volume: 1, Timestamp: ts})
+	p.shed("", models.Trade{Market: 9, Price: 1, Volume: 1, Timestamp: ts})
+	return p
+}
+
+// marketStates returns the state of the markets of the pipeline.
+func marketStates(p *pipeline) map[uint64]marketState {
+	states := map[uint64]marketState{}
+	ag := p.ags[""]
+	ag.mu.RLock()
+	defer ag.mu.RUnlock()
+	for id, mkt := range ag.mapper {
+		mkt.Lock(func(mkt *Market) {
+			states[id] = mkt.state()
+		})
+	}
+	return states
+}
+
+// checkStates compares the states of the markets restored from a checkpoint
+// with those of the pipeline it was written from.
+func checkStates(t *testing.T, got map[uint64]marketState, want map[uint64]marketState) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("got %v markets, want %v", len(got), len(want))
+	}
+	for id, st := range want {
+		if !reflect.DeepEqual(got[id], st) {
+			t.Errorf("market %v:\n got %+v\nwant %+v", id, got[id], st)
+		}
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	p := checkpointFixture(t)
+	want := marketStates(p)
+	for _, compression := range []string{feed.CompressionNone, defaultCheckpointCompression} {
+		path := filepath.Join(t.TempDir(), "checkpoint")
+		var codec *feed.Codec
+		if compression != feed.CompressionNone {
+			var err error
+			if codec, err = feed.GetCodec(compression, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeCheckpoint(path, codec, []*pipeline{p}); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := newPipeline(checkpointConfig(path), []string{""}, nil, timeModeEvent, 0)
+		if err != nil {
+			t.Fatalf("%s: %s", compression, err)
+		}
+		checkStates(t, marketStates(restored), want)
+	}
+}
+
+// TestCheckpointV2 checks that a checkpoint of version 2, written by an
+// earlier release, is still read.
+func TestCheckpointV2(t *testing.T) {
+	restored, err := newPipeline(checkpointConfig(filepath.Join("testdata", "checkpoint-v2.mckp")), []string{""}, nil, timeModeEvent, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStates(t, marketStates(restored), marketStates(checkpointFixture(t)))
+}
+
+func TestCheckpointInvalid(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid")
+	if err := writeCheckpoint(valid, nil, []*pipeline{checkpointFixture(t)}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := len(checkpointMagic) + 1 + 1 + len(feed.CompressionNone)
+	restore := func(data []byte) error {
+		path := filepath.Join(dir, "checkpoint")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		p, err := newPipeline(checkpointConfig(""), []string{""}, nil, timeModeEvent, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.restoreCheckpoint(path)
+	}
+	if err := restore(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"later version", append([]byte(checkpointMagic+"\x03"), data[len(checkpointMagic)+1:]...), "has version 3, written by a later release"},
+		{"unknown codec", append([]byte(checkpointMagic+"\x02\x04lzma"), data[header:]...), "unknown"},
+		{"no version", []byte(checkpointMagic), "is not a checkpoint"},
+		{"trailing data", append(append([]byte(nil), data...), 0), "trailing data"},
+		{"string too long", append(append([]byte(nil), data[:header]...), 1, 0xff, 0xff, 0xff, 0xff, 0x0f), "invalid string length"},
+		{"corrupt compressed data", append([]byte(checkpointMagic+"\x02\x04zstd"), data[header:]...), "error while reading checkpoint"},
+	} {
+		err := restore(tc.data)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got error %v, want %q", tc.name, err, tc.err)
+		}
+	}
+
+	// Every truncation is an error:
+	for n := header; n < len(data); n++ {
+		if err := restore(data[:n]); err == nil {
+			t.Fatalf("no error for a checkpoint truncated to %v bytes of %v", n, len(data))
+		}
+	}
+	// Corrupted bytes may be read as other numbers, but must not panic:
+	for i := header; i < len(data); i++ {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0xff
+		restore(corrupt)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the content of the file provided with -config.
+type Config struct {
+	// Pipelines are run over the same input stream;
+	// when not empty, they replace the pipeline defined via flags.
+	Pipelines []PipelineConfig `yaml:"pipelines"`
+	// Rename maps field names to the names used in the output
+	// (e.g. vwap: weighted_average_price); -rename flags take precedence.
+	Rename map[string]string `yaml:"rename"`
+	// Report sends a summary of the run at its end (see ReportConfig).
+	Report *ReportConfig `yaml:"report"`
+}
+
+// PipelineConfig defines an aggregation pipeline.
+type PipelineConfig struct {
+	// Name is added to the results as "pipeline" (if not empty).
+	Name string `yaml:"name"`
+	// Filter is an expression that selects the trades to aggregate.
+	Filter string `yaml:"filter"`
+	// Having is an expression that selects the markets whose results
+	// are emitted.
+	Having string `yaml:"having"`
+	// Script post-processes the results before they are emitted
+	// (see Script).
+	Script string `yaml:"script"`
+	// Derive are derived metrics, as name=expression.
+	Derive []string `yaml:"derive"`
+	// Window is the duration of the tumbling windows (by the time of the
+	// trades, see -time-mode);
+	// zero means a single window spanning the whole run.
+	Window time.Duration `yaml:"window"`
+	// AllowedLateness keeps windows by trade timestamp for this long after
+	// they end, so that late trades amend their results (see addLate).
+	AllowedLateness time.Duration `yaml:"allowed_lateness"`
+	// IdleFlush flushes the markets without trades for this long
+	// (by trade timestamp) during the run, see idleFlush.
+	IdleFlush time.Duration `yaml:"idle_flush"`
+	// SessionClose flushes the markets without trades since the last
+	// session close, at this time of day (HH:MM, UTC), during the run.
+	SessionClose string `yaml:"session_close"`
+	// Activity enables the rate-of-activity metrics.
+	Activity bool `yaml:"activity"`
+	// ActivityHorizon bounds the seconds counted by the activity metrics
+	// (defaultActivityHorizon if zero).
+	ActivityHorizon time.Duration `yaml:"activity_horizon"`
+	// NetFlow enables the net flow metric.
+	NetFlow bool `yaml:"net_flow"`
+	// TrimmedMean enables the trimmed mean price, without this percentage
+	// of the lowest and of the highest prices.
+	TrimmedMean float64 `yaml:"trimmed_mean"`
+	// Quotes enables quote records, and the spread metrics.
+	Quotes bool `yaml:"quotes"`
+	// BookDepth enables book update records, and the book imbalance metrics
+	// over this number of levels.
+	BookDepth int `yaml:"book_depth"`
+	// Profile is the output profile: legacy (default), extended, or full.
+	Profile string `yaml:"profile"`
+	// State adds the counts and sums of each market to the results.
+	State bool `yaml:"state"`
+	// WarmStart is the path of the results (with state) of a previous run,
+	// from which the aggregation is resumed.
+	WarmStart string `yaml:"warm_start"`
+	// TagSources aggregates each input separately.
+	TagSources bool `yaml:"tag_sources"`
+	// PerInput also aggregates each input separately, in addition to all of
+	// them (see expandPerInput).
+	PerInput bool `yaml:"per_input_results"`
+	// Rollups also aggregate groups of markets (see RollupConfig).
+	Rollups []RollupConfig `yaml:"rollups"`
+	// rollup is the level of rollups of a copy of a pipeline
+	// (see expandRollups).
+	rollup *RollupConfig
+	// Output is where the results are written: - (stdout), a file path,
+	// prometheus:<url> (a Prometheus remote-write endpoint),
+	// bigquery:project.dataset.table, or duckdb:path.
+	Output string `yaml:"output"`
+}
+
+// expandPerInput adds, after each pipeline with PerInput, a copy of it that
+// aggregates each input separately, writing its results tagged with their
+// input to the same output.
+func expandPerInput(confs []PipelineConfig) ([]PipelineConfig, error) {
+	var out []PipelineConfig
+	for _, conf := range confs {
+		out = append(out, conf)
+		if !conf.PerInput {
+			continue
+		}
+		if conf.TagSources || conf.WarmStart != "" {
+			return nil, fmt.Errorf("pipeline %q: per-input results can't be used with tagged sources or a warm start", conf.Name)
+		}
+		conf.TagSources = true
+		out = append(out, conf)
+	}
+	return out, nil
+}
+
+// LoadConfig loads the config from a YAML file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading config: %s", err)
+	}
+	var conf Config
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		return nil, fmt.Errorf("error while parsing config %s: %s", path, err)
+	}
+	return &conf, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/feed"
+)
+
+// controller serves the commands of the control socket (see -control-socket),
+// one per line, to administer a long-running aggregator; each command is
+// answered with "ok" (and what it did) or "error: <reason>".
+type controller struct {
+	pipelines []*pipeline
+	outs      *outputs
+	// stop stops reading the inputs, as if they had ended.
+	stop func()
+	// stopAfterWindow is set (to 1) by stop-after-current-window.
+	stopAfterWindow int32
+	// checkpoint is the path of the checkpoints (see -checkpoint), if any.
+	checkpoint      string
+	checkpointCodec *feed.Codec
+}
+
+// controlCommands are the commands of the control socket, with their help.
+var controlCommands = [][2]string{
+	{"flush-results", "write the results so far of the current windows, tagged as partial, without resetting them"},
+	{"rotate-output", "close the file outputs and create them again (e.g. after logrotate moved them)"},
+	{"dump-state", "write the state of the markets (their results with the state fields) to the socket, as NDJSON"},
+	{"checkpoint", "write the state of the markets to the -checkpoint path, replacing the previous checkpoint"},
+	{"stop-after-current-window", "stop reading the inputs when the current windows end (at once without windows), and exit normally"},
+	{"help", "list the commands"},
+}
+
+// listenControl listens on a Unix socket at path (replacing a stale one),
+// serving its connections until the listener is closed.
+func listenControl(path string, c *controller) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error while listening on the control socket: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.serve(conn)
+		}
+	}()
+	return listener, nil
+}
+
+// serve serves the commands of a connection.
+func (c *controller) serve(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	w := bufio.NewWriter(conn)
+	for scanner.Scan() {
+		command := strings.TrimSpace(scanner.Text())
+		if command == "" {
+			continue
+		}
+		reply, err := c.command(command, w)
+		if err != nil {
+			fmt.Fprintf(w, "error: %s\n", err)
+		} else {
+			fmt.Fprintf(w, "ok %s\n", reply)
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// command runs a command, returning its reply; output (e.g. the state)
+// is written to w before it.
+func (c *controller) command(command string, w *bufio.Writer) (string, error) {
+	fields := strings.Fields(command)
+	switch fields[0] {
+	case "flush-results":
+		n := 0
+		for _, p := range c.pipelines {
+			flushed, err := p.flush()
+			if err != nil {
+				return "", err
+			}
+			n += flushed
+		}
+		return fmt.Sprintf("flushed %v results", n), nil
+	case "rotate-output":
+		rotated, err := c.outs.rotateAll()
+		if err != nil {
+			return "", err
+		}
+		if len(rotated) == 0 {
+			return "", errors.New("no file outputs")
+		}
+		return "rotated " + strings.Join(rotated, " "), nil
+	case "dump-state":
+		n := 0
+		for _, p := range c.pipelines {
+			for _, res := range p.dumpState() {
+				line, err := json.Marshal(p.out.opts.format(res))
+				if err != nil {
+					return "", fmt.Errorf("error while encoding state: %s", err)
+				}
+				w.Write(line)
+				w.WriteByte('\n')
+				n++
+			}
+		}
+		return fmt.Sprintf("dumped %v markets", n), nil
+	case "checkpoint":
+		if c.checkpoint == "" {
+			return "", errors.New("no -checkpoint path")
+		}
+		if err := writeCheckpoint(c.checkpoint, c.checkpointCodec, c.pipelines); err != nil {
+			return "", err
+		}
+		return "wrote " + c.checkpoint, nil
+	case "stop-after-current-window":
+		if !hasWindows(c.pipelines) {
+			c.stop()
+			return "stopping", nil
+		}
+		atomic.StoreInt32(&c.stopAfterWindow, 1)
+		return "stopping after the current window", nil
+	case "help":
+		for _, cmd := range controlCommands {
+			fmt.Fprintf(w, "%s: %s\n", cmd[0], cmd[1])
+		}
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown command %q (see help)", fields[0])
+}
+
+// windowEnded stops the run after a window, if requested.
+func (c *controller) windowEnded() {
+	if atomic.LoadInt32(&c.stopAfterWindow) == 1 {
+		c.stop()
+	}
+}
+
+// flush writes the results of the current window, tagged as partial,
+// without resetting it; it returns their number.
+func (p *pipeline) flush() (int, error) {
+	if p.out == nil {
+		return 0, nil
+	}
+	p.windowMu.RLock()
+	defer p.windowMu.RUnlock()
+	var start, end time.Time
+	if p.window > 0 {
+		if p.windowStart.IsZero() {
+			return 0, nil
+		}
+		start, end = p.windowStart, p.windowStart.Add(p.window)
+	}
+	results := p.collect(start, end, false)
+	for _, res := range results {
+		res["partial"] = true
+	}
+	return len(results), p.out.write(results)
+}
+
+// dumpState returns the results of the current window with the state
+// fields, whatever the options of the pipeline (and its having filter
+// and script).
+func (p *pipeline) dumpState() []M {
+	p.windowMu.RLock()
+	defer p.windowMu.RUnlock()
+	var start, end time.Time
+	if p.window > 0 {
+		start, end = p.windowStart, p.windowStart.Add(p.window)
+	}
+	var results []M
+	for _, source := range p.sources {
+		ag := p.ags[source]
+		ag.mu.RLock()
+		opts := ag.opts
+		opts.State = true
+		opts.Having = nil
+		opts.Script = nil
+		state := &Markets{mapper: ag.mapper, opts: opts}
+		results = append(results, p.tag(state.Compute(), source, start, end)...)
+		ag.mu.RUnlock()
+	}
+	return results
+}
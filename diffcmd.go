@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	stdjson "encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gagliardetto/messari-challenge/feed"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// resultKeyFields identify a result, together with the market.
+var resultKeyFields = []string{"market", "source", "pipeline", "window_start", "rollup"}
+
+// runDiff implements the diff subcommand, which compares two result sets,
+// and prints the fields that differ for each market.
+// It returns the exit status: 0 if the results are the same, 1 if they differ.
+func runDiff(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s diff [flags] a.ndjson b.ndjson\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	tolerance := flags.Float64("tolerance", 1e-9, "Relative difference up to which numbers are considered equal")
+	var fieldTolerances stringsFlag
+	flags.Var(&fieldTolerances, "field-tolerance", "Tolerance for a specific field, as field=tolerance (e.g. vwap=1e-6); can be repeated")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	tolerances, err := parseFieldTolerances(fieldTolerances)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+
+	a, err := readResults(flags.Arg(0))
+	if err != nil {
+		panic(withExitCode(exitInput, err))
+	}
+	b, err := readResults(flags.Arg(1))
+	if err != nil {
+		panic(withExitCode(exitInput, err))
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if writeDiffs(out, a, b, *tolerance, tolerances) > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// parseFieldTolerances parses the -field-tolerance flags, as field=tolerance.
+func parseFieldTolerances(flags []string) (map[string]float64, error) {
+	tolerances := map[string]float64{}
+	for _, def := range flags {
+		eq := strings.IndexByte(def, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid field tolerance %q: expected field=tolerance", def)
+		}
+		tol, err := strconv.ParseFloat(def[eq+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid field tolerance %q: %s", def, err)
+		}
+		tolerances[def[:eq]] = tol
+	}
+	return tolerances, nil
+}
+
+// writeDiffs writes the differences between two result sets, by key,
+// as NDJSON, and returns their number.
+func writeDiffs(out io.Writer, a map[string]M, b map[string]M, tolerance float64, tolerances map[string]float64) int {
+	keys := make([]string, 0, len(a))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	numDiffs := 0
+	for _, key := range keys {
+		resA, okA := a[key]
+		resB, okB := b[key]
+		var diff M
+		switch {
+		case !okA:
+			diff = resultKey(resB)
+			diff["only_in"] = "b"
+		case !okB:
+			diff = resultKey(resA)
+			diff["only_in"] = "a"
+		default:
+			fields := diffResults(resA, resB, tolerance, tolerances)
+			if len(fields) == 0 {
+				continue
+			}
+			diff = resultKey(resA)
+			diff["fields"] = fields
+		}
+		numDiffs++
+		line, err := json.Marshal(diff)
+		if err != nil {
+			panic(withExitCode(exitOutput, err))
+		}
+		out.Write(append(line, '\n'))
+	}
+	return numDiffs
+}
+
+// readResults reads a result set, by key (see resultKeyFields).
+func readResults(path string) (map[string]M, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening %s: %s", path, err)
+	}
+	defer file.Close()
+	codec, _ := feed.GetCodec(feed.CompressionAuto, path)
+	decompressed, err := feed.NewCodecReader(codec, file)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading %s: %s", path, err)
+	}
+
+	results := map[string]M{}
+	reader := bufio.NewReader(decompressed)
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			res, err := decodeResult(line)
+			if err != nil {
+				return nil, fmt.Errorf("error while decoding %s:%v: %s", path, lineNum, err)
+			}
+			if _, ok := res["market"]; !ok {
+				// Not a market result (e.g. a metadata record):
+				continue
+			}
+			results[resultKeyString(res)] = res
+		}
+		if err != nil {
+			if err != io.EOF {
+				return nil, fmt.Errorf("error while reading %s: %s", path, err)
+			}
+			return results, nil
+		}
+	}
+}
+
+// resultNumbers decodes numbers as json.Number, so that markets are exact.
+var resultNumbers = jsoniter.Config{UseNumber: true}.Froze()
+
+// decodeResult decodes a result: the market is decoded as an uint64
+// (IDs above 2^53 can't be represented exactly as floats),
+// every other number as a float64.
+func decodeResult(line []byte) (M, error) {
+	// Records of json-seq outputs start with a record separator:
+	line = bytes.TrimLeft(line, "\x1e")
+	var res M
+	if err := resultNumbers.Unmarshal(line, &res); err != nil {
+		return nil, err
+	}
+	for name, v := range res {
+		n, ok := v.(stdjson.Number)
+		if !ok {
+			continue
+		}
+		if name == "market" {
+			if market, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+				res[name] = market
+				continue
+			}
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %q: %s", name, err)
+		}
+		res[name] = f
+	}
+	return res, nil
+}
+
+func resultKey(res M) M {
+	key := M{}
+	for _, field := range resultKeyFields {
+		if v, ok := res[field]; ok {
+			key[field] = v
+		}
+	}
+	return key
+}
+
+func resultKeyString(res M) string {
+	parts := make([]string, len(resultKeyFields))
+	for i, field := range resultKeyFields {
+		if v, ok := res[field]; ok {
+			parts[i] = fmt.Sprint(v)
+		}
+	}
+	// Pad the market so that keys sort numerically:
+	if market, ok := res["market"].(uint64); ok {
+		parts[0] = fmt.Sprintf("%020d", market)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// diffResults returns the fields that differ between a and b.
+func diffResults(a M, b M, tolerance float64, tolerances map[string]float64) M {
+	fields := M{}
+	for name, va := range a {
+		vb, ok := b[name]
+		if !ok {
+			fields[name] = M{"a": va, "b": nil}
+			continue
+		}
+		na, okA := va.(float64)
+		nb, okB := vb.(float64)
+		if okA && okB {
+			tol, ok := tolerances[name]
+			if !ok {
+				tol = tolerance
+			}
+			if diff := relativeDifference(na, nb); diff > tol {
+				fields[name] = M{"a": na, "b": nb, "difference": diff}
+			}
+			continue
+		}
+		if fmt.Sprint(va) != fmt.Sprint(vb) {
+			fields[name] = M{"a": va, "b": vb}
+		}
+	}
+	for name, vb := range b {
+		if _, ok := a[name]; !ok {
+			fields[name] = M{"a": nil, "b": vb}
+		}
+	}
+	return fields
+}
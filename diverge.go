@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// divergenceDetector compares the aggregates of the same markets across two sources,
+// in tumbling windows by arrival time.
+type divergenceDetector struct {
+	a, b      string
+	agA, agB  *Markets
+	window    time.Duration
+	threshold float64
+	out       *output
+}
+
+// run compares the sources at the end of each window, until stop is closed;
+// then it compares the last (partial) window.
+func (d *divergenceDetector) run(stop <-chan struct{}) error {
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case end := <-ticker.C:
+			if err := d.compare(start, end); err != nil {
+				return err
+			}
+			start = end
+		case <-stop:
+			return d.compare(start, time.Now())
+		}
+	}
+}
+
+// compare prints the divergences of the window that ends now,
+// and resets the state of both sources.
+func (d *divergenceDetector) compare(start time.Time, end time.Time) error {
+	a := d.agA.Swap()
+	b := d.agB.Swap()
+
+	var divergences []M
+	report := func(market uint64, metric string, x float64, y float64) {
+		diff := relativeDifference(x, y)
+		if diff <= d.threshold {
+			return
+		}
+		divergences = append(divergences,
+			M{
+				"window_start": start,
+				"window_end":   end,
+				"market":       market,
+				"metric":       metric,
+				"source_a":     d.a,
+				"source_b":     d.b,
+				"a":            x,
+				"b":            y,
+				"difference":   diff,
+			},
+		)
+	}
+
+	// The divergences are written by market, as the other results:
+	ids := make([]uint64, 0, len(a.mapper)+len(b.mapper))
+	for id := range a.mapper {
+		ids = append(ids, id)
+	}
+	for id := range b.mapper {
+		if _, ok := a.mapper[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sortMarkets(ids)
+	// Markets missing from one of the sources have no volume there:
+	for _, id := range ids {
+		mktA, okA := a.mapper[id]
+		mktB, okB := b.mapper[id]
+		switch {
+		case !okB:
+			volumeA, _ := volumeAndVWAP(mktA)
+			report(id, "total_volume", volumeA, 0)
+		case !okA:
+			volumeB, _ := volumeAndVWAP(mktB)
+			report(id, "total_volume", 0, volumeB)
+		default:
+			volumeA, vwapA := volumeAndVWAP(mktA)
+			volumeB, vwapB := volumeAndVWAP(mktB)
+			report(id, "total_volume", volumeA, volumeB)
+			if volumeA > 0 && volumeB > 0 {
+				report(id, "vwap", vwapA, vwapB)
+			}
+		}
+	}
+	return d.out.write(divergences)
+}
+
+func volumeAndVWAP(mkt *Market) (volume float64, vwap float64) {
+	mkt.Lock(func(mkt *Market) {
+		volume = mkt.totalVolume
+		vwap = mkt.priceXvolumeSum / mkt.totalVolume
+	})
+	return volume, vwap
+}
+
+// relativeDifference returns |x-y| relative to the largest of the two.
+func relativeDifference(x float64, y float64) float64 {
+	if x == y {
+		return 0
+	}
+	return math.Abs(x-y) / math.Max(math.Abs(x), math.Abs(y))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// duckDBPrefix is the prefix of the outputs that insert the results
+// into the results table of a DuckDB database, e.g.
+//
+//	duckdb:markets.duckdb
+const duckDBPrefix = "duckdb:"
+
+// duckDBTable is the table of the results in DuckDB databases.
+const duckDBTable = "results"
+
+// duckDBSink inserts the market results (metadata records are skipped)
+// into the results table of a DuckDB database, created if needed
+// with the columns of the results.
+// The results are staged in a temporary file, and inserted at the end
+// with the duckdb CLI, which must be in the PATH.
+type duckDBSink struct {
+	path    string
+	opts    outputOptions
+	staging *os.File
+	w       *bufio.Writer
+}
+
+func newDuckDBSink(location string, opts outputOptions) (*duckDBSink, error) {
+	path := strings.TrimPrefix(location, duckDBPrefix)
+	if path == "" {
+		return nil, fmt.Errorf("invalid output %q: expected %spath", location, duckDBPrefix)
+	}
+	if _, err := exec.LookPath("duckdb"); err != nil {
+		return nil, fmt.Errorf("output %q: the duckdb CLI is not in the PATH", location)
+	}
+	staging, err := os.CreateTemp("", "aggregator-*.ndjson")
+	if err != nil {
+		return nil, fmt.Errorf("error while creating staging file: %s", err)
+	}
+	return &duckDBSink{
+		path:    path,
+		opts:    opts,
+		staging: staging,
+		w:       bufio.NewWriter(staging),
+	}, nil
+}
+
+func (db *duckDBSink) write(results []M) error {
+	for _, res := range results {
+		if _, ok := res["market"]; !ok {
+			continue
+		}
+		line, err := json.Marshal(db.opts.format(res))
+		if err != nil {
+			return withExitCode(exitOutput, fmt.Errorf("error while encoding result: %s", err))
+		}
+		db.w.Write(line)
+		db.w.WriteByte('\n')
+	}
+	return nil
+}
+
+// close inserts the staged results.
+func (db *duckDBSink) close() error {
+	defer os.Remove(db.staging.Name())
+	err := db.w.Flush()
+	if closeErr := db.staging.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return withExitCode(exitOutput, fmt.Errorf("error while staging results for %s: %s", db.path, err))
+	}
+	info, err := os.Stat(db.staging.Name())
+	if err != nil || info.Size() == 0 {
+		return nil
+	}
+	source := fmt.Sprintf("read_json_auto(%s, format = 'newline_delimited')", sqlString(db.staging.Name()))
+	sql := fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s AS SELECT * FROM %s LIMIT 0; INSERT INTO %s BY NAME SELECT * FROM %s;",
+		duckDBTable, source, duckDBTable, source,
+	)
+	if err := runDuckDB(db.path, sql, io.Discard); err != nil {
+		return withExitCode(exitOutput, err)
+	}
+	return nil
+}
+
+// runDuckDB runs the SQL statements on the database with the duckdb CLI,
+// writing their output to w.
+func runDuckDB(path string, sql string, w io.Writer) error {
+	cmd := exec.Command("duckdb", path, "-bail", "-c", sql)
+	cmd.Stdout = w
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return fmt.Errorf("error of duckdb on %s: %s", path, msg)
+	}
+	return nil
+}
+
+// sqlString quotes s as an SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// duckDBPath returns the path of the DuckDB database the results
+// are written to, for -query: there must be exactly one.
+func (outs *outputs) duckDBPath() (string, error) {
+	var paths []string
+	for location := range outs.byLocation {
+		if strings.HasPrefix(location, duckDBPrefix) {
+			paths = append(paths, strings.TrimPrefix(location, duckDBPrefix))
+		}
+	}
+	if len(paths) != 1 {
+		return "", errors.New("-query requires exactly one duckdb: output")
+	}
+	return paths[0], nil
+}
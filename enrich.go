@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gagliardetto/messari-challenge/feed"
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// enrichChain is the enrichers of a run, applied in order.
+type enrichChain struct {
+	names     []string
+	enrichers []feed.Enricher
+}
+
+// parseEnrichers creates the enrichers of the -enrich flags,
+// each as name or name=config (the path of its YAML config).
+func parseEnrichers(flags []string) (*enrichChain, error) {
+	if len(flags) == 0 {
+		return nil, nil
+	}
+	chain := &enrichChain{}
+	for _, flag := range flags {
+		name, path := flag, ""
+		if eq := strings.IndexByte(flag, '='); eq >= 0 {
+			name, path = flag[:eq], flag[eq+1:]
+		}
+		var config []byte
+		if path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("error while reading the config of enricher %s: %s", name, err)
+			}
+			config = data
+		}
+		enricher, err := feed.NewEnricher(name, config)
+		if err != nil {
+			return nil, err
+		}
+		chain.names = append(chain.names, name)
+		chain.enrichers = append(chain.enrichers, enricher)
+	}
+	return chain, nil
+}
+
+// enrich applies the enrichers to a trade, until one drops it.
+func (chain *enrichChain) enrich(trade *models.Trade) (bool, error) {
+	if chain == nil {
+		return true, nil
+	}
+	for i, enricher := range chain.enrichers {
+		keep, err := enricher.Enrich(trade)
+		if err != nil {
+			return false, fmt.Errorf("error while enriching trade %v (%s): %s", trade.ID, chain.names[i], err)
+		}
+		if !keep {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// errorRateMinRecords is the number of records of an input before which
+// -max-error-rate is only checked at its end, so that an early error
+// doesn't abort the run.
+const errorRateMinRecords = 1000
+
+// maxErrorsLogged is the number of skipped records of an input written to
+// stderr; the others are only counted.
+const maxErrorsLogged = 10
+
+// errorBudget skips the records of an input that fail to parse, as long as
+// they are at most maxRate of its records (see -max-error-rate).
+// Its methods are called by the goroutine delivering the records.
+type errorBudget struct {
+	location string
+	maxRate  float64
+	log      io.Writer
+
+	numRecords uint64
+	numErrors  uint64
+	// err is set when the rate is exceeded.
+	err error
+}
+
+func newErrorBudget(location string, maxRate float64, log io.Writer) *errorBudget {
+	return &errorBudget{location: location, maxRate: maxRate, log: log}
+}
+
+// record counts a record that was parsed.
+func (b *errorBudget) record() {
+	if b == nil {
+		return
+	}
+	b.numRecords++
+}
+
+// skip counts a record that failed to parse, and tells whether to skip it;
+// otherwise the input ends.
+func (b *errorBudget) skip(err error) bool {
+	b.numErrors++
+	if b.numErrors <= maxErrorsLogged {
+		fmt.Fprintf(b.log, "%s: skipping invalid record: %s\n", b.location, err)
+	}
+	if b.exceeded(errorRateMinRecords) {
+		b.fail(err)
+		return false
+	}
+	return true
+}
+
+// exceeded tells whether the errors are more than maxRate of the records,
+// or of min records if there are fewer.
+func (b *errorBudget) exceeded(min uint64) bool {
+	total := b.numRecords + b.numErrors
+	if total < min {
+		total = min
+	}
+	return float64(b.numErrors) > b.maxRate*float64(total)
+}
+
+// fail sets the error of the budget, with the last error (if not nil).
+func (b *errorBudget) fail(last error) {
+	err := fmt.Errorf(
+		"%s: %v of %v records failed to parse, more than the -max-error-rate of %v",
+		b.location, b.numErrors, b.numRecords+b.numErrors, b.maxRate,
+	)
+	if last != nil {
+		err = fmt.Errorf("%s (the last: %s)", err, last)
+	}
+	b.err = withExitCode(exitParse, err)
+}
+
+// end checks the rate of errors at the end of the input, returning the error
+// if it is exceeded, and reports the records skipped.
+func (b *errorBudget) end() error {
+	if b == nil || b.numErrors == 0 {
+		return nil
+	}
+	if b.err == nil && b.exceeded(0) {
+		b.fail(nil)
+	}
+	if b.err == nil {
+		fmt.Fprintf(
+			b.log, "%s: skipped %v invalid records of %v (%.2f%%)\n",
+			b.location, b.numErrors, b.numRecords+b.numErrors,
+			100*float64(b.numErrors)/float64(b.numRecords+b.numErrors),
+		)
+	}
+	return b.err
+}
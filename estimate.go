@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// estimateSettings are the settings of the run that the estimate
+// makes recommendations about.
+type estimateSettings struct {
+	sample       int
+	timeMode     string
+	stateTTL     time.Duration
+	maxMarkets   int
+	parseWorkers int
+	ioReaders    int
+	format       string
+}
+
+// inputEstimate is the estimate of a run over an input, from a sample of it.
+type inputEstimate struct {
+	location string
+	// sampled is the number of trades of the sample, read in elapsed;
+	// complete tells whether the sample is the whole input.
+	sampled  int
+	elapsed  time.Duration
+	complete bool
+	// size is the size of the input in bytes (0 if unknown, e.g. for sockets),
+	// and sampleBytes the bytes read for the sample.
+	size        int64
+	sampleBytes uint64
+	// markets counts the trades of each market of the sample.
+	markets map[uint64]int
+}
+
+// trades returns the projected number of trades of the input (0 if unknown).
+func (e *inputEstimate) trades() int64 {
+	switch {
+	case e.complete:
+		return int64(e.sampled)
+	case e.size == 0 || e.sampleBytes == 0:
+		return 0
+	}
+	return int64(float64(e.size) / float64(e.sampleBytes) * float64(e.sampled))
+}
+
+// runEstimate reads a sample of each input, aggregating it with the
+// pipelines, and prints the projected cardinality, memory and running
+// time of the full run under the current settings, with recommendations.
+// It returns the number of trades read.
+func runEstimate(w io.Writer, sources []*sourceRun, pipelineConfigs []PipelineConfig, settings estimateSettings) (uint64, error) {
+	var pipelines []*pipeline
+	locations := make([]string, len(sources))
+	for i, run := range sources {
+		locations[i] = run.location
+	}
+	for _, conf := range pipelineConfigs {
+		// Without outputs, nothing is written:
+		p, err := newPipeline(conf, locations, nil, settings.timeMode, settings.stateTTL)
+		if err != nil {
+			return 0, withExitCode(exitUsage, err)
+		}
+		pipelines = append(pipelines, p)
+	}
+
+	// The memory of the markets is measured on fresh aggregators
+	// (all the trades of the sample, ignoring the filters):
+	ags := make([]*Markets, len(pipelines))
+	for i, p := range pipelines {
+		ags[i] = NewAggregator(p.opts)
+	}
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	estimates := make([]*inputEstimate, len(sources))
+	numTrades := uint64(0)
+	for i, run := range sources {
+		e := &inputEstimate{location: run.location, markets: map[uint64]int{}, complete: true}
+		if f, ok := run.closer.(*os.File); ok {
+			if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+				e.size = info.Size()
+			}
+		}
+		values := make([]float64, len(tradeVars))
+		start := time.Now()
+		err := run.source.Each(func(trade models.Trade) bool {
+			if e.sampled == settings.sample {
+				e.complete = false
+				return false
+			}
+			e.sampled++
+			e.markets[trade.Market]++
+			values = tradeValues(trade, values)
+			for _, ag := range ags {
+				ag.Add(trade, values)
+			}
+			return true
+		})
+		e.elapsed = time.Since(start)
+		if err != nil {
+			return numTrades, defaultExitCode(exitInput, fmt.Errorf("error while reading %s: %w", run.location, err))
+		}
+		if run.input != nil {
+			e.sampleBytes = run.input.Count()
+		}
+		numTrades += uint64(e.sampled)
+		estimates[i] = e
+	}
+
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(ags)
+	numMarkets := 0
+	for _, ag := range ags {
+		numMarkets += len(ag.mapper)
+	}
+	bytesPerMarket := 0.0
+	if numMarkets > 0 && after.HeapAlloc > before.HeapAlloc {
+		bytesPerMarket = float64(after.HeapAlloc-before.HeapAlloc) / float64(numMarkets)
+	}
+
+	printEstimate(w, estimates, pipelines, bytesPerMarket, settings)
+	return numTrades, nil
+}
+
+func printEstimate(w io.Writer, estimates []*inputEstimate, pipelines []*pipeline, bytesPerMarket float64, settings estimateSettings) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	// The markets of all the inputs, and the projected running time
+	// (of the slowest input, as they are read at the same time):
+	all := map[uint64]int{}
+	complete := true
+	var projected time.Duration
+	sizeKnown := true
+	for _, e := range estimates {
+		for market, n := range e.markets {
+			all[market] += n
+		}
+		complete = complete && e.complete
+		trades := e.trades()
+		fmt.Fprintf(bw, "Input %s:\n", e.location)
+		switch {
+		case e.complete:
+			fmt.Fprintf(bw, "  read entirely: %v trades\n", humanize.Comma(trades))
+		case trades > 0:
+			fmt.Fprintf(bw, "  sampled %v trades (%s) of %s: about %v trades\n",
+				humanize.Comma(int64(e.sampled)), humanize.Bytes(e.sampleBytes), humanize.Bytes(uint64(e.size)), humanize.Comma(trades))
+		default:
+			sizeKnown = false
+			fmt.Fprintf(bw, "  sampled %v trades (the size of the input is unknown, e.g. a socket or a pipe)\n", humanize.Comma(int64(e.sampled)))
+		}
+		if e.sampled > 0 && e.elapsed > 0 {
+			rate := float64(e.sampled) / e.elapsed.Seconds()
+			fmt.Fprintf(bw, "  %s trades per second", humanize.CommafWithDigits(rate, 0))
+			if trades > 0 {
+				d := time.Duration(float64(trades) / rate * float64(time.Second))
+				if d > projected {
+					projected = d
+				}
+				fmt.Fprintf(bw, ": about %s", d.Round(time.Millisecond))
+			}
+			fmt.Fprintln(bw)
+		}
+	}
+
+	markets := len(all)
+	if complete {
+		fmt.Fprintf(bw, "Markets: %v\n", humanize.Comma(int64(markets)))
+	} else {
+		markets = estimateMarkets(all)
+		fmt.Fprintf(bw, "Markets: %v in the sample, about %v in all (estimated from the markets seen once or twice)\n",
+			humanize.Comma(int64(len(all))), humanize.Comma(int64(markets)))
+	}
+
+	// Each aggregator (by pipeline, source, and the windows kept
+	// for the allowed lateness) holds the state of the markets:
+	numAggregators := 0
+	for _, p := range pipelines {
+		n := len(p.sources)
+		if p.lateness > 0 {
+			n *= 1 + int(math.Ceil(float64(p.lateness)/float64(p.window)))
+		}
+		numAggregators += n
+	}
+	memory := uint64(bytesPerMarket * float64(markets) * float64(numAggregators))
+	fmt.Fprintf(bw, "Memory: about %s for the state of the markets (%s per market and pipeline)\n",
+		humanize.Bytes(memory), humanize.Bytes(uint64(bytesPerMarket)))
+	if projected > 0 {
+		fmt.Fprintf(bw, "Running time: about %s\n", projected.Round(time.Millisecond))
+	}
+
+	var recommendations []string
+	if settings.maxMarkets == 0 {
+		recommendations = append(recommendations, fmt.Sprintf(
+			"-max-distinct-markets=%v, to abort on corrupt inputs with far more markets", 2*markets))
+	} else if markets > settings.maxMarkets {
+		recommendations = append(recommendations, fmt.Sprintf(
+			"-max-distinct-markets=%v, as the inputs likely have more than %v markets", 2*markets, settings.maxMarkets))
+	}
+	if available := availableMemory(); available > 0 && memory > available/2 {
+		shards := int(math.Ceil(float64(memory) / float64(available/2)))
+		recommendations = append(recommendations, fmt.Sprintf(
+			"%v shards by market, as the state may not fit in memory (%s available): one run for each of -filter='market %% %v == 0' to -filter='market %% %v == %v'",
+			shards, humanize.Bytes(available), shards, shards, shards-1))
+	}
+	if !sizeKnown && settings.stateTTL == 0 {
+		recommendations = append(recommendations,
+			"-state-ttl, so that the memory of long-running live inputs stays flat as markets come and go")
+	}
+	if projected > time.Hour {
+		recommendations = append(recommendations,
+			"splitting the inputs (e.g. by day) into incremental runs with -state and -warm-start, which keep the state on disk between them")
+	}
+	if len(estimates) > runtime.GOMAXPROCS(0) && settings.ioReaders == len(estimates) {
+		recommendations = append(recommendations, fmt.Sprintf(
+			"-io-readers=%v, as there are more inputs than CPUs", runtime.GOMAXPROCS(0)))
+	}
+	if settings.format == "json" && settings.parseWorkers <= 1 && len(estimates) == 1 && runtime.GOMAXPROCS(0) > 1 {
+		recommendations = append(recommendations, fmt.Sprintf(
+			"-parse-workers=%v, to decode the input on several CPUs", runtime.GOMAXPROCS(0)))
+	}
+	if len(recommendations) > 0 {
+		fmt.Fprintln(bw, "Recommendations:")
+		for _, r := range recommendations {
+			fmt.Fprintf(bw, "  - %s\n", r)
+		}
+	}
+}
+
+// estimateMarkets estimates the number of distinct markets of the inputs from
+// the number of trades of each market of a sample, with the bias-corrected
+// Chao1 estimator (the markets not seen yet are estimated from those seen
+// once and twice).
+func estimateMarkets(counts map[uint64]int) int {
+	var f1, f2 float64
+	for _, n := range counts {
+		switch n {
+		case 1:
+			f1++
+		case 2:
+			f2++
+		}
+	}
+	return len(counts) + int(math.Round(f1*(f1-1)/(2*(f2+1))))
+}
+
+// availableMemory returns the memory available to the process,
+// from /proc/meminfo (0 if unknown).
+func availableMemory() uint64 {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "MemAvailable:") {
+			var kb uint64
+			fmt.Sscanf(strings.TrimPrefix(line, "MemAvailable:"), "%d", &kb)
+			return kb * 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/gagliardetto/messari-challenge/feed"
+)
+
+// Exit statuses, so that wrapper scripts can tell failures apart.
+const (
+	exitOK = 0
+	// exitFailure is for the errors not classified below
+	// (and, for diff, for results that differ).
+	exitFailure = 1
+	// exitUsage is for invalid flags or config.
+	exitUsage = 2
+	// exitInput is for errors opening, reading, or framing an input.
+	exitInput = 3
+	// exitParse is for records of an input that can't be decoded.
+	exitParse = 4
+	// exitOutput is for errors writing the results.
+	exitOutput = 5
+	// exitInterrupted is for runs stopped by a signal
+	// (after writing the results collected so far).
+	exitInterrupted = 130
+)
+
+// exitError is an error with the exit status it causes.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode returns err, causing the given exit status.
+func withExitCode(code int, err error) error {
+	return &exitError{code: code, err: err}
+}
+
+// exitCode returns the exit status caused by err.
+func exitCode(err error) int {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	var parseErr *feed.ParseError
+	if errors.As(err, &parseErr) {
+		return exitParse
+	}
+	return exitFailure
+}
+
+// exitOnError is deferred by main: if main panics with an error,
+// it prints it and exits with its status (see exitCode).
+// Other panics, like runtime errors, keep their stack trace.
+func exitOnError() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err, ok := r.(error)
+	if _, isRuntime := r.(runtime.Error); !ok || isRuntime {
+		panic(r)
+	}
+	fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	os.Exit(exitCode(err))
+}
+
+// defaultExitCode returns err with the given exit status,
+// unless it already causes a specific one.
+func defaultExitCode(code int, err error) error {
+	if exitCode(err) != exitFailure {
+		return err
+	}
+	return withExitCode(code, err)
+}
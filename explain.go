@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gagliardetto/messari-challenge/feed"
+)
+
+// runPlan is the resolved plan of a run, printed by -explain.
+type runPlan struct {
+	inputs    []string
+	backfill  string
+	inputOpts inputOptions
+	outOpts   outputOptions
+	remap     marketRemap
+	enrich    *enrichChain
+	pipelines []*pipeline
+	confs     []PipelineConfig
+	// settings are the effective settings of the run as a whole, in order.
+	settings [][2]string
+}
+
+// print prints the plan: inputs and their decoders, then for each
+// pipeline its filter, aggregation, windows, metrics and output.
+func (plan *runPlan) print(w io.Writer) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	fmt.Fprintln(bw, "Inputs:")
+	if plan.backfill != "" {
+		fmt.Fprintf(bw, "  %s (backfill, read first)\n", plan.backfill)
+		fmt.Fprintf(bw, "    decoder: %s\n", plan.decoder(plan.backfill))
+	}
+	for _, location := range plan.inputs {
+		fmt.Fprintf(bw, "  %s\n", location)
+		fmt.Fprintf(bw, "    decoder: %s\n", plan.decoder(location))
+	}
+	if len(plan.remap) > 0 {
+		logical := map[uint64]bool{}
+		for _, market := range plan.remap {
+			logical[market] = true
+		}
+		fmt.Fprintf(bw, "  remap: %v market IDs merged into %v markets\n", len(plan.remap), len(logical))
+	}
+	if plan.enrich != nil {
+		fmt.Fprintf(bw, "  enrichers: %s\n", strings.Join(plan.enrich.names, ", "))
+	}
+
+	for i, p := range plan.pipelines {
+		conf := plan.confs[i]
+		name := "Pipeline"
+		if p.name != "" {
+			name = fmt.Sprintf("Pipeline %q", p.name)
+		}
+		fmt.Fprintf(bw, "%s:\n", name)
+		fmt.Fprintf(bw, "  filter: %s\n", orNone(conf.Filter))
+		switch {
+		case p.rollup != nil && len(p.rollup.groups) == 0:
+			fmt.Fprintf(bw, "  rollup: %s, of all the markets\n", p.rollup.name)
+		case p.rollup != nil:
+			fmt.Fprintf(bw, "  rollup: %s, of groups %s\n", p.rollup.name, strings.Join(p.rollup.names, ", "))
+		}
+		if p.tagSources {
+			fmt.Fprintf(bw, "  aggregation: by input (tagged as source)\n")
+		} else {
+			fmt.Fprintf(bw, "  aggregation: all inputs merged\n")
+		}
+		switch {
+		case p.window == 0:
+			fmt.Fprintf(bw, "  window: none (results at the end of the run)\n")
+		case p.eventTime:
+			fmt.Fprintf(bw, "  window: %s, by event time", p.window)
+			if p.lateness > 0 {
+				fmt.Fprintf(bw, ", allowed lateness %s", p.lateness)
+			}
+			fmt.Fprintln(bw)
+		default:
+			fmt.Fprintf(bw, "  window: %s, by arrival time\n", p.window)
+		}
+		if conf.IdleFlush > 0 {
+			fmt.Fprintf(bw, "  idle flush: markets without trades for %s\n", conf.IdleFlush)
+		}
+		if conf.SessionClose != "" {
+			fmt.Fprintf(bw, "  idle flush: markets without trades since the session close at %s UTC\n", conf.SessionClose)
+		}
+		if conf.WarmStart != "" {
+			fmt.Fprintf(bw, "  warm start: %s\n", conf.WarmStart)
+		}
+		fmt.Fprintf(bw, "  profile: %s\n", p.opts.Profile)
+		fmt.Fprintf(bw, "  metrics: %s\n", strings.Join(plan.metrics(p.opts), ", "))
+		fmt.Fprintf(bw, "  having: %s\n", orNone(conf.Having))
+		if p.opts.Script != nil {
+			fmt.Fprintf(bw, "  script: %s\n", p.opts.Script)
+		}
+		fmt.Fprintf(bw, "  output: %s\n", plan.sink(conf.Output))
+	}
+
+	if len(plan.settings) > 0 {
+		fmt.Fprintln(bw, "Run:")
+		for _, setting := range plan.settings {
+			fmt.Fprintf(bw, "  %s: %s\n", setting[0], setting[1])
+		}
+	}
+}
+
+// decoder describes how an input is decoded.
+func (plan *runPlan) decoder(location string) string {
+	if feed.IsExchange(location) {
+		return "exchange adapter"
+	}
+	opts := plan.inputOpts
+	parts := []string{opts.format}
+	if opts.pcapStream != "" {
+		parts = append(parts, "pcap stream "+opts.pcapStream)
+	}
+	if codec, err := inputCodec(location, opts); err == nil && codec != nil {
+		parts = append(parts, codec.Name+" compressed")
+	}
+	switch {
+	case opts.framing != "":
+		parts = append(parts, opts.framing+" framing")
+		if opts.format == avroFormat {
+			parts = append(parts, "schema registry "+opts.schemaRegistry)
+		}
+	case opts.format == "json":
+		parts = append(parts, "delimiter "+strconv.QuoteRune(rune(opts.delimiter)), "encoding "+opts.encoding)
+	}
+	if opts.format == "json" && opts.framing == "" {
+		parts = append(parts, fmt.Sprintf("side rule %s", opts.sideRules.name(location)))
+		if opts.records.maxLength > 0 {
+			parts = append(parts, "max record length "+humanize.IBytes(uint64(opts.records.maxLength)))
+		}
+		if opts.records.maxDepth > 0 {
+			parts = append(parts, fmt.Sprintf("max depth %v", opts.records.maxDepth))
+		}
+		if opts.parseWorkers > 1 {
+			parts = append(parts, fmt.Sprintf("%v parse workers", opts.parseWorkers))
+		}
+	}
+	if opts.rateLimit != (rateLimit{}) {
+		parts = append(parts, "rate limited")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// metrics returns the output names of the metrics of an aggregation.
+func (plan *runPlan) metrics(opts AggregatorOptions) []string {
+	names := []string{"total_volume", "mean_volume", "mean_price", "percentage_buy", "vwap"}
+	for _, derived := range opts.Derived {
+		names = append(names, "total_"+derived.Name, "mean_"+derived.Name)
+	}
+	if opts.Profile != profileLegacy {
+		names = append(names, "num_trades", "num_buy", "num_sell", "open", "high", "low", "close", "first_trade_ts", "last_trade_ts", "active_span")
+	}
+	if opts.NetFlow {
+		names = append(names, "net_flow")
+	}
+	if opts.TrimmedMean > 0 {
+		names = append(names, fmt.Sprintf("trimmed_mean_price (%v%% trimmed)", opts.TrimmedMean*100))
+	}
+	if opts.Activity {
+		names = append(names, fmt.Sprintf("peak_tps, mean_tps, busiest_second (horizon %s)", opts.ActivityHorizon))
+	}
+	if opts.Spreads {
+		names = append(names, "mean_spread", "mean_effective_spread")
+	}
+	if opts.BookDepth > 0 {
+		names = append(names, fmt.Sprintf("num_book_updates, mean_book_imbalance, last_book_imbalance (depth %v)", opts.BookDepth))
+	}
+	if opts.State {
+		names = append(names, "state")
+	}
+	for i, name := range names {
+		if renamed := plan.outOpts.fieldName(name); renamed != name {
+			names[i] = fmt.Sprintf("%s (as %s)", name, renamed)
+		}
+	}
+	return names
+}
+
+// sink describes an output.
+func (plan *runPlan) sink(location string) string {
+	if location == "" {
+		location = "-"
+	}
+	opts := plan.outOpts
+	var parts []string
+	switch {
+	case strings.HasPrefix(location, remoteWritePrefix):
+		parts = append(parts, "Prometheus remote write")
+	case strings.HasPrefix(location, bigQueryPrefix):
+		parts = append(parts, "BigQuery load")
+	case strings.HasPrefix(location, duckDBPrefix):
+		parts = append(parts, "DuckDB")
+	default:
+		if opts.jsonSeq {
+			parts = append(parts, outputFramingJSONSeq)
+		} else {
+			parts = append(parts, outputFramingNDJSON)
+		}
+		if codec, err := feed.GetCodec(opts.compression, location); err == nil && codec != nil {
+			parts = append(parts, codec.Name+" compressed")
+		}
+		if opts.upsert {
+			parts = append(parts, "upserted")
+		}
+	}
+	if opts.floatPrecision >= 0 {
+		parts = append(parts, fmt.Sprintf("%v decimal places", opts.floatPrecision))
+	}
+	if opts.precision != nil {
+		parts = append(parts, "price precision rules")
+	}
+	if len(opts.decimalStrings) > 0 {
+		var fields []string
+		for field := range opts.decimalStrings {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		parts = append(parts, fmt.Sprintf("%s as decimal strings (%v decimal places)", strings.Join(fields, ","), opts.decimalScale))
+	}
+	parts = append(parts, "undefined metrics as "+opts.undefined)
+	if opts.runID != "" {
+		parts = append(parts, fmt.Sprintf("keys of run %q", opts.runID))
+	}
+	if len(opts.rename) > 0 {
+		var renames []string
+		for field, name := range opts.rename {
+			renames = append(renames, field+"="+name)
+		}
+		sort.Strings(renames)
+		parts = append(parts, "renames "+strings.Join(renames, ","))
+	}
+	return fmt.Sprintf("%s (%s)", location, strings.Join(parts, ", "))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
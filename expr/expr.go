@@ -0,0 +1,150 @@
+// Package expr implements a small expression language over numeric variables,
+// e.g.
+//
+//	price > 0 && volume >= 0.01 && market != 42
+//
+// Expressions are compiled once, and can then be evaluated cheaply many times.
+// Values are numbers or booleans; booleans are not numbers, and vice versa.
+//
+// Operators, by increasing precedence:
+//
+//	||
+//	&&
+//	== != < <= > >=
+//	+ -
+//	* / %
+//	! - (unary)
+//
+// Functions: abs(x), min(x, y), max(x, y).
+package expr
+
+import (
+	"fmt"
+	"math"
+)
+
+// Type is the type of an expression.
+type Type int
+
+const (
+	Number Type = iota
+	Bool
+)
+
+func (t Type) String() string {
+	if t == Bool {
+		return "bool"
+	}
+	return "number"
+}
+
+// Var is a variable that can be used in expressions.
+// Boolean variables must be provided as 0 or 1.
+type Var struct {
+	Name string
+	Type Type
+}
+
+// Numbers returns numeric variables with the given names.
+func Numbers(names ...string) []Var {
+	vars := make([]Var, len(names))
+	for i, name := range names {
+		vars[i] = Var{Name: name, Type: Number}
+	}
+	return vars
+}
+
+// Program is a compiled expression.
+type Program struct {
+	src  string
+	typ  Type
+	eval evalFunc
+	vars []string
+}
+
+// evalFunc evaluates a node; booleans are represented as 0 and 1.
+type evalFunc func(vars []float64) float64
+
+// Compile compiles the expression;
+// the value of the i-th variable in vars is provided at evaluation time
+// as the i-th element of the slice passed to Eval.
+func Compile(src string, vars []Var) (*Program, error) {
+	p := &parser{
+		lexer: lexer{src: src},
+		vars:  vars,
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &Program{
+		src:  src,
+		typ:  n.typ,
+		eval: n.eval,
+		vars: p.used,
+	}, nil
+}
+
+// CompileBool compiles an expression that must evaluate to a boolean.
+func CompileBool(src string, vars []Var) (*Program, error) {
+	prog, err := Compile(src, vars)
+	if err != nil {
+		return nil, err
+	}
+	if prog.typ != Bool {
+		return nil, fmt.Errorf("expression %q is a %s, not a bool", src, prog.typ)
+	}
+	return prog, nil
+}
+
+// Type returns the type of the expression.
+func (p *Program) Type() Type {
+	return p.typ
+}
+
+// Variables returns the variables used by the expression.
+func (p *Program) Variables() []string {
+	return p.vars
+}
+
+func (p *Program) String() string {
+	return p.src
+}
+
+// Eval evaluates the expression; booleans are returned as 0 or 1.
+func (p *Program) Eval(vars []float64) float64 {
+	return p.eval(vars)
+}
+
+// EvalBool evaluates a boolean expression.
+func (p *Program) EvalBool(vars []float64) bool {
+	return p.eval(vars) != 0
+}
+
+type node struct {
+	typ  Type
+	eval evalFunc
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var functions = map[string]struct {
+	arity int
+	fn1   func(x float64) float64
+	fn2   func(x, y float64) float64
+}{
+	"abs": {arity: 1, fn1: math.Abs},
+	"min": {arity: 2, fn2: math.Min},
+	"max": {arity: 2, fn2: math.Max},
+}
@@ -0,0 +1,127 @@
+package expr
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+var testVars = []Var{
+	{Name: "x", Type: Number},
+	{Name: "y", Type: Number},
+	{Name: "ok", Type: Bool},
+}
+
+func TestEval(t *testing.T) {
+	values := []float64{3, 4, 1}
+	for _, tc := range []struct {
+		src  string
+		want float64
+	}{
+		// Precedence:
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"12 / 3 / 2", 2},
+		{"7 % 4 * 2", 6},
+		{"-x * 2", -6},
+		{"--x", 3},
+		{"2 + 3 < 6", 1},
+		{"(1 < 2) == true", 1},
+		{"false && false || true", 1},
+		{"true || false && false", 1},
+		{"!false && false", 0},
+		{"!(false && false)", 1},
+		{"x < y && ok", 1},
+		{"x > y || !ok", 0},
+		// Functions:
+		{"abs(x - y)", 1},
+		{"min(x, y) + max(x, y)", 7},
+		{"max(min(x, y), 3.5)", 3.5},
+		// Numbers:
+		{"1.5e2", 150},
+		{".5", 0.5},
+		{"2E-1", 0.2},
+	} {
+		prog, err := Compile(tc.src, testVars)
+		if err != nil {
+			t.Errorf("%q: %s", tc.src, err)
+			continue
+		}
+		if got := prog.Eval(values); got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestEvalDivisionByZero(t *testing.T) {
+	prog, err := Compile("x / (y - 4)", testVars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := prog.Eval([]float64{3, 4, 0}); !math.IsInf(got, 1) {
+		t.Errorf("got %v, want +Inf", got)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		err string
+	}{
+		// Syntax:
+		{"", "unexpected end of expression at position 0"},
+		{"x >", "unexpected end of expression at position 3"},
+		{"(x + 1", "expected ), got end of expression"},
+		{"x + 1)", `unexpected ")" at position 5`},
+		{"x y", `unexpected "y" at position 2`},
+		{"x # 1", `unexpected character '#' at position 2`},
+		{"1.2.3", `invalid number "1.2.3" at position 0`},
+		{"x < y < 1", `unexpected "<" at position 6`},
+		{"z > 1", `unknown variable "z" at position 0`},
+		{"sqrt(x)", `unknown function "sqrt"`},
+		{"min(x)", "function min takes 2 arguments, got 1"},
+		{"abs(x, y)", "function abs takes 1 arguments, got 2"},
+		{"min(x y)", `expected , or ), got "y"`},
+		// Types:
+		{"x && ok", "operator && requires bool operands, got number"},
+		{"ok || 1", "operator || requires bool operands, got number"},
+		{"ok + 1", "operator + requires number operands, got bool"},
+		{"x * true", "operator * requires number operands, got bool"},
+		{"ok < 1", "operator < requires number operands, got bool"},
+		{"ok == 1", "can't compare bool with number"},
+		{"!x", "operator ! requires bool operands, got number"},
+		{"-ok", "operator - requires number operands, got bool"},
+		{"abs(ok)", "arguments of abs must be numbers"},
+	} {
+		_, err := Compile(tc.src, testVars)
+		if err == nil {
+			t.Errorf("%q: expected an error", tc.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: got error %q, want %q", tc.src, err, tc.err)
+		}
+	}
+}
+
+func TestCompileBool(t *testing.T) {
+	if _, err := CompileBool("x > 1 && ok", testVars); err != nil {
+		t.Error(err)
+	}
+	_, err := CompileBool("x + 1", testVars)
+	if err == nil || !strings.Contains(err.Error(), `expression "x + 1" is a number, not a bool`) {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	prog, err := Compile("y > 1 && (x < y || y == 2)", testVars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(prog.Variables(), ",")
+	if got != "y,x" {
+		t.Errorf("got variables %q, want %q", got, "y,x")
+	}
+}
@@ -0,0 +1,338 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+)
+
+type parser struct {
+	lexer
+	tok  token
+	vars []Var
+	used []string
+}
+
+func (p *parser) next() error {
+	tok, err := p.lex()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %v of %q", fmt.Sprintf(format, args...), p.tok.pos, p.src)
+}
+
+func (p *parser) isOp(ops ...string) bool {
+	if p.tok.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(n *node, typ Type, op string) error {
+	if n.typ != typ {
+		return p.errorf("operator %s requires %s operands, got %s", op, typ, n.typ)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (*node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(left, Bool, "||"); err != nil {
+			return nil, err
+		}
+		if err := p.expect(right, Bool, "||"); err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		left = &node{Bool, func(v []float64) float64 {
+			return boolToFloat(l(v) != 0 || r(v) != 0)
+		}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (*node, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(left, Bool, "&&"); err != nil {
+			return nil, err
+		}
+		if err := p.expect(right, Bool, "&&"); err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		left = &node{Bool, func(v []float64) float64 {
+			return boolToFloat(l(v) != 0 && r(v) != 0)
+		}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseComparison() (*node, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOp("==", "!=", "<", "<=", ">", ">=") {
+		return left, nil
+	}
+	op := p.tok.text
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if op == "==" || op == "!=" {
+		if left.typ != right.typ {
+			return nil, p.errorf("can't compare %s with %s", left.typ, right.typ)
+		}
+	} else {
+		if err := p.expect(left, Number, op); err != nil {
+			return nil, err
+		}
+		if err := p.expect(right, Number, op); err != nil {
+			return nil, err
+		}
+	}
+	l, r := left.eval, right.eval
+	var eval evalFunc
+	switch op {
+	case "==":
+		eval = func(v []float64) float64 { return boolToFloat(l(v) == r(v)) }
+	case "!=":
+		eval = func(v []float64) float64 { return boolToFloat(l(v) != r(v)) }
+	case "<":
+		eval = func(v []float64) float64 { return boolToFloat(l(v) < r(v)) }
+	case "<=":
+		eval = func(v []float64) float64 { return boolToFloat(l(v) <= r(v)) }
+	case ">":
+		eval = func(v []float64) float64 { return boolToFloat(l(v) > r(v)) }
+	case ">=":
+		eval = func(v []float64) float64 { return boolToFloat(l(v) >= r(v)) }
+	}
+	return &node{Bool, eval}, nil
+}
+
+func (p *parser) parseAdditive() (*node, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+", "-") {
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(left, Number, op); err != nil {
+			return nil, err
+		}
+		if err := p.expect(right, Number, op); err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		if op == "+" {
+			left = &node{Number, func(v []float64) float64 { return l(v) + r(v) }}
+		} else {
+			left = &node{Number, func(v []float64) float64 { return l(v) - r(v) }}
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseMultiplicative() (*node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*", "/", "%") {
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(left, Number, op); err != nil {
+			return nil, err
+		}
+		if err := p.expect(right, Number, op); err != nil {
+			return nil, err
+		}
+		l, r := left.eval, right.eval
+		switch op {
+		case "*":
+			left = &node{Number, func(v []float64) float64 { return l(v) * r(v) }}
+		case "/":
+			left = &node{Number, func(v []float64) float64 { return l(v) / r(v) }}
+		case "%":
+			left = &node{Number, func(v []float64) float64 { return math.Mod(l(v), r(v)) }}
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (*node, error) {
+	if !p.isOp("!", "-") {
+		return p.parsePrimary()
+	}
+	op := p.tok.text
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	o := operand.eval
+	if op == "!" {
+		if err := p.expect(operand, Bool, op); err != nil {
+			return nil, err
+		}
+		return &node{Bool, func(v []float64) float64 { return boolToFloat(o(v) == 0) }}, nil
+	}
+	if err := p.expect(operand, Number, op); err != nil {
+		return nil, err
+	}
+	return &node{Number, func(v []float64) float64 { return -o(v) }}, nil
+}
+
+func (p *parser) parsePrimary() (*node, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		num := tok.num
+		return &node{Number, func([]float64) float64 { return num }}, nil
+	case tokLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected ), got %s", p.tok)
+		}
+		return n, p.next()
+	case tokIdent:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		switch tok.text {
+		case "true":
+			return &node{Bool, func([]float64) float64 { return 1 }}, nil
+		case "false":
+			return &node{Bool, func([]float64) float64 { return 0 }}, nil
+		}
+		if p.tok.kind == tokLParen {
+			return p.parseCall(tok)
+		}
+		return p.variable(tok)
+	}
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+func (p *parser) parseCall(name token) (*node, error) {
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %v of %q", name.text, name.pos, p.src)
+	}
+	var args []evalFunc
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for p.tok.kind != tokRParen {
+		if len(args) > 0 {
+			if p.tok.kind != tokComma {
+				return nil, p.errorf("expected , or ), got %s", p.tok)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if arg.typ != Number {
+			return nil, p.errorf("arguments of %s must be numbers", name.text)
+		}
+		args = append(args, arg.eval)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if len(args) != fn.arity {
+		return nil, fmt.Errorf("function %s takes %v arguments, got %v", name.text, fn.arity, len(args))
+	}
+	if fn.arity == 1 {
+		call, x := fn.fn1, args[0]
+		return &node{Number, func(v []float64) float64 { return call(x(v)) }}, nil
+	}
+	call, x, y := fn.fn2, args[0], args[1]
+	return &node{Number, func(v []float64) float64 { return call(x(v), y(v)) }}, nil
+}
+
+func (p *parser) variable(name token) (*node, error) {
+	for i, v := range p.vars {
+		if v.Name != name.text {
+			continue
+		}
+		p.use(v.Name)
+		return &node{v.Type, func(v []float64) float64 { return v[i] }}, nil
+	}
+	names := make([]string, len(p.vars))
+	for i, v := range p.vars {
+		names[i] = v.Name
+	}
+	return nil, fmt.Errorf("unknown variable %q at position %v of %q (available: %v)", name.text, name.pos, p.src, names)
+}
+
+func (p *parser) use(name string) {
+	for _, v := range p.used {
+		if v == name {
+			return
+		}
+	}
+	p.used = append(p.used, name)
+}
@@ -0,0 +1,496 @@
+package feed
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// avroMagic is the first byte of the records in the Confluent wire format,
+// followed by the ID of their schema (a big-endian uint32) and their
+// Avro-encoded body.
+const avroMagic = 0
+
+// avroMaxDepth bounds the nesting of the schemas and of the decoded values.
+const avroMaxDepth = 32
+
+// schemaErrorTTL is how long a failed fetch of a schema is cached, so that
+// the records of a schema that can't be fetched (e.g. while the registry is
+// down) don't each send a request.
+const schemaErrorTTL = 30 * time.Second
+
+// SchemaRegistry decodes Avro-encoded trades in the Confluent wire format,
+// with the schemas fetched from a schema registry by their ID, and cached:
+// each trade is a record with (some of) the fields of the JSON format,
+// which can be numbers of any Avro type (market also a string of digits),
+// optional (a union with null), and timestamp a long with the
+// timestamp-micros logical type. The other fields are skipped.
+// Protobuf and JSON schemas are not supported.
+type SchemaRegistry struct {
+	url    string
+	client *http.Client
+	// errorTTL is how long failed fetches are cached (schemaErrorTTL).
+	errorTTL time.Duration
+
+	mu      sync.Mutex
+	schemas map[uint32]*schemaEntry
+}
+
+// schemaEntry is a schema of the cache, fetched or being fetched.
+type schemaEntry struct {
+	// ready is closed once the schema is fetched;
+	// schema and err are set before.
+	ready  chan struct{}
+	schema *avroType
+	err    error
+	// failed is the time of a failed fetch.
+	failed time.Time
+}
+
+// NewSchemaRegistry returns a SchemaRegistry at url (e.g. http://localhost:8081).
+func NewSchemaRegistry(url string) *SchemaRegistry {
+	return &SchemaRegistry{
+		url:      strings.TrimSuffix(url, "/"),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		errorTTL: schemaErrorTTL,
+		schemas:  map[uint32]*schemaEntry{},
+	}
+}
+
+// DecodeTrade decodes a single record in the Confluent wire format;
+// it is a RecordDecoder.
+func (reg *SchemaRegistry) DecodeTrade(rec []byte) (models.Trade, error) {
+	if len(rec) < 5 || rec[0] != avroMagic {
+		return models.Trade{}, fmt.Errorf("error while decoding trade: not in the Confluent wire format")
+	}
+	schema, err := reg.schema(binary.BigEndian.Uint32(rec[1:5]))
+	if err != nil {
+		return models.Trade{}, err
+	}
+	r := &avroReader{buf: rec[5:]}
+	trade, err := schema.decodeTrade(r)
+	if err != nil {
+		return trade, fmt.Errorf("error while decoding trade: %s", err)
+	}
+	if len(r.buf) > 0 {
+		return trade, fmt.Errorf("error while decoding trade: %v trailing bytes", len(r.buf))
+	}
+	return trade, nil
+}
+
+// schema returns the schema with the given ID, fetching it if not cached
+// (or if its fetch failed more than errorTTL ago). Schemas are fetched
+// without holding mu, so that those already cached are not held up;
+// concurrent decoders of the same schema wait for the same fetch.
+func (reg *SchemaRegistry) schema(id uint32) (*avroType, error) {
+	reg.mu.Lock()
+	entry, ok := reg.schemas[id]
+	if ok && entry.err != nil && time.Since(entry.failed) >= reg.errorTTL {
+		ok = false
+	}
+	if ok {
+		reg.mu.Unlock()
+		<-entry.ready
+		return entry.schema, entry.err
+	}
+	entry = &schemaEntry{ready: make(chan struct{})}
+	reg.schemas[id] = entry
+	reg.mu.Unlock()
+
+	schema, err := reg.fetch(id)
+	reg.mu.Lock()
+	entry.schema = schema
+	if err != nil {
+		entry.err = fmt.Errorf("error while fetching schema %v from %s: %s", id, reg.url, err)
+		entry.failed = time.Now()
+	}
+	reg.mu.Unlock()
+	close(entry.ready)
+	return entry.schema, entry.err
+}
+
+func (reg *SchemaRegistry) fetch(id uint32) (*avroType, error) {
+	resp, err := reg.client.Get(fmt.Sprintf("%s/schemas/ids/%v", reg.url, id))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	var body struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxFrameSize)).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.SchemaType != "" && body.SchemaType != "AVRO" {
+		return nil, fmt.Errorf("unsupported schema type %s (only Avro schemas are supported)", body.SchemaType)
+	}
+	var def interface{}
+	if err := json.Unmarshal([]byte(body.Schema), &def); err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	schema, err := parseAvroSchema(def)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %s", err)
+	}
+	if schema.kind != "record" {
+		return nil, fmt.Errorf("expected a record schema, got %s", schema.kind)
+	}
+	return schema, nil
+}
+
+// avroType is a parsed Avro schema.
+type avroType struct {
+	// kind is the name of a primitive type, or record, enum, array, map,
+	// union or fixed.
+	kind    string
+	logical string
+	// fields are those of a record.
+	fields []avroField
+	// branches are those of a union.
+	branches []*avroType
+	// items are those of an array, or the values of a map.
+	items   *avroType
+	size    int
+	symbols []string
+}
+
+type avroField struct {
+	name string
+	typ  *avroType
+}
+
+// parseAvroSchema parses the JSON definition of a schema.
+func parseAvroSchema(def interface{}) (*avroType, error) {
+	p := &avroParser{named: map[string]*avroType{}}
+	return p.parse(def, "", 0)
+}
+
+type avroParser struct {
+	// named are the named types (records, enums and fixed) defined so far,
+	// by full and short name.
+	named map[string]*avroType
+}
+
+func (p *avroParser) parse(def interface{}, namespace string, depth int) (*avroType, error) {
+	if depth > avroMaxDepth {
+		return nil, fmt.Errorf("schema nested too deeply")
+	}
+	switch def := def.(type) {
+	case string:
+		switch def {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroType{kind: def}, nil
+		}
+		if t, ok := p.named[def]; ok {
+			return t, nil
+		}
+		if t, ok := p.named[namespace+"."+def]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", def)
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, branch := range def {
+			b, err := p.parse(branch, namespace, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			t.branches = append(t.branches, b)
+		}
+		return t, nil
+	case map[string]interface{}:
+		return p.parseComplex(def, namespace, depth)
+	}
+	return nil, fmt.Errorf("invalid type %v", def)
+}
+
+func (p *avroParser) parseComplex(def map[string]interface{}, namespace string, depth int) (*avroType, error) {
+	kind, _ := def["type"].(string)
+	logical, _ := def["logicalType"].(string)
+	switch kind {
+	case "record", "error", "enum", "fixed":
+	case "array", "map":
+		key := "items"
+		if kind == "map" {
+			key = "values"
+		}
+		items, err := p.parse(def[key], namespace, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return &avroType{kind: kind, items: items}, nil
+	default:
+		// A primitive type, possibly with a logical type:
+		t, err := p.parse(def["type"], namespace, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if logical == "" {
+			return t, nil
+		}
+		annotated := *t
+		annotated.logical = logical
+		return &annotated, nil
+	}
+
+	// A named type:
+	name, _ := def["name"].(string)
+	if name == "" {
+		return nil, fmt.Errorf("%s without a name", kind)
+	}
+	if ns, ok := def["namespace"].(string); ok {
+		namespace = ns
+	}
+	t := &avroType{kind: kind, logical: logical}
+	if kind == "error" {
+		t.kind = "record"
+	}
+	short := name
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		short = name[i+1:]
+		namespace = name[:i]
+	}
+	p.named[short] = t
+	if namespace != "" {
+		p.named[namespace+"."+short] = t
+	}
+	switch t.kind {
+	case "record":
+		fields, _ := def["fields"].([]interface{})
+		for _, f := range fields {
+			f, _ := f.(map[string]interface{})
+			name, _ := f["name"].(string)
+			if name == "" {
+				return nil, fmt.Errorf("field of record %s without a name", short)
+			}
+			typ, err := p.parse(f["type"], namespace, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("field %s of record %s: %s", name, short, err)
+			}
+			t.fields = append(t.fields, avroField{name: name, typ: typ})
+		}
+	case "enum":
+		symbols, _ := def["symbols"].([]interface{})
+		for _, s := range symbols {
+			symbol, _ := s.(string)
+			t.symbols = append(t.symbols, symbol)
+		}
+	case "fixed":
+		size, ok := def["size"].(float64)
+		if !ok || size < 0 {
+			return nil, fmt.Errorf("fixed %s without a valid size", short)
+		}
+		t.size = int(size)
+	}
+	return t, nil
+}
+
+// decodeTrade decodes a trade from a record.
+func (t *avroType) decodeTrade(r *avroReader) (models.Trade, error) {
+	var trade models.Trade
+	for _, f := range t.fields {
+		v, err := f.typ.read(r, 0)
+		if err != nil {
+			return trade, fmt.Errorf("field %s: %s", f.name, err)
+		}
+		if v == nil {
+			continue
+		}
+		switch f.name {
+		case "id":
+			var n float64
+			n, err = avroNumber(v)
+			trade.ID = int(n)
+		case "market":
+			trade.Market, err = avroMarket(v)
+		case "price":
+			trade.Price, err = avroNumber(v)
+		case "volume":
+			trade.Volume, err = avroNumber(v)
+		case "is_buy":
+			b, ok := v.(bool)
+			if !ok {
+				err = fmt.Errorf("expected a boolean, got %v", v)
+			}
+			trade.IsBuy = b
+		case "timestamp":
+			var n float64
+			n, err = avroNumber(v)
+			if f.typ.logicalType() == "timestamp-micros" {
+				n /= 1000
+			}
+			trade.Timestamp = int64(n)
+		}
+		if err != nil {
+			return trade, fmt.Errorf("field %s: %s", f.name, err)
+		}
+	}
+	return trade, nil
+}
+
+// logicalType returns the logical type of a type,
+// or of the branches of a union (e.g. of an optional value).
+func (t *avroType) logicalType() string {
+	for _, b := range t.branches {
+		if b.logical != "" {
+			return b.logical
+		}
+	}
+	return t.logical
+}
+
+func avroNumber(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %v", v)
+}
+
+func avroMarket(v interface{}) (uint64, error) {
+	if s, ok := v.(string); ok {
+		var market uint64
+		if _, err := fmt.Sscan(s, &market); err != nil {
+			return 0, fmt.Errorf("invalid market %q", s)
+		}
+		return market, nil
+	}
+	n, err := avroNumber(v)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative market %v", n)
+	}
+	return uint64(n), nil
+}
+
+// read decodes a value: an int64 (int, long and enum), float64, bool,
+// string (string and bytes) or nil (null); the values of the other types
+// are skipped, and are nil as well.
+func (t *avroType) read(r *avroReader, depth int) (interface{}, error) {
+	if depth > avroMaxDepth {
+		return nil, fmt.Errorf("value nested too deeply")
+	}
+	switch t.kind {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.bytes(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "int", "long", "enum":
+		return r.long()
+	case "float":
+		b, err := r.bytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		b, err := r.bytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "bytes", "string":
+		n, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case "fixed":
+		_, err := r.bytes(int64(t.size))
+		return nil, err
+	case "union":
+		i, err := r.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(t.branches)) {
+			return nil, fmt.Errorf("invalid union branch %v", i)
+		}
+		return t.branches[i].read(r, depth+1)
+	case "record":
+		for _, f := range t.fields {
+			if _, err := f.typ.read(r, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case "array", "map":
+		for {
+			n, err := r.long()
+			if err != nil || n == 0 {
+				return nil, err
+			}
+			if n < 0 {
+				// A block with its size in bytes:
+				n = -n
+				if _, err := r.long(); err != nil {
+					return nil, err
+				}
+			}
+			for i := int64(0); i < n; i++ {
+				if t.kind == "map" {
+					if _, err := avroString.read(r, depth+1); err != nil {
+						return nil, err
+					}
+				}
+				if _, err := t.items.read(r, depth+1); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown type %s", t.kind)
+}
+
+// avroString is the type of the keys of maps.
+var avroString = &avroType{kind: "string"}
+
+var errAvroTruncated = errors.New("truncated record")
+
+// avroReader reads the Avro encoding of a record.
+type avroReader struct {
+	buf []byte
+}
+
+// long reads a zig-zag encoded varint.
+func (r *avroReader) long() (int64, error) {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		return 0, errAvroTruncated
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *avroReader) bytes(n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(r.buf)) {
+		return nil, errAvroTruncated
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
@@ -0,0 +1,180 @@
+package feed
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+const testAvroSchema = `{"type":"record","name":"Trade","fields":[
+	{"name":"id","type":"long"},
+	{"name":"market","type":"long"},
+	{"name":"price","type":"double"},
+	{"name":"volume","type":["null","double"]},
+	{"name":"is_buy","type":"boolean"},
+	{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-micros"}}
+]}`
+
+// testRegistry serves schema 1 (testAvroSchema), 2 (a Protobuf schema),
+// and 3 (an error while failing is set), counting the requests of each.
+type testRegistry struct {
+	failing  int32
+	requests [4]int32
+	// block, if not nil, is waited for before answering for schema 1.
+	block chan struct{}
+}
+
+func (tr *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var id int
+	if _, err := fmt.Sscanf(r.URL.Path, "/schemas/ids/%d", &id); err != nil || id < 1 || id > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	atomic.AddInt32(&tr.requests[id], 1)
+	if id == 1 && tr.block != nil {
+		<-tr.block
+	}
+	switch {
+	case id == 1:
+		json.NewEncoder(w).Encode(map[string]string{"schema": testAvroSchema})
+	case id == 2:
+		json.NewEncoder(w).Encode(map[string]string{"schema": "syntax = \"proto3\";", "schemaType": "PROTOBUF"})
+	case atomic.LoadInt32(&tr.failing) != 0:
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	default:
+		json.NewEncoder(w).Encode(map[string]string{"schema": testAvroSchema})
+	}
+}
+
+// avroLong appends the zigzag varint encoding of n.
+func avroLong(buf []byte, n int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], uint64(n<<1^n>>63))]...)
+}
+
+func avroDouble(buf []byte, f float64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+	return append(buf, b[:]...)
+}
+
+// avroRecord encodes trade with testAvroSchema, in the Confluent wire format.
+func avroRecord(schemaID uint32, trade models.Trade) []byte {
+	rec := []byte{avroMagic, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(rec[1:], schemaID)
+	rec = avroLong(rec, int64(trade.ID))
+	rec = avroLong(rec, int64(trade.Market))
+	rec = avroDouble(rec, trade.Price)
+	rec = avroLong(rec, 1) // the double branch of the union
+	rec = avroDouble(rec, trade.Volume)
+	if trade.IsBuy {
+		rec = append(rec, 1)
+	} else {
+		rec = append(rec, 0)
+	}
+	return avroLong(rec, trade.Timestamp*1000)
+}
+
+var testTrade = models.Trade{ID: 7, Market: 42, Price: 3.5, Volume: 12.25, IsBuy: true, Timestamp: 1640995200123}
+
+func TestSchemaRegistryDecodeTrade(t *testing.T) {
+	server := httptest.NewServer(&testRegistry{})
+	defer server.Close()
+	reg := NewSchemaRegistry(server.URL)
+	trade, err := reg.DecodeTrade(avroRecord(1, testTrade))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade != testTrade {
+		t.Errorf("got %+v, want %+v", trade, testTrade)
+	}
+}
+
+func TestSchemaRegistryProtobuf(t *testing.T) {
+	server := httptest.NewServer(&testRegistry{})
+	defer server.Close()
+	reg := NewSchemaRegistry(server.URL)
+	_, err := reg.DecodeTrade(avroRecord(2, testTrade))
+	if err == nil || !strings.Contains(err.Error(), "unsupported schema type PROTOBUF") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestSchemaRegistrySingleFetch(t *testing.T) {
+	tr := &testRegistry{block: make(chan struct{})}
+	server := httptest.NewServer(tr)
+	defer server.Close()
+	reg := NewSchemaRegistry(server.URL)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := reg.DecodeTrade(avroRecord(1, testTrade))
+			errs <- err
+		}()
+	}
+	// While schema 1 is being fetched, the others are not held up.
+	for atomic.LoadInt32(&tr.requests[1]) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := reg.DecodeTrade(avroRecord(2, testTrade))
+		done <- err
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("schema 2 was not fetched while schema 1 was being fetched")
+	}
+	close(tr.block)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := atomic.LoadInt32(&tr.requests[1]); n != 1 {
+		t.Errorf("schema 1 was fetched %v times, want 1", n)
+	}
+}
+
+func TestSchemaRegistryErrorTTL(t *testing.T) {
+	tr := &testRegistry{failing: 1}
+	server := httptest.NewServer(tr)
+	defer server.Close()
+	reg := NewSchemaRegistry(server.URL)
+	reg.errorTTL = 50 * time.Millisecond
+
+	for i := 0; i < 10; i++ {
+		_, err := reg.DecodeTrade(avroRecord(3, testTrade))
+		if err == nil || !strings.Contains(err.Error(), "error while fetching schema 3") {
+			t.Fatalf("got error %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&tr.requests[3]); n != 1 {
+		t.Errorf("schema 3 was fetched %v times within the TTL, want 1", n)
+	}
+
+	atomic.StoreInt32(&tr.failing, 0)
+	time.Sleep(2 * reg.errorTTL)
+	if _, err := reg.DecodeTrade(avroRecord(3, testTrade)); err != nil {
+		t.Fatalf("after the TTL: %s", err)
+	}
+	if n := atomic.LoadInt32(&tr.requests[3]); n != 2 {
+		t.Errorf("schema 3 was fetched %v times, want 2", n)
+	}
+}
@@ -0,0 +1,85 @@
+package feed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// BinaryDecoder decodes a single message of a binary feed.
+type BinaryDecoder interface {
+	// Decode decodes msg; it returns ok=false (and no error)
+	// for messages that don't carry a trade.
+	// The msg must not be retained.
+	Decode(msg []byte) (trade models.Trade, ok bool, err error)
+}
+
+// BinaryDecoderFunc adapts a function to the BinaryDecoder interface.
+type BinaryDecoderFunc func(msg []byte) (models.Trade, bool, error)
+
+func (f BinaryDecoderFunc) Decode(msg []byte) (models.Trade, bool, error) {
+	return f(msg)
+}
+
+// Framer reads the next message from a stream.
+// It returns io.EOF when the stream ends cleanly between messages.
+// The returned message is only valid until the next call.
+type Framer func(r *bufio.Reader) ([]byte, error)
+
+// FrameU16 reads messages prefixed by their length as a big-endian uint16
+// (as in NASDAQ ITCH files and SoupBinTCP).
+func FrameU16() Framer {
+	var buf []byte
+	return func(r *bufio.Reader) ([]byte, error) {
+		var prefix [2]byte
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			return nil, err
+		}
+		size := int(binary.BigEndian.Uint16(prefix[:]))
+		return readFrame(r, &buf, size)
+	}
+}
+
+func readFrame(r *bufio.Reader, buf *[]byte, size int) ([]byte, error) {
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	msg := (*buf)[:size]
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// NewBinarySource returns a Source that splits r into messages with frame,
+// and decodes each one of them with dec.
+func NewBinarySource(r io.Reader, frame Framer, dec BinaryDecoder) Source {
+	return SourceFunc(func(fn func(models.Trade) bool) error {
+		reader := bufio.NewReader(r)
+		for {
+			msg, err := frame(reader)
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("error of reader: %s", err)
+			}
+			trade, ok, err := dec.Decode(msg)
+			if err != nil {
+				return &ParseError{Err: err}
+			}
+			if !ok {
+				continue
+			}
+			if !fn(trade) {
+				return nil
+			}
+		}
+	})
+}
@@ -0,0 +1,351 @@
+package feed
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+func init() {
+	RegisterFormat("cbor", NewCBORSource)
+}
+
+// CBOR major types.
+const (
+	cborUint   = 0
+	cborNegint = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+const (
+	cborIndefinite = 31
+	cborBreak      = 0xff
+	// cborMaxDepth bounds the nesting of skipped values.
+	cborMaxDepth = 32
+	// cborMaxKeyLen bounds the length of the keys that are read;
+	// longer keys can't be trade fields, and are skipped.
+	cborMaxKeyLen = 64
+)
+
+var errCBORBreak = errors.New("unexpected CBOR break")
+
+type cborReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// NewCBORSource returns a Source of CBOR-encoded trades:
+// each trade is a map with the same keys as the JSON format.
+// Since CBOR items are self-delimiting, records can follow each other directly
+// or be separated by newlines.
+func NewCBORSource(r io.Reader, noise io.Writer) Source {
+	return SourceFunc(func(fn func(models.Trade) bool) error {
+		reader := bufio.NewReader(r)
+		for {
+			head, err := reader.ReadByte()
+			if err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return fmt.Errorf("error of reader: %s", err)
+			}
+			// Newlines between records (a top-level integer 10 is not a trade):
+			if head == '\n' {
+				continue
+			}
+			trade, err := decodeCBORTrade(reader, head)
+			if err != nil {
+				return &ParseError{Err: err}
+			}
+			if !fn(trade) {
+				return nil
+			}
+		}
+	})
+}
+
+// DecodeCBORTrade decodes a single CBOR-encoded trade.
+func DecodeCBORTrade(rec []byte) (models.Trade, error) {
+	reader := bytes.NewReader(rec)
+	head, err := reader.ReadByte()
+	if err != nil {
+		return models.Trade{}, fmt.Errorf("error while decoding trade: empty record")
+	}
+	trade, err := decodeCBORTrade(reader, head)
+	if err != nil {
+		return trade, err
+	}
+	if reader.Len() > 0 {
+		return trade, fmt.Errorf("error while decoding trade: %v trailing bytes", reader.Len())
+	}
+	return trade, nil
+}
+
+func decodeCBORTrade(r cborReader, head byte) (models.Trade, error) {
+	var trade models.Trade
+	if head>>5 != cborMap {
+		return trade, fmt.Errorf("error while decoding trade: expected CBOR map, got major type %v", head>>5)
+	}
+	count, indefinite, err := cborArgument(r, head)
+	if err != nil {
+		return trade, fmt.Errorf("error while decoding trade: %s", err)
+	}
+	var keyBuf [cborMaxKeyLen]byte
+	for i := uint64(0); indefinite || i < count; i++ {
+		key, err := cborKey(r, keyBuf[:])
+		if err == errCBORBreak && indefinite {
+			break
+		}
+		if err != nil {
+			return trade, fmt.Errorf("error while decoding trade: %s", err)
+		}
+		switch key {
+		case "id":
+			var v float64
+			v, err = cborNumber(r)
+			trade.ID = int(v)
+		case "market":
+			trade.Market, err = cborMarket(r)
+		case "price":
+			trade.Price, err = cborNumber(r)
+		case "volume":
+			trade.Volume, err = cborNumber(r)
+		case "is_buy":
+			trade.IsBuy, err = cborBool(r)
+		case "timestamp":
+			var v float64
+			v, err = cborNumber(r)
+			trade.Timestamp = int64(v)
+		default:
+			err = cborSkip(r, 0)
+		}
+		if err != nil {
+			return trade, fmt.Errorf("error while decoding trade field %q: %s", key, err)
+		}
+	}
+	return trade, nil
+}
+
+// cborArgument reads the argument of an item with the given initial byte.
+func cborArgument(r cborReader, head byte) (value uint64, indefinite bool, err error) {
+	info := head & 0x1f
+	switch {
+	case info < 24:
+		return uint64(info), false, nil
+	case info == cborIndefinite:
+		return 0, true, nil
+	case info > 27:
+		return 0, false, fmt.Errorf("invalid CBOR additional info %v", info)
+	}
+	size := 1 << (info - 24)
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return 0, false, unexpectedEOF(err)
+	}
+	return binary.BigEndian.Uint64(buf[:]), false, nil
+}
+
+// cborKey reads a text key into buf (of cborMaxKeyLen bytes):
+// the key is only valid until buf is reused (see bytesToString).
+func cborKey(r cborReader, buf []byte) (string, error) {
+	head, err := r.ReadByte()
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if head == cborBreak {
+		return "", errCBORBreak
+	}
+	if head>>5 != cborText || head&0x1f == cborIndefinite {
+		// Not a key of a trade field:
+		return "", cborSkipItem(r, head, 0)
+	}
+	size, _, err := cborArgument(r, head)
+	if err != nil {
+		return "", err
+	}
+	if size > cborMaxKeyLen {
+		_, err := io.CopyN(io.Discard, r, int64(size))
+		return "", unexpectedEOF(err)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return bytesToString(buf), nil
+}
+
+func cborNumber(r cborReader) (float64, error) {
+	head, err := r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return cborNumberOf(r, head)
+}
+
+// cborNumberOf reads a number with the given initial byte.
+func cborNumberOf(r cborReader, head byte) (float64, error) {
+	major := head >> 5
+	info := head & 0x1f
+	switch {
+	case major == cborUint || major == cborNegint:
+		v, _, err := cborArgument(r, head)
+		if err != nil {
+			return 0, err
+		}
+		if major == cborNegint {
+			return -1 - float64(v), nil
+		}
+		return float64(v), nil
+	case major == cborSimple && info >= 25 && info <= 27:
+		v, _, err := cborArgument(r, head)
+		if err != nil {
+			return 0, err
+		}
+		switch info {
+		case 25:
+			return float16ToFloat64(uint16(v)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(v))), nil
+		default:
+			return math.Float64frombits(v), nil
+		}
+	}
+	return 0, fmt.Errorf("expected a number, got major type %v", major)
+}
+
+// cborMarket reads a market ID, exactly if it is an unsigned integer
+// (IDs above 2^53 can't be represented exactly as floats).
+func cborMarket(r cborReader) (uint64, error) {
+	head, err := r.ReadByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if head>>5 == cborUint {
+		v, _, err := cborArgument(r, head)
+		return v, err
+	}
+	v, err := cborNumberOf(r, head)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("negative market %v", v)
+	}
+	return uint64(v), nil
+}
+
+func cborBool(r cborReader) (bool, error) {
+	head, err := r.ReadByte()
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	switch head {
+	case 0xf4:
+		return false, nil
+	case 0xf5:
+		return true, nil
+	}
+	return false, fmt.Errorf("expected a boolean, got 0x%x", head)
+}
+
+// cborSkip skips the next item.
+func cborSkip(r cborReader, depth int) error {
+	head, err := r.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if head == cborBreak {
+		return errCBORBreak
+	}
+	return cborSkipItem(r, head, depth)
+}
+
+func cborSkipItem(r cborReader, head byte, depth int) error {
+	if depth > cborMaxDepth {
+		return fmt.Errorf("CBOR nesting deeper than %v", cborMaxDepth)
+	}
+	major := head >> 5
+	arg, indefinite, err := cborArgument(r, head)
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborUint, cborNegint, cborSimple:
+		return nil
+	case cborBytes, cborText:
+		if !indefinite {
+			if arg > math.MaxInt64 {
+				return fmt.Errorf("CBOR string too long")
+			}
+			_, err := io.CopyN(io.Discard, r, int64(arg))
+			return unexpectedEOF(err)
+		}
+		// Chunks until break:
+		for {
+			err := cborSkip(r, depth+1)
+			if err == errCBORBreak {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		return cborSkip(r, depth+1)
+	}
+	// Arrays and maps:
+	items := arg
+	if major == cborMap {
+		items *= 2
+	}
+	for i := uint64(0); indefinite || i < items; i++ {
+		err := cborSkip(r, depth+1)
+		if err == errCBORBreak && indefinite {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func float16ToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,207 @@
+package feed
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression settings other than the name of a codec.
+const (
+	// CompressionAuto selects the codec by the extension of the path.
+	CompressionAuto = "auto"
+	// CompressionNone reads and writes the bytes as they are.
+	CompressionNone = "none"
+)
+
+// Codec is a compression format, used for the inputs and the outputs.
+type Codec struct {
+	Name string
+	// Extensions are the file extensions of the format (e.g. ".gz"),
+	// by which it is selected automatically.
+	Extensions []string
+	// NewReader decompresses r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+	// NewWriter compresses to w; it is nil for formats that can only be read.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	// EncodeBlock compresses src as a single block, appended to dst, for
+	// protocols that frame the blocks themselves (e.g. snappy in remote
+	// write); it is nil for formats without a block format.
+	EncodeBlock func(dst, src []byte) []byte
+}
+
+var codecs = map[string]*Codec{}
+
+// RegisterCodec registers a new compression format.
+func RegisterCodec(codec *Codec) {
+	if _, ok := codecs[codec.Name]; ok || codec.Name == CompressionAuto || codec.Name == CompressionNone {
+		panic(fmt.Sprintf("codec %q already registered", codec.Name))
+	}
+	codecs[codec.Name] = codec
+}
+
+// Codecs returns the names of the registered codecs.
+func Codecs() []string {
+	out := make([]string, 0, len(codecs))
+	for name := range codecs {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// WritableCodecs returns the names of the registered codecs that can write.
+func WritableCodecs() []string {
+	out := []string{}
+	for _, name := range Codecs() {
+		if codecs[name].NewWriter != nil {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// CheckWritable returns an error if the codec can only be read.
+func CheckWritable(codec *Codec) error {
+	if codec != nil && codec.NewWriter == nil {
+		return fmt.Errorf("compression %s can only be read (writable: %v, or none)", codec.Name, WritableCodecs())
+	}
+	return nil
+}
+
+// GetCodec returns the codec of a file for the given compression setting:
+// a codec name, CompressionNone, or CompressionAuto to select it by the
+// extension of path. It returns nil if the file is not compressed.
+func GetCodec(compression string, path string) (*Codec, error) {
+	switch compression {
+	case CompressionNone:
+		return nil, nil
+	case CompressionAuto, "":
+		ext := strings.ToLower(filepath.Ext(path))
+		for _, codec := range codecs {
+			for _, e := range codec.Extensions {
+				if ext == e {
+					return codec, nil
+				}
+			}
+		}
+		return nil, nil
+	}
+	codec, ok := codecs[compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q (available: %v, auto or none)", compression, Codecs())
+	}
+	return codec, nil
+}
+
+// NewCodecReader returns a reader of r decompressed with the codec
+// (r itself if codec is nil).
+func NewCodecReader(codec *Codec, r io.Reader) (io.Reader, error) {
+	if codec == nil {
+		return r, nil
+	}
+	dr, err := codec.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("error while decompressing (%s): %s", codec.Name, err)
+	}
+	return dr, nil
+}
+
+// NewCodecWriter returns a writer compressing to w with the codec
+// (w itself, without closing it, if codec is nil); closing it flushes it,
+// without closing w.
+func NewCodecWriter(codec *Codec, w io.Writer) (io.WriteCloser, error) {
+	if codec == nil {
+		return nopWriteCloser{w}, nil
+	}
+	if err := CheckWritable(codec); err != nil {
+		return nil, err
+	}
+	return codec.NewWriter(w)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func init() {
+	RegisterCodec(&Codec{
+		Name:       "gzip",
+		Extensions: []string{".gz", ".gzip"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	})
+	RegisterCodec(&Codec{
+		Name:       "zlib",
+		Extensions: []string{".zz", ".zlib"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriter(w), nil
+		},
+	})
+	RegisterCodec(&Codec{
+		Name:       "lz4",
+		Extensions: []string{".lz4"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(lz4.NewReader(r)), nil
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return lz4.NewWriter(w), nil
+		},
+	})
+	// The streams of snappy are framed, its blocks are not:
+	RegisterCodec(&Codec{
+		Name:       "snappy",
+		Extensions: []string{".sz", ".snappy"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(snappy.NewReader(r)), nil
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		EncodeBlock: func(dst, src []byte) []byte {
+			return append(dst, snappy.Encode(nil, src)...)
+		},
+	})
+	RegisterCodec(&Codec{
+		Name:       "zstd",
+		Extensions: []string{".zst", ".zstd"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	})
+	// There is no bzip2 writer in the standard library:
+	RegisterCodec(&Codec{
+		Name:       "bzip2",
+		Extensions: []string{".bz2"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	})
+}
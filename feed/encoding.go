@@ -0,0 +1,135 @@
+package feed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Text encodings of the inputs (see NewDecodingReader).
+const (
+	EncodingAuto    = "auto"
+	EncodingUTF8    = "utf-8"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+)
+
+// Encodings returns the names of the supported encodings.
+func Encodings() []string {
+	return []string{EncodingAuto, EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE}
+}
+
+// NewDecodingReader returns a reader of r transcoded to UTF-8 from the given
+// encoding. With EncodingAuto, the encoding is detected from the byte order
+// mark, if any, or else from the zero bytes of the first (ASCII) character,
+// defaulting to UTF-8. Byte order marks are removed.
+func NewDecodingReader(r io.Reader, encoding string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	bom, _ := br.Peek(3)
+	switch {
+	case len(bom) >= 3 && bom[0] == 0xef && bom[1] == 0xbb && bom[2] == 0xbf:
+		if encoding == EncodingAuto || encoding == EncodingUTF8 {
+			br.Discard(3)
+			return br, nil
+		}
+	case len(bom) >= 2 && bom[0] == 0xff && bom[1] == 0xfe:
+		if encoding == EncodingAuto || encoding == EncodingUTF16LE {
+			br.Discard(2)
+			return newUTF16Reader(br, binary.LittleEndian), nil
+		}
+	case len(bom) >= 2 && bom[0] == 0xfe && bom[1] == 0xff:
+		if encoding == EncodingAuto || encoding == EncodingUTF16BE {
+			br.Discard(2)
+			return newUTF16Reader(br, binary.BigEndian), nil
+		}
+	}
+	switch encoding {
+	case EncodingAuto:
+		if len(bom) >= 2 && bom[0] != 0 && bom[1] == 0 {
+			return newUTF16Reader(br, binary.LittleEndian), nil
+		}
+		if len(bom) >= 2 && bom[0] == 0 && bom[1] != 0 {
+			return newUTF16Reader(br, binary.BigEndian), nil
+		}
+		return br, nil
+	case EncodingUTF8:
+		return br, nil
+	case EncodingUTF16LE:
+		return newUTF16Reader(br, binary.LittleEndian), nil
+	case EncodingUTF16BE:
+		return newUTF16Reader(br, binary.BigEndian), nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q (available: %v)", encoding, Encodings())
+}
+
+// utf16Reader transcodes UTF-16 to UTF-8; invalid code units
+// (unpaired surrogates, or a trailing odd byte) become U+FFFD.
+type utf16Reader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	// raw holds the bytes read, of which the first n are not decoded yet.
+	raw []byte
+	n   int
+	// out holds the UTF-8 bytes not returned yet.
+	out []byte
+	err error
+}
+
+func newUTF16Reader(r io.Reader, order binary.ByteOrder) *utf16Reader {
+	return &utf16Reader{r: r, order: order, raw: make([]byte, 16*1024)}
+}
+
+func (ur *utf16Reader) Read(p []byte) (int, error) {
+	for len(ur.out) == 0 {
+		if ur.err != nil {
+			return 0, ur.err
+		}
+		ur.fill()
+	}
+	n := copy(p, ur.out)
+	ur.out = ur.out[n:]
+	return n, nil
+}
+
+// fill reads and decodes the next bytes into out.
+func (ur *utf16Reader) fill() {
+	read, err := ur.r.Read(ur.raw[ur.n:])
+	ur.n += read
+	ur.err = err
+	out := ur.out[:0]
+	i := 0
+	for ; i+1 < ur.n; i += 2 {
+		r := rune(ur.order.Uint16(ur.raw[i:]))
+		if utf16.IsSurrogate(r) {
+			if i+3 >= ur.n && ur.err == nil {
+				// The pair may be completed by the next read:
+				break
+			}
+			if i+3 < ur.n {
+				if decoded := utf16.DecodeRune(r, rune(ur.order.Uint16(ur.raw[i+2:]))); decoded != utf8.RuneError {
+					out = appendRune(out, decoded)
+					i += 2
+					continue
+				}
+			}
+			r = utf8.RuneError
+		}
+		out = appendRune(out, r)
+	}
+	if ur.err != nil && i < ur.n {
+		// An odd byte at the end of the input:
+		out = appendRune(out, utf8.RuneError)
+		i = ur.n
+	}
+	ur.n = copy(ur.raw, ur.raw[i:ur.n])
+	ur.out = out
+}
+
+func appendRune(buf []byte, r rune) []byte {
+	var enc [utf8.UTFMax]byte
+	n := utf8.EncodeRune(enc[:], r)
+	return append(buf, enc[:n]...)
+}
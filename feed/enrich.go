@@ -0,0 +1,191 @@
+package feed
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+	"gopkg.in/yaml.v2"
+)
+
+// Enricher transforms each decoded trade before it is aggregated (after its
+// market is remapped), e.g. to resolve its market or convert its price.
+// It returns false to drop the trade; an error aborts the run.
+type Enricher interface {
+	Enrich(trade *models.Trade) (bool, error)
+}
+
+// NewEnricherFunc creates an enricher from its YAML config
+// (nil if the enricher is used without a config).
+type NewEnricherFunc func(config []byte) (Enricher, error)
+
+var enrichers = map[string]NewEnricherFunc{}
+
+// RegisterEnricher registers a new enricher, which can then be created by
+// name with NewEnricher (e.g. for -enrich); enrichers outside this package
+// register from their init function. Enrichers are compiled in: there is no
+// loading at run time, so adding one requires a new build. Registering a
+// name twice panics, at startup, as it is a mistake of the build.
+func RegisterEnricher(name string, newEnricher NewEnricherFunc) {
+	if _, ok := enrichers[name]; ok {
+		panic(fmt.Sprintf("enricher %q already registered", name))
+	}
+	enrichers[name] = newEnricher
+}
+
+// Enrichers returns the names of the registered enrichers.
+func Enrichers() []string {
+	out := make([]string, 0, len(enrichers))
+	for name := range enrichers {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// NewEnricher creates the enricher with the given name from its YAML config.
+func NewEnricher(name string, config []byte) (Enricher, error) {
+	newEnricher, ok := enrichers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown enricher %q (available: %v)", name, Enrichers())
+	}
+	enricher, err := newEnricher(config)
+	if err != nil {
+		return nil, fmt.Errorf("enricher %s: %s", name, err)
+	}
+	return enricher, nil
+}
+
+// Policies for the trades of the markets that an enricher doesn't know.
+const (
+	unknownKeep  = "keep"
+	unknownDrop  = "drop"
+	unknownError = "error"
+)
+
+func parseUnknown(policy string) (string, error) {
+	switch policy {
+	case "":
+		return unknownKeep, nil
+	case unknownKeep, unknownDrop, unknownError:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid unknown %q: must be keep, drop or error", policy)
+}
+
+// unknownMarket applies an unknown policy to a trade.
+func unknownMarket(policy string, trade *models.Trade) (bool, error) {
+	switch policy {
+	case unknownDrop:
+		return false, nil
+	case unknownError:
+		return false, fmt.Errorf("unknown market %v", trade.Market)
+	}
+	return true, nil
+}
+
+// SymbolsConfig is the config of the symbols enricher, which resolves
+// the market IDs of a venue to those of a shared table of symbols, so that
+// the results of venues with their own IDs can be joined.
+type SymbolsConfig struct {
+	// Venue are the symbols of the market IDs of the venue.
+	Venue map[uint64]string `yaml:"venue"`
+	// Symbols are the IDs of the symbols in the results.
+	Symbols map[string]uint64 `yaml:"symbols"`
+	// Unknown is what to do with the trades of the markets without a symbol:
+	// keep them (the default), drop them, or error.
+	Unknown string `yaml:"unknown"`
+}
+
+type symbolsEnricher struct {
+	markets map[uint64]uint64
+	unknown string
+}
+
+func newSymbolsEnricher(config []byte) (Enricher, error) {
+	var conf SymbolsConfig
+	if err := yaml.UnmarshalStrict(config, &conf); err != nil {
+		return nil, fmt.Errorf("error while parsing config: %s", err)
+	}
+	if len(conf.Venue) == 0 {
+		return nil, fmt.Errorf("requires a config with the symbols of the venue")
+	}
+	unknown, err := parseUnknown(conf.Unknown)
+	if err != nil {
+		return nil, err
+	}
+	e := &symbolsEnricher{markets: map[uint64]uint64{}, unknown: unknown}
+	for market, symbol := range conf.Venue {
+		id, ok := conf.Symbols[symbol]
+		if !ok {
+			return nil, fmt.Errorf("symbol %q of market %v has no ID", symbol, market)
+		}
+		e.markets[market] = id
+	}
+	return e, nil
+}
+
+func (e *symbolsEnricher) Enrich(trade *models.Trade) (bool, error) {
+	id, ok := e.markets[trade.Market]
+	if !ok {
+		return unknownMarket(e.unknown, trade)
+	}
+	trade.Market = id
+	return true, nil
+}
+
+// CurrencyConfig is the config of the currency enricher, which converts the
+// prices of the markets quoted in other currencies into a single one, so that
+// their metrics can be compared.
+type CurrencyConfig struct {
+	// Markets are the quote currencies of the markets to convert.
+	Markets map[uint64]string `yaml:"markets"`
+	// Rates are the prices of the currencies in the target currency.
+	Rates map[string]float64 `yaml:"rates"`
+	// Unknown is what to do with the trades of the other markets:
+	// keep them (the default, for those already in the target currency),
+	// drop them, or error.
+	Unknown string `yaml:"unknown"`
+}
+
+type currencyEnricher struct {
+	rates   map[uint64]float64
+	unknown string
+}
+
+func newCurrencyEnricher(config []byte) (Enricher, error) {
+	var conf CurrencyConfig
+	if err := yaml.UnmarshalStrict(config, &conf); err != nil {
+		return nil, fmt.Errorf("error while parsing config: %s", err)
+	}
+	if len(conf.Markets) == 0 {
+		return nil, fmt.Errorf("requires a config with the currencies of the markets")
+	}
+	unknown, err := parseUnknown(conf.Unknown)
+	if err != nil {
+		return nil, err
+	}
+	e := &currencyEnricher{rates: map[uint64]float64{}, unknown: unknown}
+	for market, currency := range conf.Markets {
+		rate, ok := conf.Rates[currency]
+		if !ok || rate <= 0 {
+			return nil, fmt.Errorf("currency %s of market %v requires a positive rate", currency, market)
+		}
+		e.rates[market] = rate
+	}
+	return e, nil
+}
+
+func (e *currencyEnricher) Enrich(trade *models.Trade) (bool, error) {
+	rate, ok := e.rates[trade.Market]
+	if !ok {
+		return unknownMarket(e.unknown, trade)
+	}
+	trade.Price *= rate
+	return true, nil
+}
+
+func init() {
+	RegisterEnricher("symbols", newSymbolsEnricher)
+	RegisterEnricher("currency", newCurrencyEnricher)
+}
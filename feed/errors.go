@@ -0,0 +1,15 @@
+package feed
+
+// ParseError is an error decoding a record of an input,
+// as opposed to an error reading or framing it.
+type ParseError struct {
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,299 @@
+package feed
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+	"golang.org/x/net/websocket"
+)
+
+// Exchange is a public trade WebSocket channel of an exchange.
+type Exchange struct {
+	Name string
+	// URL returns the WebSocket URL for the given symbols.
+	URL func(symbols []string) string
+	// Subscribe returns the message to send after connecting (if any).
+	Subscribe func(symbols []string) []byte
+	// Decode decodes a message; ok is false for messages that are not trades.
+	// The returned symbol is used to look up the market ID.
+	Decode func(msg []byte) (symbol string, trade models.Trade, ok bool, err error)
+	// Origin is the Origin header sent while connecting.
+	Origin string
+}
+
+var exchanges = map[string]*Exchange{}
+
+// RegisterExchange registers a new exchange adapter.
+func RegisterExchange(ex *Exchange) {
+	if _, ok := exchanges[ex.Name]; ok {
+		panic(fmt.Sprintf("exchange %q already registered", ex.Name))
+	}
+	exchanges[ex.Name] = ex
+}
+
+// IsExchange tells whether the location refers to an exchange adapter
+// (e.g. binance:btcusdt,ethusdt).
+func IsExchange(location string) bool {
+	name, _, ok := cut(location, ":")
+	if !ok {
+		return false
+	}
+	_, ok = exchanges[name]
+	return ok
+}
+
+// exchangeMarketMin is the lowest market ID derived from a symbol
+// (see ExchangeMarket): IDs from 2^52 to 2^53-1 are exact as floats
+// (e.g. in expressions), and above those of most other inputs.
+const exchangeMarketMin = 1 << 52
+
+// ExchangeMarket returns the market ID of a symbol of an exchange that has
+// no explicit ID: a hash of both (the symbol case-insensitively), so that
+// the same symbol on two exchanges, or on two inputs of different
+// exchanges, are different markets, and that the IDs are the same across runs.
+func ExchangeMarket(exchange string, symbol string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(exchange + ":" + strings.ToLower(symbol)))
+	return exchangeMarketMin + h.Sum64()%exchangeMarketMin
+}
+
+// ExchangeSource is a live Source of trades from an exchange.
+// The market ID of each symbol is the one given with it (as symbol=id),
+// or else derived from the exchange and the symbol (see ExchangeMarket).
+type ExchangeSource struct {
+	exchange *Exchange
+	symbols  []string
+	ids      []uint64
+	markets  map[string]uint64 // lowercase symbol to market ID
+	conn     *websocket.Conn
+}
+
+// DialExchange connects to the exchange specified as
+// name:symbol1,symbol2,..., each symbol possibly as symbol=id.
+func DialExchange(location string) (*ExchangeSource, error) {
+	name, list, _ := cut(location, ":")
+	ex, ok := exchanges[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown exchange %q", name)
+	}
+	src := &ExchangeSource{
+		exchange: ex,
+		markets:  map[string]uint64{},
+	}
+	symbols := map[uint64]string{}
+	for _, symbol := range strings.Split(list, ",") {
+		symbol, id, explicit := cut(strings.TrimSpace(symbol), "=")
+		symbol = strings.TrimSpace(symbol)
+		if symbol == "" {
+			continue
+		}
+		if _, ok := src.markets[strings.ToLower(symbol)]; ok {
+			continue
+		}
+		market := ExchangeMarket(name, symbol)
+		if explicit {
+			var err error
+			market, err = strconv.ParseUint(strings.TrimSpace(id), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid market ID %q of symbol %s of %s", id, symbol, name)
+			}
+		}
+		if other, ok := symbols[market]; ok {
+			return nil, fmt.Errorf("symbols %s and %s of %s have the same market ID %v", other, symbol, name, market)
+		}
+		symbols[market] = symbol
+		src.symbols = append(src.symbols, symbol)
+		src.ids = append(src.ids, market)
+		src.markets[strings.ToLower(symbol)] = market
+	}
+	if len(src.symbols) == 0 {
+		return nil, fmt.Errorf("no symbols provided for %s", name)
+	}
+
+	url := ex.URL(src.symbols)
+	conn, err := websocket.Dial(url, "", ex.Origin)
+	if err != nil {
+		return nil, fmt.Errorf("error while connecting to %s: %s", url, err)
+	}
+	src.conn = conn
+	if ex.Subscribe != nil {
+		if err := websocket.Message.Send(conn, ex.Subscribe(src.symbols)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error while subscribing to %s: %s", name, err)
+		}
+	}
+	return src, nil
+}
+
+// Symbols returns the subscribed symbols.
+func (src *ExchangeSource) Symbols() []string {
+	return src.symbols
+}
+
+// Markets returns the market IDs of the subscribed symbols, in the same order.
+func (src *ExchangeSource) Markets() []uint64 {
+	return src.ids
+}
+
+func (src *ExchangeSource) Each(fn func(models.Trade) bool) error {
+	var msg []byte
+	for {
+		if err := websocket.Message.Receive(src.conn, &msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("error of %s connection: %s", src.exchange.Name, err)
+		}
+		symbol, trade, ok, err := src.exchange.Decode(msg)
+		if err != nil {
+			return &ParseError{Err: err}
+		}
+		if !ok {
+			continue
+		}
+		// Symbols are matched case-insensitively:
+		market, ok := src.markets[strings.ToLower(symbol)]
+		if !ok {
+			continue
+		}
+		trade.Market = market
+		if !fn(trade) {
+			return nil
+		}
+	}
+}
+
+func (src *ExchangeSource) Close() error {
+	return src.conn.Close()
+}
+
+func init() {
+	RegisterExchange(&Exchange{
+		Name:   "binance",
+		Origin: "https://stream.binance.com",
+		URL: func(symbols []string) string {
+			streams := make([]string, len(symbols))
+			for i, symbol := range symbols {
+				streams[i] = strings.ToLower(symbol) + "@trade"
+			}
+			return "wss://stream.binance.com:9443/stream?streams=" + strings.Join(streams, "/")
+		},
+		Decode: decodeBinance,
+	})
+	RegisterExchange(&Exchange{
+		Name:   "coinbase",
+		Origin: "https://exchange.coinbase.com",
+		URL: func([]string) string {
+			return "wss://ws-feed.exchange.coinbase.com"
+		},
+		Subscribe: func(symbols []string) []byte {
+			msg, _ := json.Marshal(map[string]interface{}{
+				"type":        "subscribe",
+				"product_ids": symbols,
+				"channels":    []string{"matches"},
+			})
+			return msg
+		},
+		Decode: decodeCoinbase,
+	})
+}
+
+type binanceMessage struct {
+	Stream string `json:"stream"`
+	Data   struct {
+		Event        string `json:"e"`
+		Symbol       string `json:"s"`
+		ID           int    `json:"t"`
+		TradeTime    int64  `json:"T"`
+		Price        string `json:"p"`
+		Quantity     string `json:"q"`
+		IsBuyerMaker bool   `json:"m"`
+	} `json:"data"`
+}
+
+// decodeBinance decodes a message of the combined <symbol>@trade streams.
+func decodeBinance(msg []byte) (string, models.Trade, bool, error) {
+	var parsed binanceMessage
+	if err := json.Unmarshal(msg, &parsed); err != nil {
+		return "", models.Trade{}, false, fmt.Errorf("error while decoding binance message: %s", err)
+	}
+	if parsed.Data.Event != "trade" {
+		return "", models.Trade{}, false, nil
+	}
+	trade, err := newExchangeTrade(parsed.Data.ID, parsed.Data.Price, parsed.Data.Quantity)
+	if err != nil {
+		return "", trade, false, fmt.Errorf("invalid binance trade: %s", err)
+	}
+	// When the buyer is the maker, the aggressor is the seller:
+	trade.IsBuy = !parsed.Data.IsBuyerMaker
+	trade.Timestamp = parsed.Data.TradeTime
+	// The stream name has the symbol as provided by the user:
+	symbol, _, _ := cut(parsed.Stream, "@")
+	return symbol, trade, true, nil
+}
+
+type coinbaseMessage struct {
+	Type      string `json:"type"`
+	Message   string `json:"message"`
+	Reason    string `json:"reason"`
+	ProductID string `json:"product_id"`
+	TradeID   int    `json:"trade_id"`
+	Side      string `json:"side"`
+	Size      string `json:"size"`
+	Price     string `json:"price"`
+	Time      string `json:"time"`
+}
+
+// decodeCoinbase decodes a message of the matches channel.
+func decodeCoinbase(msg []byte) (string, models.Trade, bool, error) {
+	var parsed coinbaseMessage
+	if err := json.Unmarshal(msg, &parsed); err != nil {
+		return "", models.Trade{}, false, fmt.Errorf("error while decoding coinbase message: %s", err)
+	}
+	switch parsed.Type {
+	case "match":
+	case "error":
+		return "", models.Trade{}, false, fmt.Errorf("coinbase error: %s (%s)", parsed.Message, parsed.Reason)
+	default:
+		// Including last_match, which is sent on subscription
+		// and refers to a trade that happened before.
+		return "", models.Trade{}, false, nil
+	}
+	trade, err := newExchangeTrade(parsed.TradeID, parsed.Price, parsed.Size)
+	if err != nil {
+		return "", trade, false, fmt.Errorf("invalid coinbase trade: %s", err)
+	}
+	// The side is the one of the maker order:
+	trade.IsBuy = parsed.Side == "sell"
+	if t, err := time.Parse(time.RFC3339Nano, parsed.Time); err == nil {
+		trade.Timestamp = t.UnixNano() / int64(time.Millisecond)
+	}
+	return parsed.ProductID, trade, true, nil
+}
+
+func newExchangeTrade(id int, price string, volume string) (models.Trade, error) {
+	trade := models.Trade{ID: id}
+	var err error
+	trade.Price, err = strconv.ParseFloat(price, 64)
+	if err != nil {
+		return trade, fmt.Errorf("invalid price %q", price)
+	}
+	trade.Volume, err = strconv.ParseFloat(volume, 64)
+	if err != nil {
+		return trade, fmt.Errorf("invalid volume %q", volume)
+	}
+	return trade, nil
+}
+
+// cut is strings.Cut, which is not available in go1.17.
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,212 @@
+package feed
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// FIX tags used to map execution reports to trades.
+const (
+	fixTagExecID     = 17
+	fixTagExecTrans  = 20
+	fixTagLastPx     = 31
+	fixTagLastQty    = 32
+	fixTagMsgType    = 35
+	fixTagSecurityID = 48
+	fixTagSide       = 54
+	fixTagSymbol     = 55
+	fixTagTransact   = 60
+	fixTagExecType   = 150
+)
+
+const fixSOH = 0x01
+
+func init() {
+	RegisterFormat("fix", NewFIXSource)
+}
+
+// NewFIXSource returns a Source of FIX 4.2/4.4 execution reports (35=8).
+// Only fills are mapped to trades; every other message is skipped.
+// Messages are SOH-delimited and terminated by the checksum (10) field;
+// any whitespace between messages is ignored.
+func NewFIXSource(r io.Reader, noise io.Writer) Source {
+	return SourceFunc(func(fn func(models.Trade) bool) error {
+		reader := bufio.NewReader(r)
+		var msg []byte
+		for {
+			field, err := reader.ReadSlice(fixSOH)
+			if err != nil {
+				if err == bufio.ErrBufferFull {
+					return fmt.Errorf("FIX field too long")
+				}
+				if err != io.EOF {
+					return fmt.Errorf("error of reader: %s", err)
+				}
+				if len(bytes.TrimSpace(field)) > 0 || len(msg) > 0 {
+					fmt.Fprintf(noise, "incomplete FIX message at end of input\n")
+				}
+				return nil
+			}
+			if len(msg) == 0 {
+				field = bytes.TrimLeft(field, " \t\r\n")
+			}
+			msg = append(msg, field...)
+			if !bytes.HasPrefix(field, []byte("10=")) {
+				continue
+			}
+			trade, ok, err := DecodeFIX(msg)
+			msg = msg[:0]
+			if err != nil {
+				return &ParseError{Err: err}
+			}
+			if !ok {
+				continue
+			}
+			if !fn(trade) {
+				return nil
+			}
+		}
+	})
+}
+
+// DecodeFIX decodes a single SOH-delimited FIX message.
+// It returns ok=false (and no error) for messages that are not fills.
+// Values are parsed from msg without copying (see bytesToString),
+// and nothing refers to msg after DecodeFIX returns.
+func DecodeFIX(msg []byte) (trade models.Trade, ok bool, err error) {
+	var (
+		msgType    []byte
+		execType   []byte
+		execTrans  []byte
+		side       []byte
+		securityID []byte
+		symbol     []byte
+		execID     []byte
+		lastPx     []byte
+		lastQty    []byte
+		transact   []byte
+	)
+	err = iterateFIXFields(msg, func(tag int, value []byte) {
+		switch tag {
+		case fixTagMsgType:
+			msgType = value
+		case fixTagExecType:
+			execType = value
+		case fixTagExecTrans:
+			execTrans = value
+		case fixTagSide:
+			side = value
+		case fixTagSecurityID:
+			securityID = value
+		case fixTagSymbol:
+			symbol = value
+		case fixTagExecID:
+			execID = value
+		case fixTagLastPx:
+			lastPx = value
+		case fixTagLastQty:
+			lastQty = value
+		case fixTagTransact:
+			transact = value
+		}
+	})
+	if err != nil {
+		return trade, false, err
+	}
+	if string(msgType) != "8" {
+		return trade, false, nil
+	}
+	switch string(execType) {
+	case "F": // FIX 4.4 trade
+	case "1", "2": // FIX 4.2 partial fill, fill
+		// Ignore corrections and cancels of previous executions:
+		if len(execTrans) > 0 && string(execTrans) != "0" {
+			return trade, false, nil
+		}
+	default:
+		return trade, false, nil
+	}
+
+	trade.Market, err = fixMarket(securityID, symbol)
+	if err != nil {
+		return trade, false, err
+	}
+	trade.Price, err = strconv.ParseFloat(bytesToString(lastPx), 64)
+	if err != nil {
+		return trade, false, fmt.Errorf("invalid LastPx (31) %q: %s", lastPx, err)
+	}
+	trade.Volume, err = strconv.ParseFloat(bytesToString(lastQty), 64)
+	if err != nil {
+		return trade, false, fmt.Errorf("invalid LastQty (32) %q: %s", lastQty, err)
+	}
+	switch string(side) {
+	case "1", "3": // buy, buy minus
+		trade.IsBuy = true
+	case "2", "4", "5", "6": // sell, sell plus, sell short, sell short exempt
+		trade.IsBuy = false
+	default:
+		return trade, false, fmt.Errorf("invalid Side (54) %q", side)
+	}
+	// TransactTime (60) is UTCTimestamp, with optional fractional seconds:
+	if len(transact) > 0 {
+		t, err := time.Parse("20060102-15:04:05.999999999", bytesToString(transact))
+		if err != nil {
+			return trade, false, fmt.Errorf("invalid TransactTime (60) %q", transact)
+		}
+		trade.Timestamp = t.UnixNano() / int64(time.Millisecond)
+	}
+	// ExecIDs are not necessarily numeric:
+	if id, err := strconv.Atoi(bytesToString(execID)); err == nil {
+		trade.ID = id
+	}
+	return trade, true, nil
+}
+
+// fixMarket maps the SecurityID (48), or else the Symbol (55), to a market ID.
+func fixMarket(securityID []byte, symbol []byte) (uint64, error) {
+	if len(securityID) > 0 {
+		if id, err := strconv.ParseUint(bytesToString(securityID), 10, 64); err == nil {
+			return id, nil
+		}
+	}
+	if len(symbol) > 0 {
+		if id, err := strconv.ParseUint(bytesToString(symbol), 10, 64); err == nil {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no numeric SecurityID (48) or Symbol (55) to use as market: %q, %q", securityID, symbol)
+}
+
+var errFIXMalformed = errors.New("malformed FIX field")
+
+func iterateFIXFields(msg []byte, fn func(tag int, value []byte)) error {
+	for len(msg) > 0 {
+		end := bytes.IndexByte(msg, fixSOH)
+		if end < 0 {
+			end = len(msg)
+		}
+		field := msg[:end]
+		if end < len(msg) {
+			msg = msg[end+1:]
+		} else {
+			msg = nil
+		}
+		eq := bytes.IndexByte(field, '=')
+		if eq <= 0 {
+			return fmt.Errorf("%w: %q", errFIXMalformed, field)
+		}
+		tag, err := strconv.Atoi(bytesToString(field[:eq]))
+		if err != nil {
+			return fmt.Errorf("%w: %q", errFIXMalformed, field)
+		}
+		fn(tag, field[eq+1:])
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package feed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// MaxFrameSize is the maximum size of a length-prefixed record.
+const MaxFrameSize = 64 << 20
+
+// RecordDecoder decodes a single record of a record-based format.
+type RecordDecoder func(rec []byte) (models.Trade, error)
+
+var recordFormats = map[string]RecordDecoder{
+	"json": DecodeTrade,
+	"cbor": DecodeCBORTrade,
+}
+
+// RegisterRecordFormat registers a format that can be used with length-prefixed framing.
+func RegisterRecordFormat(name string, dec RecordDecoder) {
+	if _, ok := recordFormats[name]; ok {
+		panic(fmt.Sprintf("record format %q already registered", name))
+	}
+	recordFormats[name] = dec
+}
+
+var framings = map[string]func() Framer{
+	"u16":    FrameU16,
+	"u32":    FrameU32,
+	"varint": FrameVarint,
+}
+
+// Framings returns the names of the available length-prefixed framings.
+func Framings() []string {
+	out := make([]string, 0, len(framings))
+	for name := range framings {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// NewFramedSource returns a Source of records of the given format,
+// each one prefixed by its length as specified by framing.
+func NewFramedSource(format string, framing string, r io.Reader) (Source, error) {
+	dec, ok := recordFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("format %q can't be used with length-prefixed framing", format)
+	}
+	newFramer, ok := framings[framing]
+	if !ok {
+		return nil, fmt.Errorf("unknown framing %q (available: %v)", framing, Framings())
+	}
+	return NewBinarySource(
+		r,
+		newFramer(),
+		BinaryDecoderFunc(func(msg []byte) (models.Trade, bool, error) {
+			trade, err := dec(msg)
+			return trade, err == nil, err
+		}),
+	), nil
+}
+
+// FrameU32 reads messages prefixed by their length as a big-endian uint32.
+func FrameU32() Framer {
+	var buf []byte
+	return func(r *bufio.Reader) ([]byte, error) {
+		var prefix [4]byte
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(prefix[:])
+		if size > MaxFrameSize {
+			return nil, fmt.Errorf("frame too large: %v bytes", size)
+		}
+		return readFrame(r, &buf, int(size))
+	}
+}
+
+// FrameVarint reads messages prefixed by their length as an unsigned varint
+// (as in protobuf's length-delimited streams).
+func FrameVarint() Framer {
+	var buf []byte
+	return func(r *bufio.Reader) ([]byte, error) {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > MaxFrameSize {
+			return nil, fmt.Errorf("frame too large: %v bytes", size)
+		}
+		return readFrame(r, &buf, int(size))
+	}
+}
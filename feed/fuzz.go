@@ -0,0 +1,37 @@
+//go:build gofuzz
+// +build gofuzz
+
+package feed
+
+// Fuzz is the go-fuzz entrypoint for the line parser.
+// Run with:
+//
+//	go-fuzz-build ./feed && go-fuzz -bin=feed-fuzz.zip
+//
+// The same properties are checked by the native fuzz targets FuzzParseLine
+// and FuzzDecodeTrade (Go 1.18+), e.g. with:
+//
+//	go test ./feed -run=^$ -fuzz=FuzzDecodeTrade
+func Fuzz(data []byte) int {
+	kind := ParseLine(data)
+	if kind != LineTrade {
+		return 0
+	}
+	trade, err := DecodeTrade(data)
+	if err != nil {
+		return 0
+	}
+	// A decoded trade must survive a round trip:
+	encoded, err := json.Marshal(trade)
+	if err != nil {
+		panic(err)
+	}
+	again, err := DecodeTrade(encoded)
+	if err != nil {
+		panic(err)
+	}
+	if again != trade {
+		panic("trade changed after round trip")
+	}
+	return 1
+}
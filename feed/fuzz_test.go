@@ -0,0 +1,84 @@
+//go:build go1.18
+// +build go1.18
+
+package feed
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fuzzSeeds are the seed corpus of the fuzz targets:
+// markers, trades, and lines that are almost trades.
+var fuzzSeeds = []string{
+	"",
+	"BEGIN",
+	"BEGIN\n",
+	"END\r\n",
+	"BEGINS",
+	"noise",
+	`{"id":1,"market":2,"price":3.5,"volume":4,"is_buy":true}`,
+	`{"id":1,"market":2,"price":3.5,"volume":4,"is_buy":false,"timestamp":1640995200000}` + "\n",
+	`{"id":1,"market":18446744073709551615,"price":1e300,"volume":0,"is_buy":true}`,
+	`{"id":1,"market":-1,"price":1,"volume":1,"is_buy":true}`,
+	`{"id":1,"market":18446744073709551616,"price":1,"volume":1,"is_buy":true}`,
+	`{"market":"2"}`,
+	`{"id":1,"market":2,"price":`,
+	`{}`,
+	`[]`,
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		orig := append([]byte(nil), line...)
+		kind := ParseLine(line)
+		if !bytes.Equal(line, orig) {
+			t.Fatalf("ParseLine modified the line %q", orig)
+		}
+		switch kind {
+		case LineBegin:
+			if !bytes.Equal(trimNewline(line), BEGIN) {
+				t.Fatalf("%q classified as begin", line)
+			}
+		case LineEnd:
+			if !bytes.Equal(trimNewline(line), END) {
+				t.Fatalf("%q classified as end", line)
+			}
+		case LineTrade:
+			if line[0] != '{' {
+				t.Fatalf("%q classified as trade", line)
+			}
+		}
+	})
+}
+
+func FuzzDecodeTrade(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		orig := append([]byte(nil), line...)
+		trade, err := DecodeTrade(line)
+		if !bytes.Equal(line, orig) {
+			t.Fatalf("DecodeTrade modified the line %q", orig)
+		}
+		if err != nil {
+			return
+		}
+		// A decoded trade must survive a round trip:
+		encoded, err := json.Marshal(trade)
+		if err != nil {
+			t.Fatalf("error while encoding %+v: %s", trade, err)
+		}
+		again, err := DecodeTrade(encoded)
+		if err != nil {
+			t.Fatalf("error while decoding %s: %s", encoded, err)
+		}
+		if again != trade {
+			t.Fatalf("trade changed after round trip: %+v, then %+v", trade, again)
+		}
+	})
+}
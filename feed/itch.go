@@ -0,0 +1,50 @@
+package feed
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+func init() {
+	RegisterFormat("itch", func(r io.Reader, noise io.Writer) Source {
+		return NewBinarySource(r, FrameU16(), BinaryDecoderFunc(DecodeITCH))
+	})
+}
+
+const (
+	itchTradeMessage    = 'P'
+	itchTradeMessageLen = 44
+	itchPriceScale      = 10000
+)
+
+// DecodeITCH decodes a NASDAQ TotalView-ITCH 5.0 message.
+// Only non-cross trade messages ('P') are mapped to trades:
+//
+//   - the market is the Stock Locate code;
+//   - the ID is the Match Number;
+//   - the Buy/Sell Indicator is the side of the resting order,
+//     so the trade is a buy when the resting order is a sell.
+func DecodeITCH(msg []byte) (models.Trade, bool, error) {
+	if len(msg) == 0 || msg[0] != itchTradeMessage {
+		return models.Trade{}, false, nil
+	}
+	if len(msg) != itchTradeMessageLen {
+		return models.Trade{}, false, fmt.Errorf("invalid ITCH trade message length: %v", len(msg))
+	}
+	// Layout: type(1) locate(2) tracking(2) timestamp(6) order_ref(8) side(1) shares(4) stock(8) price(4) match(8)
+	side := msg[19]
+	if side != 'B' && side != 'S' {
+		return models.Trade{}, false, fmt.Errorf("invalid ITCH Buy/Sell Indicator: %q", side)
+	}
+	trade := models.Trade{
+		ID:     int(binary.BigEndian.Uint64(msg[36:44])),
+		Market: uint64(binary.BigEndian.Uint16(msg[1:3])),
+		Volume: float64(binary.BigEndian.Uint32(msg[20:24])),
+		Price:  float64(binary.BigEndian.Uint32(msg[32:36])) / itchPriceScale,
+		IsBuy:  side == 'S',
+	}
+	return trade, true, nil
+}
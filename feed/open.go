@@ -0,0 +1,33 @@
+package feed
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Open opens the input at the given location, which is one of:
+//
+//   - "-", for the standard input;
+//   - tcp://host:port, for a TCP connection to host:port;
+//   - a path, for a file (or a named pipe).
+func Open(location string) (io.ReadCloser, error) {
+	switch {
+	case location == "" || location == "-":
+		return os.Stdin, nil
+	case strings.HasPrefix(location, "tcp://"):
+		conn, err := net.Dial("tcp", strings.TrimPrefix(location, "tcp://"))
+		if err != nil {
+			return nil, fmt.Errorf("error while connecting to %s: %s", location, err)
+		}
+		return conn, nil
+	default:
+		file, err := os.Open(location)
+		if err != nil {
+			return nil, fmt.Errorf("error while opening %s: %s", location, err)
+		}
+		return file, nil
+	}
+}
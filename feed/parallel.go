@@ -0,0 +1,166 @@
+package feed
+
+import (
+	"io"
+	"sync"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// parseBatchSize is the number of lines decoded at once by a worker.
+const parseBatchSize = 1024
+
+// parseBatch is a batch of lines, decoded by a worker.
+// Batches are recycled once delivered, with their arena and records, so that
+// decoding allocates nothing in the steady state: the lines (and the records
+// that refer to them, like noise) are only valid until then.
+type parseBatch struct {
+	// arena holds the bytes of all the lines, which end at ends.
+	arena   []byte
+	ends    []int
+	lines   [][]byte
+	records []lineRecord
+	// decoded is closed when the records are decoded.
+	decoded chan struct{}
+}
+
+var parseBatches = sync.Pool{
+	New: func() interface{} {
+		return &parseBatch{}
+	},
+}
+
+func newParseBatch() *parseBatch {
+	batch := parseBatches.Get().(*parseBatch)
+	batch.arena = batch.arena[:0]
+	batch.ends = batch.ends[:0]
+	batch.lines = batch.lines[:0]
+	batch.records = batch.records[:0]
+	batch.decoded = make(chan struct{})
+	return batch
+}
+
+// add copies the line into the arena.
+func (batch *parseBatch) add(line []byte) {
+	batch.arena = append(batch.arena, line...)
+	batch.ends = append(batch.ends, len(batch.arena))
+}
+
+// decode decodes the lines into the records, once the arena is complete,
+// with the iterator of the worker.
+func (batch *parseBatch) decode(src *LineSource, iter *jsoniter.Iterator) {
+	start := 0
+	for _, end := range batch.ends {
+		batch.lines = append(batch.lines, batch.arena[start:end:end])
+		start = end
+	}
+	if cap(batch.records) < len(batch.lines) {
+		batch.records = make([]lineRecord, len(batch.lines))
+	}
+	batch.records = batch.records[:len(batch.lines)]
+	for i, line := range batch.lines {
+		src.decodeInto(iter, line, &batch.records[i])
+	}
+	close(batch.decoded)
+}
+
+// eachParallel reads the lines on one goroutine, decodes batches of them
+// on src.workers goroutines, and delivers the records in order.
+func (src *LineSource) eachParallel(fn func(models.Trade) bool) error {
+	jobs := make(chan *parseBatch, src.workers)
+	// ordered are the batches in input order, decoded or not:
+	ordered := make(chan *parseBatch, src.workers*2)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for i := 0; i < src.workers; i++ {
+		go func() {
+			iter := json.BorrowIterator(nil)
+			defer json.ReturnIterator(iter)
+			for batch := range jobs {
+				batch.decode(src, iter)
+			}
+		}()
+	}
+
+	var readErr error
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+		batch := newParseBatch()
+		send := func() bool {
+			select {
+			case ordered <- batch:
+			case <-stop:
+				return false
+			}
+			select {
+			case jobs <- batch:
+			case <-stop:
+				return false
+			}
+			batch = newParseBatch()
+			return true
+		}
+		readErr = iterateSlices(
+			newRecordReader(src.r, src.delim, src.maxLength),
+			func(line []byte) (bool, error) {
+				batch.add(line)
+				// Nothing is read after the END marker:
+				if ParseLine(line) == LineEnd {
+					return false, nil
+				}
+				if len(batch.ends) == parseBatchSize {
+					return send(), nil
+				}
+				return true, nil
+			},
+		)
+		if len(batch.ends) > 0 {
+			send()
+		}
+	}()
+
+	for batch := range ordered {
+		<-batch.decoded
+		for _, lr := range batch.records {
+			doContinue, err := src.deliver(lr, fn)
+			if err != nil {
+				return err
+			}
+			if !doContinue {
+				return nil
+			}
+		}
+		parseBatches.Put(batch)
+	}
+	return readErr
+}
+
+// iterateSlices is like iterateLines, but the line passed to the iterator
+// is only valid until it returns (it is not copied out of the reader's buffer).
+func iterateSlices(rr *recordReader, iterator func(b []byte) (bool, error)) error {
+	for {
+		line, err := rr.next()
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			// An unterminated last line is only complete
+			// when the delimiter is a separator:
+			if rr.delim != '\n' && len(line) > 0 {
+				_, err := iterator(line)
+				return err
+			}
+			return nil
+		}
+		doContinue, err := iterator(line)
+		if err != nil {
+			return err
+		}
+		if !doContinue {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package feed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+var BEGIN = []byte("BEGIN")
+var END = []byte("END")
+
+// LineKind is the classification of a single input line.
+type LineKind int
+
+const (
+	// LineNoise is anything that is neither a marker nor a trade.
+	LineNoise LineKind = iota
+	// LineBegin is the BEGIN marker.
+	LineBegin
+	// LineEnd is the END marker.
+	LineEnd
+	// LineTrade is a line that looks like a JSON trade object.
+	LineTrade
+)
+
+func (k LineKind) String() string {
+	switch k {
+	case LineBegin:
+		return "begin"
+	case LineEnd:
+		return "end"
+	case LineTrade:
+		return "trade"
+	default:
+		return "noise"
+	}
+}
+
+// ParseLine classifies a line of input.
+// The line may or may not include the trailing newline.
+// ParseLine never modifies the line and never panics.
+func ParseLine(line []byte) LineKind {
+	if len(line) == 0 {
+		return LineNoise
+	}
+	// Dispatch on the first byte, so that trades (the common case)
+	// take a single comparison, and markers are compared only
+	// when their length matches (with or without "\n" or "\r\n"):
+	switch line[0] {
+	case '{':
+		return LineTrade
+	case 'B':
+		if n := len(line); n >= len(BEGIN) && n <= len(BEGIN)+2 && bytes.Equal(trimNewline(line), BEGIN) {
+			return LineBegin
+		}
+	case 'E':
+		if n := len(line); n >= len(END) && n <= len(END)+2 && bytes.Equal(trimNewline(line), END) {
+			return LineEnd
+		}
+	}
+	return LineNoise
+}
+
+// DecodeTrade decodes a JSON-encoded trade.
+// It has no side effects: the line is not retained nor modified.
+func DecodeTrade(line []byte) (models.Trade, error) {
+	iter := json.BorrowIterator(line)
+	defer json.ReturnIterator(iter)
+	var trade models.Trade
+	err := decodeTrade(iter, line, &trade)
+	return trade, err
+}
+
+// decodeTrade decodes a JSON-encoded trade into trade (which is zeroed first)
+// with iter, as json.Unmarshal does: a worker decoding many lines reuses its
+// iterator and trades, instead of allocating them for each line.
+func decodeTrade(iter *jsoniter.Iterator, line []byte, trade *models.Trade) error {
+	*trade = models.Trade{}
+	iter.ResetBytes(line)
+	iter.Error = nil
+	iter.ReadVal(trade)
+	if iter.Error == nil {
+		// Nothing but spaces may follow the trade:
+		iter.WhatIsNext()
+		if iter.Error == nil {
+			iter.ReportError("Unmarshal", "there are bytes left after unmarshal")
+		}
+	}
+	if iter.Error != nil && iter.Error != io.EOF {
+		*trade = models.Trade{}
+		return fmt.Errorf("error while decoding trade: %s", iter.Error)
+	}
+	return nil
+}
+
+func trimNewline(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+	}
+	return line
+}
+
+// jsonDepth returns the nesting depth of the objects and arrays of a JSON
+// value, scanning it only until the depth exceeds max.
+func jsonDepth(data []byte, max int) int {
+	// Most records have few objects and arrays, so can't be too deep:
+	if n := bytes.Count(data, openObject) + bytes.Count(data, openArray); n <= max {
+		return n
+	}
+	depth, deepest := 0, 0
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inString {
+			switch c {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > deepest {
+				deepest = depth
+				if deepest > max {
+					return deepest
+				}
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+var (
+	openObject = []byte{'{'}
+	openArray  = []byte{'['}
+)
+
+// recordPrefix quotes the start of a record, for diagnostics.
+func recordPrefix(line []byte) string {
+	const n = 32
+	if len(line) > n {
+		return fmt.Sprintf("%q...", line[:n])
+	}
+	return fmt.Sprintf("%q", bytes.TrimSpace(line))
+}
@@ -0,0 +1,73 @@
+package feed
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchLines are the lines of the benchmarks: mostly trades, as in a feed.
+var benchLines = [][]byte{
+	[]byte("BEGIN\n"),
+	[]byte(`{"id":1,"market":2,"price":3.5,"volume":4,"is_buy":true,"timestamp":1640995200000}` + "\n"),
+	[]byte(`{"id":2,"market":7,"price":0.25,"volume":12.5,"is_buy":false,"timestamp":1640995200001}` + "\n"),
+	[]byte(`{"id":3,"market":2,"price":3.75,"volume":1,"is_buy":false,"timestamp":1640995200002}` + "\n"),
+	[]byte("noise\n"),
+	[]byte("END\n"),
+}
+
+func BenchmarkParseLine(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, line := range benchLines {
+			ParseLine(line)
+		}
+	}
+}
+
+func BenchmarkDecodeTrade(b *testing.B) {
+	line := benchLines[1]
+	b.ReportAllocs()
+	b.SetBytes(int64(len(line)))
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeTrade(line); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeTradeMarket(t *testing.T) {
+	tests := []struct {
+		market string
+		want   uint64
+		err    bool
+	}{
+		{market: "0", want: 0},
+		{market: "42", want: 42},
+		// Above 2^53, which a float64 can't represent exactly:
+		{market: "9007199254740993", want: 1<<53 + 1},
+		{market: "18446744073709551615", want: 1<<64 - 1},
+		{market: "18446744073709551616", err: true},
+		{market: "99999999999999999999", err: true},
+		{market: "-1", err: true},
+		{market: "-9223372036854775808", err: true},
+		{market: "1.5", err: true},
+		{market: `"7"`, err: true},
+	}
+	for _, test := range tests {
+		line := fmt.Sprintf(`{"id":1,"market":%s,"price":1,"volume":1,"is_buy":true}`, test.market)
+		trade, err := DecodeTrade([]byte(line))
+		if test.err {
+			if err == nil {
+				t.Errorf("market %s: expected an error, got market %v", test.market, trade.Market)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("market %s: %s", test.market, err)
+			continue
+		}
+		if trade.Market != test.want {
+			t.Errorf("market %s: got %v, expected %v", test.market, trade.Market, test.want)
+		}
+	}
+}
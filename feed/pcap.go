@@ -0,0 +1,422 @@
+package feed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PCAP link types.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+// maxPendingSegments bounds the out-of-order TCP segments kept in memory.
+const maxPendingSegments = 1024
+
+// PCAPStream selects the stream to extract from a capture.
+type PCAPStream struct {
+	Protocol string // "tcp" or "udp"
+	Host     net.IP // optional
+	Port     uint16
+}
+
+// ParsePCAPStream parses a stream selector in the form
+// proto:port or proto:host:port (e.g. tcp:9000, udp:233.54.12.111:26477,
+// tcp:[2001:db8::1]:9000, with IPv6 hosts in brackets).
+//
+// For TCP, the host and port are the ones of the sender of the data
+// (i.e. the server); for UDP they are the destination (e.g. a multicast group).
+func ParsePCAPStream(spec string) (*PCAPStream, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid stream %q: expected proto:[host:]port", spec)
+	}
+	stream := &PCAPStream{Protocol: parts[0]}
+	if stream.Protocol != "tcp" && stream.Protocol != "udp" {
+		return nil, fmt.Errorf("invalid stream %q: protocol must be tcp or udp", spec)
+	}
+	portStr := parts[1]
+	if strings.IndexByte(parts[1], ':') >= 0 {
+		host, port, err := net.SplitHostPort(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream %q: %s", spec, err)
+		}
+		stream.Host = net.ParseIP(host)
+		if stream.Host == nil {
+			return nil, fmt.Errorf("invalid stream %q: invalid host", spec)
+		}
+		portStr = port
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream %q: invalid port", spec)
+	}
+	stream.Port = uint16(port)
+	return stream, nil
+}
+
+// OpenPCAP opens a pcap file and returns the payload of the selected stream.
+// TCP streams are reassembled (only the first matching connection is used,
+// up to its FIN or RST); data missing from the capture (e.g. a segment that
+// was lost) fails the read. UDP payloads are concatenated in capture order.
+func OpenPCAP(path string, stream *PCAPStream) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening %s: %s", path, err)
+	}
+	reader := bufio.NewReader(file)
+	capture, err := newPCAPReader(reader)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error while reading %s: %s", path, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		err := extractStream(capture, stream, pw)
+		pw.CloseWithError(err)
+	}()
+	return &pcapReadCloser{PipeReader: pr, file: file}, nil
+}
+
+type pcapReadCloser struct {
+	*io.PipeReader
+	file *os.File
+}
+
+func (p *pcapReadCloser) Close() error {
+	p.PipeReader.Close()
+	return p.file.Close()
+}
+
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	linkType uint32
+	buf      []byte
+}
+
+func newPCAPReader(r io.Reader) (*pcapReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("invalid pcap header: %s", err)
+	}
+	pc := &pcapReader{r: r}
+	switch binary.LittleEndian.Uint32(header[0:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		pc.order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		pc.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a pcap file (pcapng is not supported)")
+	}
+	pc.linkType = pc.order.Uint32(header[20:24])
+	switch pc.linkType {
+	case linkTypeNull, linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL:
+	default:
+		return nil, fmt.Errorf("unsupported link type %v", pc.linkType)
+	}
+	return pc, nil
+}
+
+// next returns the next packet, stripped of the link layer header.
+func (pc *pcapReader) next() ([]byte, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(pc.r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(pc.order.Uint32(header[8:12]))
+	if cap(pc.buf) < size {
+		pc.buf = make([]byte, size)
+	}
+	packet := pc.buf[:size]
+	if _, err := io.ReadFull(pc.r, packet); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch pc.linkType {
+	case linkTypeNull:
+		if len(packet) < 4 {
+			return nil, nil
+		}
+		return packet[4:], nil
+	case linkTypeRaw:
+		return packet, nil
+	case linkTypeLinuxSLL:
+		if len(packet) < 16 {
+			return nil, nil
+		}
+		return packet[16:], nil
+	}
+	// Ethernet, possibly with VLAN tags:
+	if len(packet) < 14 {
+		return nil, nil
+	}
+	etherType := binary.BigEndian.Uint16(packet[12:14])
+	packet = packet[14:]
+	for etherType == 0x8100 || etherType == 0x88a8 {
+		if len(packet) < 4 {
+			return nil, nil
+		}
+		etherType = binary.BigEndian.Uint16(packet[2:4])
+		packet = packet[4:]
+	}
+	if etherType != 0x0800 && etherType != 0x86dd {
+		return nil, nil
+	}
+	return packet, nil
+}
+
+type segment struct {
+	src, dst         net.IP
+	srcPort, dstPort uint16
+	seq              uint32
+	syn, fin, rst    bool
+	payload          []byte
+}
+
+// parseIP parses an IPv4 or IPv6 packet carrying TCP or UDP.
+func parseIP(packet []byte) (proto uint8, seg segment, ok bool) {
+	if len(packet) < 1 {
+		return
+	}
+	var l4 []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if ihl < 20 || total < ihl || len(packet) < total {
+			return
+		}
+		// Fragments are not reassembled:
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+			return
+		}
+		proto = packet[9]
+		seg.src, seg.dst = net.IP(packet[12:16]), net.IP(packet[16:20])
+		l4 = packet[ihl:total]
+	case 6:
+		if len(packet) < 40 {
+			return
+		}
+		total := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if len(packet) < total {
+			return
+		}
+		proto = packet[6]
+		seg.src, seg.dst = net.IP(packet[8:24]), net.IP(packet[24:40])
+		l4 = packet[40:total]
+	default:
+		return
+	}
+	switch proto {
+	case ipProtoTCP:
+		if len(l4) < 20 {
+			return
+		}
+		offset := int(l4[12]>>4) * 4
+		if offset < 20 || len(l4) < offset {
+			return
+		}
+		seg.srcPort = binary.BigEndian.Uint16(l4[0:2])
+		seg.dstPort = binary.BigEndian.Uint16(l4[2:4])
+		seg.seq = binary.BigEndian.Uint32(l4[4:8])
+		seg.syn = l4[13]&0x02 != 0
+		seg.fin = l4[13]&0x01 != 0
+		seg.rst = l4[13]&0x04 != 0
+		seg.payload = l4[offset:]
+	case ipProtoUDP:
+		if len(l4) < 8 {
+			return
+		}
+		seg.srcPort = binary.BigEndian.Uint16(l4[0:2])
+		seg.dstPort = binary.BigEndian.Uint16(l4[2:4])
+		seg.payload = l4[8:]
+	default:
+		return
+	}
+	return proto, seg, true
+}
+
+func extractStream(capture *pcapReader, stream *PCAPStream, w io.Writer) error {
+	wantProto := uint8(ipProtoUDP)
+	if stream.Protocol == "tcp" {
+		wantProto = ipProtoTCP
+	}
+	var tcp *tcpStream
+	for {
+		packet, err := capture.next()
+		if err != nil {
+			if err == io.EOF {
+				return tcp.end()
+			}
+			return fmt.Errorf("error while reading capture: %s", err)
+		}
+		proto, seg, ok := parseIP(packet)
+		if !ok || proto != wantProto {
+			continue
+		}
+		if proto == ipProtoUDP {
+			if seg.dstPort != stream.Port || (stream.Host != nil && !stream.Host.Equal(seg.dst)) {
+				continue
+			}
+			if _, err := w.Write(seg.payload); err != nil {
+				return err
+			}
+			continue
+		}
+		if seg.srcPort != stream.Port || (stream.Host != nil && !stream.Host.Equal(seg.src)) {
+			continue
+		}
+		if tcp == nil {
+			tcp = newTCPStream(seg)
+		} else if !tcp.matches(seg) {
+			continue
+		}
+		if err := tcp.add(seg, w); err != nil {
+			return err
+		}
+		if tcp.closed {
+			return tcp.end()
+		}
+	}
+}
+
+// tcpStream reassembles one direction of a TCP connection.
+type tcpStream struct {
+	src, dst         string
+	srcPort, dstPort uint16
+	started          bool
+	next             uint32
+	pending          map[uint32][]byte
+	// fin is the seq of the FIN, if any (finSeen), which ends the stream
+	// once the data before it is written; the stream is closed then,
+	// or on a RST.
+	fin     uint32
+	finSeen bool
+	closed  bool
+}
+
+func newTCPStream(seg segment) *tcpStream {
+	return &tcpStream{
+		src:     string(seg.src),
+		dst:     string(seg.dst),
+		srcPort: seg.srcPort,
+		dstPort: seg.dstPort,
+		pending: map[uint32][]byte{},
+	}
+}
+
+func (s *tcpStream) matches(seg segment) bool {
+	return s.srcPort == seg.srcPort && s.dstPort == seg.dstPort &&
+		s.src == string(seg.src) && s.dst == string(seg.dst)
+}
+
+// end returns an error if data of the stream is missing from the capture
+// (a nil stream is complete).
+func (s *tcpStream) end() error {
+	if s == nil || len(s.pending) == 0 {
+		return nil
+	}
+	return fmt.Errorf("gap in the TCP stream: data at seq %v is missing from the capture (%v later segments were not delivered)", s.next, len(s.pending))
+}
+
+func (s *tcpStream) add(seg segment, w io.Writer) error {
+	if seg.rst {
+		s.closed = true
+		return nil
+	}
+	if seg.fin {
+		s.fin = seg.seq + uint32(len(seg.payload))
+		if seg.syn {
+			s.fin++
+		}
+		s.finSeen = true
+	}
+	defer func() {
+		if s.finSeen && s.started && int32(s.next-s.fin) >= 0 {
+			s.closed = true
+		}
+	}()
+	if seg.syn {
+		s.started = true
+		s.next = seg.seq + 1
+		return nil
+	}
+	if !s.started {
+		// Capture started mid-connection:
+		s.started = true
+		s.next = seg.seq
+	}
+	if len(seg.payload) == 0 {
+		return nil
+	}
+	delta := int32(seg.seq - s.next)
+	switch {
+	case delta > 0:
+		if len(s.pending) >= maxPendingSegments {
+			return fmt.Errorf("too many out-of-order TCP segments (missing data at seq %v)", s.next)
+		}
+		s.pending[seg.seq] = append([]byte(nil), seg.payload...)
+		return nil
+	case delta < 0:
+		// Retransmission, possibly partially overlapping:
+		if int(-delta) >= len(seg.payload) {
+			return nil
+		}
+		seg.payload = seg.payload[-delta:]
+	}
+	if err := s.write(seg.payload, w); err != nil {
+		return err
+	}
+	for len(s.pending) > 0 {
+		seq, payload, ok := s.nextPending()
+		if !ok {
+			break
+		}
+		delete(s.pending, seq)
+		overlap := int(s.next - seq)
+		if overlap >= len(payload) {
+			continue
+		}
+		if err := s.write(payload[overlap:], w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextPending returns a pending segment that starts at or before the next expected seq.
+func (s *tcpStream) nextPending() (uint32, []byte, bool) {
+	if payload, ok := s.pending[s.next]; ok {
+		return s.next, payload, true
+	}
+	for seq, payload := range s.pending {
+		if int32(seq-s.next) <= 0 {
+			return seq, payload, true
+		}
+	}
+	return 0, nil, false
+}
+
+func (s *tcpStream) write(payload []byte, w io.Writer) error {
+	s.next += uint32(len(payload))
+	_, err := w.Write(payload)
+	return err
+}
@@ -0,0 +1,201 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TCP flags of the fixture segments.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpACK = 0x10
+)
+
+// fixtureSegment is a TCP segment of a fixture capture, from the server
+// (10.0.0.1:9000) to the client (10.0.0.2:40000).
+type fixtureSegment struct {
+	seq     uint32
+	flags   byte
+	payload string
+}
+
+// writePCAPFixture writes a capture of the segments, in the given order,
+// as raw IPv4 packets.
+func writePCAPFixture(t *testing.T, segments []fixtureSegment) string {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], linkTypeRaw)
+	buf.Write(header)
+	for i, seg := range segments {
+		tcp := make([]byte, 20, 20+len(seg.payload))
+		binary.BigEndian.PutUint16(tcp[0:2], 9000)
+		binary.BigEndian.PutUint16(tcp[2:4], 40000)
+		binary.BigEndian.PutUint32(tcp[4:8], seg.seq)
+		tcp[12] = 5 << 4
+		tcp[13] = seg.flags
+		tcp = append(tcp, seg.payload...)
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+		ip[8] = 64
+		ip[9] = ipProtoTCP
+		copy(ip[12:16], net.IPv4(10, 0, 0, 1).To4())
+		copy(ip[16:20], net.IPv4(10, 0, 0, 2).To4())
+		ip = append(ip, tcp...)
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], uint32(1640995200+i))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(ip)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(ip)))
+		buf.Write(record)
+		buf.Write(ip)
+	}
+	path := filepath.Join(t.TempDir(), "fixture.pcap")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenPCAPReassembly(t *testing.T) {
+	const isn = 1000
+	tests := []struct {
+		name     string
+		segments []fixtureSegment
+		want     string
+		err      string
+	}{
+		{
+			name: "in order",
+			segments: []fixtureSegment{
+				{seq: isn, flags: tcpSYN},
+				{seq: isn + 1, flags: tcpACK, payload: "BEGIN\n"},
+				{seq: isn + 7, flags: tcpACK, payload: "END\n"},
+			},
+			want: "BEGIN\nEND\n",
+		},
+		{
+			name: "reordered and retransmitted",
+			segments: []fixtureSegment{
+				{seq: isn, flags: tcpSYN},
+				{seq: isn + 7, flags: tcpACK, payload: "{}\n"},
+				{seq: isn + 1, flags: tcpACK, payload: "BEGIN\n"},
+				{seq: isn + 1, flags: tcpACK, payload: "BEGIN\n"},
+				{seq: isn + 10, flags: tcpACK, payload: "END\n"},
+			},
+			want: "BEGIN\n{}\nEND\n",
+		},
+		{
+			name: "lost segment",
+			segments: []fixtureSegment{
+				{seq: isn, flags: tcpSYN},
+				{seq: isn + 1, flags: tcpACK, payload: "BEGIN\n"},
+				// {seq: isn + 7, payload: "{}\n"} is lost:
+				{seq: isn + 10, flags: tcpACK, payload: "END\n"},
+			},
+			want: "BEGIN\n",
+			err:  "data at seq 1007 is missing",
+		},
+		{
+			name: "FIN before the last segment",
+			segments: []fixtureSegment{
+				{seq: isn, flags: tcpSYN},
+				{seq: isn + 7, flags: tcpACK | tcpFIN, payload: "END\n"},
+				{seq: isn + 1, flags: tcpACK, payload: "BEGIN\n"},
+				// After the FIN, e.g. another connection on the same ports:
+				{seq: isn + 11, flags: tcpACK, payload: "noise\n"},
+			},
+			want: "BEGIN\nEND\n",
+		},
+		{
+			name: "RST",
+			segments: []fixtureSegment{
+				{seq: isn, flags: tcpSYN},
+				{seq: isn + 1, flags: tcpACK, payload: "BEGIN\n"},
+				{seq: isn + 7, flags: tcpRST},
+				{seq: isn + 7, flags: tcpACK, payload: "END\n"},
+			},
+			want: "BEGIN\n",
+		},
+		{
+			name: "RST with a gap",
+			segments: []fixtureSegment{
+				{seq: isn, flags: tcpSYN},
+				{seq: isn + 7, flags: tcpACK, payload: "END\n"},
+				{seq: isn + 11, flags: tcpRST},
+			},
+			err: "data at seq 1001 is missing",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writePCAPFixture(t, test.segments)
+			r, err := OpenPCAP(path, &PCAPStream{Protocol: "tcp", Port: 9000})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if string(got) != test.want {
+				t.Errorf("got %q, expected %q", got, test.want)
+			}
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("unexpected error: %s", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("got error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParsePCAPStream(t *testing.T) {
+	tests := []struct {
+		spec  string
+		proto string
+		host  string
+		port  uint16
+		err   bool
+	}{
+		{spec: "tcp:9000", proto: "tcp", port: 9000},
+		{spec: "udp:233.54.12.111:26477", proto: "udp", host: "233.54.12.111", port: 26477},
+		{spec: "tcp:[2001:db8::1]:9000", proto: "tcp", host: "2001:db8::1", port: 9000},
+		{spec: "tcp:2001:db8::1:9000", err: true},
+		{spec: "tcp:[2001:db8::1]", err: true},
+		{spec: "tcp:host.example:9000", err: true},
+		{spec: "sctp:9000", err: true},
+		{spec: "tcp:65536", err: true},
+		{spec: "9000", err: true},
+	}
+	for _, test := range tests {
+		stream, err := ParsePCAPStream(test.spec)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.spec, stream)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.spec, err)
+			continue
+		}
+		host := ""
+		if stream.Host != nil {
+			host = stream.Host.String()
+		}
+		if stream.Protocol != test.proto || host != test.host || stream.Port != test.port {
+			t.Errorf("%s: got %+v", test.spec, stream)
+		}
+	}
+}
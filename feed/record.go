@@ -0,0 +1,74 @@
+package feed
+
+import (
+	"fmt"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// RecordKind is the kind of a record of a stream that mixes trades with other data.
+type RecordKind int
+
+const (
+	RecordTrade RecordKind = iota
+	RecordQuote
+	RecordBook
+)
+
+// Record is a decoded record: only the field of its kind is set.
+type Record struct {
+	Kind  RecordKind
+	Trade models.Trade
+	Quote models.Quote
+	Book  models.BookUpdate
+}
+
+// record is the union of the fields of all the kinds of records.
+type record struct {
+	Type string `json:"type"`
+	models.Trade
+	Bid  float64 `json:"bid"`
+	Ask  float64 `json:"ask"`
+	Side string  `json:"side"`
+	Size float64 `json:"size"`
+}
+
+// DecodeRecord decodes a JSON-encoded record:
+// a quote if its "type" is "quote", a book update if it is "book",
+// a trade otherwise.
+// It has no side effects: the line is not retained nor modified.
+func DecodeRecord(line []byte) (Record, error) {
+	var rec record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return Record{}, fmt.Errorf("error while decoding record: %s", err)
+	}
+	switch rec.Type {
+	case "", "trade":
+		return Record{Kind: RecordTrade, Trade: rec.Trade}, nil
+	case "quote":
+		return Record{
+			Kind: RecordQuote,
+			Quote: models.Quote{
+				Market:    rec.Market,
+				Bid:       rec.Bid,
+				Ask:       rec.Ask,
+				Timestamp: rec.Timestamp,
+			},
+		}, nil
+	case "book":
+		if rec.Side != "bid" && rec.Side != "ask" {
+			return Record{}, fmt.Errorf("error while decoding record: invalid book side %q", rec.Side)
+		}
+		return Record{
+			Kind: RecordBook,
+			Book: models.BookUpdate{
+				Market:    rec.Market,
+				Side:      rec.Side,
+				Price:     rec.Price,
+				Size:      rec.Size,
+				Timestamp: rec.Timestamp,
+			},
+		}, nil
+	}
+	return Record{}, fmt.Errorf("error while decoding record: unknown type %q", rec.Type)
+}
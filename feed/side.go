@@ -0,0 +1,100 @@
+package feed
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// SideRule sets the aggressor side (IsBuy) of a trade decoded from a JSON
+// record, for feeds that indicate it otherwise than with is_buy;
+// an error is a ParseError of the record.
+type SideRule func(record []byte, trade *models.Trade) error
+
+// SideRuleIsBuy is the default rule: the is_buy field of the trade.
+const SideRuleIsBuy = "is_buy"
+
+var sideRules = map[string]SideRule{}
+
+// RegisterSideRule registers a new side rule.
+func RegisterSideRule(name string, rule SideRule) {
+	if _, ok := sideRules[name]; ok || name == SideRuleIsBuy {
+		panic(fmt.Sprintf("side rule %q already registered", name))
+	}
+	sideRules[name] = rule
+}
+
+// SideRules returns the names of the side rules, including the default one.
+func SideRules() []string {
+	out := []string{SideRuleIsBuy}
+	for name := range sideRules {
+		out = append(out, name)
+	}
+	sort.Strings(out[1:])
+	return out
+}
+
+// GetSideRule returns the side rule with the given name
+// (nil for the default one, which needs no classification).
+func GetSideRule(name string) (SideRule, error) {
+	if name == SideRuleIsBuy {
+		return nil, nil
+	}
+	rule, ok := sideRules[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown side rule %q (available: %v)", name, SideRules())
+	}
+	return rule, nil
+}
+
+// ClassifiedSource is a Source whose trades can be classified by a side rule.
+type ClassifiedSource interface {
+	Source
+	// SetSideRule sets the side rule of the trades;
+	// it must be called before Each.
+	SetSideRule(rule SideRule)
+}
+
+func init() {
+	// taker_side is "buy" or "sell" (or "b" or "s", in any case):
+	RegisterSideRule("taker_side", func(record []byte, trade *models.Trade) error {
+		side := json.Get(record, "taker_side").ToString()
+		switch strings.ToLower(side) {
+		case "buy", "b":
+			trade.IsBuy = true
+		case "sell", "s":
+			trade.IsBuy = false
+		default:
+			return fmt.Errorf("invalid taker_side %q: must be buy or sell", side)
+		}
+		return nil
+	})
+	// bidask is the side of the book that the trade hit: the ask for buys
+	// ("A" or "ask", in any case), the bid for sells ("B" or "bid"):
+	RegisterSideRule("bidask", func(record []byte, trade *models.Trade) error {
+		side := json.Get(record, "bidask").ToString()
+		switch strings.ToLower(side) {
+		case "ask", "a":
+			trade.IsBuy = true
+		case "bid", "b":
+			trade.IsBuy = false
+		default:
+			return fmt.Errorf("invalid bidask %q: must be A (ask) or B (bid)", side)
+		}
+		return nil
+	})
+	// The volume of sells is negative; it is made positive.
+	// Trades with zero volume keep their is_buy:
+	RegisterSideRule("volume_sign", func(record []byte, trade *models.Trade) error {
+		switch {
+		case trade.Volume > 0:
+			trade.IsBuy = true
+		case trade.Volume < 0:
+			trade.IsBuy = false
+			trade.Volume = -trade.Volume
+		}
+		return nil
+	})
+}
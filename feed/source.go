@@ -0,0 +1,369 @@
+package feed
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Source is a stream of trades.
+type Source interface {
+	// Each calls fn for every trade of the stream,
+	// until fn returns false or the stream ends.
+	Each(fn func(models.Trade) bool) error
+}
+
+// SourceFunc adapts a function to the Source interface.
+type SourceFunc func(fn func(models.Trade) bool) error
+
+func (f SourceFunc) Each(fn func(models.Trade) bool) error {
+	return f(fn)
+}
+
+// NewSourceFunc creates a Source for the given format,
+// reading from r; lines that are not trades are written to noise.
+type NewSourceFunc func(r io.Reader, noise io.Writer) Source
+
+var formats = map[string]NewSourceFunc{}
+
+// RegisterFormat registers a new input format.
+func RegisterFormat(name string, fn NewSourceFunc) {
+	if _, ok := formats[name]; ok {
+		panic(fmt.Sprintf("format %q already registered", name))
+	}
+	formats[name] = fn
+}
+
+// Formats returns the names of the registered formats.
+func Formats() []string {
+	out := make([]string, 0, len(formats))
+	for name := range formats {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// NewSource returns a Source for the given format.
+func NewSource(format string, r io.Reader, noise io.Writer) (Source, error) {
+	fn, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q (available: %v)", format, Formats())
+	}
+	return fn(r, noise), nil
+}
+
+func init() {
+	RegisterFormat("json", NewLineSource)
+}
+
+// QuoteSource is a Source that can also carry quotes, interleaved with trades.
+type QuoteSource interface {
+	Source
+	// OnQuote sets the function called for each quote of the stream;
+	// it must be called before Each.
+	OnQuote(fn func(models.Quote))
+}
+
+// BookSource is a Source that can also carry order book updates, interleaved with trades.
+type BookSource interface {
+	Source
+	// OnBook sets the function called for each book update of the stream;
+	// it must be called before Each.
+	OnBook(fn func(models.BookUpdate))
+}
+
+// ParallelSource is a Source that can decode its records with several
+// workers, while still delivering them in order.
+type ParallelSource interface {
+	Source
+	// SetParseWorkers sets the number of decoding workers;
+	// it must be called before Each.
+	SetParseWorkers(n int)
+}
+
+// LimitedSource is a Source that can bound the size of its records,
+// rejecting larger ones (as a ParseError) before they exhaust memory.
+type LimitedSource interface {
+	Source
+	// SetRecordLimits sets the maximum length of a record, in bytes,
+	// and the maximum nesting depth of its values (0 for no limit);
+	// it must be called before Each.
+	SetRecordLimits(maxLength int, maxDepth int)
+}
+
+// TolerantSource is a Source that can skip the records that fail to parse,
+// rather than ending with their ParseError.
+type TolerantSource interface {
+	Source
+	// OnParseError sets the function called with the error of each record
+	// that fails to parse: the record is skipped if it returns true;
+	// it must be called before Each.
+	OnParseError(fn func(err error) bool)
+}
+
+// NewLineSource returns a Source of newline-delimited JSON trades.
+// Reading stops at the END marker; non-trade lines are written to noise.
+func NewLineSource(r io.Reader, noise io.Writer) Source {
+	return NewDelimitedSource(r, noise, '\n')
+}
+
+// LineSource is a Source of delimited JSON records.
+type LineSource struct {
+	r       io.Reader
+	noise   io.Writer
+	delim   byte
+	onQuote func(models.Quote)
+	onBook  func(models.BookUpdate)
+	onError func(error) bool
+	workers int
+
+	maxLength int
+	maxDepth  int
+
+	sideRule SideRule
+}
+
+// NewDelimitedSource returns a Source of JSON trades separated by delim
+// (e.g. 0x1e for RFC 7464 json-seq, or NUL).
+// With delimiters other than newline, whitespace around records is ignored,
+// empty records are skipped, and the last record doesn't need to be terminated.
+func NewDelimitedSource(r io.Reader, noise io.Writer, delim byte) *LineSource {
+	return &LineSource{
+		r:     r,
+		noise: noise,
+		delim: delim,
+	}
+}
+
+// OnQuote enables quote records (see DecodeRecord);
+// otherwise every record is decoded as a trade.
+func (src *LineSource) OnQuote(fn func(models.Quote)) {
+	src.onQuote = fn
+}
+
+// OnBook enables book update records (see DecodeRecord);
+// otherwise every record is decoded as a trade.
+func (src *LineSource) OnBook(fn func(models.BookUpdate)) {
+	src.onBook = fn
+}
+
+// OnParseError skips the records that fail to parse while fn returns true
+// (records longer than the maximum length still end the input).
+func (src *LineSource) OnParseError(fn func(err error) bool) {
+	src.onError = fn
+}
+
+// SetParseWorkers decodes the records with n workers (if more than one),
+// while the input is read by another goroutine.
+func (src *LineSource) SetParseWorkers(n int) {
+	src.workers = n
+}
+
+// SetRecordLimits rejects the records longer than maxLength bytes
+// (without reading more of them), and those nested deeper than maxDepth.
+func (src *LineSource) SetRecordLimits(maxLength int, maxDepth int) {
+	src.maxLength = maxLength
+	src.maxDepth = maxDepth
+}
+
+// SetSideRule classifies the trades with the given rule (see SideRule).
+func (src *LineSource) SetSideRule(rule SideRule) {
+	src.sideRule = rule
+}
+
+func (src *LineSource) Each(fn func(models.Trade) bool) error {
+	if src.workers > 1 {
+		return src.eachParallel(fn)
+	}
+	return iterateLines(
+		newRecordReader(src.r, src.delim, src.maxLength),
+		func(line []byte) (bool, error) {
+			return src.deliver(src.decode(line), fn)
+		},
+	)
+}
+
+// lineRecord is a classified (and decoded) line.
+type lineRecord struct {
+	kind LineKind
+	// line is set for noise.
+	line []byte
+	rec  Record
+	err  error
+}
+
+// decode classifies and decodes a line; it has no side effects.
+func (src *LineSource) decode(line []byte) lineRecord {
+	iter := json.BorrowIterator(nil)
+	defer json.ReturnIterator(iter)
+	var lr lineRecord
+	src.decodeInto(iter, line, &lr)
+	return lr
+}
+
+// decodeInto is like decode, but decodes into lr with iter, so that they
+// can be reused (see parseBatch).
+func (src *LineSource) decodeInto(iter *jsoniter.Iterator, line []byte, lr *lineRecord) {
+	*lr = lineRecord{}
+	if src.delim != '\n' {
+		line = bytes.TrimSpace(bytes.TrimSuffix(line, []byte{src.delim}))
+		if len(line) == 0 {
+			// Skipped, like markers:
+			lr.kind = LineBegin
+			return
+		}
+	}
+	lr.kind = ParseLine(line)
+	switch lr.kind {
+	case LineBegin, LineEnd:
+		return
+	case LineNoise:
+		lr.line = line
+		return
+	}
+	if src.maxDepth > 0 && jsonDepth(line, src.maxDepth) > src.maxDepth {
+		lr.err = fmt.Errorf("record %s is nested deeper than the maximum depth of %v", recordPrefix(line), src.maxDepth)
+		return
+	}
+	if src.onQuote != nil || src.onBook != nil {
+		lr.rec, lr.err = DecodeRecord(line)
+	} else {
+		lr.err = decodeTrade(iter, line, &lr.rec.Trade)
+	}
+	if lr.err == nil && lr.rec.Kind == RecordTrade && src.sideRule != nil {
+		if lr.err = src.sideRule(line, &lr.rec.Trade); lr.err != nil {
+			lr.err = fmt.Errorf("error while classifying trade %s: %s", recordPrefix(line), lr.err)
+		}
+	}
+}
+
+// deliver delivers a decoded line, in order: it tells whether to continue.
+func (src *LineSource) deliver(lr lineRecord, fn func(models.Trade) bool) (bool, error) {
+	// Trades first, markers and noise are rare:
+	if lr.kind == LineTrade && lr.err == nil && lr.rec.Kind == RecordTrade {
+		return fn(lr.rec.Trade), nil
+	}
+	switch lr.kind {
+	case LineBegin:
+		return true, nil
+	case LineEnd:
+		return false, nil
+	case LineNoise:
+		fmt.Fprintf(
+			src.noise,
+			"%s",
+			lr.line,
+		)
+		if src.delim != '\n' {
+			fmt.Fprintln(src.noise)
+		}
+		return true, nil
+	}
+	if lr.err != nil {
+		err := &ParseError{Err: lr.err}
+		if src.onError != nil && src.onError(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	switch lr.rec.Kind {
+	case RecordQuote:
+		if src.onQuote != nil {
+			src.onQuote(lr.rec.Quote)
+		}
+		return true, nil
+	case RecordBook:
+		if src.onBook != nil {
+			src.onBook(lr.rec.Book)
+		}
+		return true, nil
+	}
+	return fn(lr.rec.Trade), nil
+}
+
+// iterateLines calls the iterator for each record, until it returns false;
+// the records are copied, so the iterator can retain them.
+func iterateLines(rr *recordReader, iterator func(b []byte) (bool, error)) error {
+	for {
+		line, err := rr.next()
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			// An unterminated last line is only complete
+			// when the delimiter is a separator:
+			if rr.delim != '\n' && len(line) > 0 {
+				_, err := iterator(append([]byte(nil), line...))
+				return err
+			}
+			return nil
+		}
+		doContinue, err := iterator(append([]byte(nil), line...))
+		if err != nil {
+			return err
+		}
+		if !doContinue {
+			return nil
+		}
+	}
+}
+
+// recordReader reads delimited records, of at most maxLength bytes
+// (without the delimiter) if positive.
+type recordReader struct {
+	r         *bufio.Reader
+	delim     byte
+	maxLength int
+	// long accumulates the records longer than the buffer of the reader:
+	long []byte
+	// num is the number of records read, and offset the offset of the next one.
+	num    int
+	offset int64
+}
+
+func newRecordReader(r io.Reader, delim byte, maxLength int) *recordReader {
+	return &recordReader{r: bufio.NewReader(r), delim: delim, maxLength: maxLength}
+}
+
+// next returns the next record, with its delimiter (except at the end
+// of the input, with io.EOF); it is only valid until the next call,
+// since it is not copied out of the reader's buffer.
+// A record longer than maxLength is a ParseError.
+func (rr *recordReader) next() ([]byte, error) {
+	rr.long = rr.long[:0]
+	for {
+		line, err := rr.r.ReadSlice(rr.delim)
+		if rr.maxLength > 0 {
+			length := len(rr.long) + len(line)
+			if err == nil {
+				length--
+			}
+			if length > rr.maxLength {
+				return nil, &ParseError{Err: fmt.Errorf(
+					"record %v (at byte %v) is longer than the maximum of %v bytes",
+					rr.num+1, rr.offset, rr.maxLength,
+				)}
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			rr.long = append(rr.long, line...)
+			continue
+		}
+		if len(rr.long) > 0 {
+			rr.long = append(rr.long, line...)
+			line = rr.long
+		}
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error of reader: %s", err)
+		}
+		rr.num++
+		rr.offset += int64(len(line))
+		return line, err
+	}
+}
@@ -0,0 +1,24 @@
+package feed
+
+import "unsafe"
+
+// safeStrings disables the zero-copy conversions (see bytesToString).
+var safeStrings bool
+
+// SetSafeStrings makes the decoders copy the bytes they convert to strings,
+// instead of sharing their memory; it must be called before reading.
+func SetSafeStrings(safe bool) {
+	safeStrings = safe
+}
+
+// bytesToString returns b as a string without copying it (unless safe strings
+// are enabled), to avoid an allocation per conversion in the decoders.
+// The string shares the memory of b: it must not be used after b is reused
+// or modified, so it must not be retained beyond the decoding of the record
+// (not even in the errors returned, which must format it instead).
+func bytesToString(b []byte) string {
+	if safeStrings {
+		return string(b)
+	}
+	return *(*string)(unsafe.Pointer(&b))
+}
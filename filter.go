@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gagliardetto/messari-challenge/expr"
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// tradeVars are the variables available in per-trade expressions.
+var tradeVars = []expr.Var{
+	{Name: "id", Type: expr.Number},
+	{Name: "market", Type: expr.Number},
+	{Name: "price", Type: expr.Number},
+	{Name: "volume", Type: expr.Number},
+	{Name: "is_buy", Type: expr.Bool},
+	{Name: "timestamp", Type: expr.Number},
+}
+
+// tradeValues fills values with the variables of the trade
+// (in the same order as tradeVars), and returns it.
+func tradeValues(trade models.Trade, values []float64) []float64 {
+	values = values[:0]
+	isBuy := 0.0
+	if trade.IsBuy {
+		isBuy = 1
+	}
+	return append(values,
+		float64(trade.ID),
+		float64(trade.Market),
+		trade.Price,
+		trade.Volume,
+		isBuy,
+		float64(trade.Timestamp),
+	)
+}
+
+// DerivedMetric is a user-defined metric, computed for each trade.
+type DerivedMetric struct {
+	Name    string
+	Program *expr.Program
+}
+
+// ParseDerivedMetric parses a derived metric defined as name=expression.
+func ParseDerivedMetric(def string) (*DerivedMetric, error) {
+	eq := strings.IndexByte(def, '=')
+	if eq <= 0 {
+		return nil, fmt.Errorf("invalid derived metric %q: expected name=expression", def)
+	}
+	return NewDerivedMetric(strings.TrimSpace(def[:eq]), def[eq+1:])
+}
+
+// NewDerivedMetric compiles a derived metric.
+func NewDerivedMetric(name string, src string) (*DerivedMetric, error) {
+	for _, v := range tradeVars {
+		if v.Name == name {
+			return nil, fmt.Errorf("invalid derived metric %q: the name is already a trade field", name)
+		}
+	}
+	program, err := expr.Compile(src, tradeVars)
+	if err != nil {
+		return nil, fmt.Errorf("invalid derived metric %q: %s", name, err)
+	}
+	if program.Type() != expr.Number {
+		return nil, fmt.Errorf("invalid derived metric %q: the expression must be a number", name)
+	}
+	return &DerivedMetric{
+		Name:    name,
+		Program: program,
+	}, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// outputOptions are the options of the encoding of the results.
+type outputOptions struct {
+	// floatPrecision is the number of decimal places of floats;
+	// if negative, floats are formatted with the shortest representation
+	// that round-trips.
+	floatPrecision int
+	// precision, if not nil, overrides floatPrecision for the prices
+	// (see precisionRules).
+	precision *precisionRules
+	// decimalStrings are the fields written as decimal strings with
+	// decimalScale decimal places (or those of the precision rules,
+	// for prices), e.g. "1234567.890000", for consumers that can't
+	// parse JSON numbers as decimals.
+	decimalStrings map[string]bool
+	decimalScale   int
+	// rename maps field names to the names used in the output.
+	rename map[string]string
+	// workers is the number of goroutines encoding large result sets.
+	workers int
+	// undefined is how undefined metrics (NaN or infinite, e.g. the VWAP
+	// of a market with zero volume) are written: see the undefinedX constants.
+	undefined string
+	// runID, if not empty, adds an idempotency key to each result
+	// (see idempotencyKey).
+	runID string
+	// upsert makes file outputs replace the results with the same key
+	// they already contain, instead of being truncated (see upsertFile).
+	upsert bool
+	// jsonSeq prefixes each record with a record separator,
+	// as in RFC 7464 json-seq (see -output-framing).
+	jsonSeq bool
+	// compression is the compression of the file outputs: auto (by the
+	// extension of their path), none, or the name of a codec (see feed.Codec).
+	compression string
+}
+
+const (
+	outputFramingNDJSON  = "ndjson"
+	outputFramingJSONSeq = "json-seq"
+	// recordSeparator starts the records of json-seq outputs.
+	recordSeparator = 0x1e
+)
+
+const (
+	undefinedNull = "null"
+	undefinedZero = "zero"
+	undefinedOmit = "omit"
+)
+
+// parseUndefined validates the policy for undefined metrics.
+func parseUndefined(policy string) (string, error) {
+	switch policy {
+	case undefinedNull, undefinedZero, undefinedOmit:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid undefined metrics policy %q: must be null, zero, or omit", policy)
+	}
+}
+
+// format returns the result as it is to be encoded.
+// It never contains NaN or infinities, which are not valid JSON.
+func (opts outputOptions) format(res M) M {
+	formatted := make(M, len(res)+1)
+	if opts.runID != "" {
+		if _, ok := res["market"]; ok {
+			formatted[opts.fieldName(keyField)] = idempotencyKey(opts.runID, res)
+		}
+	}
+	for key, value := range res {
+		if f, ok := value.(float64); ok {
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				switch opts.undefined {
+				case undefinedOmit:
+					continue
+				case undefinedZero:
+					f = 0
+					value = f
+				default:
+					value = nil
+				}
+			}
+			if value != nil {
+				if opts.decimalStrings[key] {
+					decimals, ok := opts.priceDecimals(key, res, f)
+					if !ok {
+						decimals = opts.decimalScale
+					}
+					value = fixedString(f, decimals)
+				} else if decimals, ok := opts.priceDecimals(key, res, f); ok {
+					value = formatFixed(f, decimals)
+				} else if opts.floatPrecision >= 0 {
+					value = formatFixed(f, opts.floatPrecision)
+				}
+			}
+		}
+		formatted[opts.fieldName(key)] = value
+	}
+	return formatted
+}
+
+// fieldName returns the name of the field in the output.
+func (opts outputOptions) fieldName(field string) string {
+	if name, ok := opts.rename[field]; ok {
+		return name
+	}
+	return field
+}
+
+// parseRenames parses field renames, as field=name,
+// and adds them to the given ones (overriding them).
+func parseRenames(renames map[string]string, specs []string) (map[string]string, error) {
+	merged := map[string]string{}
+	for field, name := range renames {
+		merged[field] = name
+	}
+	for _, spec := range specs {
+		eq := strings.IndexByte(spec, '=')
+		if eq <= 0 || eq == len(spec)-1 {
+			return nil, fmt.Errorf("invalid rename %q: expected field=name", spec)
+		}
+		merged[spec[:eq]] = spec[eq+1:]
+	}
+	// Two fields can't end up with the same name:
+	fields := map[string]string{}
+	for field, name := range merged {
+		if other, ok := fields[name]; ok {
+			return nil, fmt.Errorf("fields %q and %q are both renamed to %q", other, field, name)
+		}
+		fields[name] = field
+	}
+	return merged, nil
+}
+
+// priceDecimals returns the number of decimal places of a field of a result,
+// if it is a price to which a precision rule applies.
+func (opts outputOptions) priceDecimals(field string, res M, f float64) (int, bool) {
+	if opts.precision == nil || !priceFields[field] {
+		return 0, false
+	}
+	return opts.precision.decimals(res, f)
+}
+
+// formatFixed formats the (finite) float with a fixed number of decimal places.
+// strconv's algorithm is exact (correctly rounded), and doesn't depend
+// on the platform, so the same float is always formatted the same way.
+func formatFixed(f float64, decimals int) interface{} {
+	return jsoniter.Number(fixedString(f, decimals))
+}
+
+// fixedString formats the float as formatFixed, as a string.
+func fixedString(f float64, decimals int) string {
+	s := strconv.FormatFloat(f, 'f', decimals, 64)
+	// Don't distinguish negative zero (or negative values rounded to zero):
+	if strings.Trim(s, "-0.") == "" {
+		s = strings.TrimPrefix(s, "-")
+	}
+	return s
+}
+
+// parseDecimalStrings parses the fields written as decimal strings,
+// as a comma-separated list.
+func parseDecimalStrings(list string, scale int) (map[string]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	if scale < 0 {
+		return nil, fmt.Errorf("invalid -decimal-scale %v", scale)
+	}
+	fields := map[string]bool{}
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" || field == "market" {
+			return nil, fmt.Errorf("invalid decimal string field %q", field)
+		}
+		fields[field] = true
+	}
+	return fields, nil
+}
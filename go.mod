@@ -7,6 +7,10 @@ require (
 	github.com/gagliardetto/utilz v0.1.3
 	github.com/hako/durafmt v0.0.0-20200710122514-c0fb7b4da026
 	github.com/json-iterator/go v1.1.12
+	github.com/klauspost/compress v1.15.15
+	github.com/pierrec/lz4/v4 v4.1.17
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -20,9 +24,7 @@ require (
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/ryanuber/go-glob v1.0.0 // indirect
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad // indirect
-	golang.org/x/net v0.0.0-20190923162816-aa69164e4478 // indirect
 	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a // indirect
 	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
 	golang.org/x/term v0.0.0-20201117132131-f5c789dd3221 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The Grafana endpoints of the service implement the conventions of the
+// simple JSON datasource, over the current results of the sessions:
+//
+//	GET  /             test the connection
+//	POST /search       list the targets: session and session:field
+//	POST /query        query the targets, as time series or tables
+//	POST /annotations  (no annotations)
+//
+// A time series target, session:field, has a series for each market,
+// with the current value of the field as its only point.
+// A table target, session (or session:field), has a row for each market,
+// with all the numeric fields (or only that field).
+
+// grafanaQuery is the body of a /query request.
+type grafanaQuery struct {
+	Targets []struct {
+		Target string `json:"target"`
+		Type   string `json:"type"`
+	} `json:"targets"`
+}
+
+// numericFields returns the numeric fields of the result,
+// with undefined values (NaN or infinite) as nil.
+func numericFields(res M) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for name, v := range res {
+		var f float64
+		switch v := v.(type) {
+		case float64:
+			f = v
+		case int:
+			f = float64(v)
+		case uint64:
+			if name == "market" {
+				continue
+			}
+			f = float64(v)
+		default:
+			continue
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			fields[name] = nil
+			continue
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func (svc *service) grafanaSearch(w http.ResponseWriter, r *http.Request) error {
+	svc.mu.RLock()
+	sessions := make([]*session, 0, len(svc.sessions))
+	for _, sess := range svc.sessions {
+		sessions = append(sessions, sess)
+	}
+	svc.mu.RUnlock()
+
+	var targets []string
+	for _, sess := range sessions {
+		targets = append(targets, sess.name)
+		names := map[string]bool{}
+		for _, res := range sess.p.collect(time.Time{}, time.Time{}, false) {
+			for name := range numericFields(res) {
+				names[name] = true
+			}
+		}
+		for name := range names {
+			targets = append(targets, sess.name+":"+name)
+		}
+	}
+	sort.Strings(targets)
+	return writeJSON(w, http.StatusOK, targets)
+}
+
+func (svc *service) grafanaQuery(w http.ResponseWriter, r *http.Request) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var query grafanaQuery
+	if err := json.Unmarshal(body, &query); err != nil {
+		return errorf(http.StatusBadRequest, "error while parsing query: %s", err)
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	responses := []interface{}{}
+	for _, target := range query.Targets {
+		name, field := target.Target, ""
+		if colon := strings.IndexByte(name, ':'); colon >= 0 {
+			name, field = name[:colon], name[colon+1:]
+		}
+		sess, err := svc.get(name)
+		if err != nil {
+			return err
+		}
+		results := sess.p.collect(time.Time{}, time.Time{}, false)
+		if target.Type == "table" {
+			responses = append(responses, grafanaTable(results, field))
+			continue
+		}
+		if field == "" {
+			return errorf(http.StatusBadRequest, "time series target %q has no field: expected session:field", target.Target)
+		}
+		for _, res := range results {
+			value, ok := numericFields(res)[field]
+			if !ok {
+				continue
+			}
+			responses = append(responses, M{
+				"target":     target.Target + fmt.Sprintf("{market=%v}", res["market"]),
+				"datapoints": [][]interface{}{{value, now}},
+			})
+		}
+	}
+	return writeJSON(w, http.StatusOK, responses)
+}
+
+// grafanaTable returns a table with a row for each market, and a column
+// for the field (or for each numeric field, if empty).
+func grafanaTable(results []M, field string) M {
+	var names []string
+	if field != "" {
+		names = []string{field}
+	} else {
+		seen := map[string]bool{}
+		for _, res := range results {
+			for name := range numericFields(res) {
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+		sort.Strings(names)
+	}
+	columns := []M{{"text": "market", "type": "number"}}
+	for _, name := range names {
+		columns = append(columns, M{"text": name, "type": "number"})
+	}
+	rows := [][]interface{}{}
+	for _, res := range results {
+		fields := numericFields(res)
+		row := []interface{}{res["market"]}
+		for _, name := range names {
+			row = append(row, fields[name])
+		}
+		rows = append(rows, row)
+	}
+	return M{"type": "table", "columns": columns, "rows": rows}
+}
+
+// writeJSON writes v as a JSON document.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(data)
+	return err
+}
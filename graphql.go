@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/graphql"
+)
+
+// The /graphql endpoint of the service answers GraphQL queries over
+// the current results of the sessions, with the schema:
+//
+//	type Query {
+//	  sessions: [Session!]!
+//	  session(name: String!): Session
+//	}
+//	type Session {
+//	  name: String!
+//	  created: String!
+//	  trades: Int!
+//	  finalized: Boolean!
+//	  numFiltered: Int!
+//	  # filter is an expression over the fields of the results (as -having),
+//	  # and markets are ordered by market, or by the orderBy field.
+//	  markets(filter: String, orderBy: String, desc: Boolean, limit: Int, offset: Int): [Market!]!
+//	  market(id: ID!): Market
+//	}
+//	type Market {
+//	  market: ID!
+//	  source: String
+//	  pipeline: String
+//	  windowStart: String
+//	  windowEnd: String
+//	  metric(name: String!): Float
+//	  metrics: [Metric!]!
+//	  # Any field of the results, e.g. vwap, total_volume, mean_notional:
+//	  <field>: Float
+//	}
+//	type Metric {
+//	  name: String!
+//	  value: Float
+//	}
+//
+// Introspection is not supported, besides __typename.
+
+// graphqlRequest is the body of a POST /graphql request.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// object is a JSON object whose fields are encoded in order,
+// since GraphQL responses follow the order of the selections.
+type object []objectField
+
+type objectField struct {
+	name  string
+	value interface{}
+}
+
+func (obj object) MarshalJSON() ([]byte, error) {
+	buf := []byte{'{'}
+	for i, field := range obj {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendQuote(buf, field.name)
+		buf = append(buf, ':')
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, value...)
+	}
+	return append(buf, '}'), nil
+}
+
+func (svc *service) graphql(w http.ResponseWriter, r *http.Request) error {
+	var req graphqlRequest
+	if r.Method == http.MethodGet {
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				return errorf(http.StatusBadRequest, "error while parsing variables: %s", err)
+			}
+		}
+	} else {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return errorf(http.StatusBadRequest, "error while parsing request: %s", err)
+		}
+	}
+	doc, err := graphql.Parse(req.Query)
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, graphqlErrors(err))
+	}
+	op, err := doc.Operation(req.OperationName)
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, graphqlErrors(err))
+	}
+	ex := &executor{svc: svc, op: op, variables: req.Variables}
+	data, err := ex.selectFields(op.Selections, "Query", ex.resolveQuery)
+	if err != nil {
+		return writeJSON(w, http.StatusOK, graphqlErrors(err))
+	}
+	return writeJSON(w, http.StatusOK, M{"data": data})
+}
+
+func graphqlErrors(err error) M {
+	return M{"errors": []M{{"message": err.Error()}}, "data": nil}
+}
+
+// executor executes a query operation.
+type executor struct {
+	svc       *service
+	op        *graphql.Operation
+	variables map[string]interface{}
+}
+
+// selectFields resolves the selected fields of an object of the given type.
+func (ex *executor) selectFields(selections []*graphql.Field, typename string, resolve func(*graphql.Field, map[string]interface{}) (interface{}, error)) (object, error) {
+	obj := make(object, 0, len(selections))
+	for _, field := range selections {
+		var value interface{}
+		if field.Name == "__typename" {
+			value = typename
+		} else {
+			args, err := field.ResolveArguments(ex.op, ex.variables)
+			if err != nil {
+				return nil, err
+			}
+			if value, err = resolve(field, args); err != nil {
+				return nil, err
+			}
+		}
+		obj = append(obj, objectField{name: field.ResponseName(), value: value})
+	}
+	return obj, nil
+}
+
+func (ex *executor) resolveQuery(field *graphql.Field, args map[string]interface{}) (interface{}, error) {
+	switch field.Name {
+	case "sessions":
+		ex.svc.mu.RLock()
+		sessions := make([]*session, 0, len(ex.svc.sessions))
+		for _, sess := range ex.svc.sessions {
+			sessions = append(sessions, sess)
+		}
+		ex.svc.mu.RUnlock()
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].name < sessions[j].name
+		})
+		list := make([]interface{}, len(sessions))
+		for i, sess := range sessions {
+			obj, err := ex.selectSession(field, sess)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = obj
+		}
+		return list, nil
+	case "session":
+		name, ok := args["name"].(string)
+		if !ok {
+			return nil, fmt.Errorf("session requires a name")
+		}
+		ex.svc.mu.RLock()
+		sess, ok := ex.svc.sessions[name]
+		ex.svc.mu.RUnlock()
+		if !ok {
+			return nil, nil
+		}
+		return ex.selectSession(field, sess)
+	}
+	return nil, fmt.Errorf("no field %q on Query", field.Name)
+}
+
+func (ex *executor) selectSession(field *graphql.Field, sess *session) (object, error) {
+	if field.Selections == nil {
+		return nil, fmt.Errorf("field %q of type Session requires a selection", field.Name)
+	}
+	info := sess.info()
+	// The results are collected once, for all the fields selecting them:
+	var results []M
+	collect := func() []M {
+		if results == nil {
+			results = sess.p.collect(time.Time{}, time.Time{}, false)
+		}
+		return results
+	}
+	return ex.selectFields(field.Selections, "Session", func(field *graphql.Field, args map[string]interface{}) (interface{}, error) {
+		switch field.Name {
+		case "name", "created", "trades", "finalized":
+			return info[field.Name], nil
+		case "numFiltered":
+			return info["num_filtered"], nil
+		case "market":
+			id, err := marketID(args["id"])
+			if err != nil {
+				return nil, err
+			}
+			for _, res := range collect() {
+				if res["market"] == id {
+					return ex.selectMarket(field, res)
+				}
+			}
+			return nil, nil
+		case "markets":
+			selected, err := selectMarkets(collect(), sess.p.opts.Derived, args)
+			if err != nil {
+				return nil, err
+			}
+			list := make([]interface{}, len(selected))
+			for i, res := range selected {
+				if list[i], err = ex.selectMarket(field, res); err != nil {
+					return nil, err
+				}
+			}
+			return list, nil
+		}
+		return nil, fmt.Errorf("no field %q on Session", field.Name)
+	})
+}
+
+// marketID parses a market ID argument, given as a string or a number.
+func marketID(v interface{}) (uint64, error) {
+	switch v := v.(type) {
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	case float64:
+		if v >= 0 && v == math.Trunc(v) {
+			return uint64(v), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid market ID %v", v)
+}
+
+// selectMarkets filters, orders, and paginates the results.
+func selectMarkets(results []M, derived []*DerivedMetric, args map[string]interface{}) ([]M, error) {
+	selected := results
+	if filter, ok := args["filter"].(string); ok && filter != "" {
+		having, err := CompileHaving(filter, derived)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %s", err)
+		}
+		selected = nil
+		for _, res := range results {
+			if having.Match(res, -1) {
+				selected = append(selected, res)
+			}
+		}
+	}
+	if orderBy, ok := args["orderBy"].(string); ok && orderBy != "" && orderBy != "market" {
+		desc, _ := args["desc"].(bool)
+		sorted := append([]M(nil), selected...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			a, b := numericValue(sorted[i][orderBy]), numericValue(sorted[j][orderBy])
+			// Missing and undefined values are last:
+			if math.IsNaN(a) || math.IsNaN(b) {
+				return !math.IsNaN(a) && math.IsNaN(b)
+			}
+			if desc {
+				return a > b
+			}
+			return a < b
+		})
+		selected = sorted
+	} else if desc, _ := args["desc"].(bool); desc {
+		reversed := make([]M, len(selected))
+		for i, res := range selected {
+			reversed[len(selected)-1-i] = res
+		}
+		selected = reversed
+	}
+	if offset, ok := args["offset"].(float64); ok && offset > 0 {
+		if int(offset) >= len(selected) {
+			return nil, nil
+		}
+		selected = selected[int(offset):]
+	}
+	if limit, ok := args["limit"].(float64); ok && limit >= 0 && int(limit) < len(selected) {
+		selected = selected[:int(limit)]
+	}
+	return selected, nil
+}
+
+// numericValue returns the value of a numeric field, or NaN.
+func numericValue(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return math.NaN()
+}
+
+func (ex *executor) selectMarket(field *graphql.Field, res M) (object, error) {
+	if field.Selections == nil {
+		return nil, fmt.Errorf("field %q of type Market requires a selection", field.Name)
+	}
+	return ex.selectFields(field.Selections, "Market", func(field *graphql.Field, args map[string]interface{}) (interface{}, error) {
+		switch field.Name {
+		case "market":
+			return fmt.Sprint(res["market"]), nil
+		case "source", "pipeline":
+			return res[field.Name], nil
+		case "windowStart":
+			return res["window_start"], nil
+		case "windowEnd":
+			return res["window_end"], nil
+		case "metric":
+			name, _ := args["name"].(string)
+			return graphqlFloat(res[name]), nil
+		case "metrics":
+			if field.Selections == nil {
+				return nil, fmt.Errorf("field %q of type [Metric!]! requires a selection", field.Name)
+			}
+			fields := numericFields(res)
+			names := make([]string, 0, len(fields))
+			for name := range fields {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			list := make([]interface{}, len(names))
+			for i, name := range names {
+				metric, err := ex.selectFields(field.Selections, "Metric", func(field *graphql.Field, args map[string]interface{}) (interface{}, error) {
+					switch field.Name {
+					case "name":
+						return name, nil
+					case "value":
+						return fields[name], nil
+					}
+					return nil, fmt.Errorf("no field %q on Metric", field.Name)
+				})
+				if err != nil {
+					return nil, err
+				}
+				list[i] = metric
+			}
+			return list, nil
+		}
+		if strings.HasPrefix(field.Name, "__") {
+			return nil, fmt.Errorf("introspection is not supported")
+		}
+		return graphqlFloat(res[field.Name]), nil
+	})
+}
+
+// graphqlFloat returns a numeric value as a Float, or null
+// if it is missing or undefined.
+func graphqlFloat(v interface{}) interface{} {
+	f := numericValue(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
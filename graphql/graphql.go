@@ -0,0 +1,139 @@
+// Package graphql parses GraphQL queries, e.g.
+//
+//	query Top($limit: Int = 10) {
+//	  session(name: "job1") {
+//	    markets(orderBy: "total_volume", desc: true, limit: $limit) { market vwap }
+//	  }
+//	}
+//
+// It supports the subset needed to serve read-only queries: query operations
+// (possibly named, with variables), fields with aliases and arguments,
+// and nested selections. Fragments, directives and mutations are not supported.
+package graphql
+
+import (
+	"fmt"
+)
+
+// Document is a parsed GraphQL document.
+type Document struct {
+	Operations []*Operation
+}
+
+// Operation is a query operation.
+type Operation struct {
+	Name       string
+	Variables  []*VariableDefinition
+	Selections []*Field
+}
+
+// VariableDefinition is a variable of an operation,
+// with its default value (if any).
+type VariableDefinition struct {
+	Name    string
+	Type    string
+	Default *Value
+}
+
+// Field is a field of a selection set.
+type Field struct {
+	// Alias is the name of the field in the response (its Name if empty).
+	Alias      string
+	Name       string
+	Arguments  []*Argument
+	Selections []*Field
+}
+
+// ResponseName returns the name of the field in the response.
+func (f *Field) ResponseName() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// Argument is an argument of a field.
+type Argument struct {
+	Name  string
+	Value *Value
+}
+
+// Value is a value of an argument: a literal, or a variable.
+type Value struct {
+	// Literal is a string, float64, bool, nil, []*Value, or map[string]*Value;
+	// enum values are strings.
+	Literal  interface{}
+	Variable string
+}
+
+// Operation returns the operation with the given name;
+// if name is empty, the document must have a single operation.
+func (doc *Document) Operation(name string) (*Operation, error) {
+	if name == "" {
+		if len(doc.Operations) != 1 {
+			return nil, fmt.Errorf("the document has %v operations: an operation name is required", len(doc.Operations))
+		}
+		return doc.Operations[0], nil
+	}
+	for _, op := range doc.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("no operation %q", name)
+}
+
+// ResolveArguments returns the arguments of the field, resolving the variables
+// (given as decoded JSON) with their values or defaults.
+func (f *Field) ResolveArguments(op *Operation, variables map[string]interface{}) (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(f.Arguments))
+	for _, arg := range f.Arguments {
+		v, err := arg.Value.resolve(op, variables)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q of %q: %s", arg.Name, f.Name, err)
+		}
+		args[arg.Name] = v
+	}
+	return args, nil
+}
+
+func (v *Value) resolve(op *Operation, variables map[string]interface{}) (interface{}, error) {
+	if v.Variable != "" {
+		if value, ok := variables[v.Variable]; ok {
+			return value, nil
+		}
+		for _, def := range op.Variables {
+			if def.Name != v.Variable {
+				continue
+			}
+			if def.Default == nil {
+				return nil, nil
+			}
+			return def.Default.resolve(op, variables)
+		}
+		return nil, fmt.Errorf("undefined variable $%s", v.Variable)
+	}
+	switch literal := v.Literal.(type) {
+	case []*Value:
+		list := make([]interface{}, len(literal))
+		for i, item := range literal {
+			resolved, err := item.resolve(op, variables)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = resolved
+		}
+		return list, nil
+	case map[string]*Value:
+		object := make(map[string]interface{}, len(literal))
+		for name, item := range literal {
+			resolved, err := item.resolve(op, variables)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = resolved
+		}
+		return object, nil
+	}
+	return v.Literal, nil
+}
@@ -0,0 +1,394 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of document"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// Parse parses a GraphQL document.
+func Parse(src string) (*Document, error) {
+	p := &parser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	doc := &Document{}
+	for p.tok.kind != tokEOF {
+		op, err := p.parseOperation()
+		if err != nil {
+			return nil, err
+		}
+		doc.Operations = append(doc.Operations, op)
+	}
+	if len(doc.Operations) == 0 {
+		return nil, fmt.Errorf("empty document")
+	}
+	return doc, nil
+}
+
+type parser struct {
+	src string
+	pos int
+	tok token
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s at position %v", fmt.Sprintf(format, a...), p.tok.pos)
+}
+
+// next reads the next token; whitespace, commas and comments are ignored.
+func (p *parser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return nil
+	}
+	c := p.src[p.pos]
+	switch {
+	case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+		p.pos++
+		p.tok = token{kind: tokPunct, text: string(c), pos: start}
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		return fmt.Errorf("fragments are not supported (position %v)", start)
+	case isNameStart(c):
+		for p.pos < len(p.src) && (isNameStart(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = token{kind: tokName, text: p.src[start:p.pos], pos: start}
+	case isDigit(c) || c == '-':
+		p.pos++
+		for p.pos < len(p.src) && (isDigit(p.src[p.pos]) || strings.IndexByte(".eE+-", p.src[p.pos]) >= 0) {
+			p.pos++
+		}
+		p.tok = token{kind: tokNumber, text: p.src[start:p.pos], pos: start}
+	case c == '"':
+		s, err := p.lexString()
+		if err != nil {
+			return err
+		}
+		p.tok = token{kind: tokString, text: s, pos: start}
+	default:
+		return fmt.Errorf("unexpected character %q at position %v", c, start)
+	}
+	return nil
+}
+
+// lexString reads a quoted string, and returns its value.
+func (p *parser) lexString() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+		case '"':
+			p.pos++
+			s, err := strconv.Unquote(p.src[start:p.pos])
+			if err != nil {
+				return "", fmt.Errorf("invalid string at position %v", start)
+			}
+			return s, nil
+		case '\n':
+			return "", fmt.Errorf("unterminated string at position %v", start)
+		default:
+			p.pos++
+		}
+	}
+	return "", fmt.Errorf("unterminated string at position %v", start)
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *parser) isPunct(s string) bool {
+	return p.tok.kind == tokPunct && p.tok.text == s
+}
+
+func (p *parser) expect(s string) error {
+	if !p.isPunct(s) {
+		return p.errorf("expected %q, got %s", s, p.tok)
+	}
+	return p.next()
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != tokName {
+		return "", p.errorf("expected a name, got %s", p.tok)
+	}
+	name := p.tok.text
+	return name, p.next()
+}
+
+func (p *parser) parseOperation() (*Operation, error) {
+	op := &Operation{}
+	if p.tok.kind == tokName {
+		switch p.tok.text {
+		case "query":
+		case "mutation", "subscription":
+			return nil, p.errorf("%s operations are not supported", p.tok.text)
+		default:
+			return nil, p.errorf("unexpected %s", p.tok)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == tokName {
+			op.Name = p.tok.text
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		if p.isPunct("(") {
+			vars, err := p.parseVariableDefinitions()
+			if err != nil {
+				return nil, err
+			}
+			op.Variables = vars
+		}
+	}
+	selections, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.Selections = selections
+	return op, nil
+}
+
+func (p *parser) parseVariableDefinitions() ([]*VariableDefinition, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var defs []*VariableDefinition
+	for !p.isPunct(")") {
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		typ, err := p.parseType()
+		if err != nil {
+			return nil, err
+		}
+		def := &VariableDefinition{Name: name, Type: typ}
+		if p.isPunct("=") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if def.Default, err = p.parseValue(); err != nil {
+				return nil, err
+			}
+		}
+		defs = append(defs, def)
+	}
+	return defs, p.next()
+}
+
+// parseType parses a type reference, e.g. [Int!]!, and returns it as written.
+func (p *parser) parseType() (string, error) {
+	var typ string
+	if p.isPunct("[") {
+		if err := p.next(); err != nil {
+			return "", err
+		}
+		inner, err := p.parseType()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typ = name
+	}
+	if p.isPunct("!") {
+		typ += "!"
+		return typ, p.next()
+	}
+	return typ, nil
+}
+
+func (p *parser) parseSelectionSet() ([]*Field, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []*Field
+	for !p.isPunct("}") {
+		field, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return fields, p.next()
+}
+
+func (p *parser) parseField() (*Field, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	field := &Field{Name: name}
+	if p.isPunct(":") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		field.Alias = name
+		if field.Name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.isPunct(")") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			field.Arguments = append(field.Arguments, &Argument{Name: name, Value: value})
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("@") {
+		return nil, p.errorf("directives are not supported")
+	}
+	if p.isPunct("{") {
+		if field.Selections, err = p.parseSelectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return field, nil
+}
+
+func (p *parser) parseValue() (*Value, error) {
+	tok := p.tok
+	switch {
+	case p.isPunct("$"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return &Value{Variable: name}, nil
+	case p.isPunct("["):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		var list []*Value
+		for !p.isPunct("]") {
+			item, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return &Value{Literal: list}, p.next()
+	case p.isPunct("{"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		object := map[string]*Value{}
+		for !p.isPunct("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.parseValue(); err != nil {
+				return nil, err
+			}
+		}
+		return &Value{Literal: object}, p.next()
+	case tok.kind == tokNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", tok.text)
+		}
+		return &Value{Literal: f}, p.next()
+	case tok.kind == tokString:
+		return &Value{Literal: tok.text}, p.next()
+	case tok.kind == tokName:
+		var literal interface{}
+		switch tok.text {
+		case "true":
+			literal = true
+		case "false":
+			literal = false
+		case "null":
+			literal = nil
+		default:
+			// Enum value:
+			literal = tok.text
+		}
+		return &Value{Literal: literal}, p.next()
+	}
+	return nil, p.errorf("expected a value, got %s", tok)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/expr"
+)
+
+// resultFields are the numeric fields of the results that can be used
+// in -having expressions (besides the derived metrics).
+var resultFields = []string{
+	"market",
+	"total_volume",
+	"mean_volume",
+	"mean_price",
+	"percentage_buy",
+	"vwap",
+	"num_trades",
+	"num_buy",
+	"num_sell",
+	"net_flow",
+	"trimmed_mean_price",
+	"open",
+	"high",
+	"low",
+	"close",
+	"peak_tps",
+	"mean_tps",
+	"busiest_second",
+	"active_span",
+	"mean_spread",
+	"mean_effective_spread",
+	"num_book_updates",
+	"mean_book_imbalance",
+	"last_book_imbalance",
+	"num_shed",
+}
+
+// Having selects the results to emit.
+type Having struct {
+	Program *expr.Program
+	// fields are the result fields of the variables, in order.
+	fields []string
+}
+
+// CompileHaving compiles an expression over the fields of the results of
+// a market (see resultFields), and the derived metrics.
+func CompileHaving(src string, derived []*DerivedMetric) (*Having, error) {
+	fields := append([]string(nil), resultFields...)
+	for _, d := range derived {
+		fields = append(fields, "total_"+d.Name, "mean_"+d.Name)
+	}
+	program, err := expr.CompileBool(src, expr.Numbers(fields...))
+	if err != nil {
+		return nil, err
+	}
+	return &Having{Program: program, fields: fields}, nil
+}
+
+// Match tells whether the result of the market is selected.
+// Fields missing from the result (e.g. metrics that are not enabled,
+// or undefined) are NaN, so that comparisons with them are false;
+// num_trades is always available, from numTrades (unless negative).
+func (h *Having) Match(res M, numTrades int) bool {
+	return h.Program.EvalBool(resultValues(res, h.fields, numTrades, nil))
+}
+
+// resultValues returns the values of the fields of a result, as the
+// variables of an expression (see Having.Match), reusing values if it has
+// room for them.
+func resultValues(res M, fields []string, numTrades int, values []float64) []float64 {
+	if cap(values) < len(fields) {
+		values = make([]float64, len(fields))
+	}
+	values = values[:len(fields)]
+	for i, field := range fields {
+		values[i] = math.NaN()
+		switch v := res[field].(type) {
+		case float64:
+			values[i] = v
+		case int:
+			values[i] = float64(v)
+		case uint64:
+			values[i] = float64(v)
+		case time.Time:
+			values[i] = float64(v.Unix())
+		case nil:
+			if field == "num_trades" && numTrades >= 0 {
+				values[i] = float64(numTrades)
+			}
+		}
+	}
+	return values
+}
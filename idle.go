@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// idleFlush flushes the cold markets of a pipeline without windows during
+// the run: their results are emitted as final and their state is freed, so
+// that its memory is proportional to the active markets rather than to all
+// of them. Markets are cold when they have had no trades for idle, or since
+// the last session close, by the timestamps of the trades: the latest one
+// of the pipeline is the current time.
+type idleFlush struct {
+	idle time.Duration
+	// close is the time of day (UTC) of the session close, if hasClose.
+	close    time.Duration
+	hasClose bool
+
+	// mu is held to add the trades (shared) and to flush the markets,
+	// so that no trade is added to a market being flushed.
+	mu sync.RWMutex
+	// watermark is the latest timestamp of the trades, and next the one
+	// from which the markets are checked again (Unix milliseconds).
+	watermark int64
+	next      int64
+
+	numFlushed uint64
+}
+
+// newIdleFlush returns the idle flush of a pipeline,
+// or nil if it is not enabled.
+func newIdleFlush(conf PipelineConfig) (*idleFlush, error) {
+	if conf.IdleFlush == 0 && conf.SessionClose == "" {
+		return nil, nil
+	}
+	if conf.IdleFlush < 0 {
+		return nil, fmt.Errorf("invalid idle flush %s", conf.IdleFlush)
+	}
+	if conf.Window > 0 || conf.WarmStart != "" {
+		return nil, fmt.Errorf("idle markets can't be flushed with windows or a warm start")
+	}
+	f := &idleFlush{idle: conf.IdleFlush}
+	if conf.SessionClose != "" {
+		t, err := time.Parse("15:04", conf.SessionClose)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session close %q: must be HH:MM (UTC)", conf.SessionClose)
+		}
+		f.close = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		f.hasClose = true
+	}
+	return f, nil
+}
+
+// lastClose returns the time of the last session close at or before ts
+// (Unix milliseconds).
+func (f *idleFlush) lastClose(ts int64) int64 {
+	day := int64(24 * time.Hour / time.Millisecond)
+	closeMs := int64(f.close / time.Millisecond)
+	c := ts - ts%day + closeMs
+	if c > ts {
+		c -= day
+	}
+	return c
+}
+
+// cutoff returns the timestamp before which the last trade of a market
+// makes it cold, at the watermark.
+func (f *idleFlush) cutoff(watermark int64) int64 {
+	cutoff := int64(math.MinInt64)
+	if f.idle > 0 {
+		cutoff = watermark - int64(f.idle/time.Millisecond)
+	}
+	if f.hasClose {
+		if c := f.lastClose(watermark); c > cutoff {
+			cutoff = c
+		}
+	}
+	return cutoff
+}
+
+// nextCheck returns the timestamp from which the markets are checked again
+// after the watermark: a tenth of idle later (at least a second), or at the
+// next session close.
+func (f *idleFlush) nextCheck(watermark int64) int64 {
+	next := int64(math.MaxInt64)
+	if f.idle > 0 {
+		tick := f.idle / 10
+		if tick < time.Second {
+			tick = time.Second
+		}
+		next = watermark + int64(tick/time.Millisecond)
+	}
+	if f.hasClose {
+		if c := f.lastClose(watermark) + int64(24*time.Hour/time.Millisecond); c < next {
+			next = c
+		}
+	}
+	return next
+}
+
+// addIdle adds a trade to a pipeline with an idle flush,
+// flushing the cold markets when it is due.
+func (p *pipeline) addIdle(source string, trade models.Trade, values []float64) error {
+	f := p.idle
+	f.mu.RLock()
+	p.aggregator(source).Add(trade, values)
+	f.mu.RUnlock()
+
+	watermark := atomic.LoadInt64(&f.watermark)
+	for trade.Timestamp > watermark {
+		if atomic.CompareAndSwapInt64(&f.watermark, watermark, trade.Timestamp) {
+			watermark = trade.Timestamp
+			break
+		}
+		watermark = atomic.LoadInt64(&f.watermark)
+	}
+	next := atomic.LoadInt64(&f.next)
+	// Only one goroutine flushes, the others go on:
+	if watermark < next || !atomic.CompareAndSwapInt64(&f.next, next, math.MaxInt64) {
+		return nil
+	}
+	err := p.flushIdle(watermark)
+	atomic.StoreInt64(&f.next, f.nextCheck(watermark))
+	return err
+}
+
+// flushIdle emits the results of the markets that are cold at the watermark,
+// and removes them.
+func (p *pipeline) flushIdle(watermark int64) error {
+	f := p.idle
+	cutoff := f.cutoff(watermark)
+	for _, source := range p.sources {
+		f.mu.Lock()
+		results := p.ags[source].evict(func(mkt *Market) bool {
+			return mkt.lastTrade < cutoff
+		})
+		f.mu.Unlock()
+		if len(results) == 0 {
+			continue
+		}
+		atomic.AddUint64(&f.numFlushed, uint64(len(results)))
+		p.tag(results, source, time.Time{}, time.Time{})
+		for _, res := range results {
+			p.observe(res)
+		}
+		// Without outputs (see estimate), the results are dropped:
+		if p.out == nil {
+			continue
+		}
+		if err := p.out.write(results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gagliardetto/messari-challenge/feed"
+)
+
+// stringsFlag is a flag that can be repeated.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// avroFormat is the format of the Avro-encoded records,
+// decoded with a schema registry (see feed.SchemaRegistry).
+const avroFormat = "avro"
+
+type inputOptions struct {
+	format     string
+	framing    string
+	delimiter  byte
+	pcapStream string
+	// checksum enables the checksum of the bytes read from each input.
+	checksum bool
+	// parseWorkers is the number of goroutines decoding each input (if supported).
+	parseWorkers int
+	// rateLimit limits the ingestion rate of each input,
+	// and globalLimiter that of all of them (if not nil).
+	rateLimit     rateLimit
+	globalLimiter *limiter
+	records       recordLimits
+	// encoding is the text encoding of the json format (see feed.NewDecodingReader).
+	encoding  string
+	sideRules sideRules
+	// compression is the compression of the inputs: auto (by the extension
+	// of their path), none, or the name of a codec (see feed.Codec).
+	compression string
+	// maxErrorRate is the fraction of the records of each input that can
+	// fail to parse, and are skipped (see errorBudget).
+	maxErrorRate float64
+	// schemaRegistry is the URL of the schema registry of the avro format.
+	schemaRegistry string
+}
+
+// sideRules are the names of the side rules of the inputs (see feed.SideRule):
+// by location, or else the default one.
+type sideRules struct {
+	def     string
+	byInput map[string]string
+}
+
+// parseSideRules parses the -side-rule flags, each either a rule
+// or location=rule for one of the locations.
+func parseSideRules(flags []string, locations []string) (sideRules, error) {
+	rules := sideRules{def: feed.SideRuleIsBuy, byInput: map[string]string{}}
+	for _, flag := range flags {
+		location, name := "", flag
+		if eq := strings.LastIndexByte(flag, '='); eq >= 0 {
+			location, name = flag[:eq], flag[eq+1:]
+		}
+		if _, err := feed.GetSideRule(name); err != nil {
+			return rules, err
+		}
+		if location == "" {
+			rules.def = name
+			continue
+		}
+		known := false
+		for _, l := range locations {
+			known = known || l == location
+		}
+		if !known {
+			return rules, fmt.Errorf("invalid side rule %q: %s is not an input", flag, location)
+		}
+		rules.byInput[location] = name
+	}
+	return rules, nil
+}
+
+// name returns the name of the side rule of an input.
+func (rules sideRules) name(location string) string {
+	if name, ok := rules.byInput[location]; ok {
+		return name
+	}
+	return rules.def
+}
+
+// recordLimits bound the records of the inputs (0 for no limit),
+// see feed.LimitedSource.
+type recordLimits struct {
+	maxLength int
+	maxDepth  int
+}
+
+// sourceRun is an input being read.
+type sourceRun struct {
+	location string
+	source   feed.Source
+	closer   io.Closer
+	// input is nil for sources that are not byte streams (e.g. exchanges).
+	input *countingReader
+	// limiters limit the rate at which the input is read.
+	limiters limiters
+	// backfill is true for the historical input read before the others (see -backfill).
+	backfill bool
+	// parseErrors, if not nil, skips the records that fail to parse.
+	parseErrors *errorBudget
+	// latency, if not nil, is the ingest latency of the trades (see -track-latency).
+	latency *latencyHistogram
+	err     error
+}
+
+func openSource(location string, opts inputOptions) (*sourceRun, error) {
+	limits := newLimiters(newLimiter("the rate limit of the input", opts.rateLimit, 0), opts.globalLimiter)
+	if feed.IsExchange(location) {
+		src, err := feed.DialExchange(location)
+		if err != nil {
+			return nil, err
+		}
+		markets := src.Markets()
+		for i, symbol := range src.Symbols() {
+			fmt.Fprintf(os.Stderr, "market %v: %s\n", markets[i], symbol)
+		}
+		return &sourceRun{
+			location: location,
+			source:   src,
+			closer:   src,
+			limiters: limits,
+		}, nil
+	}
+	reader, err := openInput(location, opts.pcapStream)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = reader
+	if len(limits) > 0 {
+		r = &limitedReader{r: reader, limiters: limits, block: true}
+	}
+	input := newCountingReader(r, opts.checksum)
+	// Inputs are decompressed and transcoded after counting,
+	// so that checksums are of the input:
+	codec, err := inputCodec(location, opts)
+	if err != nil {
+		reader.Close()
+		return nil, withExitCode(exitUsage, err)
+	}
+	decompressed, err := feed.NewCodecReader(codec, input)
+	if err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("error while reading %s: %s", location, err)
+	}
+	text := decompressed
+	if opts.format == "json" && opts.framing == "" {
+		text, err = feed.NewDecodingReader(decompressed, opts.encoding)
+	} else if opts.encoding != feed.EncodingAuto {
+		err = fmt.Errorf("an encoding can only be set for the json format, without framing")
+	}
+	var source feed.Source
+	switch {
+	case err != nil:
+	case opts.framing != "":
+		source, err = feed.NewFramedSource(opts.format, opts.framing, decompressed)
+	case opts.delimiter != '\n':
+		if opts.format != "json" {
+			err = fmt.Errorf("a custom delimiter can only be used with the json format")
+			break
+		}
+		source = feed.NewDelimitedSource(text, os.Stderr, opts.delimiter)
+	default:
+		source, err = feed.NewSource(opts.format, text, os.Stderr)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, withExitCode(exitUsage, err)
+	}
+	if ls, ok := source.(feed.LimitedSource); ok {
+		ls.SetRecordLimits(opts.records.maxLength, opts.records.maxDepth)
+	}
+	var parseErrors *errorBudget
+	if opts.maxErrorRate > 0 {
+		ts, ok := source.(feed.TolerantSource)
+		if !ok {
+			reader.Close()
+			return nil, withExitCode(exitUsage, fmt.Errorf("-max-error-rate can only be used with the json format, without framing"))
+		}
+		parseErrors = newErrorBudget(location, opts.maxErrorRate, os.Stderr)
+		ts.OnParseError(parseErrors.skip)
+	}
+	if name := opts.sideRules.name(location); name != feed.SideRuleIsBuy {
+		cs, ok := source.(feed.ClassifiedSource)
+		if !ok {
+			reader.Close()
+			return nil, withExitCode(exitUsage, fmt.Errorf("side rule %q of %s can only be used with the json format", name, location))
+		}
+		rule, _ := feed.GetSideRule(name)
+		cs.SetSideRule(rule)
+	}
+	if ps, ok := source.(feed.ParallelSource); ok && opts.parseWorkers > 1 {
+		ps.SetParseWorkers(opts.parseWorkers)
+	}
+	return &sourceRun{
+		location:    location,
+		source:      source,
+		closer:      reader,
+		input:       input,
+		limiters:    limits,
+		parseErrors: parseErrors,
+	}, nil
+}
+
+// inputCodec returns the codec of an input (nil if it is not compressed);
+// packet captures are only compressed explicitly.
+func inputCodec(location string, opts inputOptions) (*feed.Codec, error) {
+	compression := opts.compression
+	if opts.pcapStream != "" && compression == feed.CompressionAuto {
+		compression = feed.CompressionNone
+	}
+	return feed.GetCodec(compression, location)
+}
+
+// countingReader counts (and optionally hashes) the bytes read from an input.
+type countingReader struct {
+	r     io.Reader
+	count uint64
+	hash  hash.Hash
+}
+
+func newCountingReader(r io.Reader, checksum bool) *countingReader {
+	cr := &countingReader{r: r}
+	if checksum {
+		cr.hash = sha256.New()
+	}
+	return cr
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddUint64(&cr.count, uint64(n))
+	if cr.hash != nil {
+		cr.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+// Count returns the number of bytes read so far.
+func (cr *countingReader) Count() uint64 {
+	return atomic.LoadUint64(&cr.count)
+}
+
+// Checksum returns the hex-encoded SHA-256 of the bytes read so far
+// (empty if not enabled).
+func (cr *countingReader) Checksum() string {
+	if cr.hash == nil {
+		return ""
+	}
+	return hex.EncodeToString(cr.hash.Sum(nil))
+}
+
+// parseRecordLength parses a maximum record length, e.g. 16MiB (0 for no limit).
+func parseRecordLength(s string) (int, error) {
+	n, err := humanize.ParseBytes(s)
+	if err != nil || n > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid maximum record length %q", s)
+	}
+	return int(n), nil
+}
+
+// parseDelimiter parses a single-byte delimiter, either literal or as a Go escape sequence.
+func parseDelimiter(s string) (byte, error) {
+	if s == `\0` {
+		return 0, nil
+	}
+	unquoted, err := strconv.Unquote(`"` + s + `"`)
+	if err != nil || len(unquoted) != 1 {
+		return 0, fmt.Errorf("invalid delimiter %q: must be a single byte", s)
+	}
+	return unquoted[0], nil
+}
+
+func openInput(location string, pcapStream string) (io.ReadCloser, error) {
+	if pcapStream == "" {
+		return feed.Open(location)
+	}
+	stream, err := feed.ParsePCAPStream(pcapStream)
+	if err != nil {
+		return nil, err
+	}
+	return feed.OpenPCAP(location, stream)
+}
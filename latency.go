@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// latencyBuckets is the number of buckets of a latencyHistogram: the first
+// four are the latencies of 0 to 3 milliseconds, then each power of two is
+// split in four, so that the quantiles are within 25% of the latencies.
+const latencyBuckets = 4 * 64
+
+// latencyHistogram is the distribution of the ingest latency of the trades
+// of an input (their arrival time minus their timestamp, in milliseconds),
+// to quantify how stale a live feed is (see -track-latency). Trades arriving
+// before their timestamp (e.g. with clock skew) have a latency of zero.
+// It is recorded by the goroutine reading the input, and read concurrently.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+	max    int64
+}
+
+// latencyBucket returns the bucket of a latency, in milliseconds.
+func latencyBucket(ms int64) int {
+	if ms < 4 {
+		if ms < 0 {
+			return 0
+		}
+		return int(ms)
+	}
+	e := bits.Len64(uint64(ms)) - 1
+	return 4*(e-1) + int(ms>>(e-2)&3)
+}
+
+// latencyBucketMax returns the highest latency of a bucket.
+func latencyBucketMax(b int) int64 {
+	if b+1 < 4 {
+		return int64(b)
+	}
+	next := b + 1
+	e := next/4 + 1
+	return int64(4+next%4)<<(e-2) - 1
+}
+
+// record records the latency of a trade; trades without a timestamp are
+// ignored. A nil histogram records nothing.
+func (h *latencyHistogram) record(timestamp int64) {
+	if h == nil || timestamp == 0 {
+		return
+	}
+	ms := time.Now().UnixNano()/int64(time.Millisecond) - timestamp
+	if ms < 0 {
+		ms = 0
+	}
+	atomic.AddUint64(&h.counts[latencyBucket(ms)], 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if ms <= max || atomic.CompareAndSwapInt64(&h.max, max, ms) {
+			return
+		}
+	}
+}
+
+// latencySnapshot is the state of a latencyHistogram at a point in time.
+type latencySnapshot struct {
+	counts [latencyBuckets]uint64
+	count  uint64
+	max    int64
+}
+
+func (h *latencyHistogram) snapshot() latencySnapshot {
+	var s latencySnapshot
+	for i := range h.counts {
+		s.counts[i] = atomic.LoadUint64(&h.counts[i])
+		s.count += s.counts[i]
+	}
+	s.max = atomic.LoadInt64(&h.max)
+	return s
+}
+
+// since returns the latencies recorded after the snapshot last,
+// without their maximum (which is not known).
+func (s latencySnapshot) since(last latencySnapshot) latencySnapshot {
+	d := latencySnapshot{max: -1}
+	for i := range s.counts {
+		d.counts[i] = s.counts[i] - last.counts[i]
+		d.count += d.counts[i]
+	}
+	return d
+}
+
+// quantile returns the latency at or below which are the fraction q of the
+// trades (rounded up to the highest latency of its bucket, and at most the
+// maximum, if known).
+func (s latencySnapshot) quantile(q float64) time.Duration {
+	rank := uint64(q*float64(s.count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	seen := uint64(0)
+	for i, n := range s.counts {
+		seen += n
+		if seen >= rank {
+			ms := latencyBucketMax(i)
+			if s.max >= 0 && ms > s.max {
+				ms = s.max
+			}
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	return time.Duration(s.max) * time.Millisecond
+}
+
+// String formats the median, 90th and 99th percentiles, and the maximum.
+func (s latencySnapshot) String() string {
+	parts := []string{
+		"p50 " + s.quantile(0.5).String(),
+		"p90 " + s.quantile(0.9).String(),
+		"p99 " + s.quantile(0.99).String(),
+	}
+	if s.max >= 0 {
+		parts = append(parts, "max "+(time.Duration(s.max)*time.Millisecond).String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// summary returns the latencies as in the summary of the run (see runSummary).
+func (s latencySnapshot) summary() M {
+	ms := func(d time.Duration) int64 {
+		return int64(d / time.Millisecond)
+	}
+	return M{
+		"trades": s.count,
+		"p50_ms": ms(s.quantile(0.5)),
+		"p90_ms": ms(s.quantile(0.9)),
+		"p99_ms": ms(s.quantile(0.99)),
+		"max_ms": s.max,
+	}
+}
+
+// printLatencies prints the ingest latency of each input that tracks it.
+func printLatencies(w io.Writer, sources []*sourceRun) {
+	for _, run := range sources {
+		if run.latency == nil {
+			continue
+		}
+		s := run.latency.snapshot()
+		if s.count == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "Ingest latency of %s: %s (%v trades)\n", run.location, s, humanize.Comma(int64(s.count)))
+	}
+}
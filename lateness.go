@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// closedWindow is a window (by trade timestamp) that has ended, kept for the
+// allowed lateness of the pipeline so that late trades amend its results.
+type closedWindow struct {
+	start time.Time
+	// ags are the aggregators of the window, by source as pipeline.ags.
+	ags map[string]*Markets
+	// revisions are the number of corrections of the results
+	// of each market, by source.
+	revisions map[string]map[uint64]int
+}
+
+// addLate adds a trade before the start of the current window: to its window,
+// if it ended within the allowed lateness of the start of the current one,
+// emitting a correction of the result of its market; otherwise, it is only
+// counted. windowMu must be held.
+func (p *pipeline) addLate(source string, trade models.Trade, values []float64, ts time.Time) error {
+	start := ts.Truncate(p.window)
+	if p.lateness == 0 || !start.Add(p.window).After(p.windowStart.Add(-p.lateness)) {
+		atomic.AddUint64(&p.numLate, 1)
+		return nil
+	}
+	w := p.closedWindow(start)
+	if w == nil {
+		// A window without trades, that was never emitted:
+		w = &closedWindow{start: start, ags: map[string]*Markets{}, revisions: map[string]map[uint64]int{}}
+		for _, s := range p.sources {
+			w.ags[s] = NewAggregator(p.opts)
+		}
+		p.closed = append(p.closed, w)
+	}
+	key := ""
+	if p.tagSources {
+		key = source
+	}
+	ag := w.ags[key]
+	ag.Add(trade, values)
+	res := ag.compute(trade.Market, ag.GetMarket(trade.Market))
+	if res == nil {
+		// Not selected (see Having):
+		return nil
+	}
+	if w.revisions[key] == nil {
+		w.revisions[key] = map[uint64]int{}
+	}
+	w.revisions[key][trade.Market]++
+	res["revision"] = w.revisions[key][trade.Market]
+	return p.out.write([]M{p.tagResult(res, source, start, start.Add(p.window))})
+}
+
+// closedWindow returns the closed window starting at start, if kept.
+func (p *pipeline) closedWindow(start time.Time) *closedWindow {
+	for _, w := range p.closed {
+		if w.start.Equal(start) {
+			return w
+		}
+	}
+	return nil
+}
+
+// keepClosed keeps the aggregators of a window that has ended, and forgets
+// those that ended before the allowed lateness of the start of the current
+// window. windowMu must be held.
+func (p *pipeline) keepClosed(start time.Time, ags map[string]*Markets) {
+	kept := p.closed[:0]
+	for _, w := range p.closed {
+		if w.start.Add(p.window).After(p.windowStart.Add(-p.lateness)) {
+			kept = append(kept, w)
+		}
+	}
+	p.closed = append(kept, &closedWindow{start: start, ags: ags, revisions: map[string]map[uint64]int{}})
+}
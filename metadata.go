@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// version is set at build time (see Makefile).
+var version = "dev"
+
+// Where the metadata record is written, if at all.
+const (
+	metadataNone    = ""
+	metadataPrepend = "prepend"
+	metadataAppend  = "append"
+)
+
+// runMetadata describes a run, so that its results are self-describing.
+type runMetadata struct {
+	start      time.Time
+	configHash string
+	sources    []*sourceRun
+	remap      *RemapConfig
+}
+
+// newRunMetadata returns the metadata of a run with the given settings.
+func newRunMetadata(opts inputOptions, pipelines []PipelineConfig, sources []*sourceRun, remap *RemapConfig) (*runMetadata, error) {
+	config, err := json.Marshal(
+		M{
+			"format":      opts.format,
+			"framing":     opts.framing,
+			"delimiter":   opts.delimiter,
+			"pcap_stream": opts.pcapStream,
+			"pipelines":   pipelines,
+			"remap":       remap,
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error while hashing config: %s", err)
+	}
+	hash := sha256.Sum256(config)
+	return &runMetadata{
+		start:      time.Now(),
+		configHash: hex.EncodeToString(hash[:]),
+		sources:    sources,
+		remap:      remap,
+	}, nil
+}
+
+// record returns the metadata record, at the end of the run.
+func (meta *runMetadata) record(numTrades uint64) M {
+	inputs := make([]M, len(meta.sources))
+	for i, run := range meta.sources {
+		input := M{
+			"location": run.location,
+		}
+		if run.input != nil {
+			input["bytes"] = run.input.Count()
+			input["sha256"] = run.input.Checksum()
+		}
+		inputs[i] = input
+	}
+	record := M{
+		"type":        "metadata",
+		"version":     version,
+		"config_hash": meta.configHash,
+		"inputs":      inputs,
+		"start_time":  meta.start,
+		"end_time":    time.Now(),
+		"trade_count": numTrades,
+	}
+	if meta.remap != nil {
+		// The logical markets, and the IDs merged into them:
+		record["remap"] = meta.remap.Markets
+	}
+	return record
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// notifyTimeout bounds the time spent notifying the webhook,
+// so that an unresponsive one doesn't hold the end of the run.
+const notifyTimeout = 10 * time.Second
+
+// runSummary returns the summary of a run, as posted to -notify-url;
+// err is the error that failed the run, if any.
+func runSummary(start time.Time, numTrades uint64, numShed uint64, pipelines []*pipeline, sources []*sourceRun, err interface{}) M {
+	summary := M{
+		"status":     "succeeded",
+		"start_time": start,
+		"end_time":   time.Now(),
+		"trades":     numTrades,
+		"shed":       numShed,
+	}
+	if err != nil {
+		summary["status"] = "failed"
+		summary["error"] = fmt.Sprint(err)
+	}
+	list := make([]M, len(pipelines))
+	for i, p := range pipelines {
+		list[i] = M{
+			"name":         p.name,
+			"num_filtered": p.numFiltered,
+			"num_late":     p.numLate,
+		}
+		if p.out != nil {
+			list[i]["output"] = p.out.name
+		}
+	}
+	summary["pipelines"] = list
+	var latencies []M
+	for _, run := range sources {
+		if run.latency != nil {
+			latency := run.latency.snapshot().summary()
+			latency["input"] = run.location
+			latencies = append(latencies, latency)
+		}
+	}
+	if len(latencies) > 0 {
+		summary["ingest_latency"] = latencies
+	}
+	return summary
+}
+
+// notify posts the summary of the run to the webhook, as a JSON object.
+func notify(url string, summary M) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("error while encoding summary: %s", err)
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error while notifying %s: %s", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error while notifying %s: %s", url, resp.Status)
+	}
+	return nil
+}
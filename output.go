@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gagliardetto/messari-challenge/feed"
+)
+
+// output is a destination of results, possibly shared by several pipelines.
+// Results are written to w as lines of JSON, unless the output has a sink.
+type output struct {
+	mu     sync.Mutex
+	name   string
+	opts   outputOptions
+	w      *bufio.Writer
+	closer io.Closer
+	sink   resultSink
+	// codec is the compression of a file output that can be rotated
+	// (nil if it is not compressed).
+	codec     *feed.Codec
+	rotatable bool
+}
+
+// resultSink is an output that writes the results
+// other than as lines of JSON (e.g. remoteWriter).
+type resultSink interface {
+	write(results []M) error
+	close() error
+}
+
+// outputs are the outputs by location, so that pipelines writing
+// to the same location share the same output.
+type outputs struct {
+	opts       outputOptions
+	byLocation map[string]*output
+}
+
+func newOutputs(opts outputOptions) *outputs {
+	return &outputs{
+		opts:       opts,
+		byLocation: map[string]*output{},
+	}
+}
+
+// get returns the output at the given location: - (stdout), a file path,
+// prometheus:<url> (see remoteWriter), bigquery:<table> (see bigQueryLoader),
+// or duckdb:<path> (see duckDBSink).
+func (outs *outputs) get(location string) (*output, error) {
+	if location == "" {
+		location = "-"
+	}
+	if out, ok := outs.byLocation[location]; ok {
+		return out, nil
+	}
+	out := &output{name: location, opts: outs.opts}
+	switch {
+	case strings.HasPrefix(location, remoteWritePrefix):
+		url, err := parseRemoteWriteURL(location)
+		if err != nil {
+			return nil, err
+		}
+		out.sink = newRemoteWriter(url, outs.opts)
+	case strings.HasPrefix(location, bigQueryPrefix):
+		bq, err := newBigQueryLoader(location, outs.opts)
+		if err != nil {
+			return nil, err
+		}
+		out.sink = bq
+	case strings.HasPrefix(location, duckDBPrefix):
+		db, err := newDuckDBSink(location, outs.opts)
+		if err != nil {
+			return nil, err
+		}
+		out.sink = db
+	case outs.opts.upsert:
+		if location == "-" {
+			return nil, fmt.Errorf("results can't be upserted to stdout")
+		}
+		codec, err := feed.GetCodec(outs.opts.compression, location)
+		if err != nil {
+			return nil, withExitCode(exitUsage, err)
+		}
+		if codec != nil {
+			return nil, fmt.Errorf("results can't be upserted to compressed outputs (%s)", location)
+		}
+		file, err := openUpsertFile(location, outs.opts.fieldName(keyField))
+		if err != nil {
+			return nil, withExitCode(exitOutput, err)
+		}
+		out.w = bufio.NewWriter(file)
+		out.closer = file
+	default:
+		codec, err := feed.GetCodec(outs.opts.compression, location)
+		if err != nil {
+			return nil, withExitCode(exitUsage, err)
+		}
+		if err := feed.CheckWritable(codec); err != nil {
+			return nil, withExitCode(exitUsage, err)
+		}
+		out.codec = codec
+		out.rotatable = location != "-"
+		if err := out.open(); err != nil {
+			return nil, err
+		}
+	}
+	outs.byLocation[location] = out
+	return out, nil
+}
+
+// open opens the file (or stdout) of the output.
+func (out *output) open() error {
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if out.name != "-" {
+		var err error
+		file, err = os.Create(out.name)
+		if err != nil {
+			return withExitCode(exitOutput, fmt.Errorf("error while creating output: %s", err))
+		}
+		w = file
+	}
+	cw, err := feed.NewCodecWriter(out.codec, w)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return withExitCode(exitOutput, err)
+	}
+	out.w = bufio.NewWriter(cw)
+	out.closer = cw
+	if file != nil {
+		// The compressed stream is completed before the file is closed:
+		out.closer = &closers{cw, file}
+	}
+	return nil
+}
+
+// rotate closes the file of the output, and creates it again (e.g. after
+// it is moved away by logrotate); it returns false if the output is not
+// a file that can be rotated.
+func (out *output) rotate() (bool, error) {
+	if !out.rotatable {
+		return false, nil
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if err := out.w.Flush(); err != nil {
+		return true, withExitCode(exitOutput, fmt.Errorf("error while writing to %s: %s", out.name, err))
+	}
+	if err := out.closer.Close(); err != nil {
+		return true, withExitCode(exitOutput, fmt.Errorf("error while closing %s: %s", out.name, err))
+	}
+	return true, out.open()
+}
+
+// closers close all their closers, in order, returning the first error.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// closeAll flushes and closes all the outputs.
+func (outs *outputs) closeAll() error {
+	for _, out := range outs.byLocation {
+		if err := out.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateAll rotates the file outputs, returning their locations.
+func (outs *outputs) rotateAll() ([]string, error) {
+	var rotated []string
+	for location, out := range outs.byLocation {
+		ok, err := out.rotate()
+		if err != nil {
+			return rotated, err
+		}
+		if ok {
+			rotated = append(rotated, location)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// writeAll writes the same record to all the outputs.
+func (outs *outputs) writeAll(res M) error {
+	for _, out := range outs.byLocation {
+		if err := out.write([]M{res}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes the results, one JSON object per line
+// (prefixed with a record separator for json-seq).
+// Large result sets are encoded in parallel (see encodeParallel).
+func (out *output) write(results []M) error {
+	if out.sink != nil {
+		out.mu.Lock()
+		defer out.mu.Unlock()
+		return out.sink.write(results)
+	}
+	if out.opts.workers > 1 && len(results) > encodeChunkSize {
+		return out.encodeParallel(results)
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	for _, res := range results {
+		line, err := json.Marshal(out.opts.format(res))
+		if err != nil {
+			return withExitCode(exitOutput, fmt.Errorf("error while encoding result: %s", err))
+		}
+		if out.opts.jsonSeq {
+			out.w.WriteByte(recordSeparator)
+		}
+		out.w.Write(line)
+		out.w.WriteByte('\n')
+	}
+	if err := out.w.Flush(); err != nil {
+		return withExitCode(exitOutput, fmt.Errorf("error while writing to %s: %s", out.name, err))
+	}
+	return nil
+}
+
+func (out *output) close() error {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.sink != nil {
+		return out.sink.close()
+	}
+	if err := out.w.Flush(); err != nil {
+		return withExitCode(exitOutput, fmt.Errorf("error while writing to %s: %s", out.name, err))
+	}
+	if out.closer != nil {
+		if err := out.closer.Close(); err != nil {
+			return withExitCode(exitOutput, fmt.Errorf("error while closing %s: %s", out.name, err))
+		}
+	}
+	return nil
+}
+
+// encodeChunkSize is the number of results encoded at once by a worker.
+const encodeChunkSize = 4096
+
+// encodedChunk is a chunk of results, encoded by a worker.
+type encodedChunk struct {
+	results []M
+	buf     []byte
+	err     error
+	// done is closed when the chunk is encoded.
+	done chan struct{}
+}
+
+// encodeParallel encodes chunks of the results on out.opts.workers goroutines,
+// and writes them in order as they are done.
+func (out *output) encodeParallel(results []M) error {
+	jobs := make(chan *encodedChunk)
+	// ordered are the chunks in order, encoded or not:
+	ordered := make(chan *encodedChunk, out.opts.workers*2)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for i := 0; i < out.opts.workers; i++ {
+		go func() {
+			for chunk := range jobs {
+				for _, res := range chunk.results {
+					line, err := json.Marshal(out.opts.format(res))
+					if err != nil {
+						chunk.err = withExitCode(exitOutput, fmt.Errorf("error while encoding result: %s", err))
+						break
+					}
+					if out.opts.jsonSeq {
+						chunk.buf = append(chunk.buf, recordSeparator)
+					}
+					chunk.buf = append(chunk.buf, line...)
+					chunk.buf = append(chunk.buf, '\n')
+				}
+				close(chunk.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+		for start := 0; start < len(results); start += encodeChunkSize {
+			end := start + encodeChunkSize
+			if end > len(results) {
+				end = len(results)
+			}
+			chunk := &encodedChunk{
+				results: results[start:end],
+				done:    make(chan struct{}),
+			}
+			select {
+			case ordered <- chunk:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- chunk:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	for chunk := range ordered {
+		<-chunk.done
+		if chunk.err != nil {
+			return chunk.err
+		}
+		out.w.Write(chunk.buf)
+	}
+	if err := out.w.Flush(); err != nil {
+		return withExitCode(exitOutput, fmt.Errorf("error while writing to %s: %s", out.name, err))
+	}
+	return nil
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/gagliardetto/messari-challenge/feed"
 	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
 	. "github.com/gagliardetto/utilz"
 	"github.com/hako/durafmt"
@@ -41,13 +47,34 @@ import (
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
-var BEGIN = []byte("BEGIN\n")
-var END = []byte("END\n")
-
 func main() {
+	defer exitOnError()
+
+	// Subcommands:
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			os.Exit(runDiff(os.Args[2:]))
+		case "serve":
+			os.Exit(runServe(os.Args[2:]))
+		case "soak":
+			os.Exit(runSoak(os.Args[2:]))
+		case "proptest":
+			os.Exit(runPropTest(os.Args[2:]))
+		case "ab":
+			os.Exit(runAB(os.Args[2:]))
+		case "vectors":
+			os.Exit(runVectors(os.Args[2:]))
+		}
+	}
+
 	took := NewTimerRaw()
 
 	numTrades := uint64(0)
+	numShed := uint64(0)
+	var pipelines []*pipeline
+	var sources []*sourceRun
+	var bf *backfill
 	defer func() {
 		// Before exiting, print stats to stderr:
 		dur := took()
@@ -58,74 +85,923 @@ func main() {
 			humanize.Comma(int64(numTrades)),
 			humanize.CommafWithDigits(float64(numTrades)/dur.Seconds(), 2),
 		)
-	}()
-
-	ag := NewAggregator()
-
-	// Iterate over input:
-	err := iterateLines(
-		os.Stdin,
-		func(line []byte) bool {
-			if line[0] != '{' {
-				if bytes.Equal(line, BEGIN[:]) {
-					return true
-				}
-				if bytes.Equal(line, END[:]) {
-					return false
-				}
+		printBandwidth(os.Stderr, sources, dur)
+		printLatencies(os.Stderr, sources)
+		if bf != nil && bf.numSkipped > 0 {
+			fmt.Fprintf(
+				os.Stderr,
+				"Skipped %v trades of the live inputs already in the backfill\n",
+				humanize.Comma(int64(bf.numSkipped)),
+			)
+		}
+		if numShed > 0 {
+			fmt.Fprintf(
+				os.Stderr,
+				"Shed %v trades (processing fell behind by more than -max-lag)\n",
+				humanize.Comma(int64(numShed)),
+			)
+		}
+		for _, p := range pipelines {
+			if p.numFiltered > 0 {
 				fmt.Fprintf(
 					os.Stderr,
-					"%s",
-					string(line),
+					"Filtered out %v trades%s\n",
+					humanize.Comma(int64(p.numFiltered)),
+					pipelineSuffix(p.name),
 				)
-				return true
 			}
-			atomic.AddUint64(&numTrades, 1)
-
-			// Parse trade:
-			var trade models.Trade
-			if err := json.Unmarshal(line, &trade); err != nil {
-				panic(err)
+			if p.numLate > 0 {
+				fmt.Fprintf(
+					os.Stderr,
+					"Dropped %v late trades (before the start of the current window)%s\n",
+					humanize.Comma(int64(p.numLate)),
+					pipelineSuffix(p.name),
+				)
 			}
-			// Get market:
-			mkt := ag.GetMarket(trade.Market)
+			if p.idle != nil && p.idle.numFlushed > 0 {
+				fmt.Fprintf(
+					os.Stderr,
+					"Flushed %v idle markets during the run%s\n",
+					humanize.Comma(int64(p.idle.numFlushed)),
+					pipelineSuffix(p.name),
+				)
+			}
+		}
+	}()
 
-			// Process trade data for the market:
-			mkt.Lock(func(mkt *Market) {
-				mkt.numTrades++
+	var inputs stringsFlag
+	flag.Var(&inputs, "input", "Input to read trades from: - (stdin), a file path, tcp://host:port, binance:symbol,... or coinbase:product,...; can be repeated to read from several inputs at the same time")
+	format := flag.String("format", "json", fmt.Sprintf("Input format (one of %v, or avro with -schema-registry)", feed.Formats()))
+	framing := flag.String("framing", "", fmt.Sprintf("Read records prefixed by their length instead of using the native framing of the format (one of %v)", feed.Framings()))
+	delimiter := flag.String("delimiter", `\n`, `Record delimiter of the json format, as a single character or escape sequence (e.g. \x1e for json-seq, \0 for NUL)`)
+	schemaRegistry := flag.String("schema-registry", "", "URL of a schema registry (e.g. http://localhost:8081) with which to decode the records of the avro format, in the Confluent wire format (as relayed from Kafka topics), by the ID of their schema; requires -framing")
+	pcapStream := flag.String("pcap-stream", "", "Treat the input as a pcap file, and read the given stream from it: tcp:[host:]port (sender) or udp:[host:]port (destination)")
+	configPath := flag.String("config", "", "YAML config file defining the aggregation pipelines (replacing -filter, -having, -derive, -window, -tag-sources and -output)")
+	tagSources := flag.Bool("tag-sources", false, "Aggregate each input separately, and tag the results with the input they come from")
+	var rollupFlags stringsFlag
+	flag.Var(&rollupFlags, "rollup", "Also aggregate groups of markets in the same pass (e.g. by exchange), as name=groups (the path of a YAML file with the markets of each group), or name for all the markets; can be repeated for each level")
+	perInput := flag.Bool("per-input-results", false, "Also aggregate each input separately, writing its results tagged with the input they come from in addition to those of all the inputs (e.g. for a breakdown by day of daily files)")
+	divergeWindow := flag.Duration("diverge-window", 0, "Compare two inputs in windows of this duration (by arrival time), and print the markets whose VWAP or volume diverge, instead of the results")
+	divergeThreshold := flag.Float64("diverge-threshold", 0.01, "Relative difference above which a market is reported as divergent")
+	var derive stringsFlag
+	flag.Var(&derive, "derive", "Derived metric computed for each trade, as name=expression (e.g. notional=price*volume); its total_<name> and mean_<name> are computed for each market; can be repeated")
+	filterExpr := flag.String("filter", "", "Only aggregate the trades for which this expression is true (e.g. 'price > 0 && volume >= 0.01 && market != 42'); variables: id, market, price, volume, is_buy, timestamp")
+	having := flag.String("having", "", "Only emit the results of the markets for which this expression is true (e.g. 'total_volume > 1e6 && num_trades >= 100'); variables: the numeric fields of the results, and num_trades")
+	scriptPath := flag.String("script", "", "File of a script post-processing the results before they are emitted: a statement per line, drop if <condition>, <field> = <expression>, rename <field> <name> or delete <field>")
+	activityMetrics := flag.Bool("activity", false, "Compute the peak and mean trades per second of each market, and its busiest second (by the time of the trades, see -time-mode)")
+	activityHorizon := flag.Duration("activity-horizon", defaultActivityHorizon, "Count the trades by second for -activity only within this long of the latest trade of each market, bounding its memory on live inputs; trades arriving later than that count in mean_tps but not in peak_tps")
+	trimmedMean := flag.Float64("trimmed-mean", 0, "Compute the mean price of each market without this percentage of its lowest and of its highest prices (e.g. 1), robust to bad prints, as trimmed_mean_price")
+	netFlow := flag.Bool("net-flow", false, "Compute the net flow of each market (the volume of its buys minus that of its sells); with -side-rule=volume_sign, sells can have negative volumes")
+	quotes := flag.Bool("quotes", false, `Accept quote records ({"type":"quote","market":...,"bid":...,"ask":...}) interleaved with trades, and compute the mean quoted and effective spread of each market (json format only)`)
+	bookDepth := flag.Int("book-depth", 0, `Accept L2 order book updates ({"type":"book","market":...,"side":"bid|ask","price":...,"size":...}) interleaved with trades, and compute the book imbalance of each market over this number of levels (json format only)`)
+	state := flag.Bool("state", false, "Include the counts and sums of each market in the results, so that a later run can resume from them with -warm-start")
+	warmStart := flag.String("warm-start", "", "Resume the aggregation from the results of a previous run written with -state (e.g. for cumulative month-to-date results)")
+	checkpoint := flag.String("checkpoint", "", "Write the state of the markets to this path at the end of the run (and on the checkpoint command of -control-socket), in a compact binary format that -warm-start resumes from; pipelines without windows only")
+	checkpointCompression := flag.String("checkpoint-compression", defaultCheckpointCompression, fmt.Sprintf("Compression of the checkpoints: %v, or none", feed.WritableCodecs()))
+	outputProfile := flag.String("output-profile", profileLegacy, "Metrics of the results: legacy (the original ones, plus those enabled explicitly), extended (adding counts and OHLC prices), or full (adding activity metrics and state)")
+	window := flag.Duration("window", 0, "Emit results for tumbling windows of this duration (by the time of the trades, see -time-mode), instead of once for the whole run")
+	allowedLateness := flag.Duration("allowed-lateness", 0, "Amend windows by event time with the trades arriving up to this long after they end, emitting correction records (with a revision number) instead of dropping them")
+	outputLocation := flag.String("output", "-", "Where to write the results: - (stdout), a file path, prometheus:<url> (pushing them to a Prometheus remote-write endpoint), bigquery:project.dataset.table (loading them into a BigQuery table), or duckdb:path (inserting them into the results table of a DuckDB database)")
+	floatPrecision := flag.Int("float-precision", -1, "Format floats with this fixed number of decimal places, so that the output is byte-identical across platforms (if negative, floats are formatted with the shortest representation)")
+	decimalStrings := flag.String("decimal-strings", "", "Comma-separated fields written as decimal strings with -decimal-scale decimal places, e.g. vwap,total_volume,total_notional (for consumers that can't parse JSON numbers as decimals)")
+	decimalScale := flag.Int("decimal-scale", 6, "Decimal places of the fields written as decimal strings (the prices with -price-precision rules keep theirs)")
+	pricePrecision := flag.String("price-precision", "", "YAML file of precision rules for the prices of the results (mean_price, vwap and OHLC): decimal places by market (or from its tick size) and by price magnitude, overriding -float-precision")
+	maxMarkets := flag.Int("max-distinct-markets", 0, "Abort when the input has more than this number of distinct markets (0 for no bound)")
+	maxMarketsWarn := flag.Bool("max-distinct-markets-warn", false, "Only warn (once) when -max-distinct-markets is exceeded, instead of aborting")
+	stateTTL := flag.Duration("state-ttl", 0, "Evict the state of the markets that have not been updated for this long (by arrival time), emitting their results as final if there are no windows; for long-running live inputs")
+	idleFlush := flag.Duration("idle-flush", 0, "Without windows, emit the results of the markets that have had no trades for this long (by trade timestamp, to the latest one) during the run, as final, and free their state; for inputs with more markets than fit in memory, only some of them active at a time")
+	sessionClose := flag.String("session-close", "", "Without windows, emit the results of the markets that have had no trades since the last session close, at this time of day (HH:MM, UTC), during the run, as final, and free their state")
+	maxLag := flag.Duration("max-lag", 0, "Shed load when falling behind live inputs: when a trade arrives later than this after its timestamp, only one trade in -shed-keep is aggregated (the number of shed trades of each market is added to its results as num_shed)")
+	shedKeep := flag.Int("shed-keep", 10, "Aggregate one trade in this many when shedding load (see -max-lag)")
+	maxProcs := flag.Int("max-procs", 0, "Maximum number of CPUs used at the same time (0 for all, or GOMAXPROCS if set)")
+	parseWorkers := flag.Int("parse-workers", 0, "Number of goroutines decoding each input, in batches, while another one reads it (0 to share the CPUs among the inputs; 1 to decode while reading; json format only)")
+	ioReaders := flag.Int("io-readers", 0, "Maximum number of inputs read at the same time (0 for all); the others are read as the first ones end")
+	pinReaders := flag.Bool("pin-readers", false, "Pin the goroutine processing each input to an OS thread")
+	outputWorkers := flag.Int("output-workers", 0, "Number of goroutines encoding large result sets, which are still written in order (0 for one per CPU)")
+	safeStrings := flag.Bool("safe-strings", false, "Copy the bytes that the decoders convert to strings, instead of sharing their memory (zero-copy)")
+	replaySpeed := flag.String("replay-speed", "max", "Pace the reading of timestamped trades to simulate their arrival in real time (1x) or accelerated (e.g. 10x), instead of reading as fast as possible (max)")
+	timeMode := flag.String("time-mode", timeModeEvent, "Time of the trades, for windows and rate metrics: event (the timestamp of the trade, or its arrival time if it has none) or arrival (the time it is read)")
+	undefined := flag.String("undefined", undefinedNull, "How to write undefined metrics (e.g. the VWAP of a market with zero volume): null, zero, or omit")
+	var rename stringsFlag
+	flag.Var(&rename, "rename", "Rename a field of the output, as field=name (e.g. vwap=weighted_average_price); can be repeated")
+	runID := flag.String("run-id", "", "Add an idempotency key to each result, from this ID of the run and the pipeline, source, market and window of the result (as the key field)")
+	upsert := flag.Bool("upsert", false, "Replace the results with the same key (see -run-id) already in the output files, instead of truncating them, so that resuming a run doesn't duplicate its results")
+	query := flag.String("query", "", "Run this SQL statement over the results table of the duckdb: output at the end of the run, and print its result (e.g. 'SELECT market, total_volume FROM results ORDER BY 2 DESC LIMIT 10')")
+	notifyURL := flag.String("notify-url", "", "POST a JSON summary of the run (status, error, trade counts, and the output of each pipeline) to this URL when it finishes or fails")
+	metadata := flag.String("metadata", metadataNone, "Write a metadata record (version, config hash, input checksums, start and end time, trade count) to each output: prepend or append")
+	chartDir := flag.String("charts", "", "Render a chart of the volume and VWAP of each market over the windows to this directory, at the end of the run (requires windows)")
+	chartFormat := flag.String("chart-format", chartFormatSVG, "Format of the charts (see -charts): svg or png (without labels)")
+	rateLimitFlag := flag.String("rate-limit", "", "Limit the ingestion rate of all the inputs, as trades=N and/or bytes=N per second (e.g. trades=10000,bytes=10MB), reading them more slowly (which applies backpressure to sockets)")
+	inputRateLimitFlag := flag.String("input-rate-limit", "", "Limit the ingestion rate of each input, as -rate-limit")
+	maxRecordLength := flag.String("max-record-length", "16MiB", "Reject records longer than this (e.g. 1MB), without reading more of them, so that a pathological line can't exhaust memory (0 for no limit; json format only)")
+	maxDepth := flag.Int("max-depth", 32, "Reject records whose values are nested deeper than this (0 for no limit; json format only)")
+	maxErrorRate := flag.Float64("max-error-rate", 0, "Skip the records that fail to parse, aborting the run if they are more than this fraction of the records of an input (e.g. 0.01; checked from 1,000 records, and at its end); 0 aborts at the first one (json format only)")
+	encoding := flag.String("encoding", feed.EncodingAuto, fmt.Sprintf("Text encoding of the json format (one of %v); auto detects UTF-16 (e.g. from Windows exporters) by its byte order mark or zero bytes, and transcodes it to UTF-8", feed.Encodings()))
+	outputFraming := flag.String("output-framing", outputFramingNDJSON, "Framing of the results: ndjson (one JSON object per line) or json-seq (RFC 7464, each object prefixed with a record separator)")
+	remapPath := flag.String("remap", "", "YAML file merging market IDs into logical markets (e.g. after a venue migration), applied to the trades, quotes and book updates before aggregation, and recorded in the metadata")
+	var enrichFlags stringsFlag
+	flag.Var(&enrichFlags, "enrich", fmt.Sprintf("Transform each trade before aggregation with an enricher (one of %v), as name or name=config (the path of its YAML config); can be repeated, applied in order", feed.Enrichers()))
+	var sideRuleFlags stringsFlag
+	flag.Var(&sideRuleFlags, "side-rule", fmt.Sprintf("How the aggressor side of the trades is indicated (one of %v), for all the inputs, or for one as location=rule (e.g. -side-rule=tcp://feed:9000=taker_side); can be repeated (json format only)", feed.SideRules()))
+	explain := flag.Bool("explain", false, "Instead of running, print the resolved plan of the run (inputs and decoders, then the filter, aggregation, window, metrics and output of each pipeline, with their effective settings), to sanity-check complex configs")
+	estimate := flag.Bool("estimate", false, "Instead of the full run, read a sample of each input (see -estimate-sample) and print the projected number of markets, memory and running time under the current settings, with recommendations")
+	estimateSample := flag.Int("estimate-sample", 100000, "Number of trades of each input read by -estimate")
+	compression := flag.String("compression", feed.CompressionAuto, fmt.Sprintf("Compression of the inputs (one of %v): auto (by the extension of their path, e.g. .gz), none, or a codec", feed.Codecs()))
+	outputCompression := flag.String("output-compression", feed.CompressionAuto, "Compression of the outputs, as -compression (stdout is compressed only if set explicitly)")
+	progressInterval := flag.Duration("progress-interval", 0, "Print the number of trades and bytes read so far, and their rates (TPS and bandwidth), to stderr at this interval")
+	controlSocket := flag.String("control-socket", "", "Serve administration commands (flush-results, rotate-output, dump-state, checkpoint, stop-after-current-window; see help) on a Unix socket at this path, one per line")
+	trackLatency := flag.Bool("track-latency", false, "Track the ingest latency of the trades of each live input (their arrival time minus their timestamp), printing its percentiles at the end of the run and with -progress-interval, and adding them to the summary of the run")
+	backfillPath := flag.String("backfill", "", "Aggregate this historical input (e.g. the trades of the day so far) before switching to the live inputs, which continue its windows and state; the trades of the live inputs up to the end of the backfill are skipped (requires -time-mode=event)")
+	flag.Parse()
 
-				mkt.totalVolume += trade.Volume
-				mkt.totalPrice += trade.Price
-				mkt.priceXvolumeSum += trade.Price * trade.Volume
+	if *notifyURL != "" {
+		start := time.Now()
+		defer func() {
+			r := recover()
+			summary := runSummary(start, atomic.LoadUint64(&numTrades), atomic.LoadUint64(&numShed), pipelines, sources, r)
+			if err := notify(*notifyURL, summary); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if r != nil {
+				panic(r)
+			}
+		}()
+	}
 
-				if trade.IsBuy {
-					mkt.numBuy++
-				}
-			})
-			return true
+	if len(inputs) == 0 {
+		inputs = stringsFlag{"-"}
+	}
+	var script string
+	if *scriptPath != "" {
+		data, err := os.ReadFile(*scriptPath)
+		if err != nil {
+			panic(withExitCode(exitUsage, fmt.Errorf("error while reading script: %s", err)))
+		}
+		script = string(data)
+	}
+	pipelineConfigs := []PipelineConfig{
+		{
+			Filter:          *filterExpr,
+			Having:          *having,
+			Script:          script,
+			Derive:          derive,
+			Window:          *window,
+			AllowedLateness: *allowedLateness,
+			IdleFlush:       *idleFlush,
+			SessionClose:    *sessionClose,
+			TagSources:      *tagSources,
+			PerInput:        *perInput,
+			Activity:        *activityMetrics,
+			ActivityHorizon: *activityHorizon,
+			NetFlow:         *netFlow,
+			TrimmedMean:     *trimmedMean,
+			Quotes:          *quotes,
+			BookDepth:       *bookDepth,
+			Profile:         *outputProfile,
+			State:           *state,
+			WarmStart:       *warmStart,
+			Output:          *outputLocation,
 		},
-	)
+	}
+	rollups, err := parseRollups(rollupFlags)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	pipelineConfigs[0].Rollups = rollups
+	var renames map[string]string
+	var reportConf *ReportConfig
+	if *configPath != "" {
+		conf, err := LoadConfig(*configPath)
+		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+		if len(conf.Pipelines) > 0 {
+			pipelineConfigs = conf.Pipelines
+		}
+		renames = conf.Rename
+		reportConf = conf.Report
+	}
+	var rep *reporter
+	if reportConf != nil {
+		var err error
+		rep, err = newReporter(*reportConf)
+		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+		start := time.Now()
+		defer func() {
+			r := recover()
+			summary := runSummary(start, atomic.LoadUint64(&numTrades), atomic.LoadUint64(&numShed), pipelines, sources, r)
+			if err := rep.send(summary); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if r != nil {
+				panic(r)
+			}
+		}()
+	}
+	renames, err = parseRenames(renames, rename)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	if *timeMode != timeModeEvent && *timeMode != timeModeArrival {
+		panic(withExitCode(exitUsage, fmt.Errorf("invalid -time-mode %q: must be event or arrival", *timeMode)))
+	}
+	pace, err := parseReplaySpeed(*replaySpeed)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	undefinedPolicy, err := parseUndefined(*undefined)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	if *maxLag < 0 || *shedKeep < 1 {
+		panic(withExitCode(exitUsage, fmt.Errorf("invalid -max-lag %s or -shed-keep %v", *maxLag, *shedKeep)))
+	}
+	feed.SetSafeStrings(*safeStrings)
+	if *schemaRegistry != "" {
+		feed.RegisterRecordFormat(avroFormat, feed.NewSchemaRegistry(*schemaRegistry).DecodeTrade)
+	}
+	if *format == avroFormat && (*schemaRegistry == "" || *framing == "") {
+		panic(withExitCode(exitUsage, fmt.Errorf("the avro format requires -schema-registry and -framing")))
+	}
+	if *maxProcs > 0 {
+		runtime.GOMAXPROCS(*maxProcs)
+	}
+	if *parseWorkers == 0 {
+		*parseWorkers = runtime.GOMAXPROCS(0) / len(inputs)
+	}
+	if *outputWorkers <= 0 {
+		*outputWorkers = runtime.GOMAXPROCS(0)
+	}
+	if *ioReaders <= 0 || *ioReaders > len(inputs) {
+		*ioReaders = len(inputs)
+	}
+	if *outputFraming != outputFramingNDJSON && *outputFraming != outputFramingJSONSeq {
+		panic(withExitCode(exitUsage, fmt.Errorf("invalid -output-framing %q: must be ndjson or json-seq", *outputFraming)))
+	}
+	if *upsert && *runID == "" {
+		panic(withExitCode(exitUsage, fmt.Errorf("-upsert requires -run-id")))
+	}
+	if *stateTTL < 0 {
+		panic(withExitCode(exitUsage, fmt.Errorf("invalid -state-ttl %s", *stateTTL)))
+	}
+	if *divergeWindow > 0 {
+		if len(inputs) != 2 {
+			panic(withExitCode(exitUsage, fmt.Errorf("-diverge-window requires exactly two inputs, got %v", len(inputs))))
+		}
+		if len(pipelineConfigs) != 1 || pipelineConfigs[0].Window > 0 {
+			panic(withExitCode(exitUsage, fmt.Errorf("-diverge-window can't be used with multiple pipelines or windows")))
+		}
+		if *stateTTL > 0 {
+			panic(withExitCode(exitUsage, fmt.Errorf("-diverge-window can't be used with -state-ttl")))
+		}
+		pipelineConfigs[0].TagSources = true
+	}
+	if *backfillPath != "" {
+		if *timeMode == timeModeArrival || *divergeWindow > 0 {
+			panic(withExitCode(exitUsage, fmt.Errorf("-backfill can't be used with -time-mode=arrival or -diverge-window")))
+		}
+		for _, conf := range pipelineConfigs {
+			if conf.TagSources || conf.PerInput {
+				panic(withExitCode(exitUsage, fmt.Errorf("-backfill can't be used with -tag-sources or -per-input-results, as its trades continue those of the live inputs")))
+			}
+		}
+	}
+	pipelineConfigs, err = expandRollups(pipelineConfigs)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	pipelineConfigs, err = expandPerInput(pipelineConfigs)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	for _, conf := range pipelineConfigs {
+		if _, err := compilePipelineExprs(conf); err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+	}
+	switch *metadata {
+	case metadataNone, metadataAppend:
+	case metadataPrepend:
+		// The record is complete only at the end, so it can be prepended
+		// only to outputs that are written at the end:
+		for _, conf := range pipelineConfigs {
+			if conf.Window > 0 || *divergeWindow > 0 || *stateTTL > 0 || conf.IdleFlush > 0 || conf.SessionClose != "" {
+				panic(withExitCode(exitUsage, fmt.Errorf("-metadata=prepend can't be used with windows, -state-ttl or flushes of idle markets, use append")))
+			}
+		}
+	default:
+		panic(withExitCode(exitUsage, fmt.Errorf("invalid -metadata %q: must be prepend or append", *metadata)))
+	}
+
+	delim, err := parseDelimiter(*delimiter)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	globalLimit, err := parseRateLimit(*rateLimitFlag)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	inputLimit, err := parseRateLimit(*inputRateLimitFlag)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	recordLength, err := parseRecordLength(*maxRecordLength)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	if *maxErrorRate < 0 || *maxErrorRate >= 1 {
+		panic(withExitCode(exitUsage, fmt.Errorf("invalid -max-error-rate %v: must be at least 0 and less than 1", *maxErrorRate)))
+	}
+	sides, err := parseSideRules(sideRuleFlags, append([]string{*backfillPath}, inputs...))
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	var precision *precisionRules
+	if *pricePrecision != "" {
+		precision, err = LoadPrecision(*pricePrecision)
+		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+	}
+	decimalFields, err := parseDecimalStrings(*decimalStrings, *decimalScale)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	var remapConf *RemapConfig
+	var remap marketRemap
+	if *remapPath != "" {
+		remapConf, remap, err = LoadRemap(*remapPath)
+		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+	}
+	enrich, err := parseEnrichers(enrichFlags)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	opts := inputOptions{
+		format:         *format,
+		framing:        *framing,
+		schemaRegistry: *schemaRegistry,
+		delimiter:      delim,
+		pcapStream:     *pcapStream,
+		checksum:       *metadata != metadataNone,
+		parseWorkers:   *parseWorkers,
+		rateLimit:      inputLimit,
+		globalLimiter:  newLimiter("the rate limit of the inputs", globalLimit, 0),
+		records:        recordLimits{maxLength: recordLength, maxDepth: *maxDepth},
+		encoding:       *encoding,
+		sideRules:      sides,
+		compression:    *compression,
+		maxErrorRate:   *maxErrorRate,
+	}
+	outOpts := outputOptions{
+		floatPrecision: *floatPrecision,
+		precision:      precision,
+		decimalStrings: decimalFields,
+		decimalScale:   *decimalScale,
+		rename:         renames,
+		undefined:      undefinedPolicy,
+		workers:        *outputWorkers,
+		runID:          *runID,
+		upsert:         *upsert,
+		jsonSeq:        *outputFraming == outputFramingJSONSeq,
+		compression:    *outputCompression,
+	}
+
+	if *explain {
+		// Print the plan without opening the inputs and outputs:
+		plan := &runPlan{
+			inputs:    inputs,
+			backfill:  *backfillPath,
+			inputOpts: opts,
+			outOpts:   outOpts,
+			remap:     remap,
+			enrich:    enrich,
+			confs:     pipelineConfigs,
+			settings: [][2]string{
+				{"time mode", *timeMode},
+				{"replay speed", *replaySpeed},
+				{"track latency", strconv.FormatBool(*trackLatency)},
+				{"max lag", fmt.Sprintf("%s (keeping 1 trade in %v)", *maxLag, *shedKeep)},
+				{"state ttl", stateTTL.String()},
+				{"checkpoint", orNone(*checkpoint)},
+				{"max distinct markets", strconv.Itoa(*maxMarkets)},
+				{"rate limit", orNone(*rateLimitFlag)},
+				{"input rate limit", orNone(*inputRateLimitFlag)},
+				{"metadata", orNone(*metadata)},
+				{"inputs read at once", strconv.Itoa(*ioReaders)},
+			},
+		}
+		for _, conf := range pipelineConfigs {
+			p, err := newPipeline(conf, inputs, nil, *timeMode, *stateTTL)
+			if err != nil {
+				panic(defaultExitCode(exitUsage, err))
+			}
+			plan.pipelines = append(plan.pipelines, p)
+		}
+		plan.print(os.Stdout)
+		return
+	}
+
+	sources = make([]*sourceRun, len(inputs))
+	for i, location := range inputs {
+		run, err := openSource(location, opts)
+		if err != nil {
+			panic(defaultExitCode(exitInput, err))
+		}
+		defer run.closer.Close()
+		if *trackLatency {
+			run.latency = &latencyHistogram{}
+		}
+		sources[i] = run
+	}
+	// The live inputs are connected before the backfill is read,
+	// so that none of their trades are missed in between:
+	if *backfillPath != "" {
+		run, err := openSource(*backfillPath, opts)
+		if err != nil {
+			panic(defaultExitCode(exitInput, err))
+		}
+		defer run.closer.Close()
+		run.backfill = true
+		sources = append([]*sourceRun{run}, sources...)
+		bf = newBackfill()
+	}
+
+	meta, err := newRunMetadata(opts, pipelineConfigs, sources, remapConf)
 	if err != nil {
 		panic(err)
 	}
 
-	// Compute results:
-	computed := ag.Compute()
+	// Outputs are truncated (unless upserted), so they can't be read from:
+	for _, conf := range pipelineConfigs {
+		for _, other := range pipelineConfigs {
+			if conf.WarmStart != "" && conf.WarmStart == other.Output && !*upsert {
+				panic(withExitCode(exitUsage, fmt.Errorf("can't warm start from %s, which is also an output", conf.WarmStart)))
+			}
+		}
+	}
+	if *estimate {
+		if *estimateSample <= 0 {
+			panic(withExitCode(exitUsage, fmt.Errorf("invalid -estimate-sample %v", *estimateSample)))
+		}
+		numTrades, err = runEstimate(os.Stdout, sources, pipelineConfigs, estimateSettings{
+			sample:       *estimateSample,
+			timeMode:     *timeMode,
+			stateTTL:     *stateTTL,
+			maxMarkets:   *maxMarkets,
+			parseWorkers: *parseWorkers,
+			ioReaders:    *ioReaders,
+			format:       *format,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+	outs := newOutputs(outOpts)
+	for _, conf := range pipelineConfigs {
+		p, err := newPipeline(conf, inputs, outs, *timeMode, *stateTTL)
+		if err != nil {
+			panic(defaultExitCode(exitUsage, err))
+		}
+		if rep != nil {
+			p.observers = append(p.observers, rep.observe)
+		}
+		pipelines = append(pipelines, p)
+	}
+	var charts *charter
+	if *chartDir != "" {
+		if !hasWindows(pipelines) {
+			panic(withExitCode(exitUsage, fmt.Errorf("-charts requires windows")))
+		}
+		charts, err = newCharter(*chartDir, *chartFormat)
+		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+		for _, p := range pipelines {
+			if p.window > 0 {
+				p.observers = append(p.observers, charts.observe)
+			}
+		}
+	}
+	var checkpointCodec *feed.Codec
+	if *checkpoint != "" {
+		for _, p := range pipelines {
+			if p.window > 0 || p.idle != nil {
+				panic(withExitCode(exitUsage, fmt.Errorf("-checkpoint can't be used with windows or flushes of idle markets")))
+			}
+			// Nor with the state that a warm start can't resume:
+			if p.opts.Activity || p.opts.TrimmedMean > 0 {
+				panic(withExitCode(exitUsage, fmt.Errorf("pipeline %q: -checkpoint can't be used with activity metrics (e.g. of the full profile) or the trimmed mean, which can't be resumed", p.name)))
+			}
+		}
+		checkpointCodec, err = feed.GetCodec(*checkpointCompression, "")
+		if err == nil {
+			err = feed.CheckWritable(checkpointCodec)
+		}
+		if err != nil {
+			panic(withExitCode(exitUsage, fmt.Errorf("invalid -checkpoint-compression: %s", err)))
+		}
+	}
+	var queryDB string
+	if *query != "" {
+		queryDB, err = outs.duckDBPath()
+		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+	}
+
+	var guard *marketGuard
+	if *maxMarkets > 0 {
+		guard = newMarketGuard(*maxMarkets, *maxMarketsWarn)
+	}
+
+	// On interrupt (or on request, see controller), stop reading and print
+	// the results collected so far (live inputs never end on their own):
+	interrupted := int32(0)
+	stopped := int32(0)
+	closeSources := sync.Once{}
+	stopReading := func() {
+		atomic.StoreInt32(&stopped, 1)
+		closeSources.Do(func() {
+			for _, run := range sources {
+				run.closer.Close()
+			}
+		})
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		atomic.StoreInt32(&interrupted, 1)
+		stopReading()
+	}()
+	// On errors that abort the run, stop reading all the inputs:
+	var abortErr error
+	abort := func(err error) {
+		closeSources.Do(func() {
+			abortErr = err
+			for _, run := range sources {
+				run.closer.Close()
+			}
+		})
+	}
 
-	// Print results:
-	for _, mc := range computed {
-		res, err := json.MarshalToString(mc)
+	if *controlSocket != "" {
+		ctl := &controller{
+			pipelines:       pipelines,
+			outs:            outs,
+			stop:            stopReading,
+			checkpoint:      *checkpoint,
+			checkpointCodec: checkpointCodec,
+		}
+		for _, p := range pipelines {
+			p.windowEnded = ctl.windowEnded
+		}
+		listener, err := listenControl(*controlSocket, ctl)
 		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+		defer os.Remove(*controlSocket)
+		defer listener.Close()
+	}
+
+	// Quotes and book updates are routed to the pipelines that use them:
+	needsQuotes := false
+	needsBook := false
+	for _, p := range pipelines {
+		needsQuotes = needsQuotes || p.opts.Spreads
+		needsBook = needsBook || p.opts.BookDepth > 0
+	}
+	for _, run := range sources {
+		location := run.location
+		if needsQuotes {
+			qs, ok := run.source.(feed.QuoteSource)
+			if !ok {
+				panic(withExitCode(exitUsage, fmt.Errorf("input %s doesn't support quotes", run.location)))
+			}
+			qs.OnQuote(func(quote models.Quote) {
+				quote.Market = remap.market(quote.Market)
+				if err := guard.check(quote.Market); err != nil {
+					abort(err)
+					return
+				}
+				for _, p := range pipelines {
+					p.addQuote(location, quote)
+				}
+			})
+		}
+		if needsBook {
+			bs, ok := run.source.(feed.BookSource)
+			if !ok {
+				panic(withExitCode(exitUsage, fmt.Errorf("input %s doesn't support book updates", run.location)))
+			}
+			bs.OnBook(func(update models.BookUpdate) {
+				update.Market = remap.market(update.Market)
+				if err := guard.check(update.Market); err != nil {
+					abort(err)
+					return
+				}
+				for _, p := range pipelines {
+					p.addBookUpdate(location, update)
+				}
+			})
+		}
+	}
+
+	// Trades without a timestamp (or all of them, by arrival time)
+	// are timestamped on arrival, when needed:
+	arrivalTime := *timeMode == timeModeArrival
+	needsTime := false
+	for _, p := range pipelines {
+		needsTime = needsTime || p.needsTime()
+	}
+
+	// Pipelines with windows by arrival time emit their results as each window ends
+	// (those by trade timestamp as the trades go past its end):
+	stop := make(chan struct{})
+	if *progressInterval > 0 {
+		go reportProgress(os.Stderr, *progressInterval, &numTrades, sources, stop)
+	}
+	// The emitters run concurrently; the first of their errors is kept:
+	emitters := sync.WaitGroup{}
+	var emitMu sync.Mutex
+	var emitErr error
+	setEmitErr := func(err error) {
+		emitMu.Lock()
+		defer emitMu.Unlock()
+		if emitErr == nil {
+			emitErr = err
+		}
+	}
+	if *divergeWindow > 0 {
+		detector := &divergenceDetector{
+			a:         sources[0].location,
+			b:         sources[1].location,
+			agA:       pipelines[0].aggregator(sources[0].location),
+			agB:       pipelines[0].aggregator(sources[1].location),
+			window:    *divergeWindow,
+			threshold: *divergeThreshold,
+			out:       pipelines[0].out,
+		}
+		emitters.Add(1)
+		go func() {
+			defer emitters.Done()
+			if err := detector.run(stop); err != nil {
+				setEmitErr(err)
+			}
+		}()
+	}
+	for _, p := range pipelines {
+		if p.window == 0 || p.eventTime {
+			continue
+		}
+		emitters.Add(1)
+		go func(p *pipeline) {
+			defer emitters.Done()
+			if err := p.run(stop); err != nil {
+				setEmitErr(err)
+			}
+		}(p)
+	}
+
+	// Expired state is evicted periodically:
+	if *stateTTL > 0 {
+		tick := *stateTTL / 10
+		if tick < time.Second {
+			tick = time.Second
+		}
+		for _, p := range pipelines {
+			emitters.Add(1)
+			go func(p *pipeline) {
+				defer emitters.Done()
+				if err := p.expire(*stateTTL, tick, stop); err != nil {
+					setEmitErr(err)
+				}
+			}(p)
+		}
+	}
+
+	// read reads an input through the pipelines; the backfill is neither
+	// paced nor shed, and the trades of live inputs it has are skipped:
+	read := func(run *sourceRun) {
+		values := make([]float64, len(tradeVars))
+		runPace := pace
+		shedder := newShedder(*maxLag, *shedKeep)
+		if run.backfill {
+			runPace, shedder = nil, nil
+		}
+		run.err = run.source.Each(
+			func(trade models.Trade) bool {
+				run.parseErrors.record()
+				run.latency.record(trade.Timestamp)
+				runPace.wait(trade.Timestamp)
+				run.limiters.waitTrade()
+				if atomic.LoadInt32(&stopped) == 1 {
+					return false
+				}
+				trade.Market = remap.market(trade.Market)
+				if keep, err := enrich.enrich(&trade); err != nil {
+					abort(withExitCode(exitParse, fmt.Errorf("%s: %s", run.location, err)))
+					return false
+				} else if !keep {
+					return true
+				}
+				if run.backfill {
+					bf.add(trade)
+				} else if bf.skip(trade) {
+					return true
+				}
+				if err := guard.check(trade.Market); err != nil {
+					abort(err)
+					return false
+				}
+				atomic.AddUint64(&numTrades, 1)
+				if shedder.shed(trade) {
+					atomic.AddUint64(&numShed, 1)
+					for _, p := range pipelines {
+						p.shed(run.location, trade)
+					}
+					return true
+				}
+
+				if needsTime && (arrivalTime || trade.Timestamp == 0) {
+					trade.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+				}
+				values = tradeValues(trade, values)
+				for _, p := range pipelines {
+					if err := p.add(run.location, trade, values); err != nil {
+						abort(err)
+						return false
+					}
+				}
+				return true
+			},
+		)
+		if err := run.parseErrors.end(); err != nil {
+			abort(err)
+		}
+	}
+
+	// The backfill is read first, then the live inputs continue its windows:
+	for _, run := range sources {
+		if run.backfill {
+			read(run)
+			if run.err != nil && atomic.LoadInt32(&stopped) == 0 {
+				panic(defaultExitCode(exitInput, fmt.Errorf("error while reading backfill %s: %w", run.location, run.err)))
+			}
+		}
+	}
+	// Iterate over inputs (at most ioReaders at the same time):
+	wg := sync.WaitGroup{}
+	readers := make(chan struct{}, *ioReaders)
+	for _, run := range sources {
+		if run.backfill {
+			continue
+		}
+		wg.Add(1)
+		go func(run *sourceRun) {
+			defer wg.Done()
+			readers <- struct{}{}
+			defer func() { <-readers }()
+			if *pinReaders {
+				runtime.LockOSThread()
+				defer runtime.UnlockOSThread()
+			}
+			read(run)
+		}(run)
+	}
+	wg.Wait()
+	if abortErr != nil {
+		panic(abortErr)
+	}
+	for _, run := range sources {
+		if run.err != nil && atomic.LoadInt32(&stopped) == 0 {
+			panic(defaultExitCode(exitInput, fmt.Errorf("error while reading %s: %w", run.location, run.err)))
+		}
+	}
+
+	// Emit the results of the last windows:
+	close(stop)
+	emitters.Wait()
+	if emitErr != nil {
+		panic(defaultExitCode(exitOutput, emitErr))
+	}
+	for _, p := range pipelines {
+		if p.eventTime {
+			if err := p.emitLast(); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if *metadata == metadataPrepend {
+		if err := outs.writeAll(meta.record(numTrades)); err != nil {
+			panic(err)
+		}
+	}
+	if *checkpoint != "" {
+		// Before the results are emitted, which resets the markets:
+		if err := writeCheckpoint(*checkpoint, checkpointCodec, pipelines); err != nil {
+			panic(withExitCode(exitOutput, err))
+		}
+	}
+	if *divergeWindow == 0 {
+		// Compute and print the results of the pipelines without windows:
+		for _, p := range pipelines {
+			if p.window == 0 {
+				if err := p.emit(time.Time{}, time.Time{}); err != nil {
+					panic(err)
+				}
+			}
+		}
+	}
+	if *metadata == metadataAppend {
+		if err := outs.writeAll(meta.record(numTrades)); err != nil {
+			panic(err)
+		}
+	}
+	if err := outs.closeAll(); err != nil {
+		panic(err)
+	}
+	if charts != nil {
+		if err := charts.render(); err != nil {
+			panic(withExitCode(exitOutput, err))
+		}
+	}
+	if *query != "" {
+		if err := runDuckDB(queryDB, *query, os.Stdout); err != nil {
 			panic(err)
 		}
-		Ln(res)
+	}
+	if atomic.LoadInt32(&interrupted) == 1 {
+		panic(withExitCode(exitInterrupted, errors.New("interrupted")))
 	}
 }
 
-func NewAggregator() *Markets {
+func hasWindows(pipelines []*pipeline) bool {
+	for _, p := range pipelines {
+		if p.window > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func pipelineSuffix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (pipeline %q)", name)
+}
+
+// AggregatorOptions are the settings of an aggregator.
+type AggregatorOptions struct {
+	// Derived are the user-defined metrics computed for each trade;
+	// their sum and mean are computed for each market.
+	Derived []*DerivedMetric
+	// Activity enables the rate-of-activity metrics (trades per second),
+	// computed from the timestamps of the trades.
+	Activity bool
+	// ActivityHorizon bounds the seconds counted by the activity metrics
+	// to those within this long of the latest trade of each market
+	// (zero for no bound, see activity).
+	ActivityHorizon time.Duration
+	// NetFlow enables the net flow metric (buy volume minus sell volume).
+	NetFlow bool
+	// TrimmedMean enables the trimmed mean price, without this fraction
+	// of the lowest and of the highest prices of each market.
+	TrimmedMean float64
+	// Spreads enables the spread metrics, from quotes (see AddQuote).
+	Spreads bool
+	// BookDepth enables the order book metrics (see AddBookUpdate),
+	// computed over this number of levels of each side.
+	BookDepth int
+	// State adds the counts and sums of each market to the results,
+	// so that a later run can be resumed from them (see Restore).
+	State bool
+	// Profile is the output profile (see profileLegacy);
+	// extended and full profiles track the OHLC prices.
+	Profile string
+	// StateTTL enables the eviction of the state of the markets
+	// that have not been updated for this long (see Evict).
+	StateTTL time.Duration
+	// Having, if not nil, selects the markets whose results are returned.
+	Having *Having
+	// Script, if not nil, post-processes the results (after Having).
+	Script *Script
+}
+
+func NewAggregator(opts AggregatorOptions) *Markets {
 	return &Markets{
 		mu:     sync.RWMutex{},
-		mapper: map[int]*Market{},
+		mapper: map[uint64]*Market{},
+		opts:   opts,
+		quotes: newLastQuotes(),
+		books:  newOrderBooks(),
 	}
 }
 
@@ -134,77 +1010,273 @@ type Market struct {
 
 	totalVolume float64
 	totalPrice  float64
+	buyVolume   float64
 
 	numBuy    int
 	numTrades int
 
 	priceXvolumeSum float64
+
+	// derivedSums are the sums of the derived metrics, in the same order as AggregatorOptions.Derived.
+	derivedSums []float64
+
+	ohlc     ohlc
+	span     tradeSpan
+	prices   priceSketch
+	activity activity
+	spreads  spreads
+	book     bookStats
+
+	// numShed is the number of trades shed (see shedder).
+	numShed int
+
+	// lastSeen is the (arrival) time of the last update, in Unix nanoseconds,
+	// tracked with AggregatorOptions.StateTTL.
+	lastSeen int64
+	// lastTrade is the latest timestamp of its trades, in Unix milliseconds
+	// (see idleFlush).
+	lastTrade int64
+	// owner is the Markets whose mapper has the market: it changes when
+	// the market is handed over by Swap, and is nil once it is removed by
+	// evict, so that updates under way go to the current market of its ID
+	// (see lockMarket).
+	owner *Markets
 }
 
 type Markets struct {
 	mu     sync.RWMutex
-	mapper map[int]*Market
+	mapper map[uint64]*Market
+	opts   AggregatorOptions
+	// quotes and books are kept across Swap.
+	quotes *lastQuotes
+	books  *orderBooks
 }
 
-func NewMarket() *Market {
-	return &Market{}
+func NewMarket(numDerived int) *Market {
+	return &Market{
+		derivedSums: make([]float64, numDerived),
+	}
 }
 
-func (ag *Markets) GetMarket(id int) *Market {
+func (ag *Markets) GetMarket(id uint64) *Market {
 	ag.mu.RLock()
 	got, ok := ag.mapper[id]
 	ag.mu.RUnlock()
 	if !ok {
 		ag.mu.Lock()
-		created := NewMarket()
-		ag.mapper[id] = created
-		got = created
+		// Another goroutine might have created it in the meantime:
+		got, ok = ag.mapper[id]
+		if !ok {
+			got = NewMarket(len(ag.opts.Derived))
+			got.owner = ag
+			ag.mapper[id] = got
+		}
 		ag.mu.Unlock()
 	}
 	return got
 }
 
+// lockMarket calls f with the market of the given ID locked, creating it
+// if needed. A market evicted (see evict) or swapped out (see Swap) before
+// it is locked is looked up again, so that no update is applied to a market
+// whose results are already being computed.
+func (ag *Markets) lockMarket(id uint64, f func(*Market)) {
+	for {
+		done := false
+		ag.GetMarket(id).Lock(func(mkt *Market) {
+			if mkt.owner != ag {
+				return
+			}
+			f(mkt)
+			done = true
+		})
+		if done {
+			return
+		}
+	}
+}
+
+// Add processes the trade data for its market;
+// values are the variables of the trade (see tradeValues).
+func (ag *Markets) Add(trade models.Trade, values []float64) {
+	var mid float64
+	var quoted bool
+	if ag.opts.Spreads {
+		mid, quoted = ag.quotes.mid(trade.Market)
+	}
+	now := ag.now()
+
+	// Process trade data for the market:
+	ag.lockMarket(trade.Market, func(mkt *Market) {
+		mkt.numTrades++
+
+		mkt.totalVolume += trade.Volume
+		mkt.totalPrice += trade.Price
+		// The explicit conversion prevents the product from being fused
+		// with the sum (FMA) on some architectures, which would change the result:
+		mkt.priceXvolumeSum += float64(trade.Price * trade.Volume)
+
+		if trade.IsBuy {
+			mkt.numBuy++
+			mkt.buyVolume += trade.Volume
+		}
+
+		for i, derived := range ag.opts.Derived {
+			mkt.derivedSums[i] += derived.Program.Eval(values)
+		}
+
+		if ag.opts.Profile != profileLegacy {
+			mkt.ohlc.add(trade.Price, trade.Timestamp)
+			mkt.span.add(trade.Timestamp)
+		}
+
+		if ag.opts.TrimmedMean > 0 {
+			mkt.prices.add(trade.Price)
+		}
+
+		if ag.opts.Activity {
+			mkt.activity.add(trade.Timestamp, int64(ag.opts.ActivityHorizon/time.Second))
+		}
+
+		if ag.opts.Spreads {
+			mkt.spreads.addTrade(trade.Price, mid, quoted)
+		}
+
+		mkt.lastSeen = now
+		if trade.Timestamp > mkt.lastTrade {
+			mkt.lastTrade = trade.Timestamp
+		}
+	})
+}
+
+// Swap returns the current state, and resets the aggregator.
+func (ag *Markets) Swap() *Markets {
+	ag.mu.Lock()
+	defer ag.mu.Unlock()
+	old := &Markets{
+		mapper: ag.mapper,
+		opts:   ag.opts,
+		quotes: ag.quotes,
+		books:  ag.books,
+	}
+	// The updates under way of the markets handed over go to the new ones
+	// (see lockMarket), rather than to markets whose results are computed:
+	for _, mkt := range old.mapper {
+		mkt.Lock(func(mkt *Market) {
+			mkt.owner = old
+		})
+	}
+	ag.mapper = map[uint64]*Market{}
+	return old
+}
+
 type M map[string]interface{}
 
+// Compute returns the results of the markets, ordered by market.
 func (ag *Markets) Compute() []M {
 	out := make([]M, 0)
-	for id, mkt := range ag.mapper {
-		out = append(out,
-			M{
-				"market":         id,
-				"total_volume":   mkt.totalVolume,
-				"mean_volume":    mkt.totalVolume / float64(mkt.numTrades),
-				"mean_price":     mkt.totalPrice / float64(mkt.numTrades),
-				"percentage_buy": GetPercent(int64(mkt.numBuy), int64(mkt.numTrades)), // 0.00 - 100.00 %
-				"vwap":           mkt.priceXvolumeSum / mkt.totalVolume,
-			},
-		)
-	}
+	ag.ForEachResult(func(res MarketResult) bool {
+		out = append(out, res.Fields)
+		return true
+	})
 	return out
 }
 
-func (mkt *Market) Lock(f func(*Market)) {
-	mkt.mu.Lock()
-	defer mkt.mu.Unlock()
-	f(mkt)
+func sortMarkets(ids []uint64) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
 }
 
-func iterateLines(source io.Reader, iterator func(b []byte) bool) error {
+// MarketResult is the result of a market.
+type MarketResult struct {
+	Market uint64
+	// Fields are the fields of the result (including "market").
+	Fields M
+}
 
-	reader := bufio.NewReader(source)
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err != io.EOF {
-				return fmt.Errorf("error of reader: %s", err)
-			}
-			break
+// ForEachResult calls fn with the result of each market, ordered by market,
+// until fn returns false; each result is computed only when it is due, so that
+// results can be streamed however many markets there are.
+// New markets can't be added until ForEachResult returns.
+func (ag *Markets) ForEachResult(fn func(MarketResult) bool) {
+	ag.mu.RLock()
+	defer ag.mu.RUnlock()
+	ids := make([]uint64, 0, len(ag.mapper))
+	for id := range ag.mapper {
+		ids = append(ids, id)
+	}
+	sortMarkets(ids)
+	for _, id := range ids {
+		res := ag.compute(id, ag.mapper[id])
+		if res == nil {
+			continue
 		}
-		doContinue := iterator(line)
-		if !doContinue {
-			return nil
+		if !fn(MarketResult{Market: id, Fields: res}) {
+			return
 		}
 	}
+}
 
-	return nil
+// compute returns the result of a market,
+// or nil if it had no trades (only quotes or book updates).
+func (ag *Markets) compute(id uint64, mkt *Market) (res M) {
+	mkt.Lock(func(mkt *Market) {
+		if mkt.numTrades == 0 {
+			// All its trades were shed:
+			if mkt.numShed > 0 {
+				res = M{"market": id, "num_shed": mkt.numShed}
+			}
+			return
+		}
+		res = M{
+			"market":         id,
+			"total_volume":   mkt.totalVolume,
+			"mean_volume":    mkt.totalVolume / float64(mkt.numTrades),
+			"mean_price":     mkt.totalPrice / float64(mkt.numTrades),
+			"percentage_buy": GetPercent(int64(mkt.numBuy), int64(mkt.numTrades)), // 0.00 - 100.00 %
+			"vwap":           mkt.priceXvolumeSum / mkt.totalVolume,
+		}
+		for i, derived := range ag.opts.Derived {
+			res["total_"+derived.Name] = mkt.derivedSums[i]
+			res["mean_"+derived.Name] = mkt.derivedSums[i] / float64(mkt.numTrades)
+		}
+		if ag.opts.Profile != profileLegacy {
+			mkt.computeExtended(res)
+		}
+		if ag.opts.NetFlow {
+			res["net_flow"] = mkt.buyVolume - (mkt.totalVolume - mkt.buyVolume)
+		}
+		if ag.opts.TrimmedMean > 0 {
+			res["trimmed_mean_price"] = mkt.prices.trimmedMean(ag.opts.TrimmedMean)
+		}
+		if ag.opts.Activity {
+			mkt.activity.compute(res, mkt.numTrades)
+		}
+		if ag.opts.Spreads {
+			mkt.spreads.compute(res)
+		}
+		if ag.opts.BookDepth > 0 {
+			mkt.book.compute(res)
+		}
+		if ag.opts.State {
+			mkt.addState(res, ag.opts)
+		}
+		if mkt.numShed > 0 {
+			res["num_shed"] = mkt.numShed
+		}
+		if ag.opts.Having != nil && !ag.opts.Having.Match(res, mkt.numTrades) {
+			res = nil
+		}
+		if ag.opts.Script != nil && res != nil {
+			res = ag.opts.Script.Run(res, mkt.numTrades)
+		}
+	})
+	return res
+}
+
+func (mkt *Market) Lock(f func(*Market)) {
+	mkt.mu.Lock()
+	defer mkt.mu.Unlock()
+	f(mkt)
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// TestMarketsSwapConcurrentAdd checks that no trade is lost when the windows
+// roll over (see Swap) while trades are added: each window is read as soon
+// as it is swapped out, as by emit, so that a trade applied to it later would
+// be counted in no window. Run it with -race.
+func TestMarketsSwapConcurrentAdd(t *testing.T) {
+	const (
+		adders         = 8
+		tradesPerAdder = 20000
+		numMarkets     = 16
+	)
+	ag := NewAggregator(AggregatorOptions{})
+	var counted int64
+	window := func(old *Markets) {
+		for _, res := range old.Compute() {
+			counted += int64(res["total_volume"].(float64))
+		}
+	}
+
+	var adding sync.WaitGroup
+	var added int64
+	for i := 0; i < adders; i++ {
+		adding.Add(1)
+		go func(i int) {
+			defer adding.Done()
+			values := make([]float64, len(tradeVars))
+			for j := 0; j < tradesPerAdder; j++ {
+				trade := models.Trade{ID: j, Market: uint64((i + j) % numMarkets), Price: 1, Volume: 1}
+				ag.Add(trade, tradeValues(trade, values))
+				atomic.AddInt64(&added, 1)
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		adding.Wait()
+		close(done)
+	}()
+	swaps := 0
+	for running := true; running; swaps++ {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		window(ag.Swap())
+	}
+	window(ag.Swap())
+
+	if counted != added {
+		t.Fatalf("%v trades counted in %v windows, %v added", counted, swaps+1, added)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/expr"
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// Time modes: the time of a trade is either its own timestamp (event),
+// or the time it is read (arrival).
+const (
+	timeModeEvent   = "event"
+	timeModeArrival = "arrival"
+)
+
+// pipeline is an aggregation of the input trades,
+// with its own filter, metrics, window, and output.
+type pipeline struct {
+	name       string
+	filter     *expr.Program
+	window     time.Duration
+	tagSources bool
+	out        *output
+	opts       AggregatorOptions
+	// rollup maps the markets to the groups aggregated instead (if not nil).
+	rollup *rollup
+
+	// ags are the aggregators by source if tagSources,
+	// otherwise there is only one, for all sources (at "").
+	ags     map[string]*Markets
+	sources []string
+
+	// eventTime tells whether windows are by trade timestamp;
+	// otherwise they are by arrival time (see run).
+	eventTime bool
+	// windowMu guards windowStart, the start of the current window
+	// (by trade timestamp, it is zero until the first trade).
+	windowMu    sync.RWMutex
+	windowStart time.Time
+	// idle, if not nil, flushes the cold markets during the run.
+	idle *idleFlush
+	// lateness is the allowed lateness, for which the closed windows are kept.
+	lateness time.Duration
+	closed   []*closedWindow
+
+	numFiltered uint64
+	numLate     uint64
+
+	// observers are called with each result emitted (see reporter and charter).
+	observers []func(M)
+	// windowEnded, if not nil, is called after the results of each window
+	// are emitted (see controller).
+	windowEnded func()
+}
+
+func newPipeline(conf PipelineConfig, sources []string, outs *outputs, timeMode string, stateTTL time.Duration) (*pipeline, error) {
+	p := &pipeline{
+		name:       conf.Name,
+		window:     conf.Window,
+		tagSources: conf.TagSources,
+		ags:        map[string]*Markets{},
+		eventTime:  conf.Window > 0 && timeMode == timeModeEvent,
+		lateness:   conf.AllowedLateness,
+	}
+	if conf.Window < 0 {
+		return nil, fmt.Errorf("pipeline %q: invalid window %s", conf.Name, conf.Window)
+	}
+	if conf.AllowedLateness < 0 || (conf.AllowedLateness > 0 && !p.eventTime) {
+		return nil, fmt.Errorf("pipeline %q: an allowed lateness requires windows by event time", conf.Name)
+	}
+	var err error
+	p.idle, err = newIdleFlush(conf)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %q: %s", conf.Name, err)
+	}
+	if conf.rollup != nil {
+		p.rollup, err = newRollup(*conf.rollup)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %q: %s", conf.Name, err)
+		}
+	}
+	exprs, err := compilePipelineExprs(conf)
+	if err != nil {
+		return nil, err
+	}
+	p.filter = exprs.filter
+	profile, err := parseProfile(conf.Profile)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %q: %s", conf.Name, err)
+	}
+	if conf.TrimmedMean < 0 || conf.TrimmedMean >= 50 {
+		return nil, fmt.Errorf("pipeline %q: invalid trimmed mean %v%%: must be from 0 to 50", conf.Name, conf.TrimmedMean)
+	}
+	aggOpts := AggregatorOptions{
+		Activity:        conf.Activity,
+		ActivityHorizon: conf.ActivityHorizon,
+		NetFlow:         conf.NetFlow,
+		TrimmedMean:     conf.TrimmedMean / 100,
+		Spreads:         conf.Quotes,
+		BookDepth:       conf.BookDepth,
+		State:           conf.State,
+		Profile:         profile,
+		StateTTL:        stateTTL,
+		Derived:         exprs.derived,
+		Having:          exprs.having,
+		Script:          exprs.script,
+	}
+	if conf.ActivityHorizon < 0 || (conf.ActivityHorizon > 0 && conf.ActivityHorizon < time.Second) {
+		return nil, fmt.Errorf("pipeline %q: invalid activity horizon %s: must be at least 1s", conf.Name, conf.ActivityHorizon)
+	}
+	if aggOpts.ActivityHorizon == 0 {
+		aggOpts.ActivityHorizon = defaultActivityHorizon
+	}
+	if profile == profileFull {
+		aggOpts.Activity = true
+		aggOpts.NetFlow = true
+		aggOpts.State = true
+	}
+	// Without outputs, results are only collected (see service):
+	if outs != nil {
+		p.out, err = outs.get(conf.Output)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %q: %w", conf.Name, err)
+		}
+	}
+
+	if p.tagSources {
+		p.sources = sources
+	} else {
+		p.sources = []string{""}
+	}
+	for _, source := range p.sources {
+		p.ags[source] = NewAggregator(aggOpts)
+	}
+	p.opts = aggOpts
+	if conf.WarmStart != "" {
+		// Windows, the rate of activity, and the distribution of the prices
+		// can't be resumed:
+		if conf.Window > 0 || aggOpts.Activity || aggOpts.TrimmedMean > 0 {
+			return nil, fmt.Errorf("pipeline %q: a warm start can't be used with windows, activity metrics or the trimmed mean", conf.Name)
+		}
+		if err := p.warmStart(conf.WarmStart); err != nil {
+			return nil, withExitCode(exitInput, fmt.Errorf("pipeline %q: %s", conf.Name, err))
+		}
+	}
+	return p, nil
+}
+
+// pipelineExprs are the compiled expressions of a pipeline.
+type pipelineExprs struct {
+	filter  *expr.Program
+	derived []*DerivedMetric
+	having  *Having
+	script  *Script
+}
+
+// compilePipelineExprs compiles the filter, derived metrics, having clause
+// and script of the pipeline; it's also called at startup, so that invalid
+// expressions (or ones that can't be used with the state) are rejected
+// before any input is read.
+func compilePipelineExprs(conf PipelineConfig) (pipelineExprs, error) {
+	var exprs pipelineExprs
+	var err error
+	if conf.Filter != "" {
+		exprs.filter, err = expr.CompileBool(conf.Filter, tradeVars)
+		if err != nil {
+			return exprs, fmt.Errorf("pipeline %q: %s", conf.Name, err)
+		}
+	}
+	for _, def := range conf.Derive {
+		derived, err := ParseDerivedMetric(def)
+		if err != nil {
+			return exprs, fmt.Errorf("pipeline %q: %s", conf.Name, err)
+		}
+		exprs.derived = append(exprs.derived, derived)
+	}
+	if conf.Having != "" {
+		exprs.having, err = CompileHaving(conf.Having, exprs.derived)
+		if err != nil {
+			return exprs, fmt.Errorf("pipeline %q: %s", conf.Name, err)
+		}
+	}
+	if conf.Script != "" {
+		exprs.script, err = CompileScript(conf.Script, exprs.derived)
+		if err != nil {
+			return exprs, fmt.Errorf("pipeline %q: %s", conf.Name, err)
+		}
+	}
+	// A warm start resumes from the results with state, which must then
+	// have every market, with its state fields as they are computed:
+	if (exprs.having != nil || exprs.script != nil) && (conf.State || conf.Profile == profileFull) {
+		return exprs, fmt.Errorf("pipeline %q: -having and -script can't be used with -state or -output-profile=full, as a warm start from their results would lose the markets dropped and the fields changed", conf.Name)
+	}
+	return exprs, nil
+}
+
+// needsTime tells whether the pipeline needs the time of each trade.
+func (p *pipeline) needsTime() bool {
+	if p.opts.Activity || p.eventTime || p.idle != nil {
+		return true
+	}
+	if p.filter != nil {
+		for _, v := range p.filter.Variables() {
+			if v == "timestamp" {
+				return true
+			}
+		}
+	}
+	for _, derived := range p.opts.Derived {
+		for _, v := range derived.Program.Variables() {
+			if v == "timestamp" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// aggregator returns the aggregator for the given source.
+func (p *pipeline) aggregator(source string) *Markets {
+	if !p.tagSources {
+		return p.ags[""]
+	}
+	return p.ags[source]
+}
+
+// add processes a trade; values are the variables of the trade (see tradeValues).
+func (p *pipeline) add(source string, trade models.Trade, values []float64) error {
+	if p.filter != nil && !p.filter.EvalBool(values) {
+		atomic.AddUint64(&p.numFiltered, 1)
+		return nil
+	}
+	if p.rollup != nil {
+		trade.Market = p.rollup.group(trade.Market)
+	}
+	if p.eventTime {
+		return p.addByEventTime(source, trade, values)
+	}
+	if p.idle != nil {
+		return p.addIdle(source, trade, values)
+	}
+	p.aggregator(source).Add(trade, values)
+	return nil
+}
+
+// addByEventTime adds the trade to the window of its timestamp:
+// a trade past the end of the current window ends it (emitting its results),
+// while a trade before its start is late (see addLate).
+func (p *pipeline) addByEventTime(source string, trade models.Trade, values []float64) error {
+	ts := time.Unix(0, trade.Timestamp*int64(time.Millisecond)).UTC()
+
+	// Most trades fall in the current window:
+	p.windowMu.RLock()
+	start := p.windowStart
+	if !start.IsZero() && !ts.Before(start) && ts.Before(start.Add(p.window)) {
+		p.aggregator(source).Add(trade, values)
+		p.windowMu.RUnlock()
+		return nil
+	}
+	p.windowMu.RUnlock()
+
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+	switch {
+	case p.windowStart.IsZero():
+		p.windowStart = ts.Truncate(p.window)
+	case ts.Before(p.windowStart):
+		return p.addLate(source, trade, values, ts)
+	case !ts.Before(p.windowStart.Add(p.window)):
+		if err := p.emit(p.windowStart, p.windowStart.Add(p.window)); err != nil {
+			return err
+		}
+		p.windowStart = ts.Truncate(p.window)
+	}
+	p.aggregator(source).Add(trade, values)
+	return nil
+}
+
+// addQuote processes a quote.
+func (p *pipeline) addQuote(source string, quote models.Quote) {
+	if !p.opts.Spreads {
+		return
+	}
+	p.aggregator(source).AddQuote(quote)
+}
+
+// addBookUpdate processes an order book update.
+func (p *pipeline) addBookUpdate(source string, update models.BookUpdate) {
+	if p.opts.BookDepth <= 0 {
+		return
+	}
+	p.aggregator(source).AddBookUpdate(update)
+}
+
+// run emits the results of each window (by arrival time) as soon as it ends,
+// until stop is closed; then it emits the results of the last (partial) window.
+func (p *pipeline) run(stop <-chan struct{}) error {
+	start := time.Now().Truncate(p.window)
+	for {
+		p.windowMu.Lock()
+		p.windowStart = start
+		p.windowMu.Unlock()
+		end := start.Add(p.window)
+		timer := time.NewTimer(time.Until(end))
+		select {
+		case <-timer.C:
+			if err := p.emit(start, end); err != nil {
+				return err
+			}
+			start = end
+		case <-stop:
+			timer.Stop()
+			return p.emit(start, end)
+		}
+	}
+}
+
+// emitLast emits the results of the last window by trade timestamp (if any).
+func (p *pipeline) emitLast() error {
+	p.windowMu.Lock()
+	defer p.windowMu.Unlock()
+	if p.windowStart.IsZero() {
+		return nil
+	}
+	return p.emit(p.windowStart, p.windowStart.Add(p.window))
+}
+
+// emit writes the results of the current window, and starts a new one.
+// For pipelines without windows, start and end are ignored.
+// Results are streamed to the output in batches.
+func (p *pipeline) emit(start time.Time, end time.Time) error {
+	var batch []M
+	var err error
+	closed := map[string]*Markets{}
+	for _, source := range p.sources {
+		ag := p.ags[source].Swap()
+		closed[source] = ag
+		ag.ForEachResult(func(res MarketResult) bool {
+			batch = append(batch, p.tagResult(res.Fields, source, start, end))
+			p.observe(res.Fields)
+			if len(batch) == emitBatchSize {
+				err = p.out.write(batch)
+				batch = batch[:0]
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if p.lateness > 0 {
+		p.keepClosed(start, closed)
+	}
+	if err := p.out.write(batch); err != nil {
+		return err
+	}
+	if p.window > 0 && p.windowEnded != nil {
+		p.windowEnded()
+	}
+	return nil
+}
+
+// observe calls the observers with an emitted result.
+func (p *pipeline) observe(res M) {
+	for _, observer := range p.observers {
+		observer(res)
+	}
+}
+
+// emitBatchSize is the maximum number of results written at once by emit.
+const emitBatchSize = 64 * 1024
+
+// collect returns the results of the current window;
+// if reset is true, a new one is started.
+func (p *pipeline) collect(start time.Time, end time.Time, reset bool) []M {
+	var results []M
+	for _, source := range p.sources {
+		ag := p.ags[source]
+		if reset {
+			ag = ag.Swap()
+		}
+		results = append(results, p.tag(ag.Compute(), source, start, end)...)
+	}
+	return results
+}
+
+// tag tags the results of the given source with the source, pipeline, and window.
+func (p *pipeline) tag(results []M, source string, start time.Time, end time.Time) []M {
+	for _, res := range results {
+		p.tagResult(res, source, start, end)
+	}
+	return results
+}
+
+func (p *pipeline) tagResult(res M, source string, start time.Time, end time.Time) M {
+	if p.rollup != nil {
+		p.rollup.tag(res)
+	}
+	if p.tagSources {
+		res["source"] = source
+	}
+	if p.name != "" {
+		res["pipeline"] = p.name
+	}
+	if p.window > 0 {
+		res["window_start"] = start
+		res["window_end"] = end
+	}
+	return res
+}
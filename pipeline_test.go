@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// TestPipelineArrivalWindowsConcurrentAdd checks that, with windows by
+// arrival time, no trade is lost when the windows are emitted (as by run)
+// while the readers add trades: every trade (of volume 1) must be counted in the results
+// of exactly one window. Run it with -race.
+func TestPipelineArrivalWindowsConcurrentAdd(t *testing.T) {
+	const (
+		readers         = 8
+		tradesPerReader = 100000
+		numMarkets      = 16
+	)
+	p, err := newPipeline(PipelineConfig{Window: time.Hour}, []string{""}, nil, timeModeArrival, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The results are only observed, so that the windows roll over often:
+	p.out = &output{name: "discard", sink: discardSink{}}
+	var counted float64
+	p.observers = append(p.observers, func(res M) {
+		counted += res["total_volume"].(float64)
+	})
+
+	var reading sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		reading.Add(1)
+		go func(i int) {
+			defer reading.Done()
+			values := make([]float64, len(tradeVars))
+			for j := 0; j < tradesPerReader; j++ {
+				trade := models.Trade{ID: j, Market: uint64((i + j) % numMarkets), Price: 1, Volume: 1}
+				if err := p.add("", trade, tradeValues(trade, values)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		reading.Wait()
+		close(done)
+	}()
+	start := time.Now().Truncate(p.window)
+	windows := 0
+	for running := true; running; windows++ {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		end := start.Add(p.window)
+		if err := p.emit(start, end); err != nil {
+			t.Fatal(err)
+		}
+		start = end
+	}
+
+	if added := float64(readers * tradesPerReader); counted != added {
+		t.Fatalf("%v trades counted in %v windows, %v added", counted, windows, added)
+	}
+}
+
+// discardSink is an output sink that discards the results.
+type discardSink struct{}
+
+func (discardSink) write([]M) error { return nil }
+
+func (discardSink) close() error { return nil }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PrecisionConfig is a precision rules file (see -price-precision): the number
+// of decimal places of the prices of the results, so that the prices of
+// sub-cent markets keep their significant digits while those of large-cap
+// markets stay compact.
+type PrecisionConfig struct {
+	// Markets are the precisions of specific markets.
+	Markets map[uint64]MarketPrecision `yaml:"markets"`
+	// Magnitudes apply to the prices of the other markets: the rule with the
+	// lowest Below above the magnitude of the price (a rule without Below
+	// applies to all the others).
+	Magnitudes []MagnitudeRule `yaml:"magnitudes"`
+}
+
+// MarketPrecision is the precision of the prices of a market: as many decimal
+// places as its TickSize (e.g. 4 for 0.0005), or Decimals.
+type MarketPrecision struct {
+	TickSize float64 `yaml:"tick_size"`
+	Decimals *int    `yaml:"decimals"`
+}
+
+// MagnitudeRule is the number of decimal places of the prices below
+// a magnitude (in absolute value).
+type MagnitudeRule struct {
+	Below    float64 `yaml:"below"`
+	Decimals int     `yaml:"decimals"`
+}
+
+// priceFields are the fields of the results that are prices.
+var priceFields = map[string]bool{
+	"mean_price":         true,
+	"trimmed_mean_price": true,
+	"vwap":               true,
+	"open":               true,
+	"high":               true,
+	"low":                true,
+	"close":              true,
+}
+
+// precisionRules are the compiled rules of a PrecisionConfig.
+type precisionRules struct {
+	markets map[uint64]int
+	// magnitudes are sorted by Below, with the default rule (if any) last.
+	magnitudes []MagnitudeRule
+}
+
+func LoadPrecision(path string) (*precisionRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading precision rules: %s", err)
+	}
+	var conf PrecisionConfig
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		return nil, fmt.Errorf("error while parsing precision rules %s: %s", path, err)
+	}
+	rules := &precisionRules{markets: map[uint64]int{}}
+	for market, mp := range conf.Markets {
+		switch {
+		case mp.Decimals != nil && mp.TickSize == 0 && *mp.Decimals >= 0:
+			rules.markets[market] = *mp.Decimals
+		case mp.Decimals == nil && mp.TickSize > 0:
+			rules.markets[market] = tickDecimals(mp.TickSize)
+		default:
+			return nil, fmt.Errorf("precision rules %s: market %v requires either a positive tick_size or decimals", path, market)
+		}
+	}
+	defaults := 0
+	for _, rule := range conf.Magnitudes {
+		if rule.Below < 0 || rule.Decimals < 0 {
+			return nil, fmt.Errorf("precision rules %s: invalid magnitude rule (below %v, decimals %v)", path, rule.Below, rule.Decimals)
+		}
+		if rule.Below == 0 {
+			defaults++
+		}
+		rules.magnitudes = append(rules.magnitudes, rule)
+	}
+	if defaults > 1 {
+		return nil, fmt.Errorf("precision rules %s: more than one magnitude rule without below", path)
+	}
+	sort.Slice(rules.magnitudes, func(i, j int) bool {
+		a, b := rules.magnitudes[i].Below, rules.magnitudes[j].Below
+		return a != 0 && (b == 0 || a < b)
+	})
+	return rules, nil
+}
+
+// tickDecimals returns the number of decimal places of a tick size.
+func tickDecimals(tick float64) int {
+	s := strconv.FormatFloat(tick, 'f', -1, 64)
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		return len(s) - dot - 1
+	}
+	return 0
+}
+
+// decimals returns the number of decimal places of a price of a market
+// (ok is false if no rule applies).
+func (rules *precisionRules) decimals(res M, price float64) (int, bool) {
+	if market, ok := res["market"].(uint64); ok {
+		if decimals, ok := rules.markets[market]; ok {
+			return decimals, true
+		}
+	}
+	magnitude := math.Abs(price)
+	for _, rule := range rules.magnitudes {
+		if rule.Below == 0 || magnitude < rule.Below {
+			return rule.Decimals, true
+		}
+	}
+	return 0, false
+}
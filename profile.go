@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Output profiles select the metrics of the results:
+// legacy has the original metrics (plus the ones enabled explicitly),
+// extended adds the counts, the OHLC prices and the time span of each market,
+// and full adds the activity metrics and the state (counts and sums).
+const (
+	profileLegacy   = "legacy"
+	profileExtended = "extended"
+	profileFull     = "full"
+)
+
+func parseProfile(profile string) (string, error) {
+	switch profile {
+	case "":
+		return profileLegacy, nil
+	case profileLegacy, profileExtended, profileFull:
+		return profile, nil
+	default:
+		return "", fmt.Errorf("invalid output profile %q: must be legacy, extended, or full", profile)
+	}
+}
+
+// ohlc tracks the open, high, low, and close prices of a market:
+// open and close are by trade timestamp (or in input order).
+type ohlc struct {
+	set     bool
+	open    float64
+	high    float64
+	low     float64
+	close   float64
+	openTS  int64
+	closeTS int64
+}
+
+func (o *ohlc) add(price float64, ts int64) {
+	if !o.set {
+		*o = ohlc{
+			set:     true,
+			open:    price,
+			high:    price,
+			low:     price,
+			close:   price,
+			openTS:  ts,
+			closeTS: ts,
+		}
+		return
+	}
+	if ts < o.openTS {
+		o.open = price
+		o.openTS = ts
+	}
+	if ts >= o.closeTS {
+		o.close = price
+		o.closeTS = ts
+	}
+	o.high = math.Max(o.high, price)
+	o.low = math.Min(o.low, price)
+}
+
+// restore restores the prices of a previous run:
+// its open comes before, and its close after, those of any new trade.
+func (o *ohlc) restore(open, high, low, close float64) {
+	o.add(open, math.MinInt64)
+	o.high = math.Max(o.high, high)
+	o.low = math.Min(o.low, low)
+	if o.closeTS == math.MinInt64 {
+		o.close = close
+	}
+}
+
+// tradeSpan tracks the timestamps (Unix milliseconds) of the first and the
+// last trades of a market; trades without a timestamp are ignored.
+type tradeSpan struct {
+	first int64
+	last  int64
+}
+
+func (s *tradeSpan) add(ts int64) {
+	if ts == 0 {
+		return
+	}
+	if s.first == 0 || ts < s.first {
+		s.first = ts
+	}
+	if ts > s.last {
+		s.last = ts
+	}
+}
+
+// compute adds the time span to the result: the times of the first and
+// the last trades, and the seconds between them.
+func (s *tradeSpan) compute(res M) {
+	if s.first == 0 {
+		return
+	}
+	res["first_trade_ts"] = time.Unix(0, s.first*int64(time.Millisecond)).UTC()
+	res["last_trade_ts"] = time.Unix(0, s.last*int64(time.Millisecond)).UTC()
+	res["active_span"] = float64(s.last-s.first) / 1000
+}
+
+// computeExtended adds the metrics of the extended profile to the result.
+func (mkt *Market) computeExtended(res M) {
+	res["num_trades"] = mkt.numTrades
+	res["num_buy"] = mkt.numBuy
+	res["num_sell"] = mkt.numTrades - mkt.numBuy
+	if mkt.ohlc.set {
+		res["open"] = mkt.ohlc.open
+		res["high"] = mkt.ohlc.high
+		res["low"] = mkt.ohlc.low
+		res["close"] = mkt.ohlc.close
+	}
+	mkt.span.compute(res)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// runPropTest implements the proptest subcommand, which checks the
+// aggregation against a brute-force computation of each metric, over
+// random sets of trades: every field of the results must be checked, so
+// that a new metric fails until its brute force is added to expectedResult.
+func runPropTest(args []string) int {
+	flags := flag.NewFlagSet("proptest", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s proptest [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	runs := flags.Int("runs", 1000, "Number of random sets of trades")
+	seed := flags.Int64("seed", 0, "Seed of the first set (0 for a random one); set i uses seed+i, so that a failure can be replayed with -runs=1")
+	maxTrades := flags.Int("max-trades", 1000, "Maximum number of trades of a set")
+	numMarkets := flags.Int("markets", 10, "Maximum number of markets of a set")
+	tolerance := flags.Float64("tolerance", 1e-9, "Relative tolerance of the floating-point metrics")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	if *runs <= 0 || *maxTrades <= 0 || *numMarkets <= 0 || *tolerance < 0 {
+		panic(withExitCode(exitUsage, fmt.Errorf("invalid -runs %v, -max-trades %v, -markets %v or -tolerance %v", *runs, *maxTrades, *numMarkets, *tolerance)))
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	failed := 0
+	for i := 0; i < *runs; i++ {
+		t := &propTest{
+			rnd:       rand.New(rand.NewSource(*seed + int64(i))),
+			tolerance: *tolerance,
+		}
+		trades := t.trades(*maxTrades, *numMarkets)
+		t.check(trades)
+		t.checkRestore(trades)
+		if len(t.failures) > 0 {
+			failed++
+			fmt.Fprintf(os.Stderr, "Set with seed %v (%v trades, %s):\n", *seed+int64(i), len(trades), t.describe())
+			for _, failure := range t.failures {
+				fmt.Fprintf(os.Stderr, "  %s\n", failure)
+			}
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%v of %v sets failed (seed %v)\n", failed, *runs, *seed)
+		return exitFailure
+	}
+	fmt.Fprintf(os.Stderr, "%v sets passed (seed %v)\n", *runs, *seed)
+	return exitOK
+}
+
+// propTest is a check of a random set of trades.
+type propTest struct {
+	rnd       *rand.Rand
+	tolerance float64
+	opts      AggregatorOptions
+	failures  []string
+}
+
+// trades generates a set of trades, with prices of any magnitude
+// (and a few bad prints), some zero volumes, and increasing timestamps.
+func (t *propTest) trades(maxTrades int, maxMarkets int) []models.Trade {
+	numMarkets := 1 + t.rnd.Intn(maxMarkets)
+	trades := make([]models.Trade, t.rnd.Intn(maxTrades+1))
+	ts := int64(1640995200000) + t.rnd.Int63n(int64(24*time.Hour/time.Millisecond))
+	for i := range trades {
+		price := math.Pow(10, -4+9*t.rnd.Float64()) * (1 + t.rnd.Float64())
+		if t.rnd.Intn(100) == 0 {
+			price *= 1000
+		}
+		volume := t.rnd.Float64() * 100
+		if t.rnd.Intn(20) == 0 {
+			volume = 0
+		}
+		ts += t.rnd.Int63n(1500)
+		trades[i] = models.Trade{
+			ID:        i,
+			Market:    uint64(1 + t.rnd.Intn(numMarkets)),
+			Price:     price,
+			Volume:    volume,
+			IsBuy:     t.rnd.Intn(2) == 0,
+			Timestamp: ts,
+		}
+	}
+	return trades
+}
+
+// check compares the results of the aggregation of the trades, with random
+// options, to the brute force.
+func (t *propTest) check(trades []models.Trade) {
+	t.opts = AggregatorOptions{
+		Profile:  profileFull,
+		Activity: true,
+		NetFlow:  true,
+		State:    true,
+	}
+	if t.rnd.Intn(2) == 0 {
+		t.opts.Profile = profileLegacy
+		t.opts.Activity = t.rnd.Intn(2) == 0
+		t.opts.NetFlow = t.rnd.Intn(2) == 0
+		t.opts.State = t.rnd.Intn(2) == 0
+	}
+	if trim := []float64{0, 0.01, 0.05, 0.2}[t.rnd.Intn(4)]; trim > 0 {
+		t.opts.TrimmedMean = trim
+	}
+	if t.rnd.Intn(2) == 0 {
+		derived, err := ParseDerivedMetric("notional=price*volume")
+		if err != nil {
+			panic(err)
+		}
+		t.opts.Derived = []*DerivedMetric{derived}
+	}
+	// The trades arrive in any order (e.g. from several inputs):
+	shuffled := append([]models.Trade(nil), trades...)
+	t.rnd.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	ag := NewAggregator(t.opts)
+	values := make([]float64, len(tradeVars))
+	for _, trade := range shuffled {
+		values = tradeValues(trade, values)
+		ag.Add(trade, values)
+	}
+	t.compare("", ag.Compute(), shuffled)
+}
+
+// checkRestore checks that the results of the aggregation of the trades
+// resumed (see Restore) from those of a part of them are the same; the
+// trades are in the order of their timestamps, as a resumed run expects.
+func (t *propTest) checkRestore(trades []models.Trade) {
+	// Activity metrics and the trimmed mean can't be resumed:
+	opts := AggregatorOptions{Profile: profileExtended, NetFlow: true, State: true, Derived: t.opts.Derived}
+	split := 0
+	if len(trades) > 0 {
+		split = t.rnd.Intn(len(trades))
+	}
+	values := make([]float64, len(tradeVars))
+	first := NewAggregator(opts)
+	for _, trade := range trades[:split] {
+		values = tradeValues(trade, values)
+		first.Add(trade, values)
+	}
+	ag := NewAggregator(opts)
+	format := outputOptions{floatPrecision: -1, undefined: undefinedNull}
+	for _, res := range first.Compute() {
+		line, err := json.Marshal(format.format(res))
+		if err != nil {
+			panic(err)
+		}
+		decoded, err := decodeResult(line)
+		if err != nil {
+			panic(err)
+		}
+		if err := ag.Restore(decoded); err != nil {
+			t.failures = append(t.failures, fmt.Sprintf("restore after %v trades: %s", split, err))
+			return
+		}
+	}
+	for _, trade := range trades[split:] {
+		values = tradeValues(trade, values)
+		ag.Add(trade, values)
+	}
+	saved := t.opts
+	t.opts = opts
+	t.compare(fmt.Sprintf("restored after %v trades: ", split), ag.Compute(), trades)
+	t.opts = saved
+}
+
+// compare compares the results to the brute force, field by field.
+func (t *propTest) compare(prefix string, results []M, trades []models.Trade) {
+	byMarket := map[uint64][]models.Trade{}
+	for _, trade := range trades {
+		byMarket[trade.Market] = append(byMarket[trade.Market], trade)
+	}
+	if len(results) != len(byMarket) {
+		t.failures = append(t.failures, fmt.Sprintf("%s%v results, expected %v", prefix, len(results), len(byMarket)))
+		return
+	}
+	for _, res := range results {
+		market, _ := res["market"].(uint64)
+		expected := t.expectedResult(market, byMarket[market])
+		if expected == nil {
+			t.failures = append(t.failures, fmt.Sprintf("%sunexpected market %v", prefix, res["market"]))
+			continue
+		}
+		names := make([]string, 0, len(res))
+		for name := range res {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			want, ok := expected[name]
+			if !ok {
+				t.failures = append(t.failures, fmt.Sprintf("%smarket %v: %s is not checked (add its brute force to expectedResult)", prefix, market, name))
+				continue
+			}
+			if !t.equal(name, res[name], want) {
+				t.failures = append(t.failures, fmt.Sprintf("%smarket %v: %s is %v, expected %v", prefix, market, name, res[name], want))
+			}
+		}
+		for name := range expected {
+			if _, ok := res[name]; !ok {
+				t.failures = append(t.failures, fmt.Sprintf("%smarket %v: %s is missing", prefix, market, name))
+			}
+		}
+	}
+}
+
+// expectedResult computes the result of a market by brute force,
+// from the definitions of the metrics.
+func (t *propTest) expectedResult(market uint64, trades []models.Trade) M {
+	if len(trades) == 0 {
+		return nil
+	}
+	n := float64(len(trades))
+	var totalVolume, totalPrice, priceVolume, buyVolume float64
+	numBuy := 0
+	for _, trade := range trades {
+		totalVolume += trade.Volume
+		totalPrice += trade.Price
+		priceVolume += trade.Price * trade.Volume
+		if trade.IsBuy {
+			numBuy++
+			buyVolume += trade.Volume
+		}
+	}
+	res := M{
+		"market":         market,
+		"total_volume":   totalVolume,
+		"mean_volume":    totalVolume / n,
+		"mean_price":     totalPrice / n,
+		"percentage_buy": float64(numBuy) / n * 100,
+		"vwap":           priceVolume / totalVolume,
+	}
+	for _, derived := range t.opts.Derived {
+		sum := 0.0
+		values := make([]float64, len(tradeVars))
+		for _, trade := range trades {
+			sum += derived.Program.Eval(tradeValues(trade, values))
+		}
+		res["total_"+derived.Name] = sum
+		res["mean_"+derived.Name] = sum / n
+	}
+	if t.opts.Profile != profileLegacy {
+		// The open is the earliest trade (the first one to arrive, among
+		// those at the same time), the close the latest (the last one):
+		open, close := trades[0], trades[0]
+		high, low := math.Inf(-1), math.Inf(1)
+		for _, trade := range trades {
+			if trade.Timestamp < open.Timestamp {
+				open = trade
+			}
+			if trade.Timestamp >= close.Timestamp {
+				close = trade
+			}
+			high = math.Max(high, trade.Price)
+			low = math.Min(low, trade.Price)
+		}
+		res["num_trades"] = len(trades)
+		res["num_buy"] = numBuy
+		res["num_sell"] = len(trades) - numBuy
+		res["open"] = open.Price
+		res["high"] = high
+		res["low"] = low
+		res["close"] = close.Price
+		res["first_trade_ts"] = time.Unix(0, open.Timestamp*int64(time.Millisecond)).UTC()
+		res["last_trade_ts"] = time.Unix(0, close.Timestamp*int64(time.Millisecond)).UTC()
+		res["active_span"] = float64(close.Timestamp-open.Timestamp) / 1000
+	}
+	if t.opts.NetFlow {
+		res["net_flow"] = buyVolume - (totalVolume - buyVolume)
+	}
+	if t.opts.TrimmedMean > 0 {
+		prices := make([]float64, len(trades))
+		for i, trade := range trades {
+			prices[i] = trade.Price
+		}
+		sort.Float64s(prices)
+		drop := int(n * t.opts.TrimmedMean)
+		res["trimmed_mean_price"] = math.NaN()
+		if keep := len(prices) - 2*drop; keep > 0 {
+			sum := 0.0
+			for _, price := range prices[drop : drop+keep] {
+				sum += price
+			}
+			res["trimmed_mean_price"] = sum / float64(keep)
+		}
+	}
+	if t.opts.Activity {
+		// The trades of each whole second (the timestamps are positive):
+		perSecond := map[int64]int64{}
+		firstSecond, lastSecond := trades[0].Timestamp/1000, trades[0].Timestamp/1000
+		for _, trade := range trades {
+			second := trade.Timestamp / 1000
+			perSecond[second]++
+			if second < firstSecond {
+				firstSecond = second
+			}
+			if second > lastSecond {
+				lastSecond = second
+			}
+		}
+		// The peak is that of the busiest second (the earliest of them), the
+		// mean that of every second from the first trade to the last one:
+		var peak, peakSecond, total, seconds int64
+		for second := firstSecond; second <= lastSecond; second++ {
+			if perSecond[second] > peak {
+				peak, peakSecond = perSecond[second], second
+			}
+			total += perSecond[second]
+			seconds++
+		}
+		res["peak_tps"] = peak
+		res["mean_tps"] = float64(total) / float64(seconds)
+		res["busiest_second"] = time.Unix(peakSecond, 0).UTC()
+	}
+	if t.opts.State {
+		res[stateNumTrades] = len(trades)
+		res[stateNumBuy] = numBuy
+		res[stateTotalPrice] = totalPrice
+		res[statePriceVolumeSum] = priceVolume
+		if t.opts.NetFlow {
+			res[stateBuyVolume] = buyVolume
+		}
+	}
+	return res
+}
+
+// equal compares a field of a result to its expected value:
+// floats within the tolerance (the trimmed mean, within the accuracy
+// of the price sketch).
+func (t *propTest) equal(name string, got interface{}, want interface{}) bool {
+	g, ok := got.(float64)
+	if !ok {
+		return fmt.Sprint(got) == fmt.Sprint(want)
+	}
+	w, ok := want.(float64)
+	if !ok {
+		return false
+	}
+	if math.IsNaN(g) || math.IsNaN(w) {
+		return math.IsNaN(g) && math.IsNaN(w)
+	}
+	tolerance := t.tolerance
+	if name == "trimmed_mean_price" {
+		tolerance = math.Max(tolerance, 2*priceSketchAccuracy)
+	}
+	return math.Abs(g-w) <= tolerance*math.Max(1, math.Max(math.Abs(g), math.Abs(w)))
+}
+
+// describe describes the options of the aggregation.
+func (t *propTest) describe() string {
+	s := fmt.Sprintf("profile %s, activity %v, net flow %v, state %v, trimmed mean %v", t.opts.Profile, t.opts.Activity, t.opts.NetFlow, t.opts.State, t.opts.TrimmedMean)
+	if len(t.opts.Derived) > 0 {
+		s += ", derived " + t.opts.Derived[0].Name
+	}
+	return s
+}
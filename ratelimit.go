@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// rateLimit is a limit of an ingestion rate, per second (0 for no limit).
+type rateLimit struct {
+	trades float64
+	bytes  float64
+}
+
+// parseRateLimit parses a rate limit, as trades=N and/or bytes=N per second
+// (e.g. trades=10000,bytes=10MB); it returns a zero limit for an empty string.
+func parseRateLimit(s string) (rateLimit, error) {
+	var limit rateLimit
+	if s == "" {
+		return limit, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			return limit, fmt.Errorf("invalid rate limit %q: expected trades=N and/or bytes=N", s)
+		}
+		name, value := strings.TrimSpace(part[:eq]), strings.TrimSpace(part[eq+1:])
+		switch name {
+		case "trades":
+			trades, err := strconv.ParseFloat(value, 64)
+			if err != nil || trades <= 0 {
+				return limit, fmt.Errorf("invalid rate limit %q: invalid number of trades %q", s, value)
+			}
+			limit.trades = trades
+		case "bytes":
+			bytes, err := humanize.ParseBytes(value)
+			if err != nil || bytes == 0 {
+				return limit, fmt.Errorf("invalid rate limit %q: invalid number of bytes %q", s, value)
+			}
+			limit.bytes = float64(bytes)
+		default:
+			return limit, fmt.Errorf("invalid rate limit %q: unknown limit %q", s, name)
+		}
+	}
+	return limit, nil
+}
+
+// limiter limits the rate of an ingestion (e.g. of an input, or of all of them).
+type limiter struct {
+	// name describes the limit in errors, e.g. "the rate limit of the connection".
+	name   string
+	limit  rateLimit
+	trades *tokenBucket
+	bytes  *tokenBucket
+}
+
+// newLimiter returns a limiter with bursts of up to burst trades, and one
+// second of bytes (with burst 0, one second of trades); it returns nil
+// if there is no limit.
+func newLimiter(name string, limit rateLimit, burst float64) *limiter {
+	if limit.trades == 0 && limit.bytes == 0 {
+		return nil
+	}
+	l := &limiter{name: name, limit: limit}
+	if limit.trades > 0 {
+		if burst == 0 {
+			burst = limit.trades
+		}
+		l.trades = newTokenBucket(limit.trades, math.Max(burst, 1))
+	}
+	if limit.bytes > 0 {
+		l.bytes = newTokenBucket(limit.bytes, math.Max(limit.bytes, 1))
+	}
+	return l
+}
+
+// limiters are limits that all apply to an ingestion.
+type limiters []*limiter
+
+// newLimiters returns the limiters that are not nil.
+func newLimiters(ls ...*limiter) limiters {
+	var nonNil limiters
+	for _, l := range ls {
+		if l != nil {
+			nonNil = append(nonNil, l)
+		}
+	}
+	return nonNil
+}
+
+// waitTrade waits until a trade can be ingested.
+func (ls limiters) waitTrade() {
+	for _, l := range ls {
+		if l.trades != nil {
+			l.trades.wait(1)
+		}
+	}
+}
+
+// takeTrade returns an error (429, with the time to wait)
+// if a trade can't be ingested now.
+func (ls limiters) takeTrade() error {
+	for _, l := range ls {
+		if l.trades == nil {
+			continue
+		}
+		if ok, wait := l.trades.take(1); !ok {
+			return &httpError{
+				status:     http.StatusTooManyRequests,
+				msg:        fmt.Sprintf("exceeded %s (%v trades per second)", l.name, l.limit.trades),
+				retryAfter: wait,
+			}
+		}
+	}
+	return nil
+}
+
+// returnTrades gives back the trades taken by an ingestion
+// that was rejected, none of whose trades were ingested.
+func (ls limiters) returnTrades(n int) {
+	for _, l := range ls {
+		if l.trades != nil {
+			l.trades.give(float64(n))
+		}
+	}
+}
+
+// maxRead returns the maximum number of bytes read at once,
+// which must be less than the bursts of the byte limits.
+func (ls limiters) maxRead(n int) int {
+	for _, l := range ls {
+		if l.bytes != nil && int(l.bytes.burst) < n {
+			n = int(l.bytes.burst)
+		}
+	}
+	return n
+}
+
+// limitedReader limits the rate at which bytes are read: if block is true,
+// reads wait (applying backpressure to sockets); otherwise, reads exceeding
+// the limits fail with err.
+type limitedReader struct {
+	r        io.Reader
+	limiters limiters
+	block    bool
+	err      error
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	p = p[:lr.limiters.maxRead(len(p))]
+	n, err := lr.r.Read(p)
+	for _, l := range lr.limiters {
+		if l.bytes == nil || n == 0 {
+			continue
+		}
+		if lr.block {
+			l.bytes.wait(float64(n))
+			continue
+		}
+		if ok, wait := l.bytes.take(float64(n)); !ok {
+			lr.err = &httpError{
+				status:     http.StatusTooManyRequests,
+				msg:        fmt.Sprintf("exceeded %s (%s per second)", l.name, humanize.Bytes(uint64(l.limit.bytes))),
+				retryAfter: wait,
+			}
+			return 0, lr.err
+		}
+	}
+	return n, err
+}
+
+// The limiters of the service are in the context of the requests:
+// the global one, in the base context of the server,
+// and the one of each connection, in the context of the connection.
+type limitersKey struct{}
+
+// serveLimited serves the handler on the address, with the rate limits.
+func serveLimited(addr string, handler http.Handler, global rateLimit, perConn rateLimit) error {
+	globalLimiter := newLimiter("the rate limit of the service", global, 0)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), limitersKey{}, newLimiters(globalLimiter))
+		},
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			connLimiter := newLimiter("the rate limit of the connection", perConn, 0)
+			return context.WithValue(ctx, limitersKey{}, append(newLimiters(connLimiter), requestLimiters(ctx)...))
+		},
+	}
+	return server.ListenAndServe()
+}
+
+// requestLimiters returns the limiters of a request.
+func requestLimiters(ctx context.Context) limiters {
+	ls, _ := ctx.Value(limitersKey{}).(limiters)
+	return ls
+}
+
+// tokenBucket limits a rate, allowing bursts.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take takes n tokens (at most burst) if available, and tells whether it did;
+// if not, it returns how long until they will be.
+func (tb *tokenBucket) take(n float64) (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	if tb.tokens >= n {
+		tb.tokens -= n
+		return true, 0
+	}
+	return false, time.Duration((n - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// give gives back n tokens taken (up to burst).
+func (tb *tokenBucket) give(n float64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.tokens = math.Min(tb.burst, tb.tokens+n)
+}
+
+// wait waits until n tokens (at most burst) are available, and takes them.
+func (tb *tokenBucket) wait(n float64) {
+	for {
+		ok, wait := tb.take(n)
+		if ok {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RemapConfig is a remap file (see -remap): it merges market IDs into logical
+// markets, e.g. after a venue migration or for duplicate listings.
+type RemapConfig struct {
+	// Markets are the IDs merged into each logical market, by its ID
+	// (which may be one of them).
+	Markets map[uint64][]uint64 `yaml:"markets"`
+}
+
+// marketRemap maps market IDs to the logical markets they are merged into;
+// the other IDs are unchanged.
+type marketRemap map[uint64]uint64
+
+func LoadRemap(path string) (*RemapConfig, marketRemap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while reading remap: %s", err)
+	}
+	var conf RemapConfig
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("error while parsing remap %s: %s", path, err)
+	}
+	remap := marketRemap{}
+	for market, ids := range conf.Markets {
+		for _, id := range ids {
+			if other, ok := remap[id]; ok && other != market {
+				return nil, nil, fmt.Errorf("remap %s: market %v is merged into both %v and %v", path, id, other, market)
+			}
+			remap[id] = market
+		}
+	}
+	// Logical markets can't be merged into others, which would depend on the order:
+	for id, market := range remap {
+		if other, ok := remap[market]; ok && other != market {
+			return nil, nil, fmt.Errorf("remap %s: market %v is merged into %v, which is merged into %v", path, id, market, other)
+		}
+	}
+	return &conf, remap, nil
+}
+
+// market returns the logical market of a market ID.
+func (remap marketRemap) market(id uint64) uint64 {
+	if market, ok := remap[id]; ok {
+		return market
+	}
+	return id
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/feed"
+)
+
+// remoteWritePrefix is the prefix of the outputs that push the results
+// to a Prometheus remote-write endpoint, e.g.
+//
+//	prometheus:http://localhost:9090/api/v1/write
+const remoteWritePrefix = "prometheus:"
+
+const (
+	// remoteWriteMaxSeries is the maximum number of series sent at once.
+	remoteWriteMaxSeries = 10000
+	// remoteWriteAttempts is the number of attempts of each request,
+	// which are retried on network and server errors.
+	remoteWriteAttempts = 3
+	// metricPrefix is the prefix of the names of the metrics.
+	metricPrefix = "aggregator_"
+	// remoteWriteCompression is the codec of the requests, in its block format.
+	remoteWriteCompression = "snappy"
+)
+
+// remoteWriter pushes the numeric fields of the results as samples
+// of Prometheus metrics (e.g. aggregator_vwap{market="42"}),
+// timestamped with the end of their window (or the time they are written).
+// Corrections of the results (see addLate) are not pushed: their samples
+// would have the series and timestamp of those of the original result,
+// which Prometheus rejects as duplicates (or out of order).
+type remoteWriter struct {
+	url    string
+	opts   outputOptions
+	client *http.Client
+	// numCorrections is the number of corrections not pushed.
+	numCorrections int
+}
+
+func newRemoteWriter(url string, opts outputOptions) *remoteWriter {
+	return &remoteWriter{
+		url:    url,
+		opts:   opts,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// series is a Prometheus time series, with a single sample.
+type series struct {
+	// labels are name and value pairs, sorted by name.
+	labels    [][2]string
+	value     float64
+	timestamp int64
+}
+
+func (rw *remoteWriter) write(results []M) error {
+	var batch []series
+	now := time.Now()
+	for _, res := range results {
+		batch = rw.appendSeries(batch, res, now)
+		if len(batch) >= remoteWriteMaxSeries {
+			if err := rw.push(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return rw.push(batch)
+}
+
+func (rw *remoteWriter) close() error {
+	if rw.numCorrections > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %v corrections of late trades, which can't be pushed to %s\n", rw.numCorrections, rw.url)
+	}
+	return nil
+}
+
+// appendSeries appends a series for each numeric field of the result;
+// records that are not market results (e.g. metadata records),
+// and undefined metrics, are skipped.
+// Results without a window are timestamped with now.
+func (rw *remoteWriter) appendSeries(batch []series, res M, now time.Time) []series {
+	market, ok := res["market"]
+	if !ok {
+		return batch
+	}
+	if _, ok := res["revision"]; ok {
+		rw.numCorrections++
+		return batch
+	}
+	ts := now
+	if end, ok := res["window_end"].(time.Time); ok {
+		ts = end
+	}
+	labels := [][2]string{{"market", fmt.Sprint(market)}}
+	for _, name := range []string{"pipeline", "source", "rollup"} {
+		if v, ok := res[name].(string); ok {
+			labels = append(labels, [2]string{name, v})
+		}
+	}
+	// Remote write requires the labels of a series sorted by name
+	// (__name__, added below, sorts before the others):
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i][0] < labels[j][0]
+	})
+	names := make([]string, 0, len(res))
+	for name := range res {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var value float64
+		switch v := res[name].(type) {
+		case float64:
+			value = v
+		case int:
+			value = float64(v)
+		case uint64:
+			if name == "market" {
+				continue
+			}
+			value = float64(v)
+		default:
+			continue
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		batch = append(batch, series{
+			labels:    append([][2]string{{"__name__", metricName(rw.opts.fieldName(name))}}, labels...),
+			value:     value,
+			timestamp: ts.UnixNano() / int64(time.Millisecond),
+		})
+	}
+	return batch
+}
+
+// metricName returns the name of the metric of a field,
+// replacing the characters that are not valid in metric names.
+func metricName(field string) string {
+	return metricPrefix + strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, field)
+}
+
+// push sends the series in a remote-write request.
+func (rw *remoteWriter) push(batch []series) error {
+	codec, err := feed.GetCodec(remoteWriteCompression, "")
+	if err != nil {
+		return withExitCode(exitOutput, err)
+	}
+	body := codec.EncodeBlock(nil, encodeWriteRequest(batch))
+	for attempt := 0; attempt < remoteWriteAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var retry bool
+		retry, err = rw.send(body)
+		if err == nil || !retry {
+			break
+		}
+	}
+	if err != nil {
+		return withExitCode(exitOutput, fmt.Errorf("error while pushing to %s: %s", rw.url, err))
+	}
+	return nil
+}
+
+// send sends a request, and tells whether it can be retried if it fails.
+func (rw *remoteWriter) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, rw.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode/100 == 5, fmt.Errorf("%s", resp.Status)
+	}
+	return false, nil
+}
+
+// encodeWriteRequest encodes the series as a remote-write WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(batch []series) []byte {
+	var buf, ts, msg []byte
+	for _, s := range batch {
+		ts = ts[:0]
+		for _, label := range s.labels {
+			msg = msg[:0]
+			msg = appendProtoBytes(msg, 1, []byte(label[0]))
+			msg = appendProtoBytes(msg, 2, []byte(label[1]))
+			ts = appendProtoBytes(ts, 1, msg)
+		}
+		msg = msg[:0]
+		msg = appendUvarint(msg, 1<<3|1)
+		var value [8]byte
+		binary.LittleEndian.PutUint64(value[:], math.Float64bits(s.value))
+		msg = append(msg, value[:]...)
+		msg = appendUvarint(msg, 2<<3)
+		msg = appendUvarint(msg, uint64(s.timestamp))
+		ts = appendProtoBytes(ts, 2, msg)
+		buf = appendProtoBytes(buf, 1, ts)
+	}
+	return buf
+}
+
+// appendProtoBytes appends a length-delimited protobuf field.
+func appendProtoBytes(buf []byte, field uint64, data []byte) []byte {
+	buf = appendUvarint(buf, field<<3|2)
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// parseRemoteWriteURL returns the URL of a remote-write output location.
+func parseRemoteWriteURL(location string) (string, error) {
+	url := strings.TrimPrefix(location, remoteWritePrefix)
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "", fmt.Errorf("invalid output %q: expected %shttp(s)://host/path", location, remoteWritePrefix)
+	}
+	return url, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+	"github.com/klauspost/compress/snappy"
+)
+
+// fakePrometheus is a remote-write endpoint that, as Prometheus, rejects
+// a sample with the series and timestamp of one it already has.
+type fakePrometheus struct {
+	mu      sync.Mutex
+	samples map[string]float64
+}
+
+func (fp *fakePrometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	err = forEachProtoField(req, func(_ uint64, ts []byte) error {
+		var labels []string
+		var value float64
+		var timestamp int64
+		err := forEachProtoField(ts, func(field uint64, msg []byte) error {
+			if field == 1 {
+				return forEachProtoField(msg, func(_ uint64, s []byte) error {
+					labels = append(labels, string(s))
+					return nil
+				})
+			}
+			// A sample: its value (fixed64), then its timestamp (varint).
+			if len(msg) < 10 || msg[0] != 1<<3|1 || msg[9] != 2<<3 {
+				return fmt.Errorf("invalid sample")
+			}
+			value = math.Float64frombits(binary.LittleEndian.Uint64(msg[1:9]))
+			t, _ := binary.Uvarint(msg[10:])
+			timestamp = int64(t)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s@%v", strings.Join(labels, ","), timestamp)
+		if _, ok := fp.samples[key]; ok {
+			return fmt.Errorf("duplicate sample for timestamp")
+		}
+		fp.samples[key] = value
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// forEachProtoField calls fn with the length-delimited fields of a message.
+func forEachProtoField(msg []byte, fn func(field uint64, data []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 || key&7 != 2 {
+			return fmt.Errorf("invalid field")
+		}
+		length, m := binary.Uvarint(msg[n:])
+		if m <= 0 || uint64(len(msg)-n-m) < length {
+			return fmt.Errorf("invalid length")
+		}
+		data := msg[n+m : n+m+int(length)]
+		if err := fn(key>>3, data); err != nil {
+			return err
+		}
+		msg = msg[n+m+int(length):]
+	}
+	return nil
+}
+
+// TestRemoteWriteLateness checks that the corrections of late trades, which
+// Prometheus would reject, are not pushed, and that the run doesn't fail.
+func TestRemoteWriteLateness(t *testing.T) {
+	prom := &fakePrometheus{samples: map[string]float64{}}
+	server := httptest.NewServer(prom)
+	defer server.Close()
+
+	conf := PipelineConfig{
+		Window:          time.Minute,
+		AllowedLateness: 5 * time.Minute,
+		Output:          remoteWritePrefix + server.URL,
+	}
+	outs := newOutputs(outputOptions{floatPrecision: -1, undefined: undefinedNull, workers: 1})
+	p, err := newPipeline(conf, []string{""}, outs, timeModeEvent, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := int64(1640995200000)
+	values := make([]float64, len(tradeVars))
+	for _, trade := range []models.Trade{
+		{ID: 1, Market: 1, Price: 10, Volume: 1, Timestamp: start},
+		{ID: 2, Market: 1, Price: 20, Volume: 1, Timestamp: start + 60000}, // Ends the first window.
+		{ID: 3, Market: 1, Price: 30, Volume: 1, Timestamp: start + 1000},  // Late, amending it.
+	} {
+		if err := p.add("", trade, tradeValues(trade, values)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.emitLast(); err != nil {
+		t.Fatal(err)
+	}
+	if err := outs.closeAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first result of each window is pushed:
+	vwap := `__name__,aggregator_vwap,market,1@`
+	for ts, want := range map[int64]float64{start + 60000: 10, start + 120000: 20} {
+		if got, ok := prom.samples[fmt.Sprint(vwap, ts)]; !ok || got != want {
+			t.Errorf("got vwap %v (pushed: %v) at %v, want %v", got, ok, ts, want)
+		}
+	}
+	if got := p.out.sink.(*remoteWriter).numCorrections; got != 1 {
+		t.Errorf("got %v corrections skipped, want 1", got)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pacer paces the reading of timestamped trades, to replay them
+// as if they were arriving in real time (or faster).
+type pacer struct {
+	speed float64
+
+	mu    sync.Mutex
+	start time.Time
+	// first is the timestamp of the first trade (Unix milliseconds).
+	first int64
+}
+
+// parseReplaySpeed parses a replay speed: max (as fast as possible), or a factor like 1x or 10x.
+// It returns nil for max.
+func parseReplaySpeed(s string) (*pacer, error) {
+	if s == "max" {
+		return nil, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || !strings.HasSuffix(s, "x") || speed <= 0 {
+		return nil, fmt.Errorf("invalid replay speed %q: must be max or a positive factor like 1x or 10x", s)
+	}
+	return &pacer{speed: speed}, nil
+}
+
+// wait waits until the trade with the given timestamp (Unix milliseconds)
+// is due, relative to the first one; trades without a timestamp are not paced.
+// A nil pacer doesn't wait.
+func (pc *pacer) wait(ts int64) {
+	if pc == nil || ts == 0 {
+		return
+	}
+	pc.mu.Lock()
+	if pc.start.IsZero() {
+		pc.start = time.Now()
+		pc.first = ts
+	}
+	offset := time.Duration(float64(ts-pc.first) / pc.speed * float64(time.Millisecond))
+	due := pc.start.Add(offset)
+	pc.mu.Unlock()
+	time.Sleep(time.Until(due))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ReportConfig configures the end-of-run summary report,
+// sent to Slack and/or by email (see reporter).
+type ReportConfig struct {
+	// Slack is the URL of a Slack incoming webhook.
+	Slack string `yaml:"slack_webhook"`
+	// Email sends the report by email.
+	Email *EmailConfig `yaml:"email"`
+	// Top is the number of top markets in the report (10 by default).
+	Top int `yaml:"top"`
+	// TopBy is the field by which markets are ranked (total_volume by default).
+	TopBy string `yaml:"top_by"`
+}
+
+// EmailConfig configures the sending of reports by email.
+type EmailConfig struct {
+	// SMTP is the address of the SMTP server, as host:port.
+	SMTP string   `yaml:"smtp"`
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+	// Username, if not empty, authenticates with the password
+	// in the environment variable PasswordEnv.
+	Username    string `yaml:"username"`
+	PasswordEnv string `yaml:"password_env"`
+	Subject     string `yaml:"subject"`
+}
+
+// reporter tracks the results emitted by the pipelines,
+// and sends a summary of the run at its end.
+type reporter struct {
+	conf ReportConfig
+
+	mu sync.Mutex
+	// top are the top results, by conf.TopBy (descending).
+	top         []M
+	numResults  int
+	totalVolume float64
+}
+
+func newReporter(conf ReportConfig) (*reporter, error) {
+	if conf.Slack == "" && conf.Email == nil {
+		return nil, fmt.Errorf("report: slack_webhook or email is required")
+	}
+	if email := conf.Email; email != nil && (email.SMTP == "" || email.From == "" || len(email.To) == 0) {
+		return nil, fmt.Errorf("report: email requires smtp, from and to")
+	}
+	if conf.Top <= 0 {
+		conf.Top = 10
+	}
+	if conf.TopBy == "" {
+		conf.TopBy = "total_volume"
+	}
+	return &reporter{conf: conf}, nil
+}
+
+// observe records an emitted result.
+func (rep *reporter) observe(res M) {
+	if _, ok := res["market"]; !ok {
+		return
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.numResults++
+	if volume, ok := res["total_volume"].(float64); ok {
+		rep.totalVolume += volume
+	}
+	value := numericValue(res[rep.conf.TopBy])
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	i := sort.Search(len(rep.top), func(i int) bool {
+		return numericValue(rep.top[i][rep.conf.TopBy]) < value
+	})
+	if i >= rep.conf.Top {
+		return
+	}
+	rep.top = append(rep.top, nil)
+	copy(rep.top[i+1:], rep.top[i:])
+	rep.top[i] = res
+	if len(rep.top) > rep.conf.Top {
+		rep.top = rep.top[:rep.conf.Top]
+	}
+}
+
+// format formats the report of the run, from its summary (see runSummary).
+func (rep *reporter) format(summary M) string {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	var b strings.Builder
+	if summary["status"] == "failed" {
+		fmt.Fprintf(&b, "Aggregation FAILED: %s\n", summary["error"])
+	} else {
+		fmt.Fprintf(&b, "Aggregation succeeded\n")
+	}
+	start := summary["start_time"].(time.Time)
+	end := summary["end_time"].(time.Time)
+	fmt.Fprintf(&b, "Duration: %s\n", end.Sub(start).Round(time.Millisecond))
+	fmt.Fprintf(&b, "Trades: %s (shed: %s)\n",
+		humanize.Comma(int64(summary["trades"].(uint64))),
+		humanize.Comma(int64(summary["shed"].(uint64))),
+	)
+	fmt.Fprintf(&b, "Market results: %s, total volume: %s\n",
+		humanize.Comma(int64(rep.numResults)),
+		humanize.CommafWithDigits(rep.totalVolume, 2),
+	)
+	for _, p := range summary["pipelines"].([]M) {
+		name := p["name"].(string)
+		if name == "" {
+			name = "(default)"
+		}
+		fmt.Fprintf(&b, "Pipeline %s: %v filtered, %v late trades, output %v\n", name, p["num_filtered"], p["num_late"], p["output"])
+	}
+	if latencies, ok := summary["ingest_latency"].([]M); ok {
+		for _, l := range latencies {
+			fmt.Fprintf(&b, "Ingest latency of %s: p50 %vms, p90 %vms, p99 %vms, max %vms\n", l["input"], l["p50_ms"], l["p90_ms"], l["p99_ms"], l["max_ms"])
+		}
+	}
+	if len(rep.top) > 0 {
+		fmt.Fprintf(&b, "\nTop %v markets by %s:\n", len(rep.top), rep.conf.TopBy)
+		for i, res := range rep.top {
+			fmt.Fprintf(&b, "%2d. market %v", i+1, res["market"])
+			for _, tag := range []string{"pipeline", "source"} {
+				if v, ok := res[tag].(string); ok && v != "" {
+					fmt.Fprintf(&b, " (%s %s)", tag, v)
+				}
+			}
+			if start, ok := res["window_start"].(time.Time); ok {
+				fmt.Fprintf(&b, " [%s]", start.UTC().Format(time.RFC3339))
+			}
+			fmt.Fprintf(&b, ": %s\n", humanize.CommafWithDigits(numericValue(res[rep.conf.TopBy]), 2))
+		}
+	}
+	return b.String()
+}
+
+// send sends the report of the run to Slack and/or by email.
+func (rep *reporter) send(summary M) error {
+	text := rep.format(summary)
+	var errs []string
+	if rep.conf.Slack != "" {
+		if err := sendSlack(rep.conf.Slack, text); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if rep.conf.Email != nil {
+		if err := sendEmail(rep.conf.Email, summary["status"].(string), text); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error while sending report: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func sendSlack(url string, text string) error {
+	body, err := json.Marshal(M{"text": "```\n" + text + "```"})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("slack: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("slack: %s", resp.Status)
+	}
+	return nil
+}
+
+func sendEmail(conf *EmailConfig, status string, text string) error {
+	subject := conf.Subject
+	if subject == "" {
+		subject = "Aggregation report"
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", conf.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(conf.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s (%s)\r\n", subject, status)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if conf.Username != "" {
+		host := conf.SMTP
+		if colon := strings.LastIndexByte(host, ':'); colon >= 0 {
+			host = host[:colon]
+		}
+		auth = smtp.PlainAuth("", conf.Username, os.Getenv(conf.PasswordEnv), host)
+	}
+	if err := smtp.SendMail(conf.SMTP, auth, conf.From, conf.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("email: %s", err)
+	}
+	return nil
+}
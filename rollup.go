@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RollupConfig is a level of rollups of a pipeline: the aggregation of the
+// trades of groups of markets (e.g. by exchange), or of all of them if it
+// has no groups, in the same pass as that of the markets.
+type RollupConfig struct {
+	// Name is added to the results of the level as "rollup"; their "market"
+	// is the name of their group (or Name itself, without groups).
+	Name string `yaml:"name"`
+	// Groups are the markets of each group, by its name;
+	// the other markets are in the group "other".
+	Groups map[string][]uint64 `yaml:"groups"`
+}
+
+// rollupOther is the group of the markets that are in no group.
+const rollupOther = "other"
+
+// rollup maps the markets to the groups of a level of rollups,
+// which are aggregated as markets.
+type rollup struct {
+	name string
+	// groups are the indexes of the groups of the markets in names
+	// (those missing are in the last one, "other" or the whole level).
+	groups map[uint64]uint64
+	names  []string
+}
+
+func newRollup(conf RollupConfig) (*rollup, error) {
+	if conf.Name == "" {
+		return nil, fmt.Errorf("rollups require a name")
+	}
+	r := &rollup{name: conf.Name, groups: map[uint64]uint64{}}
+	names := make([]string, 0, len(conf.Groups))
+	for name := range conf.Groups {
+		if name == rollupOther {
+			return nil, fmt.Errorf("rollup %s: group %q is reserved for the markets in no group", conf.Name, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, market := range conf.Groups[name] {
+			if other, ok := r.groups[market]; ok {
+				return nil, fmt.Errorf("rollup %s: market %v is in both %s and %s", conf.Name, market, r.names[other], name)
+			}
+			r.groups[market] = uint64(len(r.names))
+		}
+		r.names = append(r.names, name)
+	}
+	if len(r.names) > 0 {
+		r.names = append(r.names, rollupOther)
+	} else {
+		r.names = []string{conf.Name}
+	}
+	return r, nil
+}
+
+// group returns the group of a market, as a market of the rollup.
+func (r *rollup) group(market uint64) uint64 {
+	if group, ok := r.groups[market]; ok {
+		return group
+	}
+	return uint64(len(r.names) - 1)
+}
+
+// tag replaces the market of a result of the rollup with its group.
+func (r *rollup) tag(res M) {
+	if group, ok := res["market"].(uint64); ok {
+		res["market"] = r.names[group]
+	}
+	res["rollup"] = r.name
+}
+
+// expandRollups adds, after each pipeline with rollups, a copy of it for each
+// level, writing its results to the same output. Quotes and book updates
+// are not rolled up.
+func expandRollups(confs []PipelineConfig) ([]PipelineConfig, error) {
+	var out []PipelineConfig
+	for _, conf := range confs {
+		out = append(out, conf)
+		if len(conf.Rollups) == 0 {
+			continue
+		}
+		if conf.WarmStart != "" {
+			return nil, fmt.Errorf("pipeline %q: rollups can't be used with a warm start", conf.Name)
+		}
+		seen := map[string]bool{}
+		for i := range conf.Rollups {
+			level := conf.Rollups[i]
+			if seen[level.Name] {
+				return nil, fmt.Errorf("pipeline %q: duplicate rollup %q", conf.Name, level.Name)
+			}
+			seen[level.Name] = true
+			rolled := conf
+			rolled.Rollups = nil
+			rolled.rollup = &level
+			rolled.Quotes = false
+			rolled.BookDepth = 0
+			out = append(out, rolled)
+		}
+	}
+	return out, nil
+}
+
+// parseRollups parses the -rollup flags, each as name (for a single group
+// of all the markets) or name=groups (the path of a YAML file
+// with the markets of each group).
+func parseRollups(flags []string) ([]RollupConfig, error) {
+	var rollups []RollupConfig
+	for _, flag := range flags {
+		conf := RollupConfig{Name: flag}
+		if eq := strings.IndexByte(flag, '='); eq >= 0 {
+			conf.Name = flag[:eq]
+			data, err := os.ReadFile(flag[eq+1:])
+			if err != nil {
+				return nil, fmt.Errorf("error while reading the groups of rollup %s: %s", conf.Name, err)
+			}
+			if err := yaml.UnmarshalStrict(data, &conf.Groups); err != nil {
+				return nil, fmt.Errorf("error while parsing the groups of rollup %s: %s", conf.Name, err)
+			}
+		}
+		rollups = append(rollups, conf)
+	}
+	return rollups, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gagliardetto/messari-challenge/expr"
+)
+
+// Script post-processes the results of a pipeline before they are emitted,
+// for customizations that don't require a new build. It has a statement per
+// line (blank lines and those starting with # are ignored), run in order:
+//
+//	drop if <condition>     drops the result
+//	<field> = <expression>  sets a numeric field (e.g. a ratio)
+//	rename <field> <name>   renames a field
+//	delete <field>          deletes a field
+//
+// Expressions are those of -having, over the numeric fields of the result
+// (see resultFields), those of the derived metrics, and those set or renamed
+// by the statements before; fields missing from the result are NaN.
+//
+// Scripts are deliberately not a general-purpose language (e.g. Starlark):
+// they only reshape a result, which these statements cover, with the same
+// expressions as -filter and -having, rather than a second syntax and a new
+// dependency. A script can't loop, nor see other results, so its cost per
+// result is bounded by its length.
+type Script struct {
+	statements []scriptStatement
+	// fields are the fields that can be used in the expressions, in order.
+	fields []string
+}
+
+// scriptStatement is a statement of a script:
+// program is evaluated for drop and assignment statements.
+type scriptStatement struct {
+	op      string
+	program *expr.Program
+	field   string
+	name    string
+}
+
+// The operations of the statements of a script.
+const (
+	scriptDrop   = "drop"
+	scriptSet    = "set"
+	scriptRename = "rename"
+	scriptDelete = "delete"
+)
+
+// CompileScript compiles a script over the fields of the results of a market,
+// and the derived metrics.
+func CompileScript(src string, derived []*DerivedMetric) (*Script, error) {
+	s := &Script{fields: append([]string(nil), resultFields...)}
+	for _, d := range derived {
+		s.fields = append(s.fields, "total_"+d.Name, "mean_"+d.Name)
+	}
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		st, err := s.compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("error in line %v of the script: %s", i+1, err)
+		}
+		s.statements = append(s.statements, st)
+	}
+	return s, nil
+}
+
+// compile compiles a statement, adding the field it sets or renames to
+// those of the expressions of the next ones.
+func (s *Script) compile(line string) (scriptStatement, error) {
+	words := strings.Fields(line)
+	switch {
+	case words[0] == scriptDrop:
+		if len(words) < 3 || words[1] != "if" {
+			return scriptStatement{}, fmt.Errorf("expected drop if <condition>, got %q", line)
+		}
+		cond := strings.TrimSpace(line[len(scriptDrop):])
+		program, err := expr.CompileBool(strings.TrimSpace(cond[len("if"):]), expr.Numbers(s.fields...))
+		if err != nil {
+			return scriptStatement{}, err
+		}
+		return scriptStatement{op: scriptDrop, program: program}, nil
+	case words[0] == scriptRename:
+		if len(words) != 3 {
+			return scriptStatement{}, fmt.Errorf("expected rename <field> <name>, got %q", line)
+		}
+		s.addField(words[2])
+		return scriptStatement{op: scriptRename, field: words[1], name: words[2]}, nil
+	case words[0] == scriptDelete:
+		if len(words) != 2 {
+			return scriptStatement{}, fmt.Errorf("expected delete <field>, got %q", line)
+		}
+		return scriptStatement{op: scriptDelete, field: words[1]}, nil
+	}
+	eq := strings.IndexByte(line, '=')
+	if eq <= 0 || strings.HasPrefix(line[eq:], "==") {
+		return scriptStatement{}, fmt.Errorf("unknown statement %q (expected drop if, rename, delete, or an assignment)", line)
+	}
+	field := strings.TrimSpace(line[:eq])
+	if strings.ContainsAny(field, " \t") {
+		return scriptStatement{}, fmt.Errorf("invalid field %q", field)
+	}
+	program, err := expr.Compile(strings.TrimSpace(line[eq+1:]), expr.Numbers(s.fields...))
+	if err != nil {
+		return scriptStatement{}, err
+	}
+	if program.Type() != expr.Number {
+		return scriptStatement{}, fmt.Errorf("expression %q is a %s, not a number", program, program.Type())
+	}
+	s.addField(field)
+	return scriptStatement{op: scriptSet, program: program, field: field}, nil
+}
+
+func (s *Script) addField(field string) {
+	for _, f := range s.fields {
+		if f == field {
+			return
+		}
+	}
+	s.fields = append(s.fields, field)
+}
+
+// Run runs the script over the result of a market (with numTrades trades,
+// see Having.Match), returning nil if it is dropped.
+func (s *Script) Run(res M, numTrades int) M {
+	var values []float64
+	for _, st := range s.statements {
+		switch st.op {
+		case scriptDrop:
+			values = resultValues(res, s.fields, numTrades, values)
+			if st.program.EvalBool(values) {
+				return nil
+			}
+		case scriptSet:
+			values = resultValues(res, s.fields, numTrades, values)
+			res[st.field] = st.program.Eval(values)
+		case scriptRename:
+			if v, ok := res[st.field]; ok {
+				delete(res, st.field)
+				res[st.name] = v
+			}
+		case scriptDelete:
+			delete(res, st.field)
+		}
+	}
+	return res
+}
+
+// String returns a summary of the statements of the script.
+func (s *Script) String() string {
+	parts := make([]string, len(s.statements))
+	for i, st := range s.statements {
+		switch st.op {
+		case scriptDrop:
+			parts[i] = "drop if " + st.program.String()
+		case scriptSet:
+			parts[i] = st.field + " = " + st.program.String()
+		case scriptRename:
+			parts[i] = "rename " + st.field + " " + st.name
+		case scriptDelete:
+			parts[i] = "delete " + st.field
+		}
+	}
+	return strings.Join(parts, "; ")
+}
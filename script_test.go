@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScriptRun(t *testing.T) {
+	derived, err := ParseDerivedMetric("notional=price*volume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := CompileScript(strings.Join([]string{
+		"# keep busy markets only",
+		"drop if num_trades < 3",
+		"",
+		"buy_share = num_buy / num_trades",
+		"rename vwap weighted_price",
+		"  range = (high - low) / weighted_price * 100  ",
+		"delete total_price",
+		"rename missing other",
+		"notional_share = total_notional / total_volume",
+		"undefined = open + 1",
+		"drop if buy_share > 0.9",
+	}, "\n"), []*DerivedMetric{derived})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := func(numBuy int) M {
+		return M{
+			"market":         uint64(1),
+			"num_buy":        numBuy,
+			"vwap":           50.0,
+			"high":           60.0,
+			"low":            40.0,
+			"total_price":    150.0,
+			"total_volume":   4.0,
+			"total_notional": 200.0,
+		}
+	}
+
+	if res := script.Run(result(1), 2); res != nil {
+		t.Errorf("got %v, want the result dropped", res)
+	}
+	if res := script.Run(result(4), 4); res != nil {
+		t.Errorf("got %v, want the result dropped by the last statement", res)
+	}
+	res := script.Run(result(1), 4)
+	undefined, _ := res["undefined"].(float64)
+	if !math.IsNaN(undefined) {
+		t.Errorf("got undefined %v, want NaN for a missing field", res["undefined"])
+	}
+	delete(res, "undefined")
+	want := M{
+		"market":         uint64(1),
+		"num_buy":        1,
+		"buy_share":      0.25,
+		"weighted_price": 50.0,
+		"high":           60.0,
+		"low":            40.0,
+		"range":          40.0,
+		"total_volume":   4.0,
+		"total_notional": 200.0,
+		"notional_share": 50.0,
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("got %v, want %v", res, want)
+	}
+	if got, want := script.String(), "drop if num_trades < 3; buy_share = num_buy / num_trades; rename vwap weighted_price; range = (high - low) / weighted_price * 100; delete total_price; rename missing other; notional_share = total_notional / total_volume; undefined = open + 1; drop if buy_share > 0.9"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCompileScriptErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		err string
+	}{
+		{"drop num_trades < 3", "line 1 of the script: expected drop if <condition>"},
+		{"drop if", "line 1 of the script: expected drop if <condition>"},
+		{"drop if num_trades", "line 1 of the script: expression \"num_trades\" is a number, not a bool"},
+		{"\n# comment\nrename vwap", "line 3 of the script: expected rename <field> <name>"},
+		{"delete", "expected delete <field>"},
+		{"delete a b", "expected delete <field>"},
+		{"vwap", "unknown statement \"vwap\""},
+		{"vwap == 1", "unknown statement"},
+		{"= 1", "unknown statement"},
+		{"a b = 1", "invalid field \"a b\""},
+		{"share = num_buy > 1", "expression \"num_buy > 1\" is a bool, not a number"},
+		{"share = nope / 2", "unknown variable \"nope\""},
+		// A field can only be used after the statement setting it:
+		{"b = a * 2\na = 1", "line 1 of the script: unknown variable \"a\""},
+		{"rename vwap price2\ndrop if vwap > 1\nx = price2", ""},
+	} {
+		_, err := CompileScript(tc.src, nil)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%q: %s", tc.src, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: got error %v, want %q", tc.src, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/feed"
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+	"gopkg.in/yaml.v2"
+)
+
+// runServe implements the serve subcommand, which serves named aggregation
+// sessions over HTTP, each with its own state and lifecycle:
+//
+//	PUT    /sessions/{name}           create, with the pipeline config as body (YAML or JSON)
+//	POST   /sessions/{name}/trades    ingest trades (body in the format given by ?format=, json by default)
+//	GET    /sessions/{name}           query the current results
+//	POST   /sessions/{name}/finalize  stop ingesting, and return the final results
+//	DELETE /sessions/{name}           delete
+//	GET    /sessions                  list the sessions
+//
+// Results are returned one JSON object per line, as written by the aggregator.
+// With -tenants, each tenant has its own sessions (see tenantServer).
+// The service is also a Grafana datasource (see grafana.go),
+// and answers GraphQL queries at /graphql (see graphql.go).
+func runServe(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s serve [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	listen := flags.String("listen", "localhost:8080", "Address to listen on")
+	floatPrecision := flags.Int("float-precision", -1, "Format floats with this fixed number of decimal places (if negative, with the shortest representation)")
+	pricePrecision := flags.String("price-precision", "", "YAML file of precision rules for the prices of the results, overriding -float-precision")
+	decimalStrings := flags.String("decimal-strings", "", "Comma-separated fields written as decimal strings with -decimal-scale decimal places (e.g. vwap,total_volume)")
+	decimalScale := flags.Int("decimal-scale", 6, "Decimal places of the fields written as decimal strings (the prices with precision rules keep theirs)")
+	undefined := flags.String("undefined", undefinedNull, "How to write undefined metrics: null, zero, or omit")
+	rateLimitFlag := flags.String("rate-limit", "", "Limit the ingestion rate of the service, as trades=N and/or bytes=N per second (e.g. trades=100000,bytes=50MB); ingestions exceeding it are rejected with 429")
+	connRateLimitFlag := flags.String("conn-rate-limit", "", "Limit the ingestion rate of each connection, as -rate-limit")
+	maxRecordLength := flags.String("max-record-length", "16MiB", "Reject the ingestions with records longer than this (0 for no limit; json format only)")
+	maxDepth := flags.Int("max-depth", 32, "Reject the ingestions with records nested deeper than this (0 for no limit; json format only)")
+	tenantsPath := flags.String("tenants", "", "YAML file defining the tenants: each has its own sessions, an API key authenticating its requests, and ingestion quotas")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	undefinedPolicy, err := parseUndefined(*undefined)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+
+	globalLimit, err := parseRateLimit(*rateLimitFlag)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	connLimit, err := parseRateLimit(*connRateLimitFlag)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	recordLength, err := parseRecordLength(*maxRecordLength)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	var precision *precisionRules
+	if *pricePrecision != "" {
+		precision, err = LoadPrecision(*pricePrecision)
+		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+	}
+	decimalFields, err := parseDecimalStrings(*decimalStrings, *decimalScale)
+	if err != nil {
+		panic(withExitCode(exitUsage, err))
+	}
+	outOpts := outputOptions{
+		floatPrecision: *floatPrecision,
+		precision:      precision,
+		decimalStrings: decimalFields,
+		decimalScale:   *decimalScale,
+		undefined:      undefinedPolicy,
+	}
+	records := recordLimits{maxLength: recordLength, maxDepth: *maxDepth}
+	var handler http.Handler = newService(outOpts, records)
+	if *tenantsPath != "" {
+		conf, err := LoadTenants(*tenantsPath)
+		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+		handler = newTenantServer(conf, outOpts, records)
+	}
+	fmt.Fprintf(os.Stderr, "Serving sessions on %s\n", *listen)
+	if err := serveLimited(*listen, handler, globalLimit, connLimit); err != nil {
+		panic(fmt.Errorf("error while serving: %s", err))
+	}
+	return exitOK
+}
+
+// service holds the aggregation sessions (of a tenant, see tenantServer).
+type service struct {
+	mu       sync.RWMutex
+	sessions map[string]*session
+	outOpts  outputOptions
+	records  recordLimits
+
+	// The quotas of the tenant, if any:
+	tenant      string
+	maxSessions int
+	quota       *limiter
+}
+
+// session is a named aggregation, with its own state.
+type session struct {
+	name    string
+	created time.Time
+	p       *pipeline
+
+	// Ingestions hold mu for reading, so that finalizing waits for them.
+	mu        sync.RWMutex
+	finalized int32
+	numTrades uint64
+}
+
+func newService(outOpts outputOptions, records recordLimits) *service {
+	return &service{
+		sessions: map[string]*session{},
+		outOpts:  outOpts,
+		records:  records,
+	}
+}
+
+// httpError is an error with the HTTP status to respond with.
+type httpError struct {
+	status int
+	msg    string
+	// retryAfter, if not zero, is sent as the Retry-After header.
+	retryAfter time.Duration
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func errorf(status int, format string, a ...interface{}) error {
+	return &httpError{status: status, msg: fmt.Sprintf(format, a...)}
+}
+
+func (svc *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := svc.route(w, r); err != nil {
+		status := http.StatusInternalServerError
+		if herr, ok := err.(*httpError); ok {
+			status = herr.status
+			if herr.retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(herr.retryAfter.Seconds()))))
+			}
+		}
+		http.Error(w, err.Error(), status)
+	}
+}
+
+func (svc *service) route(w http.ResponseWriter, r *http.Request) error {
+	path := strings.Trim(r.URL.Path, "/")
+	// Grafana datasource (see grafana.go), and GraphQL (see graphql.go):
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		return writeJSON(w, http.StatusOK, M{"status": "ok"})
+	case path == "search" && r.Method == http.MethodPost:
+		return svc.grafanaSearch(w, r)
+	case path == "query" && r.Method == http.MethodPost:
+		return svc.grafanaQuery(w, r)
+	case path == "annotations" && r.Method == http.MethodPost:
+		return writeJSON(w, http.StatusOK, []M{})
+	case path == "graphql" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		return svc.graphql(w, r)
+	}
+	parts := strings.Split(path, "/")
+	if parts[0] != "sessions" || len(parts) > 3 || (len(parts) > 1 && parts[1] == "") {
+		return errorf(http.StatusNotFound, "not found: %s", r.URL.Path)
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		return svc.list(w)
+	case len(parts) == 2 && r.Method == http.MethodPut:
+		return svc.create(w, r, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		return svc.query(w, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		return svc.delete(w, parts[1])
+	case len(parts) == 3 && parts[2] == "trades" && r.Method == http.MethodPost:
+		return svc.ingest(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "finalize" && r.Method == http.MethodPost:
+		return svc.finalize(w, parts[1])
+	}
+	return errorf(http.StatusMethodNotAllowed, "method %s not allowed on %s", r.Method, r.URL.Path)
+}
+
+func (svc *service) get(name string) (*session, error) {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+	sess, ok := svc.sessions[name]
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "no session %q", name)
+	}
+	return sess, nil
+}
+
+func (svc *service) list(w http.ResponseWriter) error {
+	svc.mu.RLock()
+	list := make([]M, 0, len(svc.sessions))
+	for _, sess := range svc.sessions {
+		list = append(list, sess.info())
+	}
+	svc.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["name"].(string) < list[j]["name"].(string)
+	})
+	return svc.write(w, http.StatusOK, list)
+}
+
+func (svc *service) create(w http.ResponseWriter, r *http.Request, name string) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("error while reading config: %s", err)
+	}
+	var conf PipelineConfig
+	if err := yaml.UnmarshalStrict(body, &conf); err != nil {
+		return errorf(http.StatusBadRequest, "error while parsing config: %s", err)
+	}
+	// Results are queried, and the state of the service is only its sessions:
+	if conf.Window > 0 || conf.TagSources || conf.PerInput || len(conf.Rollups) > 0 || conf.Output != "" || conf.WarmStart != "" || conf.IdleFlush > 0 || conf.SessionClose != "" {
+		return errorf(http.StatusBadRequest, "sessions can't have windows, tagged sources, per-input results, rollups, outputs, warm starts, or idle flushes")
+	}
+	conf.Name = name
+	p, err := newPipeline(conf, []string{""}, nil, timeModeEvent, 0)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%s", err)
+	}
+	sess := &session{
+		name:    name,
+		created: time.Now().UTC(),
+		p:       p,
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if _, ok := svc.sessions[name]; ok {
+		return errorf(http.StatusConflict, "session %q already exists", name)
+	}
+	if svc.maxSessions > 0 && len(svc.sessions) >= svc.maxSessions {
+		return errorf(http.StatusTooManyRequests, "tenant %q has reached its quota of %v sessions", svc.tenant, svc.maxSessions)
+	}
+	svc.sessions[name] = sess
+	return svc.write(w, http.StatusCreated, []M{sess.info()})
+}
+
+func (svc *service) ingest(w http.ResponseWriter, r *http.Request, name string) error {
+	sess, err := svc.get(name)
+	if err != nil {
+		return err
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	limits := append(newLimiters(svc.quota), requestLimiters(r.Context())...)
+	limited := &limitedReader{r: r.Body, limiters: limits}
+	var body io.Reader = limited
+	if ce := r.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		codec, err := feed.GetCodec(ce, "")
+		if err != nil {
+			return errorf(http.StatusUnsupportedMediaType, "%s", err)
+		}
+		if body, err = feed.NewCodecReader(codec, limited); err != nil {
+			return errorf(http.StatusBadRequest, "%s", err)
+		}
+	}
+	if format == "json" {
+		encoding := r.URL.Query().Get("encoding")
+		if encoding == "" {
+			encoding = feed.EncodingAuto
+		}
+		if body, err = feed.NewDecodingReader(body, encoding); err != nil {
+			return errorf(http.StatusBadRequest, "%s", err)
+		}
+	}
+	// The last line of the body doesn't need to be terminated:
+	body = io.MultiReader(body, strings.NewReader("\n"))
+	source, err := feed.NewSource(format, body, io.Discard)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%s", err)
+	}
+	if ls, ok := source.(feed.LimitedSource); ok {
+		ls.SetRecordLimits(svc.records.maxLength, svc.records.maxDepth)
+	}
+	if name := r.URL.Query().Get("side_rule"); name != "" {
+		rule, err := feed.GetSideRule(name)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "%s", err)
+		}
+		cs, ok := source.(feed.ClassifiedSource)
+		if !ok && rule != nil {
+			return errorf(http.StatusBadRequest, "side rule %q can only be used with the json format", name)
+		}
+		if rule != nil {
+			cs.SetSideRule(rule)
+		}
+	}
+	if atomic.LoadInt32(&sess.finalized) == 1 {
+		return errorf(http.StatusConflict, "session %q is finalized", name)
+	}
+
+	// An ingestion is all or nothing, so that a rejected one can be retried
+	// as it is: its trades (and quotes and book updates) are aggregated only
+	// once the whole body has been read, within the limits.
+	p := sess.p
+	var events []ingestEvent
+	if p.opts.Spreads {
+		if qs, ok := source.(feed.QuoteSource); ok {
+			qs.OnQuote(func(quote models.Quote) {
+				events = append(events, ingestEvent{quote: &quote})
+			})
+		}
+	}
+	if p.opts.BookDepth > 0 {
+		if bs, ok := source.(feed.BookSource); ok {
+			bs.OnBook(func(update models.BookUpdate) {
+				events = append(events, ingestEvent{update: &update})
+			})
+		}
+	}
+	needsTime := p.needsTime()
+	numTrades := uint64(0)
+	var limitErr error
+	err = source.Each(func(trade models.Trade) bool {
+		if limitErr = limits.takeTrade(); limitErr != nil {
+			return false
+		}
+		if needsTime && trade.Timestamp == 0 {
+			trade.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		events = append(events, ingestEvent{trade: trade})
+		numTrades++
+		return true
+	})
+	if err == nil {
+		err = limitErr
+	}
+	if limited.err != nil {
+		err = limited.err
+	}
+	if err != nil {
+		limits.returnTrades(int(numTrades))
+	}
+	if herr, ok := err.(*httpError); ok {
+		herr.msg = fmt.Sprintf("error after %v trades, none of which were ingested: %s", numTrades, herr.msg)
+		return herr
+	}
+	if err != nil {
+		return errorf(http.StatusBadRequest, "error after %v trades, none of which were ingested: %s", numTrades, err)
+	}
+
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	if atomic.LoadInt32(&sess.finalized) == 1 {
+		return errorf(http.StatusConflict, "session %q is finalized", name)
+	}
+	values := make([]float64, len(tradeVars))
+	for _, ev := range events {
+		switch {
+		case ev.quote != nil:
+			p.addQuote("", *ev.quote)
+		case ev.update != nil:
+			p.addBookUpdate("", *ev.update)
+		default:
+			// Sessions have no windows nor idle flushes, the only errors of add:
+			values = tradeValues(ev.trade, values)
+			if err := p.add("", ev.trade, values); err != nil {
+				return err
+			}
+		}
+	}
+	atomic.AddUint64(&sess.numTrades, numTrades)
+	return svc.write(w, http.StatusOK, []M{{"trades": numTrades}})
+}
+
+// ingestEvent is a trade, a quote or a book update of an ingestion,
+// aggregated once the whole ingestion is accepted (see ingest).
+type ingestEvent struct {
+	trade  models.Trade
+	quote  *models.Quote
+	update *models.BookUpdate
+}
+
+func (svc *service) query(w http.ResponseWriter, name string) error {
+	sess, err := svc.get(name)
+	if err != nil {
+		return err
+	}
+	return svc.write(w, http.StatusOK, sess.p.collect(time.Time{}, time.Time{}, false))
+}
+
+func (svc *service) finalize(w http.ResponseWriter, name string) error {
+	sess, err := svc.get(name)
+	if err != nil {
+		return err
+	}
+	sess.mu.Lock()
+	atomic.StoreInt32(&sess.finalized, 1)
+	sess.mu.Unlock()
+	return svc.write(w, http.StatusOK, sess.p.collect(time.Time{}, time.Time{}, false))
+}
+
+func (svc *service) delete(w http.ResponseWriter, name string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if _, ok := svc.sessions[name]; !ok {
+		return errorf(http.StatusNotFound, "no session %q", name)
+	}
+	delete(svc.sessions, name)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// write writes the records, one JSON object per line.
+func (svc *service) write(w http.ResponseWriter, status int, records []M) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(status)
+	out := &output{
+		name: "response",
+		opts: svc.outOpts,
+		w:    bufio.NewWriter(w),
+	}
+	return out.write(records)
+}
+
+func (sess *session) info() M {
+	return M{
+		"name":         sess.name,
+		"created":      sess.created,
+		"trades":       atomic.LoadUint64(&sess.numTrades),
+		"finalized":    atomic.LoadInt32(&sess.finalized) == 1,
+		"num_filtered": atomic.LoadUint64(&sess.p.numFiltered),
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestServiceIngestAllOrNothing checks that an ingestion rejected part way
+// (with a malformed record, or exceeding a rate limit) aggregates none of
+// its trades, so that it can be retried as it is.
+func TestServiceIngestAllOrNothing(t *testing.T) {
+	svc := newService(outputOptions{floatPrecision: -1, undefined: undefinedNull}, recordLimits{})
+	svc.quota = newLimiter("the quota of the tenant", rateLimit{trades: 0.001}, 3)
+	server := httptest.NewServer(svc)
+	defer server.Close()
+
+	do := func(method string, path string, body string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, strings.TrimSpace(string(data))
+	}
+	trade := `{"id":1,"market":1,"price":10,"volume":1,"is_buy":true}` + "\n"
+	if status, body := do(http.MethodPut, "/sessions/s", "{}"); status != http.StatusCreated {
+		t.Fatalf("got %v creating the session: %s", status, body)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+		err    string
+	}{
+		{"malformed", trade + "{\n", http.StatusBadRequest, "error after 1 trades, none of which were ingested"},
+		{"limit", strings.Repeat(trade, 4), http.StatusTooManyRequests, "error after 3 trades, none of which were ingested: exceeded the quota of the tenant"},
+	} {
+		status, body := do(http.MethodPost, "/sessions/s/trades", tc.body)
+		if status != tc.status || !strings.Contains(body, tc.err) {
+			t.Errorf("%s: got %v %q, want %v %q", tc.name, status, body, tc.status, tc.err)
+		}
+		if status, body := do(http.MethodGet, "/sessions/s", ""); status != http.StatusOK || body != "" {
+			t.Errorf("%s: got results %v %q, want none", tc.name, status, body)
+		}
+	}
+
+	// The trades of the rejected ingestions don't count against the quota:
+	if status, body := do(http.MethodPost, "/sessions/s/trades", strings.Repeat(trade, 3)); status != http.StatusOK || body != `{"trades":3}` {
+		t.Fatalf("got %v %q", status, body)
+	}
+	status, body := do(http.MethodGet, "/sessions/s", "")
+	if status != http.StatusOK || !strings.Contains(body, `"total_volume":3,`) {
+		t.Errorf("got results %v %q", status, body)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// shedder sheds load when the processing of an input falls behind,
+// by sampling its trades: when the lag of a trade (arrival time minus its timestamp)
+// exceeds maxLag, only one trade in keep is processed.
+// A shedder is used by a single goroutine.
+type shedder struct {
+	maxLag int64 // milliseconds
+	keep   int
+	n      int
+}
+
+// newShedder returns a shedder, or nil if maxLag is zero.
+func newShedder(maxLag time.Duration, keep int) *shedder {
+	if maxLag <= 0 {
+		return nil
+	}
+	return &shedder{
+		maxLag: int64(maxLag / time.Millisecond),
+		keep:   keep,
+	}
+}
+
+// shed tells whether the trade is to be shed.
+// Trades without a timestamp are never shed, since their lag is unknown.
+// A nil shedder never sheds.
+func (s *shedder) shed(trade models.Trade) bool {
+	if s == nil || trade.Timestamp == 0 {
+		return false
+	}
+	lag := time.Now().UnixNano()/int64(time.Millisecond) - trade.Timestamp
+	if lag <= s.maxLag {
+		s.n = 0
+		return false
+	}
+	s.n++
+	return (s.n-1)%s.keep != 0
+}
+
+// Shed records a trade shed for its market.
+func (ag *Markets) Shed(trade models.Trade) {
+	ag.lockMarket(trade.Market, func(mkt *Market) {
+		mkt.numShed++
+	})
+}
+
+// shed records a shed trade.
+func (p *pipeline) shed(source string, trade models.Trade) {
+	p.aggregator(source).Shed(trade)
+}
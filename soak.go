@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// runSoak implements the soak subcommand, which feeds generated trades to
+// the pipelines in-process, at a sustained rate, for a duration (or until
+// interrupted), while exporting metrics of the throughput and the memory,
+// to validate that they stay flat before a deployment.
+func runSoak(args []string) int {
+	flags := flag.NewFlagSet("soak", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s soak [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	tpsFlag := flags.String("tps", "100k", "Target rate of generated trades per second, with an optional SI suffix (e.g. 2M)")
+	duration := flags.Duration("duration", 0, "Duration of the soak test (0 to run until interrupted)")
+	numMarkets := flags.Int("markets", 10000, "Number of distinct markets of the generated trades")
+	workers := flags.Int("workers", 0, "Number of goroutines generating trades (0 for one per CPU)")
+	configPath := flags.String("config", "", "YAML config file defining the aggregation pipelines (replacing -window, -derive and -output-profile)")
+	window := flags.Duration("window", time.Minute, "Duration of the tumbling windows (by the time the trades are generated), so that the state is emitted and dropped periodically (0 to keep it for the whole run)")
+	var derive stringsFlag
+	flags.Var(&derive, "derive", "Derived metric computed for each trade, as name=expression; can be repeated")
+	outputProfile := flags.String("output-profile", profileLegacy, "Metrics of the results: legacy, extended, or full")
+	stateTTL := flags.Duration("state-ttl", 0, "Evict the state of the markets that have not been updated for this long")
+	outputLocation := flags.String("output", os.DevNull, "Where to write the results")
+	metricsListen := flags.String("metrics-listen", "", "Address on which to export the metrics for Prometheus, at /metrics (e.g. localhost:9100)")
+	reportInterval := flags.Duration("report-interval", 10*time.Second, "Interval between the reports of the metrics to stderr")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	tps, _, err := humanize.ParseSI(*tpsFlag)
+	if err != nil || tps <= 0 {
+		panic(withExitCode(exitUsage, fmt.Errorf("invalid -tps %q", *tpsFlag)))
+	}
+	if *numMarkets <= 0 || *reportInterval <= 0 {
+		panic(withExitCode(exitUsage, fmt.Errorf("invalid -markets %v or -report-interval %s", *numMarkets, *reportInterval)))
+	}
+	if *workers <= 0 {
+		*workers = runtime.GOMAXPROCS(0)
+	}
+
+	pipelineConfigs := []PipelineConfig{
+		{
+			Derive:  derive,
+			Window:  *window,
+			Profile: *outputProfile,
+			Output:  *outputLocation,
+		},
+	}
+	if *configPath != "" {
+		conf, err := LoadConfig(*configPath)
+		if err != nil {
+			panic(withExitCode(exitUsage, err))
+		}
+		pipelineConfigs = conf.Pipelines
+	}
+	outs := newOutputs(outputOptions{floatPrecision: -1, undefined: undefinedNull, workers: runtime.GOMAXPROCS(0)})
+	var pipelines []*pipeline
+	for _, conf := range pipelineConfigs {
+		// Windows are by the time the trades are generated:
+		p, err := newPipeline(conf, []string{"soak"}, outs, timeModeEvent, *stateTTL)
+		if err != nil {
+			panic(defaultExitCode(exitUsage, err))
+		}
+		pipelines = append(pipelines, p)
+	}
+
+	s := &soak{
+		start:     time.Now(),
+		tps:       tps,
+		pipelines: pipelines,
+	}
+	if *metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", s.serveMetrics)
+		go func() {
+			if err := http.ListenAndServe(*metricsListen, mux); err != nil {
+				s.abort(fmt.Errorf("error while serving metrics: %s", err))
+			}
+		}()
+		fmt.Fprintf(os.Stderr, "Exporting metrics on %s/metrics\n", *metricsListen)
+	}
+
+	stop := make(chan struct{})
+	stopOnce := sync.Once{}
+	stopAll := func() { stopOnce.Do(func() { close(stop) }) }
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		stopAll()
+	}()
+	if *duration > 0 {
+		time.AfterFunc(*duration, stopAll)
+	}
+	s.stop = stopAll
+
+	// Expired state is evicted periodically:
+	background := sync.WaitGroup{}
+	if *stateTTL > 0 {
+		tick := *stateTTL / 10
+		if tick < time.Second {
+			tick = time.Second
+		}
+		for _, p := range pipelines {
+			background.Add(1)
+			go func(p *pipeline) {
+				defer background.Done()
+				if err := p.expire(*stateTTL, tick, stop); err != nil {
+					s.abort(err)
+				}
+			}(p)
+		}
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		s.report(*reportInterval, stop)
+	}()
+
+	generators := sync.WaitGroup{}
+	for i := 0; i < *workers; i++ {
+		generators.Add(1)
+		go func(i int) {
+			defer generators.Done()
+			s.generate(tps/float64(*workers), *numMarkets, int64(i), stop)
+		}(i)
+	}
+	generators.Wait()
+	background.Wait()
+
+	for _, p := range pipelines {
+		if err := p.emitLast(); err != nil {
+			panic(err)
+		}
+		if p.window == 0 {
+			if err := p.emit(time.Time{}, time.Time{}); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if err := outs.closeAll(); err != nil {
+		panic(err)
+	}
+	s.printReport()
+	if s.err != nil {
+		panic(s.err)
+	}
+	return exitOK
+}
+
+// soak is a running soak test.
+type soak struct {
+	start     time.Time
+	tps       float64
+	pipelines []*pipeline
+	stop      func()
+
+	// numTrades is the number of trades generated.
+	numTrades uint64
+
+	errOnce sync.Once
+	err     error
+}
+
+// abort stops the soak test with an error.
+func (s *soak) abort(err error) {
+	s.errOnce.Do(func() {
+		s.err = err
+		s.stop()
+	})
+}
+
+// soakTick is the interval at which the trades are generated, in batches.
+const soakTick = 10 * time.Millisecond
+
+// generate generates trades at the given rate, until stop is closed;
+// trades not generated in time (when the pipelines are too slow)
+// are generated as soon as possible.
+func (s *soak) generate(tps float64, numMarkets int, seed int64, stop <-chan struct{}) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + seed))
+	values := make([]float64, len(tradeVars))
+	start := time.Now()
+	generated := 0
+	ticker := time.NewTicker(soakTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		due := int(now.Sub(start).Seconds()*tps) - generated
+		ts := now.UnixNano() / int64(time.Millisecond)
+		for i := 0; i < due; i++ {
+			market := uint64(rnd.Intn(numMarkets) + 1)
+			trade := models.Trade{
+				ID:        generated + i,
+				Market:    market,
+				Price:     float64(market%52) + rnd.Float64(),
+				Volume:    rnd.Float64() * 5000,
+				IsBuy:     rnd.Intn(5) != 0,
+				Timestamp: ts,
+			}
+			values = tradeValues(trade, values)
+			for _, p := range s.pipelines {
+				if err := p.add("soak", trade, values); err != nil {
+					s.abort(err)
+					return
+				}
+			}
+		}
+		generated += due
+		atomic.AddUint64(&s.numTrades, uint64(due))
+	}
+}
+
+// soakMetrics are the metrics of a soak test at a point in time.
+type soakMetrics struct {
+	elapsed   time.Duration
+	numTrades uint64
+	// behind is the number of trades behind the target rate.
+	behind     uint64
+	numMarkets int
+	mem        runtime.MemStats
+	goroutines int
+}
+
+func (s *soak) metrics() soakMetrics {
+	m := soakMetrics{
+		elapsed:    time.Since(s.start),
+		numTrades:  atomic.LoadUint64(&s.numTrades),
+		goroutines: runtime.NumGoroutine(),
+	}
+	// The trades of the current tick are not due yet:
+	if due := uint64((m.elapsed - soakTick).Seconds() * s.tps); due > m.numTrades {
+		m.behind = due - m.numTrades
+	}
+	runtime.ReadMemStats(&m.mem)
+	for _, p := range s.pipelines {
+		for _, source := range p.sources {
+			ag := p.aggregator(source)
+			ag.mu.RLock()
+			m.numMarkets += len(ag.mapper)
+			ag.mu.RUnlock()
+		}
+	}
+	return m
+}
+
+// report prints the metrics to stderr at each interval, until stop is closed.
+func (s *soak) report(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := s.metrics()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		m := s.metrics()
+		tps := float64(m.numTrades-last.numTrades) / (m.elapsed - last.elapsed).Seconds()
+		fmt.Fprintf(
+			os.Stderr,
+			"%s: %s TPS (target %s), %v trades (%v behind), %v markets, heap %s, RSS %s, %v GCs, %v goroutines\n",
+			m.elapsed.Round(time.Second),
+			humanize.CommafWithDigits(tps, 0),
+			humanize.CommafWithDigits(s.tps, 0),
+			humanize.Comma(int64(m.numTrades)),
+			humanize.Comma(int64(m.behind)),
+			humanize.Comma(int64(m.numMarkets)),
+			humanize.IBytes(m.mem.HeapAlloc),
+			humanize.IBytes(m.mem.Sys),
+			m.mem.NumGC,
+			m.goroutines,
+		)
+		last = m
+	}
+}
+
+// printReport prints the summary of the soak test to stderr.
+func (s *soak) printReport() {
+	m := s.metrics()
+	fmt.Fprintf(
+		os.Stderr,
+		"Soaked for %s: %v trades (%s TPS, target %s), heap %s, GC pauses %s in total\n",
+		m.elapsed.Round(time.Second),
+		humanize.Comma(int64(m.numTrades)),
+		humanize.CommafWithDigits(float64(m.numTrades)/m.elapsed.Seconds(), 0),
+		humanize.CommafWithDigits(s.tps, 0),
+		humanize.IBytes(m.mem.HeapAlloc),
+		time.Duration(m.mem.PauseTotalNs),
+	)
+}
+
+// serveMetrics exports the metrics in the Prometheus text format.
+func (s *soak) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	m := s.metrics()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	metric := func(name string, kind string, help string, value interface{}) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("soak_trades_total", "counter", "Trades generated and aggregated.", m.numTrades)
+	metric("soak_trades_behind", "gauge", "Trades behind the target rate.", m.behind)
+	metric("soak_target_trades_per_second", "gauge", "Target rate of generated trades.", s.tps)
+	metric("soak_elapsed_seconds", "gauge", "Time since the start of the soak test.", m.elapsed.Seconds())
+	metric("soak_markets", "gauge", "Markets in the state of the pipelines.", m.numMarkets)
+	metric("soak_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.", m.mem.HeapAlloc)
+	metric("soak_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.", m.mem.HeapInuse)
+	metric("soak_sys_bytes", "gauge", "Bytes of memory obtained from the OS.", m.mem.Sys)
+	metric("soak_gc_total", "counter", "Completed GC cycles.", m.mem.NumGC)
+	metric("soak_gc_pause_seconds_total", "counter", "Total GC pause time.", float64(m.mem.PauseTotalNs)/1e9)
+	metric("soak_goroutines", "gauge", "Number of goroutines.", m.goroutines)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// lastQuotes holds the midpoint of the last quote of each market.
+type lastQuotes struct {
+	mu   sync.RWMutex
+	mids map[uint64]quoteMid
+}
+
+type quoteMid struct {
+	mid float64
+	// seen is the (arrival) time of the quote, in Unix nanoseconds.
+	seen int64
+}
+
+func newLastQuotes() *lastQuotes {
+	return &lastQuotes{
+		mids: map[uint64]quoteMid{},
+	}
+}
+
+func (q *lastQuotes) set(market uint64, mid float64, seen int64) {
+	q.mu.Lock()
+	q.mids[market] = quoteMid{mid: mid, seen: seen}
+	q.mu.Unlock()
+}
+
+func (q *lastQuotes) mid(market uint64) (float64, bool) {
+	q.mu.RLock()
+	got, ok := q.mids[market]
+	q.mu.RUnlock()
+	return got.mid, ok
+}
+
+// spreads tracks the quoted and effective spreads of a market.
+type spreads struct {
+	spreadSum float64
+	numQuotes int
+
+	// The effective spread of a trade is 2*|price - midpoint|,
+	// with the midpoint of the last quote before the trade.
+	effectiveSum float64
+	numEffective int
+}
+
+// AddQuote processes a quote for its market.
+// One-sided (or empty) quotes are ignored.
+func (ag *Markets) AddQuote(quote models.Quote) {
+	if quote.Bid <= 0 || quote.Ask <= 0 {
+		return
+	}
+	now := ag.now()
+	ag.quotes.set(quote.Market, (quote.Bid+quote.Ask)/2, now)
+
+	ag.lockMarket(quote.Market, func(mkt *Market) {
+		mkt.spreads.spreadSum += quote.Ask - quote.Bid
+		mkt.spreads.numQuotes++
+		mkt.lastSeen = now
+	})
+}
+
+// addTrade records the effective spread of a trade, if the market has been quoted.
+func (s *spreads) addTrade(price float64, mid float64, quoted bool) {
+	if !quoted {
+		return
+	}
+	// Not fused (see Markets.Add):
+	s.effectiveSum += float64(2 * math.Abs(price-mid))
+	s.numEffective++
+}
+
+// compute adds the spread metrics to the result (if any).
+func (s *spreads) compute(res M) {
+	if s.numQuotes > 0 {
+		res["mean_spread"] = s.spreadSum / float64(s.numQuotes)
+	}
+	if s.numEffective > 0 {
+		res["mean_effective_spread"] = s.effectiveSum / float64(s.numEffective)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// bytesRead returns the number of bytes read from the inputs
+// (as they are read, e.g. compressed), and whether any is a byte stream.
+func bytesRead(sources []*sourceRun) (uint64, bool) {
+	total := uint64(0)
+	counted := false
+	for _, run := range sources {
+		if run.input != nil {
+			total += run.input.Count()
+			counted = true
+		}
+	}
+	return total, counted
+}
+
+// bandwidth formats a rate of bytes per second.
+func bandwidth(bytes uint64, d time.Duration) string {
+	if d <= 0 {
+		return "0 B/s"
+	}
+	return humanize.Bytes(uint64(float64(bytes)/d.Seconds())) + "/s"
+}
+
+// printBandwidth prints the bytes read from the inputs and their rate
+// over the duration of the run, and those of each input if there are several.
+func printBandwidth(w io.Writer, sources []*sourceRun, d time.Duration) {
+	total, counted := bytesRead(sources)
+	if !counted {
+		return
+	}
+	fmt.Fprintf(w, "Read %s from the inputs (%s)\n", humanize.Bytes(total), bandwidth(total, d))
+	if len(sources) < 2 {
+		return
+	}
+	for _, run := range sources {
+		if run.input != nil {
+			n := run.input.Count()
+			fmt.Fprintf(w, "  %s: %s (%s)\n", run.location, humanize.Bytes(n), bandwidth(n, d))
+		}
+	}
+}
+
+// reportProgress prints the number of trades and bytes read so far, and their
+// rates over the last interval, at each interval until stop is closed; for the
+// inputs that track it, it also prints the ingest latency over the interval.
+func reportProgress(w io.Writer, interval time.Duration, numTrades *uint64, sources []*sourceRun, stop <-chan struct{}) {
+	start := time.Now()
+	precision := time.Second
+	if interval < time.Second {
+		precision = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := start
+	lastTrades := uint64(0)
+	lastBytes := uint64(0)
+	lastLatencies := make([]latencySnapshot, len(sources))
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			trades := atomic.LoadUint64(numTrades)
+			bytes, _ := bytesRead(sources)
+			elapsed := now.Sub(last)
+			fmt.Fprintf(
+				w,
+				"%s: %v trades (%s TPS), %s read (%s)\n",
+				now.Sub(start).Round(precision),
+				humanize.Comma(int64(trades)),
+				humanize.CommafWithDigits(float64(trades-lastTrades)/elapsed.Seconds(), 0),
+				humanize.Bytes(bytes),
+				bandwidth(bytes-lastBytes, elapsed),
+			)
+			for i, run := range sources {
+				if run.latency == nil {
+					continue
+				}
+				s := run.latency.snapshot()
+				if d := s.since(lastLatencies[i]); d.count > 0 {
+					fmt.Fprintf(w, "  %s: ingest latency %s\n", run.location, d)
+				}
+				lastLatencies[i] = s
+			}
+			last, lastTrades, lastBytes = now, trades, bytes
+		}
+	}
+}
@@ -46,7 +46,7 @@ func sendTrades(count int, marketCount int) {
 
 		t := models.Trade{
 			ID:     countElapsed + 1,
-			Market: currentMarketID,
+			Market: uint64(currentMarketID),
 			Price:  float64(currentMarketID%52) + rand.Float64(),
 			Volume: rand.Float64() * 5000.00,
 			IsBuy:  isBuy,
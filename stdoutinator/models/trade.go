@@ -2,8 +2,31 @@ package models
 
 type Trade struct {
 	ID     int     `json:"id"`
-	Market int     `json:"market"`
+	Market uint64  `json:"market"`
 	Price  float64 `json:"price"`
 	Volume float64 `json:"volume"`
 	IsBuy  bool    `json:"is_buy"`
+	// Timestamp is the time of the trade, in Unix milliseconds (0 if unknown).
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// Quote is the best bid and ask of a market.
+type Quote struct {
+	Market uint64  `json:"market"`
+	Bid    float64 `json:"bid"`
+	Ask    float64 `json:"ask"`
+	// Timestamp is the time of the quote, in Unix milliseconds (0 if unknown).
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// BookUpdate is a change of a price level of the order book of a market.
+type BookUpdate struct {
+	Market uint64 `json:"market"`
+	// Side is "bid" or "ask".
+	Side  string  `json:"side"`
+	Price float64 `json:"price"`
+	// Size is the new size of the level; 0 removes the level.
+	Size float64 `json:"size"`
+	// Timestamp is the time of the update, in Unix milliseconds (0 if unknown).
+	Timestamp int64 `json:"timestamp,omitempty"`
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TenantsConfig is the config file of a multi-tenant service (see serve -tenants).
+type TenantsConfig struct {
+	Tenants []TenantConfig `yaml:"tenants"`
+}
+
+// TenantConfig defines a tenant: its sessions are isolated from the others,
+// and its ingestion is subject to its quotas.
+type TenantConfig struct {
+	Name string `yaml:"name"`
+	// APIKey authenticates the requests of the tenant.
+	APIKey string `yaml:"api_key"`
+	// TradesPerSecond is the maximum ingestion rate of the tenant,
+	// across its sessions (0 for no limit), with bursts of up to Burst trades
+	// (TradesPerSecond by default).
+	TradesPerSecond float64 `yaml:"trades_per_second"`
+	Burst           float64 `yaml:"burst"`
+	// MaxSessions is the maximum number of sessions of the tenant (0 for no limit).
+	MaxSessions int `yaml:"max_sessions"`
+}
+
+func LoadTenants(path string) (*TenantsConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading tenants: %s", err)
+	}
+	var conf TenantsConfig
+	if err := yaml.UnmarshalStrict(data, &conf); err != nil {
+		return nil, fmt.Errorf("error while parsing tenants %s: %s", path, err)
+	}
+	names := map[string]bool{}
+	keys := map[string]bool{}
+	for _, tenant := range conf.Tenants {
+		if tenant.Name == "" || tenant.APIKey == "" {
+			return nil, fmt.Errorf("tenants %s: each tenant requires a name and an api_key", path)
+		}
+		if names[tenant.Name] || keys[tenant.APIKey] {
+			return nil, fmt.Errorf("tenants %s: duplicate name or api_key of tenant %q", path, tenant.Name)
+		}
+		if tenant.TradesPerSecond < 0 || tenant.Burst < 0 || tenant.MaxSessions < 0 {
+			return nil, fmt.Errorf("tenants %s: invalid quotas of tenant %q", path, tenant.Name)
+		}
+		names[tenant.Name] = true
+		keys[tenant.APIKey] = true
+	}
+	if len(conf.Tenants) == 0 {
+		return nil, fmt.Errorf("tenants %s: no tenants", path)
+	}
+	return &conf, nil
+}
+
+// tenantServer authenticates the requests with the API key of a tenant,
+// and routes them to its own service.
+type tenantServer struct {
+	tenants []*tenant
+}
+
+type tenant struct {
+	apiKey []byte
+	svc    *service
+}
+
+func newTenantServer(conf *TenantsConfig, outOpts outputOptions, records recordLimits) *tenantServer {
+	ts := &tenantServer{}
+	for _, tc := range conf.Tenants {
+		svc := newService(outOpts, records)
+		svc.tenant = tc.Name
+		svc.maxSessions = tc.MaxSessions
+		svc.quota = newLimiter(fmt.Sprintf("the quota of tenant %q", tc.Name), rateLimit{trades: tc.TradesPerSecond}, tc.Burst)
+		ts.tenants = append(ts.tenants, &tenant{apiKey: []byte(tc.APIKey), svc: svc})
+	}
+	return ts
+}
+
+func (ts *tenantServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	for _, t := range ts.tenants {
+		// Constant-time, so that keys can't be guessed from timings:
+		if subtle.ConstantTimeCompare([]byte(key), t.apiKey) == 1 {
+			t.svc.ServeHTTP(w, r)
+			return
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="aggregator"`)
+	http.Error(w, "invalid or missing API key", http.StatusUnauthorized)
+}
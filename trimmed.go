@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// priceSketchAccuracy is the relative width of the buckets of a priceSketch.
+const priceSketchAccuracy = 0.001
+
+// priceSketchGamma is the ratio of the bounds of the buckets.
+var priceSketchGamma = math.Log((1 + priceSketchAccuracy) / (1 - priceSketchAccuracy))
+
+// priceSketch tracks the distribution of the prices of a market, in buckets
+// of prices within priceSketchAccuracy of each other (by magnitude, so
+// that their number grows with the range of the prices, not their count).
+// Each bucket has the sum of its prices, so that the trimmed mean is exact
+// but for the bucket it is trimmed within.
+type priceSketch struct {
+	buckets map[int32]*priceBucket
+	count   int
+}
+
+type priceBucket struct {
+	count int
+	sum   float64
+}
+
+// bucket returns the index of the bucket of a price, ordered as the prices:
+// 0 for zero, and those of the magnitudes offset to be positive (those of
+// the smallest magnitudes of float64 are above -2^19), negated for negative
+// prices.
+func (s *priceSketch) bucket(price float64) int32 {
+	if price == 0 {
+		return 0
+	}
+	index := int32(math.Ceil(math.Log(math.Abs(price))/priceSketchGamma)) + 1<<20
+	if price < 0 {
+		return -index
+	}
+	return index
+}
+
+// add records a price.
+func (s *priceSketch) add(price float64) {
+	if s.buckets == nil {
+		s.buckets = map[int32]*priceBucket{}
+	}
+	index := s.bucket(price)
+	b, ok := s.buckets[index]
+	if !ok {
+		b = &priceBucket{}
+		s.buckets[index] = b
+	}
+	b.count++
+	b.sum += price
+	s.count++
+}
+
+// trimmedMean returns the mean of the prices without the lowest and the
+// highest of them, as the fraction trim of their number (rounded down).
+func (s *priceSketch) trimmedMean(trim float64) float64 {
+	drop := int(float64(s.count) * trim)
+	keep := s.count - 2*drop
+	if keep <= 0 {
+		return math.NaN()
+	}
+	indexes := make([]int32, 0, len(s.buckets))
+	for index := range s.buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+	// The prices of the buckets from the drop-th to the (drop+keep)-th,
+	// those of partially trimmed buckets at their mean:
+	sum := 0.0
+	seen := 0
+	for _, index := range indexes {
+		b := s.buckets[index]
+		from, to := seen, seen+b.count
+		seen = to
+		if from < drop {
+			from = drop
+		}
+		if to > drop+keep {
+			to = drop + keep
+		}
+		switch {
+		case from >= to:
+		case to-from == b.count:
+			sum += b.sum
+		default:
+			sum += b.sum / float64(b.count) * float64(to-from)
+		}
+	}
+	return sum / float64(keep)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"time"
+)
+
+// now returns the current time in Unix nanoseconds, if the state of the markets
+// expires (see AggregatorOptions.StateTTL), and zero otherwise.
+func (ag *Markets) now() int64 {
+	if ag.opts.StateTTL <= 0 {
+		return 0
+	}
+	return time.Now().UnixNano()
+}
+
+// Evict removes the markets that have not been updated since before
+// (in Unix nanoseconds), and returns their results, ordered by market.
+// The last quotes and order books of those markets are removed too.
+func (ag *Markets) Evict(before int64) []M {
+	out := ag.evict(func(mkt *Market) bool {
+		return mkt.lastSeen < before
+	})
+	ag.quotes.evict(before)
+	ag.books.evict(before)
+	return out
+}
+
+// evict removes the markets for which cold returns true (called with the
+// market locked), and returns their results, ordered by market. The updates
+// of the markets that are already under way when they are removed go to
+// new markets (see lockMarket), rather than being lost.
+func (ag *Markets) evict(cold func(*Market) bool) []M {
+	ag.mu.Lock()
+	var ids []uint64
+	evicted := map[uint64]*Market{}
+	for id, mkt := range ag.mapper {
+		var isCold bool
+		mkt.Lock(func(mkt *Market) {
+			isCold = cold(mkt)
+			if isCold {
+				mkt.owner = nil
+			}
+		})
+		if isCold {
+			ids = append(ids, id)
+			evicted[id] = mkt
+			delete(ag.mapper, id)
+		}
+	}
+	ag.mu.Unlock()
+
+	sortMarkets(ids)
+	out := make([]M, 0)
+	for _, id := range ids {
+		if res := ag.compute(id, evicted[id]); res != nil {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+func (q *lastQuotes) evict(before int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for market, quote := range q.mids {
+		if quote.seen < before {
+			delete(q.mids, market)
+		}
+	}
+}
+
+func (books *orderBooks) evict(before int64) {
+	books.mu.Lock()
+	defer books.mu.Unlock()
+	for market, book := range books.mapper {
+		if book.seen < before {
+			delete(books.mapper, market)
+		}
+	}
+}
+
+// expire evicts the state of the pipeline that has not been updated
+// for longer than ttl, every tick, until stop is closed.
+// Without windows, the results of the evicted markets are emitted (as final);
+// with windows, only the state kept across windows (quotes and books) is evicted,
+// since the markets of past windows are already gone.
+func (p *pipeline) expire(ttl time.Duration, tick time.Duration, stop <-chan struct{}) error {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+		before := time.Now().Add(-ttl).UnixNano()
+		for _, source := range p.sources {
+			ag := p.ags[source]
+			if p.window > 0 {
+				ag.quotes.evict(before)
+				ag.books.evict(before)
+				continue
+			}
+			results := ag.Evict(before)
+			if len(results) == 0 {
+				continue
+			}
+			p.tag(results, source, time.Time{}, time.Time{})
+			for _, res := range results {
+				p.observe(res)
+			}
+			if err := p.out.write(results); err != nil {
+				return err
+			}
+		}
+	}
+}
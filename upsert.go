@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// keyField is the field of the idempotency key of a result (see -run-id).
+const keyField = "key"
+
+// idempotencyKey returns the key identifying a result across the runs
+// with the same run ID: the run ID, pipeline, source, market, and window,
+// so that the results emitted again after resuming a run can be recognized.
+func idempotencyKey(runID string, res M) string {
+	parts := []string{runID, "", "", "", ""}
+	if name, ok := res["pipeline"].(string); ok {
+		parts[1] = name
+	}
+	if source, ok := res["source"].(string); ok {
+		parts[2] = source
+	}
+	parts[3] = fmt.Sprint(res["market"])
+	if level, ok := res["rollup"].(string); ok {
+		parts[3] = level + ":" + parts[3]
+	}
+	if start, ok := res["window_start"].(time.Time); ok {
+		parts[4] = start.UTC().Format(time.RFC3339Nano)
+	}
+	return strings.Join(parts, "/")
+}
+
+// upsertFile is a file output that replaces the records with the same key
+// it already contains, and appends the others; records without a key
+// (e.g. metadata records) are always appended.
+// The records are kept in memory, and the file is replaced on Close.
+type upsertFile struct {
+	path    string
+	keyName string
+	lines   [][]byte
+	byKey   map[string]int
+	// partial is the last line written, until it is terminated.
+	partial []byte
+}
+
+func openUpsertFile(path string, keyName string) (*upsertFile, error) {
+	f := &upsertFile{
+		path:    path,
+		keyName: keyName,
+		byKey:   map[string]int{},
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error while reading output %s: %s", path, err)
+	}
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			f.put(line)
+		}
+	}
+	return f, nil
+}
+
+// put adds the record, replacing the one with the same key (if any).
+func (f *upsertFile) put(line []byte) {
+	key := jsoniter.Get(bytes.TrimLeft(line, "\x1e"), f.keyName)
+	if key.ValueType() == jsoniter.StringValue {
+		if i, ok := f.byKey[key.ToString()]; ok {
+			f.lines[i] = line
+			return
+		}
+		f.byKey[key.ToString()] = len(f.lines)
+	}
+	f.lines = append(f.lines, line)
+}
+
+// Write adds the records, one per line.
+func (f *upsertFile) Write(p []byte) (int, error) {
+	f.partial = append(f.partial, p...)
+	for {
+		end := bytes.IndexByte(f.partial, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		f.put(append([]byte(nil), f.partial[:end]...))
+		f.partial = f.partial[end+1:]
+	}
+}
+
+// Close replaces the file with the records, atomically.
+func (f *upsertFile) Close() error {
+	if len(bytes.TrimSpace(f.partial)) > 0 {
+		f.put(f.partial)
+	}
+	tmp := f.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, line := range f.lines {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+	"gopkg.in/yaml.v2"
+)
+
+// vectorsInput is the name of the input of the pipelines of the test vectors.
+const vectorsInput = "vectors"
+
+// runVectors implements the vectors subcommand, which writes test vectors of
+// the output contract: small sets of trades, each with the config of its
+// pipeline and the exact results of the aggregation, one JSON object per line,
+// so that consumers reimplemented in other languages can be validated against
+// this implementation. It returns the exit status.
+func runVectors(args []string) int {
+	flags := flag.NewFlagSet("vectors", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s vectors [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	outputPath := flags.String("output", "-", "Where to write the test vectors: - (stdout) or a file path")
+	name := flags.String("name", "", "Only write the test vector with this name")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	f := os.Stdout
+	if *outputPath != "-" {
+		var err error
+		f, err = os.Create(*outputPath)
+		if err != nil {
+			panic(withExitCode(exitOutput, fmt.Errorf("error while creating %s: %s", *outputPath, err)))
+		}
+	}
+	w := bufio.NewWriter(f)
+	found := false
+	for _, v := range testVectors() {
+		if *name != "" && v.Name != *name {
+			continue
+		}
+		found = true
+		if err := v.run(); err != nil {
+			panic(fmt.Errorf("error while running test vector %s: %s", v.Name, err))
+		}
+		line, err := json.Marshal(v)
+		if err != nil {
+			panic(withExitCode(exitOutput, fmt.Errorf("error while encoding test vector %s: %s", v.Name, err)))
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if !found {
+		panic(withExitCode(exitUsage, fmt.Errorf("unknown test vector %q", *name)))
+	}
+	if err := w.Flush(); err != nil {
+		panic(withExitCode(exitOutput, fmt.Errorf("error while writing %s: %s", *outputPath, err)))
+	}
+	if f != os.Stdout {
+		if err := f.Close(); err != nil {
+			panic(withExitCode(exitOutput, fmt.Errorf("error while writing %s: %s", *outputPath, err)))
+		}
+	}
+	return exitOK
+}
+
+// testVector is a test vector of the output contract: the results of the
+// aggregation of the trades (in order) by a pipeline with the config (as in
+// the pipelines of -config), as they are written, sorted by market and window.
+type testVector struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Config      M              `json:"config"`
+	Trades      []models.Trade `json:"trades"`
+	Results     []M            `json:"results"`
+}
+
+// run computes the results of the test vector.
+func (v *testVector) run() error {
+	// The config is parsed as it is from a config file:
+	src, err := yaml.Marshal(v.Config)
+	if err != nil {
+		return err
+	}
+	var conf PipelineConfig
+	if err := yaml.UnmarshalStrict(src, &conf); err != nil {
+		return fmt.Errorf("invalid config: %s", err)
+	}
+	conf.Output = os.DevNull
+	outs := newOutputs(outputOptions{floatPrecision: -1, undefined: undefinedNull, workers: 1})
+	p, err := newPipeline(conf, []string{vectorsInput}, outs, timeModeEvent, 0)
+	if err != nil {
+		return err
+	}
+	v.Results = []M{}
+	var resErr error
+	p.observers = append(p.observers, func(res M) {
+		res, err := writtenResult(p.out, res)
+		if err != nil {
+			resErr = err
+			return
+		}
+		v.Results = append(v.Results, res)
+	})
+
+	values := make([]float64, len(tradeVars))
+	for _, trade := range v.Trades {
+		values = tradeValues(trade, values)
+		if err := p.add(vectorsInput, trade, values); err != nil {
+			return err
+		}
+	}
+	if p.eventTime {
+		err = p.emitLast()
+	} else {
+		err = p.emit(time.Time{}, time.Time{})
+	}
+	if err == nil {
+		err = outs.closeAll()
+	}
+	if err == nil {
+		err = resErr
+	}
+	sort.Slice(v.Results, func(i, j int) bool {
+		return resultKeyString(v.Results[i]) < resultKeyString(v.Results[j])
+	})
+	return err
+}
+
+// vectorsStart is the timestamp of the first trade of the test vectors
+// (2022-01-01T00:00:00Z, in Unix milliseconds).
+const vectorsStart = 1640995200000
+
+// vectorTrade returns a trade of a test vector, at offset seconds from vectorsStart.
+func vectorTrade(id int, market uint64, price float64, volume float64, isBuy bool, offset int64) models.Trade {
+	return models.Trade{
+		ID:        id,
+		Market:    market,
+		Price:     price,
+		Volume:    volume,
+		IsBuy:     isBuy,
+		Timestamp: vectorsStart + offset*1000,
+	}
+}
+
+// testVectors returns the test vectors. Their prices and volumes are exact
+// in binary floating point, so that most results are exact too; each one
+// covers a metric or a setting, and a new one should be added with each
+// change of the output contract.
+func testVectors() []*testVector {
+	mixed := []models.Trade{
+		vectorTrade(1, 1, 10, 2, true, 0),
+		vectorTrade(2, 2, 0.5, 8, false, 5),
+		vectorTrade(3, 1, 12, 1, false, 10),
+		vectorTrade(4, 1, 11, 1, true, 20),
+		vectorTrade(5, 2, 0.75, 4, true, 30),
+		vectorTrade(6, 1, 9, 4, false, 45),
+	}
+	return []*testVector{
+		{
+			Name:        "single_trade",
+			Description: "A single trade, with the default (legacy) profile",
+			Config:      M{},
+			Trades:      []models.Trade{vectorTrade(1, 7, 2.5, 4, true, 0)},
+		},
+		{
+			Name:        "markets",
+			Description: "Interleaved trades of two markets, buys and sells",
+			Config:      M{},
+			Trades:      mixed,
+		},
+		{
+			Name:        "zero_volume",
+			Description: "A market with only zero volumes: its VWAP is undefined (null)",
+			Config:      M{},
+			Trades: []models.Trade{
+				vectorTrade(1, 3, 4, 0, true, 0),
+				vectorTrade(2, 3, 6, 0, false, 1),
+			},
+		},
+		{
+			Name:        "full_profile",
+			Description: "All the metrics of the full profile: counts, OHLC, time span",
+			Config:      M{"profile": profileFull},
+			Trades:      mixed,
+		},
+		{
+			Name:        "state",
+			Description: "The counts and sums of each market, with which a warm start resumes",
+			Config:      M{"state": true},
+			Trades:      mixed,
+		},
+		{
+			Name:        "activity_net_flow",
+			Description: "The rate-of-activity metrics and the net flow",
+			Config:      M{"activity": true, "net_flow": true},
+			Trades:      mixed,
+		},
+		{
+			Name:        "trimmed_mean",
+			Description: "The mean price without the lowest and highest 20% of the prices",
+			Config:      M{"trimmed_mean": 20},
+			Trades: []models.Trade{
+				vectorTrade(1, 1, 1, 1, true, 0),
+				vectorTrade(2, 1, 2, 1, true, 1),
+				vectorTrade(3, 1, 3, 1, false, 2),
+				vectorTrade(4, 1, 4, 1, true, 3),
+				vectorTrade(5, 1, 100, 1, false, 4),
+			},
+		},
+		{
+			Name:        "derived",
+			Description: "A derived metric, with its total and mean",
+			Config:      M{"derive": []string{"notional=price*volume"}},
+			Trades:      mixed,
+		},
+		{
+			Name:        "filter_having",
+			Description: "Trades filtered out before aggregation, and markets whose results are not emitted",
+			Config:      M{"profile": profileExtended, "filter": "volume >= 2", "having": "total_volume > 10"},
+			Trades:      mixed,
+		},
+		{
+			Name:        "script",
+			Description: "Results post-processed by a script",
+			Config:      M{"profile": profileExtended, "script": "buy_ratio = num_buy / num_trades\nrename vwap average_price\ndelete mean_volume"},
+			Trades:      mixed,
+		},
+		{
+			Name:        "windows",
+			Description: "Tumbling windows of 15 seconds, by the timestamps of the trades",
+			Config:      M{"window": "15s"},
+			Trades:      mixed,
+		},
+	}
+}
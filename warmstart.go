@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// State fields are the counts and sums of a market,
+// added to the results with AggregatorOptions.State,
+// from which the aggregation can be resumed (see Markets.Restore).
+const (
+	stateNumTrades          = "num_trades"
+	stateNumBuy             = "num_buy"
+	stateBuyVolume          = "buy_volume"
+	stateTotalPrice         = "total_price"
+	statePriceVolumeSum     = "price_volume_sum"
+	stateSpreadSum          = "spread_sum"
+	stateNumQuotes          = "num_quotes"
+	stateEffectiveSpreadSum = "effective_spread_sum"
+	stateNumEffective       = "num_effective_spreads"
+	stateImbalanceSum       = "book_imbalance_sum"
+	stateNumImbalances      = "num_book_imbalances"
+)
+
+// addState adds the state fields of the market to the result.
+func (mkt *Market) addState(res M, opts AggregatorOptions) {
+	res[stateNumTrades] = mkt.numTrades
+	res[stateNumBuy] = mkt.numBuy
+	res[stateTotalPrice] = mkt.totalPrice
+	res[statePriceVolumeSum] = mkt.priceXvolumeSum
+	// The derived sums are already in the results, as total_<name>.
+	if opts.NetFlow {
+		res[stateBuyVolume] = mkt.buyVolume
+	}
+	if opts.Spreads {
+		res[stateSpreadSum] = mkt.spreads.spreadSum
+		res[stateNumQuotes] = mkt.spreads.numQuotes
+		res[stateEffectiveSpreadSum] = mkt.spreads.effectiveSum
+		res[stateNumEffective] = mkt.spreads.numEffective
+	}
+	if opts.BookDepth > 0 {
+		res[stateImbalanceSum] = mkt.book.imbalanceSum
+		res[stateNumImbalances] = mkt.book.numImbalances
+	}
+}
+
+// marketState is the state of a market, from which its aggregation
+// is resumed: from the state fields of a result, or from a checkpoint.
+type marketState struct {
+	numTrades      int
+	numBuy         int
+	totalVolume    float64
+	totalPrice     float64
+	priceVolumeSum float64
+	buyVolume      float64
+	// derivedSums are in the order of AggregatorOptions.Derived.
+	derivedSums []float64
+
+	hasOHLC                bool
+	open, high, low, close float64
+	span                   tradeSpan
+
+	spreadSum    float64
+	numQuotes    int
+	effectiveSum float64
+	numEffective int
+
+	numUpdates    int
+	imbalanceSum  float64
+	numImbalances int
+	lastImbalance float64
+
+	numShed int
+}
+
+// Restore adds the state of a market, from a result with state fields,
+// to the aggregation.
+func (ag *Markets) Restore(res M) error {
+	state := stateReader{res: res}
+	id, ok := res["market"].(uint64)
+	if !ok {
+		return fmt.Errorf("invalid market %v", res["market"])
+	}
+	var numShed int
+	if _, ok := res["num_shed"]; ok {
+		numShed = state.int("num_shed")
+	}
+	if _, ok := res[stateNumTrades]; !ok && numShed > 0 {
+		// All the trades of the market were shed (see compute):
+		if state.err != nil {
+			return state.err
+		}
+		ag.restore(id, marketState{numShed: numShed})
+		return nil
+	}
+	st := marketState{
+		numTrades:      state.int(stateNumTrades),
+		numBuy:         state.int(stateNumBuy),
+		totalVolume:    state.float("total_volume"),
+		totalPrice:     state.float(stateTotalPrice),
+		priceVolumeSum: state.float(statePriceVolumeSum),
+		numShed:        numShed,
+	}
+	if ag.opts.NetFlow {
+		st.buyVolume = state.float(stateBuyVolume)
+	}
+	st.derivedSums = make([]float64, len(ag.opts.Derived))
+	for i, derived := range ag.opts.Derived {
+		st.derivedSums[i] = state.float("total_" + derived.Name)
+	}
+	if ag.opts.Spreads {
+		st.spreadSum = state.float(stateSpreadSum)
+		st.numQuotes = state.int(stateNumQuotes)
+		st.effectiveSum = state.float(stateEffectiveSpreadSum)
+		st.numEffective = state.int(stateNumEffective)
+	}
+	if ag.opts.BookDepth > 0 {
+		st.numUpdates = state.int("num_book_updates")
+		st.imbalanceSum = state.float(stateImbalanceSum)
+		st.numImbalances = state.int(stateNumImbalances)
+		if st.numImbalances > 0 {
+			st.lastImbalance = state.float("last_book_imbalance")
+		}
+	}
+	// The OHLC prices are in the results of the extended profiles:
+	_, st.hasOHLC = res["open"]
+	if ag.opts.Profile != profileLegacy && st.hasOHLC {
+		st.open = state.float("open")
+		st.high = state.float("high")
+		st.low = state.float("low")
+		st.close = state.float("close")
+	}
+	// So is the time span, if the trades had timestamps:
+	if _, ok := res["first_trade_ts"]; ok && ag.opts.Profile != profileLegacy {
+		st.span.add(state.time("first_trade_ts"))
+		st.span.add(state.time("last_trade_ts"))
+	}
+	if state.err != nil {
+		return state.err
+	}
+	ag.restore(id, st)
+	return nil
+}
+
+// restore adds the state of a market to the aggregation.
+func (ag *Markets) restore(id uint64, st marketState) {
+	mkt := ag.GetMarket(id)
+	mkt.Lock(func(mkt *Market) {
+		mkt.numTrades += st.numTrades
+		mkt.numBuy += st.numBuy
+		mkt.buyVolume += st.buyVolume
+		mkt.totalVolume += st.totalVolume
+		mkt.totalPrice += st.totalPrice
+		mkt.priceXvolumeSum += st.priceVolumeSum
+		for i := range st.derivedSums {
+			mkt.derivedSums[i] += st.derivedSums[i]
+		}
+		mkt.spreads.spreadSum += st.spreadSum
+		mkt.spreads.numQuotes += st.numQuotes
+		mkt.spreads.effectiveSum += st.effectiveSum
+		mkt.spreads.numEffective += st.numEffective
+		if ag.opts.Profile != profileLegacy && st.hasOHLC {
+			mkt.ohlc.restore(st.open, st.high, st.low, st.close)
+		}
+		mkt.span.add(st.span.first)
+		mkt.span.add(st.span.last)
+		mkt.book.numUpdates += st.numUpdates
+		mkt.book.imbalanceSum += st.imbalanceSum
+		if st.numImbalances > 0 {
+			mkt.book.numImbalances += st.numImbalances
+			mkt.book.lastImbalance = st.lastImbalance
+		}
+		mkt.numShed += st.numShed
+	})
+}
+
+// state returns the state of the market; it must be locked.
+func (mkt *Market) state() marketState {
+	return marketState{
+		numTrades:      mkt.numTrades,
+		numBuy:         mkt.numBuy,
+		totalVolume:    mkt.totalVolume,
+		totalPrice:     mkt.totalPrice,
+		priceVolumeSum: mkt.priceXvolumeSum,
+		buyVolume:      mkt.buyVolume,
+		derivedSums:    mkt.derivedSums,
+		hasOHLC:        mkt.ohlc.set,
+		open:           mkt.ohlc.open,
+		high:           mkt.ohlc.high,
+		low:            mkt.ohlc.low,
+		close:          mkt.ohlc.close,
+		span:           mkt.span,
+		spreadSum:      mkt.spreads.spreadSum,
+		numQuotes:      mkt.spreads.numQuotes,
+		effectiveSum:   mkt.spreads.effectiveSum,
+		numEffective:   mkt.spreads.numEffective,
+		numUpdates:     mkt.book.numUpdates,
+		imbalanceSum:   mkt.book.imbalanceSum,
+		numImbalances:  mkt.book.numImbalances,
+		lastImbalance:  mkt.book.lastImbalance,
+		numShed:        mkt.numShed,
+	}
+}
+
+// stateReader reads the fields of a decoded result,
+// keeping the first error.
+type stateReader struct {
+	res M
+	err error
+}
+
+// time reads a time, in Unix milliseconds.
+func (r *stateReader) time(field string) int64 {
+	s, _ := r.res[field].(string)
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil && r.err == nil {
+		r.err = fmt.Errorf("invalid %q: %s", field, err)
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (r *stateReader) float(field string) float64 {
+	v, ok := r.res[field].(float64)
+	if s, isString := r.res[field].(string); isString {
+		// Written as a decimal string (see -decimal-strings):
+		var err error
+		v, err = strconv.ParseFloat(s, 64)
+		ok = err == nil
+	}
+	if !ok && r.err == nil {
+		r.err = fmt.Errorf("missing or invalid %q (the results must have been written with -state)", field)
+	}
+	return v
+}
+
+func (r *stateReader) int(field string) int {
+	return int(r.float(field))
+}
+
+// warmStart initializes the aggregators of the pipeline
+// from the results (with state fields) of a previous run,
+// or from a checkpoint.
+func (p *pipeline) warmStart(path string) error {
+	if checkpoint, err := isCheckpoint(path); err != nil {
+		return err
+	} else if checkpoint {
+		return p.restoreCheckpoint(path)
+	}
+	results, err := readResults(path)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if name, _ := res["pipeline"].(string); name != p.name {
+			// Results of another pipeline in the same output:
+			continue
+		}
+		if _, ok := res["rollup"]; ok {
+			// Results of the rollups of the pipeline:
+			continue
+		}
+		ag := p.ags[""]
+		if p.tagSources {
+			source, _ := res["source"].(string)
+			ag = p.ags[source]
+			if ag == nil {
+				return fmt.Errorf("error while restoring from %s: source %q is not an input", path, source)
+			}
+		}
+		if err := ag.Restore(res); err != nil {
+			return fmt.Errorf("error while restoring market %v from %s: %s", res["market"], path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gagliardetto/messari-challenge/stdoutinator/models"
+)
+
+// TestWarmStartRoundTrip checks that a run warm-started from the results
+// (with -state) of a previous one has the results of a single run over the
+// trades of both, including the trades shed (all those of market 3).
+func TestWarmStartRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	type event struct {
+		trade models.Trade
+		shed  bool
+	}
+	var events []event
+	for i := 0; i < 40; i++ {
+		trade := models.Trade{
+			ID:        i,
+			Market:    uint64(1 + i%3),
+			Price:     100 + float64(i%7)*0.25,
+			Volume:    1 + float64(i%5)*0.1,
+			IsBuy:     i%2 == 0,
+			Timestamp: 1640995200000 + int64(i)*250,
+		}
+		events = append(events, event{trade, trade.Market == 3 || i%11 == 0})
+	}
+
+	run := func(events []event, warmStart string, output string) {
+		conf := PipelineConfig{
+			Derive:    []string{"notional=price*volume"},
+			NetFlow:   true,
+			Profile:   profileExtended,
+			State:     true,
+			WarmStart: warmStart,
+			Output:    filepath.Join(dir, output),
+		}
+		outs := newOutputs(outputOptions{floatPrecision: -1, undefined: undefinedNull, workers: 1})
+		p, err := newPipeline(conf, []string{""}, outs, timeModeEvent, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make([]float64, len(tradeVars))
+		for _, ev := range events {
+			if ev.shed {
+				p.shed("", ev.trade)
+				continue
+			}
+			if err := p.add("", ev.trade, tradeValues(ev.trade, values)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.emit(time.Time{}, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := outs.closeAll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(events, "", "single.json")
+	run(events[:20], "", "first.json")
+	run(events[20:], filepath.Join(dir, "first.json"), "resumed.json")
+
+	single, err := readResults(filepath.Join(dir, "single.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := readResults(filepath.Join(dir, "resumed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(single) != 3 {
+		t.Fatalf("got %v results, want 3", len(single))
+	}
+	for key, res := range single {
+		if !reflect.DeepEqual(resumed[key], res) {
+			t.Errorf("market %v:\n resumed %v\n  single %v", res["market"], resumed[key], res)
+		}
+	}
+}